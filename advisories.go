@@ -0,0 +1,45 @@
+//go:build !websocket
+
+package main
+
+// Advisories: the AIRMETs and SIGMETs getwx keeps, written as JSON to
+// output.advisories for mapserver to draw.
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// advisoryData is one AIRMET or SIGMET. Points is the closed outline as
+// [lat, lng] pairs. MinFt and MaxFt are MSL and 0 when the report does not
+// give them.
+type advisoryData struct {
+	Type      string       `json:"type"`
+	Hazard    string       `json:"hazard"`
+	Severity  string       `json:"severity,omitempty"`
+	ValidFrom time.Time    `json:"valid_from"`
+	ValidTo   time.Time    `json:"valid_to"`
+	MinFt     int          `json:"min_ft,omitempty"`
+	MaxFt     int          `json:"max_ft,omitempty"`
+	Raw       string       `json:"raw"`
+	Points    [][2]float64 `json:"points"`
+}
+
+// readAdvisories reads output.advisories and reports when it was written.
+func readAdvisories() ([]advisoryData, time.Time, error) {
+	fname := cfg.Path(cfg.Output.Advisories)
+	st, err := os.Stat(fname)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var all []advisoryData
+	if err := json.Unmarshal(buf, &all); err != nil {
+		return nil, time.Time{}, err
+	}
+	return all, st.ModTime(), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+// The airport database: name, type, use, frequencies and both the ICAO and
+// the FAA identifier of every airport in the region, written by getwx
+// -import-airports from OurAirports or FAA NASR data. Besides answering
+// req=airport it is how the programs turn the identifiers the feeds and
+// users give into the one a station goes by.
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type airportFreq struct {
+	Type        string  `json:"type"` // CTAF, TWR, GND, ATIS, UNIC, ...
+	Description string  `json:"description,omitempty"`
+	MHz         float64 `json:"mhz"`
+}
+
+type airportInfo struct {
+	// Ident is the ICAO identifier when the airport has one and the FAA
+	// one otherwise; it is what weather.txt and the map use.
+	Ident       string        `json:"ident"`
+	ICAO        string        `json:"icao,omitempty"`
+	FAA         string        `json:"faa,omitempty"`
+	Name        string        `json:"name"`
+	City        string        `json:"city,omitempty"`
+	State       string        `json:"state,omitempty"`
+	Country     string        `json:"country,omitempty"`
+	Type        string        `json:"type"`
+	Use         string        `json:"use,omitempty"` // public or private
+	Towered     bool          `json:"towered"`
+	Lat         float64       `json:"lat"`
+	Lng         float64       `json:"lng"`
+	ElevationFt float64       `json:"elevation_ft"`
+	Frequencies []airportFreq `json:"frequencies,omitempty"`
+}
+
+type airportIndex struct {
+	Airports []airportInfo
+	byID     map[string]int
+}
+
+func newAirportIndex(list []airportInfo) *airportIndex {
+	db := &airportIndex{Airports: list, byID: make(map[string]int, 2*len(list))}
+	// ICAO identifiers first, so an FAA one that happens to be the same
+	// never hides them.
+	for k, a := range list {
+		for _, id := range []string{a.Ident, a.ICAO} {
+			if _, ok := db.byID[id]; id != "" && !ok {
+				db.byID[id] = k
+			}
+		}
+	}
+	for k, a := range list {
+		if _, ok := db.byID[a.FAA]; a.FAA != "" && !ok {
+			db.byID[a.FAA] = k
+		}
+	}
+	return db
+}
+
+// find looks an airport up by either identifier. A K in front of an FAA
+// one is let through, so KANC finds PANC. find works on a nil index.
+func (db *airportIndex) find(id string) *airportInfo {
+	if db == nil {
+		return nil
+	}
+	id = strings.ToUpper(strings.TrimSpace(id))
+	k, ok := db.byID[id]
+	if !ok && len(id) == 4 && id[0] == 'K' {
+		k, ok = db.byID[id[1:]]
+	}
+	if !ok {
+		return nil
+	}
+	return &db.Airports[k]
+}
+
+// ident is the identifier id goes by on the map. For an airport the
+// database does not have, three letters are taken for a US identifier and
+// get a K; anything else, PANC, CYYZ or 00AL, is left alone.
+func (db *airportIndex) ident(id string) string {
+	id = strings.ToUpper(strings.TrimSpace(id))
+	if a := db.find(id); a != nil {
+		return a.Ident
+	}
+	if len(id) == 3 && isLetters(id) {
+		return "K" + id
+	}
+	return id
+}
+
+func isLetters(s string) bool {
+	return s != "" && strings.Trim(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+}
+
+// aliases lists every identifier id is known by, id first.
+func (db *airportIndex) aliases(id string) []string {
+	id = strings.ToUpper(strings.TrimSpace(id))
+	out := []string{id}
+	add := func(s string) {
+		for _, o := range out {
+			if o == s {
+				return
+			}
+		}
+		out = append(out, s)
+	}
+	if a := db.find(id); a != nil {
+		for _, s := range []string{a.Ident, a.ICAO, a.FAA} {
+			if s != "" {
+				add(s)
+			}
+		}
+	} else if canon := db.ident(id); canon != id {
+		add(canon)
+	} else if len(id) == 4 && id[0] == 'K' {
+		add(id[1:])
+	}
+	return out
+}
+
+var airportDBCache struct {
+	sync.Mutex
+	modTime time.Time
+	db      *airportIndex
+}
+
+// readAirportDB reads paths.airport_db, keeping it until the file changes.
+// Without the file it returns a nil index, which falls back to guessing.
+func readAirportDB() (*airportIndex, error) {
+	if cfg.Paths.AirportDB == "" {
+		return nil, nil
+	}
+	fname := cfg.Path(cfg.Paths.AirportDB)
+	st, err := os.Stat(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	airportDBCache.Lock()
+	defer airportDBCache.Unlock()
+	if airportDBCache.db != nil && st.ModTime().Equal(airportDBCache.modTime) {
+		return airportDBCache.db, nil
+	}
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var list []airportInfo
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, err
+	}
+	db := newAirportIndex(list)
+	airportDBCache.modTime, airportDBCache.db = st.ModTime(), db
+	return db, nil
+}
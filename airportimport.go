@@ -0,0 +1,239 @@
+//go:build getwx
+
+package main
+
+// getwx -import-airports: builds the airport database from OurAirports
+// (airports.csv and airport-frequencies.csv) or from the FAA's NASR CSV
+// files (APT_BASE.csv and FRQ.csv). Which one a file is comes from its
+// header. Only NASR says whether an airport is public; OurAirports
+// airports count as towered when they have a tower frequency.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var nasrSiteTypes = map[string]string{
+	"A": "airport",
+	"B": "balloonport",
+	"C": "seaplane_base",
+	"G": "gliderport",
+	"H": "heliport",
+	"U": "ultralight",
+}
+
+// importAirports writes the airports in the ingest region to
+// paths.airport_db, with the frequencies in freqFile when it is set.
+func importAirports(aptFile, freqFile string, stats *sourceStats) error {
+	list, bySource, err := readAirportList(aptFile, stats)
+	if err != nil {
+		return err
+	}
+	if freqFile != "" {
+		if err := readAirportFrequencies(freqFile, list, bySource); err != nil {
+			return err
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Ident < list[j].Ident })
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg.Path(cfg.Paths.AirportDB), append(b, '\n'))
+}
+
+// openTable reads a CSV file whose header has the required columns, nil
+// if it has not. A file that cannot be read as CSV is an error.
+func openTable(fname string, required ...string) (*awcTable, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := readAWCTable(f, required...)
+	if errors.Is(err, errNoHeader) {
+		return nil, nil
+	}
+	// A CSV parse error does not say which file it is in; a read error
+	// does.
+	var perr *csv.ParseError
+	if errors.As(err, &perr) {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readAirportList reads the open airports in the region. bySource maps the
+// identifier the source's other files use to the airport's place in list.
+func readAirportList(fname string, stats *sourceStats) ([]airportInfo, map[string]int, error) {
+	var list []airportInfo
+	bySource := make(map[string]int)
+	add := func(key string, a airportInfo) {
+		if a.Ident == "" {
+			stats.reject("%s: airport without an identifier", fname)
+			return
+		}
+		if !hasValue(a.Lat) || !hasValue(a.Lng) {
+			stats.reject("%s: %s has no position", fname, a.Ident)
+			return
+		}
+		if !cfg.Region.Contains(a.Lat, a.Lng) {
+			stats.Outside++
+			return
+		}
+		if !hasValue(a.ElevationFt) {
+			a.ElevationFt = 0
+		}
+		stats.Accepted++
+		bySource[key] = len(list)
+		list = append(list, a)
+	}
+	if t, err := openTable(fname, "ident", "latitude_deg", "longitude_deg"); err != nil {
+		return nil, nil, err
+	} else if t != nil {
+		stats.rejectRows(t.Skipped, fname)
+		for _, row := range t.Rows {
+			typ := t.str(row, "type")
+			if typ == "closed" {
+				continue
+			}
+			country := t.str(row, "iso_country")
+			icao := t.str(row, "icao_code")
+			if gps := t.str(row, "gps_code"); icao == "" && len(gps) == 4 && isLetters(gps) {
+				icao = gps
+			}
+			var faa string
+			if country == "US" {
+				faa = t.str(row, "local_code")
+			}
+			_, state, _ := strings.Cut(t.str(row, "iso_region"), "-")
+			add(t.str(row, "ident"), airportInfo{
+				Ident:       firstOf(icao, faa, t.str(row, "ident")),
+				ICAO:        icao,
+				FAA:         faa,
+				Name:        t.str(row, "name"),
+				City:        t.str(row, "municipality"),
+				State:       state,
+				Country:     country,
+				Type:        typ,
+				Lat:         t.float(row, "latitude_deg"),
+				Lng:         t.float(row, "longitude_deg"),
+				ElevationFt: t.float(row, "elevation_ft"),
+			})
+		}
+		return list, bySource, nil
+	}
+	if t, err := openTable(fname, "arpt_id", "lat_decimal", "long_decimal"); err != nil {
+		return nil, nil, err
+	} else if t != nil {
+		stats.rejectRows(t.Skipped, fname)
+		for _, row := range t.Rows {
+			if status := t.str(row, "arpt_status"); status != "" && status != "O" {
+				continue
+			}
+			faa, icao := t.str(row, "arpt_id"), t.str(row, "icao_id")
+			use := ""
+			switch t.str(row, "facility_use_code") {
+			case "PU":
+				use = "public"
+			case "PR":
+				use = "private"
+			}
+			add(faa, airportInfo{
+				Ident:       firstOf(icao, faa),
+				ICAO:        icao,
+				FAA:         faa,
+				Name:        t.str(row, "arpt_name"),
+				City:        t.str(row, "city"),
+				State:       t.str(row, "state_code"),
+				Country:     t.str(row, "country_code"),
+				Type:        nasrSiteTypes[t.str(row, "site_type_code")],
+				Use:         use,
+				Towered:     strings.HasPrefix(t.str(row, "twr_type_code"), "ATCT"),
+				Lat:         t.float(row, "lat_decimal"),
+				Lng:         t.float(row, "long_decimal"),
+				ElevationFt: t.float(row, "elev"),
+			})
+		}
+		return list, bySource, nil
+	}
+	return nil, nil, fmt.Errorf("%s: neither an OurAirports airports.csv nor a NASR APT_BASE.csv", fname)
+}
+
+// readAirportFrequencies adds the frequencies in fname to the airports in
+// list. A tower frequency makes an airport towered.
+func readAirportFrequencies(fname string, list []airportInfo, bySource map[string]int) error {
+	add := func(key, typ, desc, freq string) {
+		k, ok := bySource[key]
+		fields := strings.Fields(freq)
+		if !ok || len(fields) == 0 {
+			return
+		}
+		mhz, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || mhz <= 0 {
+			return
+		}
+		a := &list[k]
+		for _, f := range a.Frequencies {
+			if f.Type == typ && f.MHz == mhz {
+				return
+			}
+		}
+		a.Frequencies = append(a.Frequencies, airportFreq{Type: typ, Description: desc, MHz: mhz})
+		if typ == "TWR" {
+			a.Towered = true
+		}
+	}
+	if t, err := openTable(fname, "airport_ident", "frequency_mhz"); err != nil {
+		return err
+	} else if t != nil {
+		for _, row := range t.Rows {
+			add(t.str(row, "airport_ident"), strings.ToUpper(t.str(row, "type")), t.str(row, "description"), t.str(row, "frequency_mhz"))
+		}
+		return nil
+	}
+	if t, err := openTable(fname, "serviced_facility", "freq"); err != nil {
+		return err
+	} else if t != nil {
+		for _, row := range t.Rows {
+			use := t.str(row, "freq_use")
+			add(t.str(row, "serviced_facility"), nasrFreqType(use), use, t.str(row, "freq"))
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: neither an OurAirports airport-frequencies.csv nor a NASR FRQ.csv", fname)
+}
+
+// nasrFreqType turns a NASR frequency use like "LCL/P" into the short
+// types OurAirports uses.
+func nasrFreqType(use string) string {
+	u := strings.ToUpper(use)
+	for _, m := range []struct{ in, typ string }{
+		{"CTAF", "CTAF"}, {"ATIS", "ATIS"}, {"LCL", "TWR"}, {"GND", "GND"},
+		{"CD", "CLD"}, {"UNICOM", "UNIC"}, {"AWOS", "AWOS"}, {"ASOS", "ASOS"},
+		{"APCH", "APP"}, {"DEP", "DEP"},
+	} {
+		if strings.Contains(u, m.in) {
+			return m.typ
+		}
+	}
+	return u
+}
+
+func firstOf(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,706 @@
+//go:build getwx
+
+package main
+
+// Weather alerts: after every ingest getwx checks the rules in alerts.rules
+// and posts a JSON notification to each of alerts.webhooks when a rule
+// starts to match a station, PIREP or advisory it did not match after the
+// previous ingest. What matched last time is kept in alerts.state_file, so
+// a restart does not repeat every alert. A rule is one line such as
+//
+//	KRAC category drops below MVFR
+//	gusts over 25 kt within 50 nm of KMKE
+//	any UUA PIREP in bounds
+//	new convective SIGMET on route KRAC KMSN KLSE
+//	racine-wind: KRAC wind above 20 kt
+//
+// with an optional "name: " in front. Station rules compare category,
+// ceiling, visibility, wind, gusts or temperature; without a station they
+// cover every station in the area. The area is "within N nm of X",
+// "within N nm of route A B ..", "on route A B .." (25 nm either side),
+// "in bounds" for map.bounds, or the whole ingest region when left out.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const alertCorridorNM = 25
+
+type alertKind int
+
+const (
+	alertStation alertKind = iota
+	alertPirep
+	alertAdvisory
+)
+
+var alertKindNames = [...]string{alertStation: "metar", alertPirep: "pirep", alertAdvisory: "advisory"}
+
+type alertArea int
+
+const (
+	areaRegion alertArea = iota
+	areaNear
+	areaBounds
+	areaRoute
+)
+
+type alertRule struct {
+	Name string
+	Text string // the rule as written, name included
+	kind alertKind
+
+	// station rules
+	station string // "" for every station
+	metric  string
+	above   bool
+	value   float64 // in the metric's units; °C for temperature
+	unit    string
+
+	// PIREP rules
+	urgent, turbulence, icing, severe bool
+
+	// advisory rules
+	advType, hazard string
+
+	area   alertArea
+	radius float64
+	center string   // areaNear around a point
+	route  []string // areaNear around a route, or areaRoute
+}
+
+// alertMetrics are the station values a rule can compare, by the words
+// that name them.
+var alertMetrics = map[string]string{
+	"category": "category", "ceiling": "ceiling", "visibility": "visibility", "vis": "visibility",
+	"wind": "wind", "winds": "wind", "gust": "gusts", "gusts": "gusts",
+	"temperature": "temperature", "temp": "temperature",
+}
+
+var alertUnits = map[string]map[string]string{
+	"ceiling":     {"ft": "ft", "feet": "ft"},
+	"visibility":  {"sm": "sm", "mi": "sm", "miles": "sm"},
+	"wind":        {"kt": "kt", "kts": "kt", "knots": "kt"},
+	"gusts":       {"kt": "kt", "kts": "kt", "knots": "kt"},
+	"temperature": {"c": "C", "°c": "C", "f": "F", "°f": "F"},
+}
+
+var alertDefaultUnits = map[string]string{"ceiling": "ft", "visibility": "sm", "wind": "kt", "gusts": "kt", "temperature": "C"}
+
+// alertComparisons are longest first, so "drops below" is not read as
+// "drops" followed by "below".
+var alertComparisons = []struct {
+	words []string
+	above bool
+}{
+	{[]string{"drops", "below"}, false}, {[]string{"falls", "below"}, false}, {[]string{"goes", "below"}, false},
+	{[]string{"rises", "above"}, true}, {[]string{"goes", "above"}, true},
+	{[]string{"below"}, false}, {[]string{"under"}, false},
+	{[]string{"above"}, true}, {[]string{"over"}, true}, {[]string{"exceeds"}, true},
+}
+
+var advisoryHazards = map[string]string{
+	"convective": "CONVECTIVE", "turbulence": "TURB", "icing": "ICE", "ifr": "IFR", "ash": "ASH",
+	"mountain": "MTN OBSCN", "obscuration": "MTN OBSCN",
+}
+
+// parseAlertRules reads alerts.rules, reporting every rule it cannot.
+func parseAlertRules(lines []string) ([]*alertRule, error) {
+	var rules []*alertRule
+	var errs []error
+	for _, line := range lines {
+		r, err := parseAlertRule(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("alerts.rules %q: %w", line, err))
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules, errors.Join(errs...)
+}
+
+func parseAlertRule(line string) (*alertRule, error) {
+	r := &alertRule{Text: strings.TrimSpace(line)}
+	text := r.Text
+	if name, rest, ok := strings.Cut(text, ":"); ok && name != "" && !strings.ContainsAny(name, " \t") {
+		r.Name, text = name, rest
+	}
+	words := strings.Fields(text)
+	lower := strings.Fields(strings.ToLower(text))
+	if len(words) == 0 {
+		return nil, errors.New("empty rule")
+	}
+
+	// The area comes last; everything before it says what to look for.
+	end := len(lower)
+	for k, w := range lower {
+		if w == "within" || w == "in" || w == "on" {
+			end = k
+			break
+		}
+	}
+	if err := r.parseArea(words[end:], lower[end:]); err != nil {
+		return nil, err
+	}
+	words, lower = words[:end], lower[:end]
+	for len(lower) > 0 && (lower[0] == "any" || lower[0] == "new" || lower[0] == "a") {
+		words, lower = words[1:], lower[1:]
+	}
+	if len(lower) == 0 {
+		return nil, errors.New("nothing to look for")
+	}
+	switch strings.TrimSuffix(lower[len(lower)-1], "s") {
+	case "pirep":
+		r.kind = alertPirep
+		for _, w := range lower[:len(lower)-1] {
+			switch w {
+			case "uua", "urgent":
+				r.urgent = true
+			case "turbulence", "turb":
+				r.turbulence = true
+			case "icing":
+				r.icing = true
+			case "severe":
+				r.severe = true
+			case "ua":
+			default:
+				return nil, fmt.Errorf("unknown PIREP qualifier %q", w)
+			}
+		}
+		return r, nil
+	case "sigmet", "airmet", "advisory", "advisorie":
+		r.kind = alertAdvisory
+		if t := strings.ToUpper(strings.TrimSuffix(lower[len(lower)-1], "s")); t == "SIGMET" || t == "AIRMET" {
+			r.advType = t
+		}
+		for _, w := range lower[:len(lower)-1] {
+			h, ok := advisoryHazards[w]
+			if !ok {
+				return nil, fmt.Errorf("unknown advisory hazard %q", w)
+			}
+			r.hazard = h
+		}
+		return r, nil
+	}
+
+	r.kind = alertStation
+	if _, ok := alertMetrics[lower[0]]; !ok {
+		r.station = strings.ToUpper(words[0])
+		if len(r.station) < 3 || len(r.station) > 4 || strings.Trim(r.station, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "" {
+			return nil, fmt.Errorf("%q is neither a station nor one of category, ceiling, visibility, wind, gusts or temperature", words[0])
+		}
+		lower = lower[1:]
+	}
+	if len(lower) == 0 || alertMetrics[lower[0]] == "" {
+		return nil, errors.New("expected category, ceiling, visibility, wind, gusts or temperature")
+	}
+	r.metric, lower = alertMetrics[lower[0]], lower[1:]
+	if len(lower) > 0 && lower[0] == "is" {
+		lower = lower[1:]
+	}
+	found := false
+	for _, c := range alertComparisons {
+		if len(lower) >= len(c.words) && strings.Join(lower[:len(c.words)], " ") == strings.Join(c.words, " ") {
+			r.above, lower, found = c.above, lower[len(c.words):], true
+			break
+		}
+	}
+	if !found || len(lower) == 0 {
+		return nil, fmt.Errorf("expected below or above and a value after %s", r.metric)
+	}
+	if r.metric == "category" {
+		r.value = -1
+		for k, name := range categoryNames {
+			if strings.EqualFold(lower[0], name) {
+				r.value = float64(k)
+			}
+		}
+		if r.value < 0 {
+			return nil, fmt.Errorf("unknown flight category %q", lower[0])
+		}
+		lower = lower[1:]
+	} else {
+		num, unit := lower[0], ""
+		// "25kt" as well as "25 kt"
+		k := strings.IndexFunc(num, func(c rune) bool { return (c < '0' || c > '9') && c != '.' && c != '-' })
+		if k > 0 {
+			num, unit = num[:k], num[k:]
+		}
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", lower[0])
+		}
+		lower = lower[1:]
+		if unit == "" && len(lower) > 0 {
+			unit, lower = lower[0], lower[1:]
+		}
+		r.unit = alertDefaultUnits[r.metric]
+		if unit != "" {
+			u, ok := alertUnits[r.metric][unit]
+			if !ok {
+				return nil, fmt.Errorf("%s is not a unit of %s", unit, r.metric)
+			}
+			r.unit = u
+		}
+		if r.unit == "F" {
+			v = (v - 32) * 5 / 9
+		}
+		r.value = v
+	}
+	if len(lower) > 0 {
+		return nil, fmt.Errorf("unexpected %q", strings.Join(lower, " "))
+	}
+	return r, nil
+}
+
+func (r *alertRule) parseArea(words, lower []string) error {
+	switch {
+	case len(lower) == 0:
+		r.area = areaRegion
+	case len(lower) == 2 && lower[0] == "in" && lower[1] == "bounds":
+		r.area = areaBounds
+	case len(lower) >= 3 && lower[0] == "on" && lower[1] == "route":
+		r.area, r.radius, r.route = areaRoute, alertCorridorNM, upperAll(words[2:])
+		if len(r.route) < 2 {
+			return errors.New("a route needs at least two waypoints")
+		}
+	case len(lower) >= 5 && lower[0] == "within" && lower[2] == "nm" && lower[3] == "of":
+		v, err := strconv.ParseFloat(lower[1], 64)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("%q is not a distance", words[1])
+		}
+		r.area, r.radius = areaNear, v
+		switch {
+		case lower[4] == "route" && len(lower) >= 7:
+			r.route = upperAll(words[5:])
+		case len(lower) == 5:
+			r.center = strings.ToUpper(words[4])
+		default:
+			return fmt.Errorf("unexpected %q", strings.Join(words[4:], " "))
+		}
+	default:
+		return fmt.Errorf("expected within N nm of X, on route A B .. or in bounds, not %q", strings.Join(words, " "))
+	}
+	return nil
+}
+
+func upperAll(s []string) []string {
+	out := make([]string, len(s))
+	for k, v := range s {
+		out[k] = strings.ToUpper(v)
+	}
+	return out
+}
+
+// alertMatch is something a rule matched. Key tells it apart from the
+// rule's other matches from one ingest to the next.
+type alertMatch struct {
+	Key      string
+	Subject  string
+	Message  string
+	Report   string
+	Lat, Lng float64
+}
+
+// alertNotification is the body posted to the webhooks.
+type alertNotification struct {
+	Rule    string    `json:"rule"`
+	Name    string    `json:"name,omitempty"`
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject"`
+	Message string    `json:"message"`
+	Report  string    `json:"report"`
+	Lat     float64   `json:"lat"`
+	Lng     float64   `json:"lng"`
+	Time    time.Time `json:"time"`
+}
+
+// alertState is what the rules matched after the last ingest, by rule
+// and match key, with when each match started.
+type alertState map[string]time.Time
+
+func alertKey(r *alertRule, key string) string {
+	return r.Text + "|" + key
+}
+
+var alertNotifications = newCounter("getwx_alert_notifications_total", "Alert notifications posted to webhooks, by result.", "result")
+
+// checkAlerts runs the rules against what the last ingest read. fresh
+// says which kinds were read this time; the matches of rules on the rest
+// are carried over rather than dropped and sent again later.
+func checkAlerts(rules []*alertRule, fresh map[alertKind]bool) error {
+	fname := cfg.Path(cfg.Alerts.StateFile)
+	prev, err := readAlertState(fname)
+	if err != nil {
+		return err
+	}
+	next := make(alertState)
+	var errs []error
+	for _, r := range rules {
+		if !fresh[r.kind] {
+			for k, t := range prev {
+				if strings.HasPrefix(k, r.Text+"|") {
+					next[k] = t
+				}
+			}
+			continue
+		}
+		matches, err := r.evaluate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %q: %w", r.Text, err))
+			continue
+		}
+		for _, m := range matches {
+			key := alertKey(r, m.Key)
+			if t, ok := prev[key]; ok {
+				next[key] = t
+				continue
+			}
+			if err := sendAlert(r, m); err != nil {
+				// Left out of the state so the next ingest tries again.
+				errs = append(errs, err)
+				continue
+			}
+			next[key] = time.Now().UTC()
+		}
+	}
+	b, err := json.MarshalIndent(next, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(fname, append(b, '\n'))
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("writing %s: %w", fname, err))
+	}
+	return errors.Join(errs...)
+}
+
+func readAlertState(fname string) (alertState, error) {
+	buf, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return alertState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := alertState{}
+	if err := json.Unmarshal(buf, &st); err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return st, nil
+}
+
+// sendAlert logs the alert and posts it to every webhook. A webhook that
+// fails makes the alert count as not sent, so the ones that did get it
+// will get it again after the next ingest.
+func sendAlert(r *alertRule, m alertMatch) error {
+	n := alertNotification{
+		Rule:    r.Text,
+		Name:    r.Name,
+		Kind:    alertKindNames[r.kind],
+		Subject: m.Subject,
+		Message: m.Message,
+		Report:  m.Report,
+		Lat:     m.Lat,
+		Lng:     m.Lng,
+		Time:    time.Now().UTC(),
+	}
+	slog.Info("alert", "rule", r.Text, "subject", m.Subject, "message", m.Message)
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: cfg.Alerts.Timeout}
+	var errs []error
+	for _, hook := range cfg.Alerts.Webhooks {
+		if err := postWebhook(client, hook, body); err != nil {
+			alertNotifications.Inc("failed")
+			errs = append(errs, err)
+			continue
+		}
+		alertNotifications.Inc("sent")
+	}
+	return errors.Join(errs...)
+}
+
+func postWebhook(client *http.Client, hook string, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), "POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s: HTTP %d", hook, resp.StatusCode)
+	}
+	return nil
+}
+
+// alertPlace is the area of a rule with its points looked up.
+type alertPlace struct {
+	rule     *alertRule
+	lat, lng float64
+	route    []waypoint
+}
+
+// evaluate lists what the rule matches in the data getwx just read.
+func (r *alertRule) evaluate() ([]alertMatch, error) {
+	p, err := r.place()
+	if err != nil {
+		return nil, err
+	}
+	var out []alertMatch
+	switch r.kind {
+	case alertStation:
+		want := map[string]bool{}
+		for _, id := range airportDB.aliases(r.station) {
+			want[id] = true
+		}
+		for _, m := range metars {
+			lat, err1 := strconv.ParseFloat(m.LAT, 64)
+			lng, err2 := strconv.ParseFloat(m.LONG, 64)
+			if err1 != nil || err2 != nil || r.station != "" && !want[m.ICAO] || !p.containsPoint(lat, lng) {
+				continue
+			}
+			if msg, ok := r.matchMetar(m); ok {
+				out = append(out, alertMatch{Key: m.ICAO, Subject: m.ICAO, Message: msg, Report: m.METAR, Lat: lat, Lng: lng})
+			}
+		}
+	case alertPirep:
+		for _, rep := range pireps {
+			lat, err1 := strconv.ParseFloat(rep.Lat, 64)
+			lng, err2 := strconv.ParseFloat(rep.Lng, 64)
+			if err1 != nil || err2 != nil || !r.matchPirep(rep.Report) || !p.containsPoint(lat, lng) {
+				continue
+			}
+			subject, _, _ := strings.Cut(rep.Report, " ")
+			kind := "PIREP"
+			if pirepUrgent(rep.Report) {
+				kind = "urgent PIREP"
+			}
+			out = append(out, alertMatch{
+				Key: textKey(rep.Report), Subject: subject, Report: rep.Report, Lat: lat, Lng: lng,
+				Message: fmt.Sprintf("%s near %s: %s", kind, subject, rep.Report),
+			})
+		}
+	case alertAdvisory:
+		for _, a := range advisories {
+			if r.advType != "" && a.Type != r.advType || r.hazard != "" && a.Hazard != r.hazard || !p.containsOutline(a) {
+				continue
+			}
+			lat, lng := outlineCentre(a.Points)
+			subject := strings.TrimSpace(a.Hazard + " " + a.Type)
+			out = append(out, alertMatch{
+				Key: textKey(a.Raw), Subject: subject, Report: a.Raw, Lat: lat, Lng: lng,
+				Message: fmt.Sprintf("%s valid until %s", subject, a.ValidTo.UTC().Format("021504Z")),
+			})
+		}
+	}
+	return out, nil
+}
+
+// matchMetar says whether a station's report meets the rule and how.
+func (r *alertRule) matchMetar(m Metar) (string, bool) {
+	obs := parseMetarText(m.METAR)
+	var v float64
+	switch r.metric {
+	case "category":
+		v = metarCategory(m.COND, obs)
+	case "ceiling":
+		v = obs.Ceiling
+		if math.IsNaN(v) && obs.Cover != "" {
+			v = math.Inf(1)
+		}
+	case "visibility":
+		v = obs.VisSM
+	case "wind":
+		v = obs.WindSpeed
+	case "gusts":
+		v = obs.WindGust
+	case "temperature":
+		v = obs.TempC
+	}
+	if math.IsNaN(v) || r.above && !(v > r.value) || !r.above && !(v < r.value) {
+		return "", false
+	}
+	how := "below"
+	if r.above {
+		how = "above"
+	}
+	if r.metric == "category" {
+		return fmt.Sprintf("%s is %s, %s %s", m.ICAO, categoryNames[int(v)], how, categoryNames[int(r.value)]), true
+	}
+	if math.IsInf(v, 1) {
+		return fmt.Sprintf("%s has no ceiling", m.ICAO), true
+	}
+	show := func(x float64) string {
+		if r.unit == "F" {
+			x = cToF(x)
+		}
+		return strconv.FormatFloat(math.Round(x*10)/10, 'f', -1, 64) + " " + r.unit
+	}
+	return fmt.Sprintf("%s %s %s, %s %s", m.ICAO, r.metric, show(v), how, show(r.value)), true
+}
+
+// metarCategory is the flight category from the feed, or worked out from
+// the report when the feed has none.
+func metarCategory(cond string, obs metarObs) float64 {
+	for k, name := range categoryNames {
+		if strings.EqualFold(cond, name) {
+			return float64(k)
+		}
+	}
+	ceiling := obs.Ceiling
+	if math.IsNaN(ceiling) && obs.Cover != "" {
+		ceiling = unlimitedCeiling
+	}
+	return flightCategory(ceiling, obs.VisSM)
+}
+
+func (r *alertRule) matchPirep(report string) bool {
+	upper := " " + strings.ToUpper(report) + " "
+	switch {
+	case r.urgent && !pirepUrgent(report):
+		return false
+	case r.turbulence && !strings.Contains(upper, "/TB"):
+		return false
+	case r.icing && !strings.Contains(upper, "/IC"):
+		return false
+	case r.severe && !strings.Contains(upper, "SEV"):
+		return false
+	}
+	return true
+}
+
+func pirepUrgent(report string) bool {
+	return strings.Contains(" "+strings.ToUpper(report)+" ", " UUA ")
+}
+
+// textKey is a short stable key for a report's text.
+func textKey(s string) string {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(strings.Fields(s), " ")))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func outlineCentre(points [][2]float64) (lat, lng float64) {
+	for _, p := range points {
+		lat += p[0]
+		lng += p[1]
+	}
+	n := float64(max(len(points), 1))
+	return lat / n, lng / n
+}
+
+// place looks up the points the rule's area is given by.
+func (r *alertRule) place() (*alertPlace, error) {
+	p := &alertPlace{rule: r}
+	if r.center != "" {
+		var ok bool
+		if p.lat, p.lng, ok = alertPoint(r.center); !ok {
+			return nil, fmt.Errorf("cannot find %s", r.center)
+		}
+	}
+	for k, name := range r.route {
+		lat, lng, ok := alertPoint(name)
+		if !ok {
+			return nil, fmt.Errorf("cannot find %s", name)
+		}
+		w := waypoint{Ident: name, Lat: lat, Lng: lng}
+		if k > 0 {
+			last := p.route[k-1]
+			w.DistanceNM = last.DistanceNM + gcDistance(last.Lat, last.Lng, lat, lng)
+		}
+		p.route = append(p.route, w)
+	}
+	return p, nil
+}
+
+// alertPoint finds a point named in a rule: lat/lng, an airport in the
+// database, a station that just reported or an airport in airports.txt.
+func alertPoint(name string) (lat, lng float64, ok bool) {
+	if a, b, found := strings.Cut(name, "/"); found {
+		lat, err1 := strconv.ParseFloat(a, 64)
+		lng, err2 := strconv.ParseFloat(b, 64)
+		return lat, lng, err1 == nil && err2 == nil
+	}
+	if a := airportDB.find(name); a != nil {
+		return a.Lat, a.Lng, true
+	}
+	for _, id := range airportDB.aliases(name) {
+		for _, m := range metars {
+			if m.ICAO == id {
+				lat, err1 := strconv.ParseFloat(m.LAT, 64)
+				lng, err2 := strconv.ParseFloat(m.LONG, 64)
+				if err1 == nil && err2 == nil {
+					return lat, lng, true
+				}
+			}
+		}
+		for _, a := range airports {
+			if a.ICAO == id {
+				lat, err1 := strconv.ParseFloat(a.Lat, 64)
+				lng, err2 := strconv.ParseFloat(a.Lng, 64)
+				if err1 == nil && err2 == nil {
+					return lat, lng, true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func (p *alertPlace) containsPoint(lat, lng float64) bool {
+	r := p.rule
+	switch r.area {
+	case areaBounds:
+		return cfg.Map.Bounds.Contains(lat, lng)
+	case areaNear:
+		if p.route != nil {
+			_, off := routePosition(p.route, lat, lng)
+			return off <= r.radius
+		}
+		return gcDistance(p.lat, p.lng, lat, lng) <= r.radius
+	case areaRoute:
+		_, off := routePosition(p.route, lat, lng)
+		return off <= r.radius
+	}
+	return true
+}
+
+func (p *alertPlace) containsOutline(a advisoryData) bool {
+	r := p.rule
+	switch r.area {
+	case areaBounds:
+		b := cfg.Map.Bounds
+		for _, pt := range a.Points {
+			if b.Contains(pt[0], pt[1]) {
+				return true
+			}
+		}
+		// An outline larger than the bounds has no point in them.
+		return polygonDistance(a.Points, (b.LatMin+b.LatMax)/2, (b.LngMin+b.LngMax)/2) == 0
+	case areaNear, areaRoute:
+		if p.route != nil {
+			_, _, _, ok := advisoryPosition(p.route, a, r.radius)
+			return ok
+		}
+		return polygonDistance(a.Points, p.lat, p.lng) <= r.radius
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+//go:build getwx
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder is a webhook receiver that keeps what it is sent, or
+// answers 503 while down is set.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	down     bool
+	attempts int
+	received []alertNotification
+}
+
+func (h *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.attempts++
+	if h.down {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+		return
+	}
+	var n alertNotification
+	body, _ := io.ReadAll(r.Body)
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &n) != nil {
+		http.Error(w, "bad notification", http.StatusBadRequest)
+		return
+	}
+	h.received = append(h.received, n)
+}
+
+// take returns what arrived since the last call, and how many posts were
+// tried.
+func (h *webhookRecorder) take() ([]alertNotification, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	got, n := h.received, h.attempts
+	h.received, h.attempts = nil, 0
+	return got, n
+}
+
+func (h *webhookRecorder) setDown(down bool) {
+	h.mu.Lock()
+	h.down = down
+	h.mu.Unlock()
+}
+
+func TestCheckAlerts(t *testing.T) {
+	hook := &webhookRecorder{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	oldCfg, oldMetars, oldDB := cfg, metars, airportDB
+	t.Cleanup(func() { cfg, metars, airportDB = oldCfg, oldMetars, oldDB })
+	cfg = defaultConfig()
+	cfg.Paths.DataDir = t.TempDir()
+	cfg.Alerts.Webhooks = []string{srv.URL}
+	cfg.Alerts.Timeout = 5 * time.Second
+	airportDB = nil
+
+	rules, err := parseAlertRules([]string{"racine-wind: KRAC wind above 20 kt", "gusts over 30 kt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setWind := func(krac, kmke string) {
+		metars = []Metar{
+			{ICAO: "KRAC", METAR: "KRAC 191855Z " + krac + " 10SM CLR 18/06 A3002", COND: "VFR", LAT: "42.76", LONG: "-87.81"},
+			{ICAO: "KMKE", METAR: "KMKE 191852Z " + kmke + " 10SM FEW250 19/05 A3001", COND: "VFR", LAT: "42.95", LONG: "-87.90"},
+		}
+	}
+	state := func() alertState {
+		t.Helper()
+		st, err := readAlertState(cfg.Path(cfg.Alerts.StateFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	run := func(fresh bool) error {
+		return checkAlerts(rules, map[alertKind]bool{alertStation: fresh})
+	}
+	const racineKey = "racine-wind: KRAC wind above 20 kt|KRAC"
+
+	// The rule starts to match: one notification.
+	setWind("27025KT", "27010KT")
+	if err := run(true); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := hook.take()
+	if len(got) != 1 {
+		t.Fatalf("first ingest sent %d notifications, want 1: %+v", len(got), got)
+	}
+	n := got[0]
+	if n.Name != "racine-wind" || n.Kind != "metar" || n.Subject != "KRAC" || n.Lat != 42.76 || n.Lng != -87.81 ||
+		n.Message != "KRAC wind 25 kt, above 20 kt" || !strings.HasPrefix(n.Report, "KRAC 191855Z") {
+		t.Errorf("notification = %+v", n)
+	}
+	started, ok := state()[racineKey]
+	if !ok {
+		t.Fatalf("alerts.json has no %q: %v", racineKey, state())
+	}
+
+	// Still matching after the next ingest, and after one that did not
+	// read the METARs: nothing more is sent and the start time stays.
+	for _, fresh := range []bool{true, false} {
+		if err := run(fresh); err != nil {
+			t.Fatal(err)
+		}
+		if got, tries := hook.take(); tries != 0 {
+			t.Errorf("fresh=%v: sent %+v again", fresh, got)
+		}
+		if st := state(); !st[racineKey].Equal(started) || len(st) != 1 {
+			t.Errorf("fresh=%v: state = %v, want only %s at %v", fresh, st, racineKey, started)
+		}
+	}
+
+	// The wind drops and the match is forgotten; when it picks up
+	// again, that is a new alert.
+	setWind("27010KT", "27010KT")
+	if err := run(true); err != nil {
+		t.Fatal(err)
+	}
+	if len(state()) != 0 {
+		t.Errorf("state after the wind dropped = %v, want it empty", state())
+	}
+	setWind("27024KT", "27010KT")
+	if err := run(true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := hook.take(); len(got) != 1 || got[0].Subject != "KRAC" {
+		t.Errorf("after the wind picked up again: %+v, want one KRAC alert", got)
+	}
+
+	// KMKE gusts while the receiver is down: the alert is tried, left
+	// out of alerts.json, and sent once the receiver is back.
+	hook.setDown(true)
+	setWind("27024KT", "27020G35KT")
+	if err := run(true); err == nil || !strings.Contains(err.Error(), "HTTP 503") {
+		t.Errorf("ingest with the receiver down: err = %v, want the 503", err)
+	}
+	if _, tries := hook.take(); tries != 1 {
+		t.Errorf("tried %d posts with the receiver down, want 1", tries)
+	}
+	st := state()
+	if _, ok := st["gusts over 30 kt|KMKE"]; ok {
+		t.Errorf("alert that was not delivered is in alerts.json: %v", st)
+	}
+	if _, ok := st[racineKey]; !ok {
+		t.Errorf("alert already delivered was dropped from alerts.json: %v", st)
+	}
+	hook.setDown(false)
+	if err := run(true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := hook.take(); len(got) != 1 || got[0].Subject != "KMKE" || got[0].Message != "KMKE gusts 35 kt, above 30 kt" {
+		t.Errorf("retry sent %+v, want the KMKE gust alert", got)
+	}
+	if err := run(true); err != nil {
+		t.Fatal(err)
+	}
+	if got, tries := hook.take(); tries != 0 {
+		t.Errorf("sent %+v after the retry had got through", got)
+	}
+	if st := state(); len(st) != 2 {
+		t.Errorf("state = %v, want the KRAC and KMKE alerts", st)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build !getwx && !websocket
+
+package main
+
+// Checking map API requests before any work is done. Bounds are read as
+// west,south,east,north: the latitudes must be in order and on the globe,
+// longitudes past ±180 are wrapped, as Leaflet gives them when the map
+// has been panned around the world, and a box whose west edge is east of
+// its east edge crosses the antimeridian. Boxes over map.max_area square
+// degrees are refused. Errors go back as {"error": "...", "status": 400}.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// apiError is a request the map API will not answer, with the status to
+// say so.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+func badRequest(format string, args ...any) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeAPIError sends msg as a JSON error body.
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	h := w.Header()
+	h.Del("ETag")
+	h.Del("Cache-Control")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{msg, status})
+}
+
+// parseViewBounds reads and checks the bounds parameter.
+func parseViewBounds(s string) (Bounds, error) {
+	if s == "" {
+		return Bounds{}, badRequest("bounds is required")
+	}
+	b, err := parseBoundsArg(s)
+	if err != nil {
+		return Bounds{}, badRequest("%v", err)
+	}
+	for _, v := range []float64{b.LngMin, b.LatMin, b.LngMax, b.LatMax} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Bounds{}, badRequest("bounds %q must be numbers", s)
+		}
+	}
+	if b.LatMin < -90 || b.LatMax > 90 {
+		return Bounds{}, badRequest("bounds %q: latitudes must be between -90 and 90", s)
+	}
+	if b.LatMin >= b.LatMax {
+		return Bounds{}, badRequest("bounds %q: the south edge must be below the north edge", s)
+	}
+	if math.Abs(b.LngMin) > 540 || math.Abs(b.LngMax) > 540 {
+		return Bounds{}, badRequest("bounds %q: longitudes must be between -540 and 540", s)
+	}
+	if b.LngMin < b.LngMax && b.LngMax-b.LngMin >= 360 {
+		b.LngMin, b.LngMax = -180, 180
+	} else {
+		b.LngMin, b.LngMax = wrapLng(b.LngMin), wrapLng(b.LngMax)
+	}
+	if area := boundsWidth(b) * (b.LatMax - b.LatMin); area > cfg.Map.MaxArea {
+		return Bounds{}, badRequest("bounds %q cover %.0f square degrees, more than the %.0f allowed", s, area, cfg.Map.MaxArea)
+	}
+	return b, nil
+}
+
+// wrapLng brings a longitude into -180..180.
+func wrapLng(lng float64) float64 {
+	if lng >= -180 && lng <= 180 {
+		return lng
+	}
+	lng = math.Mod(lng+180, 360)
+	if lng < 0 {
+		lng += 360
+	}
+	return lng - 180
+}
+
+// boundsWidth is the width of b in degrees of longitude, across the
+// antimeridian when the west edge is east of the east edge.
+func boundsWidth(b Bounds) float64 {
+	if b.LngMin > b.LngMax {
+		return b.LngMax - b.LngMin + 360
+	}
+	return b.LngMax - b.LngMin
+}
+
+var mapAPIRequests = []string{"airports", "pireps", "densityalt", "airport", "nearestwx", "route", "plan"}
+
+// checkAPIRequest turns away what no req answers: other methods than GET
+// and HEAD, and a missing or unknown req.
+func checkAPIRequest(r *http.Request, req string) *apiError {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return &apiError{Status: http.StatusMethodNotAllowed, Message: "the map API only answers GET"}
+	}
+	if req == "" {
+		return badRequest("req is required: one of %s", strings.Join(mapAPIRequests, ", "))
+	}
+	for _, name := range mapAPIRequests {
+		if req == name {
+			return nil
+		}
+	}
+	return badRequest("unknown req %q: one of %s", req, strings.Join(mapAPIRequests, ", "))
+}
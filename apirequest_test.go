@@ -0,0 +1,352 @@
+//go:build !getwx && !websocket
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestConfig points cfg at the defaults with a fresh data directory
+// holding files, name to contents, and puts the old cfg back afterwards.
+func useTestConfig(t *testing.T, files map[string]string) *Config {
+	t.Helper()
+	old := cfg
+	t.Cleanup(func() { cfg = old })
+	cfg = defaultConfig()
+	cfg.Paths.DataDir = t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(cfg.Paths.DataDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+func TestParseViewBounds(t *testing.T) {
+	useTestConfig(t, nil).Map.MaxArea = 1000
+	tests := []struct {
+		name, bounds string
+		want         Bounds
+		err          string
+	}{
+		{name: "plain", bounds: "-90,40,-85,45", want: Bounds{LngMin: -90, LatMin: 40, LngMax: -85, LatMax: 45}},
+		{name: "spaces", bounds: " -90 , 40 , -85 , 45 ", want: Bounds{LngMin: -90, LatMin: 40, LngMax: -85, LatMax: 45}},
+		{name: "antimeridian", bounds: "170,-20,-170,-10", want: Bounds{LngMin: 170, LatMin: -20, LngMax: -170, LatMax: -10}},
+		{name: "panned east", bounds: "190,10,200,20", want: Bounds{LngMin: -170, LatMin: 10, LngMax: -160, LatMax: 20}},
+		{name: "panned west", bounds: "-370,10,-360,20", want: Bounds{LngMin: -10, LatMin: 10, LngMax: 0, LatMax: 20}},
+		{name: "panned across", bounds: "350,10,370,20", want: Bounds{LngMin: -10, LatMin: 10, LngMax: 10, LatMax: 20}},
+		{name: "round the world", bounds: "-200,0,200,1", want: Bounds{LngMin: -180, LatMin: 0, LngMax: 180, LatMax: 1}},
+		{name: "at max_area", bounds: "0,0,40,25", want: Bounds{LngMin: 0, LatMin: 0, LngMax: 40, LatMax: 25}},
+		{name: "over max_area", bounds: "0,0,40,26", err: "more than the 1000 allowed"},
+		{name: "over max_area across the antimeridian", bounds: "160,0,-160,30", err: "cover 1200 square degrees"},
+		{name: "missing", bounds: "", err: "bounds is required"},
+		{name: "three numbers", bounds: "1,2,3", err: "must be lng1,lat1,lng2,lat2"},
+		{name: "not a number", bounds: "a,2,3,4", err: "invalid syntax"},
+		{name: "NaN", bounds: "NaN,2,3,4", err: "must be numbers"},
+		{name: "infinite", bounds: "1,2,Inf,4", err: "must be numbers"},
+		{name: "south of the pole", bounds: "0,-91,1,0", err: "between -90 and 90"},
+		{name: "upside down", bounds: "0,10,1,5", err: "south edge must be below"},
+		{name: "no height", bounds: "0,10,1,10", err: "south edge must be below"},
+		{name: "too far round", bounds: "-541,0,0,1", err: "between -540 and 540"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseViewBounds(tt.bounds)
+			if tt.err != "" {
+				var aerr *apiError
+				if !errors.As(err, &aerr) || aerr.Status != http.StatusBadRequest {
+					t.Fatalf("parseViewBounds(%q) error = %v, want a 400", tt.bounds, err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("parseViewBounds(%q) error = %q, want it to say %q", tt.bounds, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseViewBounds(%q): %v", tt.bounds, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseViewBounds(%q) = %+v, want %+v", tt.bounds, got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzParseViewBounds(f *testing.F) {
+	for _, s := range []string{"-90,40,-85,45", "170,-20,-170,-10", "190,10,200,20", "-200,0,200,1",
+		"0,0,40,26", "", "1,2,3", "NaN,2,3,4", "0,-91,1,0", "1e308,0,-1e308,1", "540,0,-540,1"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		old := cfg
+		defer func() { cfg = old }()
+		cfg = defaultConfig()
+		b, err := parseViewBounds(s)
+		if err != nil {
+			var aerr *apiError
+			if !errors.As(err, &aerr) || aerr.Status != http.StatusBadRequest {
+				t.Fatalf("parseViewBounds(%q) error = %v, want a 400", s, err)
+			}
+			return
+		}
+		for _, lng := range []float64{b.LngMin, b.LngMax} {
+			if !(lng >= -180 && lng <= 180) {
+				t.Fatalf("parseViewBounds(%q) = %+v: longitude %v is not wrapped", s, b, lng)
+			}
+		}
+		if !(b.LatMin >= -90 && b.LatMin < b.LatMax && b.LatMax <= 90) {
+			t.Fatalf("parseViewBounds(%q) = %+v: latitudes out of order", s, b)
+		}
+		if area := boundsWidth(b) * (b.LatMax - b.LatMin); area > cfg.Map.MaxArea || math.IsNaN(area) {
+			t.Fatalf("parseViewBounds(%q) = %+v covers %v square degrees, over %v", s, b, area, cfg.Map.MaxArea)
+		}
+	})
+}
+
+// finite reports whether none of vs is NaN or infinite.
+func finite(vs ...float64) bool {
+	for _, v := range vs {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzParseNearestQuery(f *testing.F) {
+	f.Add("3CK", "", "", "")
+	f.Add("", "42.7", "-87.8", "5")
+	f.Add("", "NaN", "-87", "")
+	f.Add("", "91", "0", "")
+	f.Add("", "1e400", "Inf", "")
+	f.Add("KRAC", "", "", "11")
+	f.Fuzz(func(t *testing.T, id, lat, lng, n string) {
+		q, err := parseNearestQuery(id, lat, lng, n)
+		if err != nil {
+			return
+		}
+		if q.n < 1 || q.n > maxNearest {
+			t.Fatalf("parseNearestQuery(%q, %q, %q, %q): n = %d", id, lat, lng, n, q.n)
+		}
+		if q.id == "" && (!finite(q.lat, q.lng) || math.Abs(q.lat) > 90 || math.Abs(q.lng) > 180) {
+			t.Fatalf("parseNearestQuery(%q, %q, %q, %q): position %v, %v", id, lat, lng, n, q.lat, q.lng)
+		}
+	})
+}
+
+func FuzzParseRouteQuery(f *testing.F) {
+	f.Add("KRAC KMSN", "", "")
+	f.Add("KRAC+KMSN+43.5/-90.2", "25", "6000")
+	f.Add("KRAC", "NaN", "")
+	f.Add("KRAC,KMSN", "Inf", "-1")
+	f.Add("A B", "1e-300", "60001")
+	f.Fuzz(func(t *testing.T, route, width, altitude string) {
+		q, err := parseRouteQuery(route, width, altitude)
+		if err != nil {
+			return
+		}
+		if len(q.names) < 2 || len(q.names) > maxWaypoints {
+			t.Fatalf("parseRouteQuery(%q, %q, %q): %d waypoints", route, width, altitude, len(q.names))
+		}
+		if !finite(q.width) || !(q.width > 0) || q.width > maxCorridorNM {
+			t.Fatalf("parseRouteQuery(%q, %q, %q): width %v", route, width, altitude, q.width)
+		}
+		if q.altitude < 0 || q.altitude > 60000 {
+			t.Fatalf("parseRouteQuery(%q, %q, %q): altitude %d", route, width, altitude, q.altitude)
+		}
+	})
+}
+
+func FuzzParsePlanQuery(f *testing.F) {
+	f.Add("KRAC KMSN", "6500", "120", "9.5", "")
+	f.Add("KRAC KMSN", "6500", "120", "NaN", "")
+	f.Add("KRAC KMSN", "6500", "NaN", "", "")
+	f.Add("KRAC KMSN", "", "120", "", "")
+	f.Add("KRAC KMSN", "6500", "120", "Inf", "2999")
+	f.Add("KRAC KMSN", "6500", "1e309", "-0", "39000")
+	f.Fuzz(func(t *testing.T, route, altitude, tas, burn, maxAltitude string) {
+		q, err := parsePlanQuery(route, altitude, tas, burn, maxAltitude)
+		if err != nil {
+			return
+		}
+		if len(q.names) < 2 || q.altitude < 0 || q.altitude > 60000 || q.maxAltitude < standardLevels[0] {
+			t.Fatalf("parsePlanQuery(%q, %q, %q, %q, %q) = %+v", route, altitude, tas, burn, maxAltitude, q)
+		}
+		if !finite(q.tas, q.burn) || !(q.tas > 0) || q.tas > 1000 || q.burn < 0 {
+			t.Fatalf("parsePlanQuery(%q, %q, %q, %q, %q): tas %v, burn %v", route, altitude, tas, burn, maxAltitude, q.tas, q.burn)
+		}
+	})
+}
+
+func FuzzParseLODQuery(f *testing.F) {
+	for _, s := range [][2]string{{"", ""}, {"5", ""}, {"5", "100"}, {"-1", ""}, {"23", ""}, {"x", "0"}, {"", "501"}} {
+		f.Add(s[0], s[1])
+	}
+	f.Fuzz(func(t *testing.T, zoom, max string) {
+		old := cfg
+		defer func() { cfg = old }()
+		cfg = defaultConfig()
+		q, err := parseLODQuery(zoom, max)
+		if err != nil {
+			return
+		}
+		if q.zoom < -1 || q.zoom > maxLODZoom || (zoom == "") != (q.zoom == -1) {
+			t.Fatalf("parseLODQuery(%q, %q): zoom %d", zoom, max, q.zoom)
+		}
+		if q.max < 0 || q.max > cfg.Map.MaxStations || (zoom == "" && max == "") != (q.max == 0) {
+			t.Fatalf("parseLODQuery(%q, %q): max %d", zoom, max, q.max)
+		}
+	})
+}
+
+func TestCheckAPIRequest(t *testing.T) {
+	tests := []struct {
+		method, req string
+		status      int
+	}{
+		{http.MethodGet, "airports", 0},
+		{http.MethodHead, "plan", 0},
+		{http.MethodGet, "", http.StatusBadRequest},
+		{http.MethodGet, "metars", http.StatusBadRequest},
+		{http.MethodGet, "Airports", http.StatusBadRequest},
+		{http.MethodPost, "airports", http.StatusMethodNotAllowed},
+		{http.MethodPut, "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "airports", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api", nil)
+		aerr := checkAPIRequest(r, tt.req)
+		switch {
+		case tt.status == 0 && aerr != nil:
+			t.Errorf("%s req=%q: %v, want it answered", tt.method, tt.req, aerr)
+		case tt.status != 0 && (aerr == nil || aerr.Status != tt.status):
+			t.Errorf("%s req=%q: %v, want %d", tt.method, tt.req, aerr, tt.status)
+		}
+	}
+}
+
+// TestMapAPIErrors runs requests through the handler and checks the
+// status, the JSON error body, and for the ones answered, which stations
+// came back.
+func TestMapAPIErrors(t *testing.T) {
+	useTestConfig(t, map[string]string{
+		"weather.txt": `[
+{ "Lng": "179.5", "Lat": "-17.5", "ICAO": "NFTF", "Metar": "NFTF 191300Z 12010KT 9999 FEW020 27/22 Q1012" },
+{ "Lng": "-179.5", "Lat": "-17.5", "ICAO": "NFTW", "Metar": "NFTW 191300Z 12008KT 9999 SCT025 26/21 Q1012" },
+{ "Lng": "-87.81", "Lat": "42.76", "ICAO": "KRAC", "Metar": "KRAC 191855Z 27014KT 10SM CLR 18/06 A3002" },
+{} ]`,
+		"airportdb.txt": `[{"ident":"KRAC","icao":"KRAC","name":"Batten","type":"small_airport","lat":42.76,"lng":-87.81}]`,
+	}).Map.MaxArea = 1000
+	tests := []struct {
+		name, method, query string
+		status              int
+		err                 string
+		stations            []string
+	}{
+		{name: "POST", method: http.MethodPost, query: "req=airports&bounds=-90,40,-85,45", status: 405, err: "only answers GET"},
+		{name: "no req", query: "bounds=-90,40,-85,45", status: 400, err: "req is required"},
+		{name: "unknown req", query: "req=metars", status: 400, err: `unknown req "metars"`},
+		{name: "no bounds", query: "req=airports", status: 400, err: "bounds is required"},
+		{name: "bad bounds", query: "req=pireps&bounds=1,2", status: 400, err: "lng1,lat1,lng2,lat2"},
+		{name: "over max_area", query: "req=airports&bounds=-120,20,-70,50", status: 400, err: "more than the 1000 allowed"},
+		{name: "unknown airport", query: "req=airport&id=KZZZ", status: 404, err: "KZZZ"},
+		{name: "no id", query: "req=airport", status: 400, err: "id is required"},
+		{name: "bad zoom", query: "req=airports&bounds=-90,40,-85,45&zoom=x", status: 400},
+		{name: "in view", query: "req=airports&bounds=-90,40,-85,45", status: 200, stations: []string{"KRAC"}},
+		{name: "across the antimeridian", query: "req=airports&bounds=179,-18,-179,-17", status: 200, stations: []string{"NFTF", "NFTW"}},
+		{name: "panned west across the antimeridian", query: "req=airports&bounds=-181,-18,-179,-17", status: 200, stations: []string{"NFTF", "NFTW"}},
+		{name: "east of the antimeridian only", query: "req=airports&bounds=-180,-18,-179,-17", status: 200, stations: []string{"NFTW"}},
+	}
+	h := mapAPIHandler()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(method, "/api?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			if tt.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD" {
+				t.Errorf("Allow = %q, want GET, HEAD", w.Header().Get("Allow"))
+			}
+			if tt.status != http.StatusOK {
+				var body struct {
+					Error  string `json:"error"`
+					Status int    `json:"status"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("error body %q: %v", w.Body, err)
+				}
+				if body.Status != tt.status || !strings.Contains(body.Error, tt.err) {
+					t.Errorf("error body = %+v, want status %d and %q", body, tt.status, tt.err)
+				}
+				if w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+					t.Errorf("error answer has cache headers: %v", w.Header())
+				}
+				return
+			}
+			var list []weatherData
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatalf("answer %q: %v", w.Body, err)
+			}
+			var got []string
+			for _, wx := range list {
+				got = append(got, wx.ICAO)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.stations, " ") {
+				t.Errorf("stations = %v, want %v", got, tt.stations)
+			}
+		})
+	}
+}
+
+// TestMapAPIErrorsWithETag checks that a bad request is refused even when
+// it carries the ETag of the current data.
+func TestMapAPIErrorsWithETag(t *testing.T) {
+	useTestConfig(t, map[string]string{
+		"weather.txt": `[{ "Lng": "-87.81", "Lat": "42.76", "ICAO": "KRAC", "Metar": "KRAC 191855Z 27014KT 10SM CLR 18/06 A3002" }]`,
+	})
+	h := mapAPIHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api?req=airports&bounds=-90,40,-85,45", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q; want 200 with an ETag", w.Code, etag)
+	}
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"req=airports&bounds=-90,40,-85,45", http.StatusNotModified},
+		{"req=airports&bounds=1,2", http.StatusBadRequest},
+		{"req=airports&bounds=-90,40,-85,45&zoom=x", http.StatusBadRequest},
+		{"req=pireps", http.StatusBadRequest},
+		{"req=airport", http.StatusBadRequest},
+		{"req=nearestwx&lat=NaN&lng=-87", http.StatusBadRequest},
+		{"req=route&route=KRAC", http.StatusBadRequest},
+		{"req=plan&route=KRAC+KMSN&altitude=6500&tas=0", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api?"+tt.query, nil)
+		r.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s with a matching ETag: status %d, want %d", tt.query, w.Code, tt.status)
+		}
+	}
+}
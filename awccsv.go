@@ -0,0 +1,624 @@
+//go:build getwx
+
+package main
+
+// Readers for the aviationweather.gov cache CSV files (metars.cache.csv,
+// tafs.cache.csv, pireps.cache.csv, aircraftreports.cache.csv,
+// airsigmets.cache.csv).
+//
+// The files start with a short preamble ("No errors", "No warnings",
+// "data source=metars", "4553 results") followed by a header row and the
+// data. Columns are looked up by their header name so a column being added,
+// removed or moved upstream does not put the wrong data on the map.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// awcTable is a cache CSV with its header row mapped by column name.
+// Some names repeat (sky_cover, cloud_base_ft_agl, the TAF forecast
+// groups), so every name maps to all of its column positions in order.
+type awcTable struct {
+	Header  []string
+	Columns map[string][]int
+	Rows    [][]string
+	Skipped int
+}
+
+// errNoHeader is returned by readAWCTable for a file without a header row
+// it can use.
+var errNoHeader = errors.New("no header row")
+
+// readAWCTable scans past the preamble to the first row that contains every
+// required column and uses it as the header. Data rows that do not have the
+// same number of fields as the header are counted in Skipped.
+func readAWCTable(r io.Reader, required ...string) (*awcTable, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var t *awcTable
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			if cols := mapColumns(line); hasColumns(cols, required) {
+				t = &awcTable{Header: line, Columns: cols}
+			}
+			continue
+		}
+		if len(line) != len(t.Header) {
+			t.Skipped++
+			continue
+		}
+		t.Rows = append(t.Rows, line)
+	}
+	if t == nil {
+		return nil, fmt.Errorf("%w with columns %s", errNoHeader, strings.Join(required, ","))
+	}
+	return t, nil
+}
+
+func mapColumns(header []string) map[string][]int {
+	cols := make(map[string][]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		cols[name] = append(cols[name], i)
+	}
+	return cols
+}
+
+func hasColumns(cols map[string][]int, required []string) bool {
+	for _, name := range required {
+		if _, ok := cols[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// nth returns the value of the n'th column called name, or "" if the file
+// does not have that many.
+func (t *awcTable) nth(row []string, name string, n int) string {
+	idx := t.Columns[name]
+	if n >= len(idx) {
+		return ""
+	}
+	return strings.TrimSpace(row[idx[n]])
+}
+
+func (t *awcTable) str(row []string, name string) string {
+	return t.nth(row, name, 0)
+}
+
+func (t *awcTable) count(name string) int {
+	return len(t.Columns[name])
+}
+
+func (t *awcTable) float(row []string, name string) float64 {
+	return parseAWCFloat(t.str(row, name))
+}
+
+func (t *awcTable) bool(row []string, name string) bool {
+	return parseAWCBool(t.str(row, name))
+}
+
+func (t *awcTable) time(row []string, name string) time.Time {
+	return parseAWCTime(t.str(row, name))
+}
+
+// span is a half-open range of column positions. TAF rows repeat a block of
+// forecast columns, and a span covers one of those blocks.
+type span struct {
+	start, end int
+}
+
+// spans splits the header into blocks that each begin at a column called
+// anchor.
+func (t *awcTable) spans(anchor string) []span {
+	idx := t.Columns[anchor]
+	out := make([]span, len(idx))
+	for i, start := range idx {
+		end := len(t.Header)
+		if i+1 < len(idx) {
+			end = idx[i+1]
+		}
+		out[i] = span{start, end}
+	}
+	return out
+}
+
+// within returns every value of the columns called name inside s.
+func (t *awcTable) within(row []string, name string, s span) []string {
+	var out []string
+	for _, i := range t.Columns[name] {
+		if i >= s.start && i < s.end {
+			out = append(out, strings.TrimSpace(row[i]))
+		}
+	}
+	return out
+}
+
+func (t *awcTable) firstWithin(row []string, name string, s span) string {
+	if v := t.within(row, name, s); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Missing numeric values are NaN; use hasValue before trusting a number.
+func parseAWCFloat(s string) float64 {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "+")
+	if s == "" {
+		return math.NaN()
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
+
+func parseAWCBool(s string) bool {
+	return strings.EqualFold(strings.TrimSpace(s), "TRUE")
+}
+
+func parseAWCTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func hasValue(v float64) bool {
+	return !math.IsNaN(v)
+}
+
+// formatAWCFloat turns a parsed number back into the plain decimal text the
+// rest of the code passes around, or "" when the value was missing.
+func formatAWCFloat(v float64) string {
+	if !hasValue(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type SkyCondition struct {
+	Cover  string
+	BaseFt float64
+	TopFt  float64
+	Type   string
+}
+
+type MetarRecord struct {
+	RawText                   string
+	StationID                 string
+	ObservationTime           time.Time
+	Latitude                  float64
+	Longitude                 float64
+	TempC                     float64
+	DewpointC                 float64
+	WindDirDegrees            float64
+	WindSpeedKt               float64
+	WindGustKt                float64
+	VisibilityStatuteMi       float64
+	AltimInHg                 float64
+	SeaLevelPressureMb        float64
+	Corrected                 bool
+	Auto                      bool
+	AutoStation               bool
+	MaintenanceIndicatorOn    bool
+	NoSignal                  bool
+	LightningSensorOff        bool
+	FreezingRainSensorOff     bool
+	PresentWeatherSensorOff   bool
+	WxString                  string
+	SkyConditions             []SkyCondition
+	FlightCategory            string
+	ThreeHrPressureTendencyMb float64
+	MaxTC                     float64
+	MinTC                     float64
+	MaxT24hrC                 float64
+	MinT24hrC                 float64
+	PrecipIn                  float64
+	Pcp3hrIn                  float64
+	Pcp6hrIn                  float64
+	Pcp24hrIn                 float64
+	SnowIn                    float64
+	VertVisFt                 float64
+	MetarType                 string
+	ElevationM                float64
+}
+
+var metarRequired = []string{"raw_text", "station_id", "latitude", "longitude", "flight_category"}
+
+func readMetarRecords(r io.Reader) ([]MetarRecord, *awcTable, error) {
+	t, err := readAWCTable(r, metarRequired...)
+	if err != nil {
+		return nil, nil, err
+	}
+	recs := make([]MetarRecord, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		m := MetarRecord{
+			RawText:                   t.str(row, "raw_text"),
+			StationID:                 t.str(row, "station_id"),
+			ObservationTime:           t.time(row, "observation_time"),
+			Latitude:                  t.float(row, "latitude"),
+			Longitude:                 t.float(row, "longitude"),
+			TempC:                     t.float(row, "temp_c"),
+			DewpointC:                 t.float(row, "dewpoint_c"),
+			WindDirDegrees:            t.float(row, "wind_dir_degrees"),
+			WindSpeedKt:               t.float(row, "wind_speed_kt"),
+			WindGustKt:                t.float(row, "wind_gust_kt"),
+			VisibilityStatuteMi:       t.float(row, "visibility_statute_mi"),
+			AltimInHg:                 t.float(row, "altim_in_hg"),
+			SeaLevelPressureMb:        t.float(row, "sea_level_pressure_mb"),
+			Corrected:                 t.bool(row, "corrected"),
+			Auto:                      t.bool(row, "auto"),
+			AutoStation:               t.bool(row, "auto_station"),
+			MaintenanceIndicatorOn:    t.bool(row, "maintenance_indicator_on"),
+			NoSignal:                  t.bool(row, "no_signal"),
+			LightningSensorOff:        t.bool(row, "lightning_sensor_off"),
+			FreezingRainSensorOff:     t.bool(row, "freezing_rain_sensor_off"),
+			PresentWeatherSensorOff:   t.bool(row, "present_weather_sensor_off"),
+			WxString:                  t.str(row, "wx_string"),
+			FlightCategory:            t.str(row, "flight_category"),
+			ThreeHrPressureTendencyMb: t.float(row, "three_hr_pressure_tendency_mb"),
+			MaxTC:                     t.float(row, "maxt_c"),
+			MinTC:                     t.float(row, "mint_c"),
+			MaxT24hrC:                 t.float(row, "maxt24hr_c"),
+			MinT24hrC:                 t.float(row, "mint24hr_c"),
+			PrecipIn:                  t.float(row, "precip_in"),
+			Pcp3hrIn:                  t.float(row, "pcp3hr_in"),
+			Pcp6hrIn:                  t.float(row, "pcp6hr_in"),
+			Pcp24hrIn:                 t.float(row, "pcp24hr_in"),
+			SnowIn:                    t.float(row, "snow_in"),
+			VertVisFt:                 t.float(row, "vert_vis_ft"),
+			MetarType:                 t.str(row, "metar_type"),
+			ElevationM:                t.float(row, "elevation_m"),
+		}
+		for n := 0; n < t.count("sky_cover"); n++ {
+			cover := t.nth(row, "sky_cover", n)
+			if cover == "" {
+				continue
+			}
+			m.SkyConditions = append(m.SkyConditions, SkyCondition{
+				Cover:  cover,
+				BaseFt: parseAWCFloat(t.nth(row, "cloud_base_ft_agl", n)),
+				TopFt:  math.NaN(),
+			})
+		}
+		recs = append(recs, m)
+	}
+	return recs, t, nil
+}
+
+type TafForecast struct {
+	FcstTimeFrom        time.Time
+	FcstTimeTo          time.Time
+	ChangeIndicator     string
+	TimeBecoming        time.Time
+	Probability         float64
+	WindDirDegrees      float64
+	WindSpeedKt         float64
+	WindGustKt          float64
+	WindShearHgtFtAgl   float64
+	WindShearDirDegrees float64
+	WindShearSpeedKt    float64
+	VisibilityStatuteMi float64
+	AltimInHg           float64
+	VertVisFt           float64
+	WxString            string
+	NotDecoded          string
+	SkyConditions       []SkyCondition
+}
+
+type TafRecord struct {
+	RawText       string
+	StationID     string
+	IssueTime     time.Time
+	BulletinTime  time.Time
+	ValidTimeFrom time.Time
+	ValidTimeTo   time.Time
+	Remarks       string
+	Latitude      float64
+	Longitude     float64
+	ElevationM    float64
+	Forecasts     []TafForecast
+}
+
+var tafRequired = []string{"raw_text", "station_id"}
+
+func readTafRecords(r io.Reader) ([]TafRecord, *awcTable, error) {
+	t, err := readAWCTable(r, tafRequired...)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups := t.spans("fcst_time_from")
+	recs := make([]TafRecord, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		taf := TafRecord{
+			RawText:       t.str(row, "raw_text"),
+			StationID:     t.str(row, "station_id"),
+			IssueTime:     t.time(row, "issue_time"),
+			BulletinTime:  t.time(row, "bulletin_time"),
+			ValidTimeFrom: t.time(row, "valid_time_from"),
+			ValidTimeTo:   t.time(row, "valid_time_to"),
+			Remarks:       t.str(row, "remarks"),
+			Latitude:      t.float(row, "latitude"),
+			Longitude:     t.float(row, "longitude"),
+			ElevationM:    t.float(row, "elevation_m"),
+		}
+		for _, g := range groups {
+			from := t.firstWithin(row, "fcst_time_from", g)
+			if from == "" {
+				continue
+			}
+			f := TafForecast{
+				FcstTimeFrom:        parseAWCTime(from),
+				FcstTimeTo:          parseAWCTime(t.firstWithin(row, "fcst_time_to", g)),
+				ChangeIndicator:     t.firstWithin(row, "change_indicator", g),
+				TimeBecoming:        parseAWCTime(t.firstWithin(row, "time_becoming", g)),
+				Probability:         parseAWCFloat(t.firstWithin(row, "probability", g)),
+				WindDirDegrees:      parseAWCFloat(t.firstWithin(row, "wind_dir_degrees", g)),
+				WindSpeedKt:         parseAWCFloat(t.firstWithin(row, "wind_speed_kt", g)),
+				WindGustKt:          parseAWCFloat(t.firstWithin(row, "wind_gust_kt", g)),
+				WindShearHgtFtAgl:   parseAWCFloat(t.firstWithin(row, "wind_shear_hgt_ft_agl", g)),
+				WindShearDirDegrees: parseAWCFloat(t.firstWithin(row, "wind_shear_dir_degrees", g)),
+				WindShearSpeedKt:    parseAWCFloat(t.firstWithin(row, "wind_shear_speed_kt", g)),
+				VisibilityStatuteMi: parseAWCFloat(t.firstWithin(row, "visibility_statute_mi", g)),
+				AltimInHg:           parseAWCFloat(t.firstWithin(row, "altim_in_hg", g)),
+				VertVisFt:           parseAWCFloat(t.firstWithin(row, "vert_vis_ft", g)),
+				WxString:            t.firstWithin(row, "wx_string", g),
+				NotDecoded:          t.firstWithin(row, "not_decoded", g),
+			}
+			covers := t.within(row, "sky_cover", g)
+			bases := t.within(row, "cloud_base_ft_agl", g)
+			types := t.within(row, "cloud_type", g)
+			for n, cover := range covers {
+				if cover == "" {
+					continue
+				}
+				sky := SkyCondition{Cover: cover, BaseFt: math.NaN(), TopFt: math.NaN()}
+				if n < len(bases) {
+					sky.BaseFt = parseAWCFloat(bases[n])
+				}
+				if n < len(types) {
+					sky.Type = types[n]
+				}
+				f.SkyConditions = append(f.SkyConditions, sky)
+			}
+			taf.Forecasts = append(taf.Forecasts, f)
+		}
+		recs = append(recs, taf)
+	}
+	return recs, t, nil
+}
+
+type TurbulenceCondition struct {
+	Type      string
+	Intensity string
+	BaseFtMsl float64
+	TopFtMsl  float64
+	Freq      string
+}
+
+type IcingCondition struct {
+	Type      string
+	Intensity string
+	BaseFtMsl float64
+	TopFtMsl  float64
+}
+
+type PirepRecord struct {
+	ReceiptTime          time.Time
+	ObservationTime      time.Time
+	AircraftRef          string
+	Latitude             float64
+	Longitude            float64
+	AltitudeFtMsl        float64
+	SkyConditions        []SkyCondition
+	TurbulenceConditions []TurbulenceCondition
+	IcingConditions      []IcingCondition
+	VisibilityStatuteMi  float64
+	WxString             string
+	TempC                float64
+	WindDirDegrees       float64
+	WindSpeedKt          float64
+	VertGustKt           float64
+	ReportType           string
+	RawText              string
+}
+
+var pirepRequired = []string{"raw_text", "latitude", "longitude"}
+
+func readPirepRecords(r io.Reader) ([]PirepRecord, *awcTable, error) {
+	t, err := readAWCTable(r, pirepRequired...)
+	if err != nil {
+		return nil, nil, err
+	}
+	recs := make([]PirepRecord, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		p := PirepRecord{
+			ReceiptTime:         t.time(row, "receipt_time"),
+			ObservationTime:     t.time(row, "observation_time"),
+			AircraftRef:         t.str(row, "aircraft_ref"),
+			Latitude:            t.float(row, "latitude"),
+			Longitude:           t.float(row, "longitude"),
+			AltitudeFtMsl:       t.float(row, "altitude_ft_msl"),
+			VisibilityStatuteMi: t.float(row, "visibility_statute_mi"),
+			WxString:            t.str(row, "wx_string"),
+			TempC:               t.float(row, "temp_c"),
+			WindDirDegrees:      t.float(row, "wind_dir_degrees"),
+			WindSpeedKt:         t.float(row, "wind_speed_kt"),
+			VertGustKt:          t.float(row, "vert_gust_kt"),
+			ReportType:          t.str(row, "report_type"),
+			RawText:             t.str(row, "raw_text"),
+		}
+		for n := 0; n < t.count("sky_cover"); n++ {
+			cover := t.nth(row, "sky_cover", n)
+			if cover == "" {
+				continue
+			}
+			p.SkyConditions = append(p.SkyConditions, SkyCondition{
+				Cover:  cover,
+				BaseFt: parseAWCFloat(t.nth(row, "cloud_base_ft_msl", n)),
+				TopFt:  parseAWCFloat(t.nth(row, "cloud_top_ft_msl", n)),
+			})
+		}
+		for n := 0; n < t.count("turbulence_intensity"); n++ {
+			intensity := t.nth(row, "turbulence_intensity", n)
+			if intensity == "" {
+				continue
+			}
+			p.TurbulenceConditions = append(p.TurbulenceConditions, TurbulenceCondition{
+				Type:      t.nth(row, "turbulence_type", n),
+				Intensity: intensity,
+				BaseFtMsl: parseAWCFloat(t.nth(row, "turbulence_base_ft_msl", n)),
+				TopFtMsl:  parseAWCFloat(t.nth(row, "turbulence_top_ft_msl", n)),
+				Freq:      t.nth(row, "turbulence_freq", n),
+			})
+		}
+		for n := 0; n < t.count("icing_intensity"); n++ {
+			intensity := t.nth(row, "icing_intensity", n)
+			if intensity == "" {
+				continue
+			}
+			p.IcingConditions = append(p.IcingConditions, IcingCondition{
+				Type:      t.nth(row, "icing_type", n),
+				Intensity: intensity,
+				BaseFtMsl: parseAWCFloat(t.nth(row, "icing_base_ft_msl", n)),
+				TopFtMsl:  parseAWCFloat(t.nth(row, "icing_top_ft_msl", n)),
+			})
+		}
+		recs = append(recs, p)
+	}
+	return recs, t, nil
+}
+
+// AirSigmetRecord is one AIRMET or SIGMET. Points is its outline as
+// [lat, lng] pairs in the order the file gives them.
+type AirSigmetRecord struct {
+	RawText            string
+	ValidTimeFrom      time.Time
+	ValidTimeTo        time.Time
+	Points             [][2]float64
+	MinFtMsl           float64
+	MaxFtMsl           float64
+	MovementDirDegrees float64
+	MovementSpeedKt    float64
+	Hazard             string
+	Severity           string
+	AirSigmetType      string
+}
+
+var airSigmetRequired = []string{"raw_text", "lon:lat points"}
+
+func readAirSigmetRecords(r io.Reader) ([]AirSigmetRecord, *awcTable, error) {
+	t, err := readAWCTable(r, airSigmetRequired...)
+	if err != nil {
+		return nil, nil, err
+	}
+	recs := make([]AirSigmetRecord, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		recs = append(recs, AirSigmetRecord{
+			RawText:            t.str(row, "raw_text"),
+			ValidTimeFrom:      t.time(row, "valid_time_from"),
+			ValidTimeTo:        t.time(row, "valid_time_to"),
+			Points:             parseAWCPoints(t.str(row, "lon:lat points")),
+			MinFtMsl:           t.float(row, "min_ft_msl"),
+			MaxFtMsl:           t.float(row, "max_ft_msl"),
+			MovementDirDegrees: t.float(row, "movement_dir_degrees"),
+			MovementSpeedKt:    t.float(row, "movement_speed_kt"),
+			Hazard:             t.str(row, "hazard"),
+			Severity:           t.str(row, "severity"),
+			AirSigmetType:      t.str(row, "airsigmet_type"),
+		})
+	}
+	return recs, t, nil
+}
+
+// parseAWCPoints reads an outline written as "lon:lat;lon:lat;...". A pair
+// that does not parse is left out.
+func parseAWCPoints(s string) [][2]float64 {
+	var pts [][2]float64
+	for _, pair := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == ' ' }) {
+		lng, lat, ok := strings.Cut(pair, ":")
+		if !ok {
+			continue
+		}
+		x, y := parseAWCFloat(lng), parseAWCFloat(lat)
+		if !hasValue(x) || !hasValue(y) {
+			continue
+		}
+		pts = append(pts, [2]float64{y, x})
+	}
+	return pts
+}
+
+func readMetarFile(fname string) ([]MetarRecord, *awcTable, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	recs, t, err := readMetarRecords(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return recs, t, nil
+}
+
+func readTafFile(fname string) ([]TafRecord, *awcTable, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	recs, t, err := readTafRecords(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return recs, t, nil
+}
+
+func readPirepFile(fname string) ([]PirepRecord, *awcTable, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	recs, t, err := readPirepRecords(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return recs, t, nil
+}
+
+func readAirSigmetFile(fname string) ([]AirSigmetRecord, *awcTable, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	recs, t, err := readAirSigmetRecords(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return recs, t, nil
+}
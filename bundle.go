@@ -0,0 +1,457 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// Offline bundles for the cockpit, where there is no internet. mapserver
+// -export-bundle weather.zip writes one zip with everything the map page
+// needs: the chart tiles for a route or region, getwx's weather and the
+// airport files, Leaflet and the page's scripts, and bundle.json to say
+// what is in it. mapserver -bundle weather.zip -serve serves the page from
+// it, on a tablet or on a Raspberry Pi next to the UAT receiver. The
+// weather is copied into paths.data_dir unless newer files are there
+// already, so getwx or the websocket client running alongside keep it
+// current.
+//
+// It is a zip rather than MBTiles, which is SQLite and would need a
+// driver from outside the standard library.
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bundleManifest = "bundle.json"
+
+// bundleInfo is bundle.json.
+type bundleInfo struct {
+	Created time.Time `json:"created"`
+	// Weather is when getwx last wrote the files in data/.
+	Weather      time.Time `json:"weather"`
+	Bounds       Bounds    `json:"bounds"`
+	Route        []string  `json:"route,omitempty"`
+	CorridorNM   float64   `json:"corridor_nm,omitempty"`
+	MinZoom      int       `json:"min_zoom"`
+	MaxZoom      int       `json:"max_zoom"`
+	Attribution  string    `json:"attribution"`
+	Tiles        int       `json:"tiles"`
+	MissingTiles int       `json:"missing_tiles"`
+	Scripts      []string  `json:"scripts"`
+	// Data is the file under data/ for each config setting.
+	Data map[string]string `json:"data"`
+}
+
+// leafletFiles are the parts of Leaflet the page loads.
+var leafletFiles = []string{
+	"dist/leaflet.js", "dist/leaflet.css",
+	"dist/images/layers.png", "dist/images/layers-2x.png",
+	"dist/images/marker-icon.png", "dist/images/marker-icon-2x.png", "dist/images/marker-shadow.png",
+}
+
+// bundleData is the data files that go in a bundle, by config setting.
+func bundleData() map[string]*string {
+	return map[string]*string{
+		"output.weather":    &cfg.Output.Weather,
+		"output.pireps":     &cfg.Output.Pireps,
+		"output.advisories": &cfg.Output.Advisories,
+		"paths.airports":    &cfg.Paths.Airports,
+		"paths.navaids":     &cfg.Paths.Navaids,
+		"paths.runways":     &cfg.Paths.Runways,
+		"paths.airport_db":  &cfg.Paths.AirportDB,
+	}
+}
+
+type tileID struct{ z, x, y int }
+
+var errNotFound = errors.New("not found")
+
+// tileLatLng is the corner of tile x/y at zoom z, or a point inside it
+// for fractional x and y.
+func tileLatLng(z int, x, y float64) (lat, lng float64) {
+	n := math.Exp2(float64(z))
+	return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi, x/n*360 - 180
+}
+
+// bundleRegion is the box to bundle and, for a route, its waypoints. The
+// box around a route reaches bundle.corridor_nm past it.
+func bundleRegion(route string, region Bounds) (Bounds, []waypoint, error) {
+	if route == "" {
+		return region, nil, nil
+	}
+	q, err := parseRouteQuery(route, "", "")
+	if err != nil {
+		return Bounds{}, nil, err
+	}
+	// Without weather the waypoints are still found in the airport files.
+	stations, _ := ParseAirports(-180, -90, 180, 90)
+	wps, err := resolveWaypoints(q.names, stations)
+	if err != nil {
+		return Bounds{}, nil, err
+	}
+	b := Bounds{LatMin: 90, LatMax: -90, LngMin: 180, LngMax: -180}
+	for _, p := range wps {
+		b.LatMin, b.LatMax = math.Min(b.LatMin, p.Lat), math.Max(b.LatMax, p.Lat)
+		b.LngMin, b.LngMax = math.Min(b.LngMin, p.Lng), math.Max(b.LngMax, p.Lng)
+	}
+	dlat := cfg.Bundle.CorridorNM / 60
+	b.LatMin, b.LatMax = math.Max(b.LatMin-dlat, -85), math.Min(b.LatMax+dlat, 85)
+	dlng := dlat / math.Cos(toRad(math.Max(math.Abs(b.LatMin), math.Abs(b.LatMax))))
+	b.LngMin, b.LngMax = math.Max(b.LngMin-dlng, -180), math.Min(b.LngMax+dlng, 180)
+	return b, wps, nil
+}
+
+// bundleTiles lists the chart tiles over b, only those that come within
+// the corridor when there is a route.
+func bundleTiles(b Bounds, route []waypoint) ([]tileID, error) {
+	var tiles []tileID
+	for z := cfg.Bundle.MinZoom; z <= cfg.Bundle.MaxZoom; z++ {
+		last := 1<<z - 1
+		x0, y0 := worldPixel(b.LatMax, b.LngMin, z)
+		x1, y1 := worldPixel(b.LatMin, b.LngMax, z)
+		for x := int(x0 / 256); x <= min(int(x1/256), last); x++ {
+			for y := int(y0 / 256); y <= min(int(y1/256), last); y++ {
+				if route != nil {
+					lat, lng := tileLatLng(z, float64(x)+0.5, float64(y)+0.5)
+					clat, clng := tileLatLng(z, float64(x), float64(y))
+					if _, off := routePosition(route, lat, lng); off > cfg.Bundle.CorridorNM+gcDistance(lat, lng, clat, clng) {
+						continue
+					}
+				}
+				tiles = append(tiles, tileID{z, x, y})
+				if len(tiles) > cfg.Bundle.MaxTiles {
+					return nil, fmt.Errorf("the bundle needs more than bundle.max_tiles (%d) tiles; lower bundle.max_zoom or bundle less", cfg.Bundle.MaxTiles)
+				}
+			}
+		}
+	}
+	return tiles, nil
+}
+
+// bundleURL resolves a URL from the config against server.public_url, as
+// there is no request to take the server from.
+func bundleURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.IsAbs() {
+		return s, nil
+	}
+	if cfg.Server.PublicURL == "" {
+		return "", fmt.Errorf("%q is relative; set server.public_url to where it is served", s)
+	}
+	base, _ := url.Parse(cfg.Server.PublicURL + "/")
+	return base.ResolveReference(u).String(), nil
+}
+
+func fetchBundleFile(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("%s: %w", u, errNotFound)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func addBundleFile(zw *zip.Writer, name string, method uint16, modified time.Time, body []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	return err
+}
+
+// fetchTiles downloads the tiles bundle.fetchers at a time into zw. The
+// ones that cannot be had, such as those off the edge of the chart, are
+// left out and counted as missing.
+func fetchTiles(zw *zip.Writer, client *http.Client, tiles []tileID) (fetched, missing int, err error) {
+	type result struct {
+		t    tileID
+		body []byte
+		err  error
+	}
+	jobs := make(chan tileID)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for range cfg.Bundle.Fetchers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				u, err := bundleURL(fillTileURL(cfg.Map.Tiles, t.z, t.x, t.y))
+				var body []byte
+				if err == nil {
+					body, err = fetchBundleFile(client, u)
+				}
+				results <- result{t, body, err}
+			}
+		}()
+	}
+	go func() {
+		for _, t := range tiles {
+			jobs <- t
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	now := time.Now()
+	for r := range results {
+		if r.err != nil {
+			missing++
+			if !errors.Is(r.err, errNotFound) {
+				slog.Warn("fetching chart tile", "z", r.t.z, "x", r.t.x, "y", r.t.y, "err", r.err)
+			}
+			continue
+		}
+		// Keep draining results after an error so the fetchers finish.
+		if err == nil {
+			// PNGs are compressed already.
+			err = addBundleFile(zw, fmt.Sprintf("tiles/%d/%d/%d.png", r.t.z, r.t.x, r.t.y), zip.Store, now, r.body)
+		}
+		fetched++
+		if fetched%500 == 0 {
+			slog.Info("fetching chart tiles", "done", fetched+missing, "of", len(tiles))
+		}
+	}
+	if err == nil && fetched == 0 && len(tiles) > 0 {
+		err = fmt.Errorf("none of the %d chart tiles could be fetched from map.tiles.url", len(tiles))
+	}
+	return fetched, missing, err
+}
+
+// exportBundle writes the bundle for route, or for region when there is
+// no route, to fname.
+func exportBundle(fname, route string, region Bounds) error {
+	b, wps, err := bundleRegion(route, region)
+	if err != nil {
+		return err
+	}
+	tiles, err := bundleTiles(b, wps)
+	if err != nil {
+		return err
+	}
+	if _, err := bundleURL(cfg.Map.Tiles.URL); err != nil {
+		return fmt.Errorf("map.tiles.url: %w", err)
+	}
+	info := bundleInfo{
+		Created:     time.Now().UTC(),
+		Weather:     dataGeneration().UTC(),
+		Bounds:      b,
+		MinZoom:     cfg.Bundle.MinZoom,
+		MaxZoom:     cfg.Bundle.MaxZoom,
+		Attribution: cfg.Map.Tiles.Attribution,
+		Scripts:     []string{},
+		Data:        map[string]string{},
+	}
+	if wps != nil {
+		for _, p := range wps {
+			info.Route = append(info.Route, p.Ident)
+		}
+		info.CorridorNM = cfg.Bundle.CorridorNM
+	}
+	slog.Info("writing bundle", "file", fname, "tiles", len(tiles))
+
+	tmp := fname + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for _, name := range leafletFiles {
+		u, err := bundleURL(cfg.Map.Leaflet + "/" + name)
+		if err != nil {
+			return fmt.Errorf("map.leaflet: %w", err)
+		}
+		body, err := fetchBundleFile(client, u)
+		if err != nil {
+			return fmt.Errorf("fetching Leaflet: %w", err)
+		}
+		if err := addBundleFile(zw, "leaflet/"+name, zip.Deflate, info.Created, body); err != nil {
+			return err
+		}
+	}
+	for _, s := range cfg.Map.Scripts {
+		// The plugins that come with the page are taken as they are.
+		if rel, ok := strings.CutPrefix(s, cfg.Map.Static); ok {
+			if body, err := fs.ReadFile(staticFiles(), rel); err == nil {
+				name := "scripts/" + path.Base(rel)
+				if err := addBundleFile(zw, name, zip.Deflate, info.Created, body); err != nil {
+					return err
+				}
+				info.Scripts = append(info.Scripts, name)
+				continue
+			}
+		}
+		u, err := bundleURL(s)
+		if err != nil {
+			return fmt.Errorf("map.scripts: %w", err)
+		}
+		body, err := fetchBundleFile(client, u)
+		if err != nil {
+			return fmt.Errorf("fetching map.scripts: %w", err)
+		}
+		pu, _ := url.Parse(u)
+		name := "scripts/" + path.Base(pu.Path)
+		if err := addBundleFile(zw, name, zip.Deflate, info.Created, body); err != nil {
+			return err
+		}
+		info.Scripts = append(info.Scripts, name)
+	}
+	for key, setting := range bundleData() {
+		if *setting == "" {
+			continue
+		}
+		src := cfg.Path(*setting)
+		st, err := os.Stat(src)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		body, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(src)
+		if err := addBundleFile(zw, "data/"+name, zip.Deflate, st.ModTime(), body); err != nil {
+			return err
+		}
+		info.Data[key] = name
+	}
+	if _, ok := info.Data["output.weather"]; !ok {
+		slog.Warn("the bundle has no weather; run getwx first", "file", cfg.Path(cfg.Output.Weather))
+	}
+
+	info.Tiles, info.MissingTiles, err = fetchTiles(zw, client, tiles)
+	if err != nil {
+		return err
+	}
+	manifest, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addBundleFile(zw, bundleManifest, zip.Deflate, info.Created, manifest); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	slog.Info("wrote bundle", "file", fname, "tiles", info.Tiles, "missing_tiles", info.MissingTiles)
+	return os.Rename(tmp, fname)
+}
+
+// bundleFS is the bundle mapserver -serve serves under /bundle/, nil
+// without -bundle.
+var bundleFS fs.FS
+
+// openBundle sets mapserver -serve up to serve the bundle in fname: the
+// page takes its chart tiles, Leaflet and scripts from /bundle/, and the
+// bundle's data files go into paths.data_dir where there is nothing newer.
+func openBundle(fname string) error {
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		return err
+	}
+	// zr stays open for as long as the server runs.
+	buf, err := fs.ReadFile(zr, bundleManifest)
+	if err != nil {
+		return fmt.Errorf("%s is not a bundle: %w", fname, err)
+	}
+	var info bundleInfo
+	if err := json.Unmarshal(buf, &info); err != nil {
+		return fmt.Errorf("%s: %w", bundleManifest, err)
+	}
+	if err := os.MkdirAll(cfg.Paths.DataDir, 0755); err != nil {
+		return err
+	}
+	settings := bundleData()
+	for key, name := range info.Data {
+		setting, ok := settings[key]
+		if !ok || name != filepath.Base(name) {
+			continue
+		}
+		if err := extractBundleFile(zr, name); err != nil {
+			return err
+		}
+		*setting = name
+	}
+
+	m := &cfg.Map
+	m.Tiles = TilesConfig{URL: "bundle/tiles/{z}/{x}/{y}.png", Attribution: info.Attribution}
+	m.Leaflet = "bundle/leaflet"
+	m.Scripts = nil
+	for _, s := range info.Scripts {
+		m.Scripts = append(m.Scripts, "bundle/"+s)
+	}
+	m.Bounds = info.Bounds
+	m.MinZoom, m.MaxZoom = info.MinZoom, info.MaxZoom
+	m.Zoom = min(max(m.Zoom, m.MinZoom), m.MaxZoom)
+	if !m.Bounds.Contains(m.CenterLat, m.CenterLng) {
+		m.CenterLat, m.CenterLng = (m.Bounds.LatMin+m.Bounds.LatMax)/2, (m.Bounds.LngMin+m.Bounds.LngMax)/2
+	}
+	bundleFS = zr
+	slog.Info("serving bundle", "file", fname, "created", info.Created, "weather", info.Weather, "tiles", info.Tiles)
+	return nil
+}
+
+// extractBundleFile copies data/name into paths.data_dir, unless the file
+// there is at least as new, keeping the time it was written by getwx.
+func extractBundleFile(zr *zip.ReadCloser, name string) error {
+	var zf *zip.File
+	for _, f := range zr.File {
+		if f.Name == "data/"+name {
+			zf = f
+			break
+		}
+	}
+	if zf == nil {
+		return fmt.Errorf("%s lists data/%s, which it does not have", bundleManifest, name)
+	}
+	dst := filepath.Join(cfg.Paths.DataDir, name)
+	if st, err := os.Stat(dst); err == nil && !st.ModTime().Before(zf.Modified) {
+		slog.Info("keeping newer file than the bundle's", "file", dst)
+		return nil
+	}
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dst, body); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, zf.Modified, zf.Modified)
+}
@@ -0,0 +1,652 @@
+package main
+
+// Configuration shared by getwx, mapserver, the CGI and the UAT websocket
+// client. Settings come from built-in defaults, then the TOML config file
+// (see mapsrv.toml), then command line overrides.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const defaultConfigFile = "mapsrv.toml"
+
+// Bounds is a lat/lng box. Longitudes are west-negative.
+type Bounds struct {
+	LatMin float64 `toml:"lat_min" json:"lat_min"`
+	LatMax float64 `toml:"lat_max" json:"lat_max"`
+	LngMin float64 `toml:"lng_min" json:"lng_min"`
+	LngMax float64 `toml:"lng_max" json:"lng_max"`
+}
+
+func (b Bounds) Contains(lat, lng float64) bool {
+	return lat >= b.LatMin && lat <= b.LatMax && lng >= b.LngMin && lng <= b.LngMax
+}
+
+type PathsConfig struct {
+	DataDir  string `toml:"data_dir"`
+	Airports string `toml:"airports"`
+	// Navaids is optional and in the same format as the airports file.
+	Navaids string `toml:"navaids"`
+	// Runways is written by getwx -import-runways.
+	Runways string `toml:"runways"`
+	// AirportDB is written by getwx -import-airports.
+	AirportDB string `toml:"airport_db"`
+}
+
+type SourceConfig struct {
+	Enabled  bool          `toml:"enabled"`
+	URL      string        `toml:"url"`
+	File     string        `toml:"file"`
+	Interval time.Duration `toml:"interval"`
+}
+
+type SourcesConfig struct {
+	Metars          SourceConfig `toml:"metars"`
+	Tafs            SourceConfig `toml:"tafs"`
+	Pireps          SourceConfig `toml:"pireps"`
+	AircraftReports SourceConfig `toml:"aircraft_reports"`
+	AirSigmets      SourceConfig `toml:"airsigmets"`
+	Winds           SourceConfig `toml:"winds"`
+}
+
+type ReceiverConfig struct {
+	Addr         string        `toml:"addr"`
+	Path         string        `toml:"path"`
+	Dump         string        `toml:"dump"`
+	SaveInterval time.Duration `toml:"save_interval"`
+}
+
+type SchedulerConfig struct {
+	Jitter       time.Duration `toml:"jitter"`
+	Retries      int           `toml:"retries"`
+	RetryBackoff time.Duration `toml:"retry_backoff"`
+	StatusFile   string        `toml:"status_file"`
+}
+
+type LogConfig struct {
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+}
+
+// MetricsConfig holds the /metrics listen address of each long-running
+// program. An empty address turns the endpoint off.
+type MetricsConfig struct {
+	Getwx     string `toml:"getwx"`
+	Websocket string `toml:"websocket"`
+}
+
+type ServerConfig struct {
+	Listen string `toml:"listen"`
+	// PushInterval is how often mapserver -serve looks for new weather to
+	// push to the map pages on /events. 0 turns the live updates off.
+	PushInterval time.Duration `toml:"push_interval"`
+	// PublicURL is where clients reach mapserver -serve, for the links in
+	// the WMS and WMTS capabilities. Empty takes it from each request.
+	PublicURL string `toml:"public_url"`
+}
+
+// TilesConfig is the chart layer under the weather.
+type TilesConfig struct {
+	URL         string `toml:"url"`
+	Attribution string `toml:"attribution"`
+	TMS         bool   `toml:"tms"`
+}
+
+// MapConfig describes the map page. The page loads its stations and PIREPs
+// from the map API at api, which is /api under mapserver -serve or the CGI's
+// URL when the page is served by Apache.
+type MapConfig struct {
+	Bounds    Bounds        `toml:"bounds"`
+	Tiles     TilesConfig   `toml:"tiles"`
+	Title     string        `toml:"title"`
+	API       string        `toml:"api"`
+	Static    string        `toml:"static"`
+	Leaflet   string        `toml:"leaflet"`
+	Scripts   []string      `toml:"scripts"`
+	CenterLat float64       `toml:"center_lat"`
+	CenterLng float64       `toml:"center_lng"`
+	Zoom      int           `toml:"zoom"`
+	MinZoom   int           `toml:"min_zoom"`
+	MaxZoom   int           `toml:"max_zoom"`
+	Refresh   time.Duration `toml:"refresh"`
+	// StationLayer is "markers" to draw stations in the browser or
+	// "tiles" to use the server's /wxtiles, which needs mapserver -serve.
+	StationLayer string `toml:"station_layer"`
+	// CrosswindLimit flags stations whose favoured runway has more
+	// crosswind than this, in knots, gusts included. 0 turns it off.
+	CrosswindLimit float64 `toml:"crosswind_limit"`
+	// DensityAltitudeAlert flags stations whose density altitude is at or
+	// above this many feet. 0 turns it off.
+	DensityAltitudeAlert float64 `toml:"density_altitude_alert"`
+	// MaxStations caps req=airports when the page gives its zoom. Below
+	// ThinZoom stations are also kept StationSpacing pixels apart, and
+	// below DetailZoom they come without their report text.
+	MaxStations    int     `toml:"max_stations"`
+	StationSpacing float64 `toml:"station_spacing"`
+	ThinZoom       int     `toml:"thin_zoom"`
+	DetailZoom     int     `toml:"detail_zoom"`
+	// MaxArea is the largest bounds, in square degrees, the map API
+	// answers for.
+	MaxArea float64 `toml:"max_area"`
+}
+
+// GridConfig controls the interpolated surface analysis: a grid of
+// resolution degrees over map.bounds, where each point is the inverse
+// distance weighted mean of the stations within radius_nm, or empty when
+// there are fewer than min_stations.
+type GridConfig struct {
+	Resolution  float64 `toml:"resolution"`
+	RadiusNM    float64 `toml:"radius_nm"`
+	Power       float64 `toml:"power"`
+	MinStations int     `toml:"min_stations"`
+}
+
+// AlertsConfig holds the rules getwx checks after every ingest and the
+// webhooks it posts to when one of them starts to match. Each rule is a
+// line of the alert language, optionally named with "name: " in front.
+type AlertsConfig struct {
+	Rules     []string      `toml:"rules"`
+	Webhooks  []string      `toml:"webhooks"`
+	StateFile string        `toml:"state_file"`
+	Timeout   time.Duration `toml:"timeout"`
+}
+
+// DigestConfig is the weather digest getwx -daemon mails every interval.
+// Each subscriber is "address: AIRPORT AIRPORT ...", the airports they
+// watch.
+type DigestConfig struct {
+	Enabled     bool          `toml:"enabled"`
+	Interval    time.Duration `toml:"interval"`
+	Subject     string        `toml:"subject"`
+	HTML        bool          `toml:"html"`
+	Subscribers []string      `toml:"subscribers"`
+	StateFile   string        `toml:"state_file"`
+	SMTP        SMTPConfig    `toml:"smtp"`
+}
+
+// SMTPConfig is the relay the digest is sent through. Without a username
+// it is sent without authenticating.
+type SMTPConfig struct {
+	Addr     string `toml:"addr"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	From     string `toml:"from"`
+}
+
+// BundleConfig is what mapserver -export-bundle puts in an offline
+// bundle: the chart tiles from min_zoom to max_zoom, within corridor_nm of
+// the route when there is one, fetched fetchers at a time. A bundle that
+// would need more than max_tiles tiles is refused.
+type BundleConfig struct {
+	MinZoom    int     `toml:"min_zoom"`
+	MaxZoom    int     `toml:"max_zoom"`
+	CorridorNM float64 `toml:"corridor_nm"`
+	MaxTiles   int     `toml:"max_tiles"`
+	Fetchers   int     `toml:"fetchers"`
+}
+
+type OutputConfig struct {
+	Weather    string `toml:"weather"`
+	Pireps     string `toml:"pireps"`
+	Advisories string `toml:"advisories"`
+	CodeJS     string `toml:"code_js"`
+}
+
+type Config struct {
+	Paths     PathsConfig     `toml:"paths"`
+	Region    Bounds          `toml:"region"`
+	Map       MapConfig       `toml:"map"`
+	Grid      GridConfig      `toml:"grid"`
+	Sources   SourcesConfig   `toml:"sources"`
+	Receiver  ReceiverConfig  `toml:"receiver"`
+	Scheduler SchedulerConfig `toml:"scheduler"`
+	Output    OutputConfig    `toml:"output"`
+	Log       LogConfig       `toml:"log"`
+	Metrics   MetricsConfig   `toml:"metrics"`
+	Server    ServerConfig    `toml:"server"`
+	Alerts    AlertsConfig    `toml:"alerts"`
+	Digest    DigestConfig    `toml:"digest"`
+	Bundle    BundleConfig    `toml:"bundle"`
+}
+
+func defaultConfig() *Config {
+	conus := Bounds{
+		LatMin: 20.0001576517236,
+		LatMax: 55.4189882586259,
+		LngMin: -179.0008962332189,
+		LngMax: -53.7449437099231,
+	}
+	adds := "https://aviationweather.gov/adds/dataserver_current/current/"
+	return &Config{
+		Paths: PathsConfig{
+			DataDir:   "/disk/dev/mapsrv",
+			Airports:  "airports.txt",
+			Runways:   "runways.txt",
+			AirportDB: "airportdb.txt",
+		},
+		Region: conus,
+		Map: MapConfig{
+			Bounds: conus,
+			Tiles: TilesConfig{
+				URL:         "http://www.linair.net/map/tiles/{z}/{x}/{y}.png",
+				Attribution: "Chicago Sectional",
+				TMS:         true,
+			},
+			Title:                "Weather Map",
+			API:                  "/api",
+			Static:               "static/",
+			Leaflet:              "https://unpkg.com/leaflet@1.9.4",
+			Scripts:              []string{"https://unpkg.com/leaflet-contextmenu@1.4.0/dist/leaflet.contextmenu.min.js", "static/leaflet.viewpoint.js"},
+			CenterLat:            42.7611667,
+			CenterLng:            -87.8139167,
+			Zoom:                 9,
+			MinZoom:              6,
+			MaxZoom:              11,
+			Refresh:              5 * time.Minute,
+			StationLayer:         "markers",
+			CrosswindLimit:       15,
+			DensityAltitudeAlert: 6000,
+			MaxStations:          500,
+			StationSpacing:       40,
+			ThinZoom:             9,
+			DetailZoom:           8,
+			MaxArea:              10000,
+		},
+		Grid: GridConfig{
+			Resolution:  0.25,
+			RadiusNM:    100,
+			Power:       2,
+			MinStations: 3,
+		},
+		Sources: SourcesConfig{
+			Metars:          SourceConfig{Enabled: true, URL: adds + "metars.cache.csv", File: "metars.csv", Interval: 5 * time.Minute},
+			Tafs:            SourceConfig{Enabled: true, URL: adds + "tafs.cache.csv", File: "tafs.csv", Interval: 30 * time.Minute},
+			Pireps:          SourceConfig{Enabled: true, URL: adds + "pireps.cache.csv", File: "pireps.csv", Interval: 10 * time.Minute},
+			AircraftReports: SourceConfig{Enabled: true, URL: adds + "aircraftreports.cache.csv", File: "reports.csv", Interval: 10 * time.Minute},
+			AirSigmets:      SourceConfig{Enabled: true, URL: adds + "airsigmets.cache.csv", File: "airsigmets.csv", Interval: 10 * time.Minute},
+			Winds:           SourceConfig{Enabled: true, URL: "https://aviationweather.gov/api/data/windtemp?region=all&level=low&fcst=06", File: "winds.txt", Interval: time.Hour},
+		},
+		Receiver: ReceiverConfig{
+			Addr:         "192.168.1.8",
+			Path:         "/weather",
+			Dump:         "dump.txt",
+			SaveInterval: 10 * time.Second,
+		},
+		Scheduler: SchedulerConfig{
+			Jitter:       20 * time.Second,
+			Retries:      3,
+			RetryBackoff: 15 * time.Second,
+			StatusFile:   "status.json",
+		},
+		Output: OutputConfig{
+			Weather:    "weather.txt",
+			Pireps:     "pireps.txt",
+			Advisories: "advisories.txt",
+			CodeJS:     "/var/www/html/map/code.js",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Metrics: MetricsConfig{
+			Getwx:     ":9101",
+			Websocket: ":9102",
+		},
+		Server: ServerConfig{
+			Listen:       ":8080",
+			PushInterval: 5 * time.Second,
+		},
+		Alerts: AlertsConfig{
+			StateFile: "alerts.json",
+			Timeout:   10 * time.Second,
+		},
+		Digest: DigestConfig{
+			Interval:  12 * time.Hour,
+			Subject:   "Weather digest",
+			HTML:      true,
+			StateFile: "digest.json",
+			SMTP: SMTPConfig{
+				Addr: "localhost:25",
+				From: "weather@localhost",
+			},
+		},
+		Bundle: BundleConfig{
+			MinZoom:    6,
+			MaxZoom:    11,
+			CorridorNM: 25,
+			MaxTiles:   20000,
+			Fetchers:   4,
+		},
+	}
+}
+
+// Path resolves a file name from the config against the data directory.
+func (c *Config) Path(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(c.Paths.DataDir, name)
+}
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Paths.DataDir == "" {
+		errs = append(errs, errors.New("paths.data_dir is empty"))
+	}
+	if c.Paths.Airports == "" {
+		errs = append(errs, errors.New("paths.airports is empty"))
+	}
+	errs = append(errs, validateBounds("region", c.Region)...)
+	errs = append(errs, validateBounds("map.bounds", c.Map.Bounds)...)
+
+	enabled := 0
+	for _, src := range c.sources() {
+		name := src.Name
+		if !src.Enabled {
+			continue
+		}
+		enabled++
+		if u, err := url.Parse(src.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("sources.%s.url %q is not an absolute URL", name, src.URL))
+		}
+		if src.File == "" {
+			errs = append(errs, fmt.Errorf("sources.%s.file is empty", name))
+		}
+		if src.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("sources.%s.interval must be positive", name))
+		}
+	}
+	if enabled == 0 {
+		errs = append(errs, errors.New("no sources are enabled"))
+	}
+
+	if c.Receiver.Addr == "" {
+		errs = append(errs, errors.New("receiver.addr is empty"))
+	}
+	if c.Receiver.SaveInterval <= 0 {
+		errs = append(errs, errors.New("receiver.save_interval must be positive"))
+	}
+	if c.Scheduler.Jitter < 0 {
+		errs = append(errs, errors.New("scheduler.jitter must not be negative"))
+	}
+	if c.Scheduler.Retries < 0 {
+		errs = append(errs, errors.New("scheduler.retries must not be negative"))
+	}
+	if c.Scheduler.Retries > 0 && c.Scheduler.RetryBackoff <= 0 {
+		errs = append(errs, errors.New("scheduler.retry_backoff must be positive"))
+	}
+	if c.Map.API == "" {
+		errs = append(errs, errors.New("map.api is empty"))
+	}
+	if c.Map.MinZoom < 0 || c.Map.MinZoom > c.Map.MaxZoom || c.Map.Zoom < c.Map.MinZoom || c.Map.Zoom > c.Map.MaxZoom {
+		errs = append(errs, fmt.Errorf("map zooms must satisfy 0 <= min_zoom (%d) <= zoom (%d) <= max_zoom (%d)", c.Map.MinZoom, c.Map.Zoom, c.Map.MaxZoom))
+	}
+	if c.Map.StationLayer != "markers" && c.Map.StationLayer != "tiles" {
+		errs = append(errs, fmt.Errorf("map.station_layer %q must be markers or tiles", c.Map.StationLayer))
+	}
+	if c.Map.CrosswindLimit < 0 {
+		errs = append(errs, errors.New("map.crosswind_limit must not be negative"))
+	}
+	if c.Map.DensityAltitudeAlert < 0 {
+		errs = append(errs, errors.New("map.density_altitude_alert must not be negative"))
+	}
+	if c.Map.MaxStations <= 0 {
+		errs = append(errs, errors.New("map.max_stations must be positive"))
+	}
+	if c.Map.MaxArea <= 0 {
+		errs = append(errs, errors.New("map.max_area must be positive"))
+	}
+	if c.Map.StationSpacing < 0 {
+		errs = append(errs, errors.New("map.station_spacing must not be negative"))
+	}
+	if c.Map.Refresh <= 0 {
+		errs = append(errs, errors.New("map.refresh must be positive"))
+	}
+	if c.Grid.Resolution <= 0 || c.Grid.RadiusNM <= 0 || c.Grid.Power <= 0 {
+		errs = append(errs, errors.New("grid.resolution, grid.radius_nm and grid.power must be positive"))
+	}
+	if c.Grid.MinStations < 1 {
+		errs = append(errs, errors.New("grid.min_stations must be at least 1"))
+	}
+	if c.Output.Weather == "" || c.Output.Pireps == "" {
+		errs = append(errs, errors.New("output.weather and output.pireps must be set"))
+	}
+	errs = append(errs, validateLogConfig(c.Log)...)
+	if c.Server.Listen == "" {
+		errs = append(errs, errors.New("server.listen is empty"))
+	}
+	if c.Server.PushInterval < 0 {
+		errs = append(errs, errors.New("server.push_interval must not be negative"))
+	}
+	if c.Server.PublicURL != "" {
+		if u, err := url.Parse(c.Server.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("server.public_url %q must be an http or https URL", c.Server.PublicURL))
+		}
+	}
+	for _, hook := range c.Alerts.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("alerts.webhooks: %q is not an http or https URL", hook))
+		}
+	}
+	if len(c.Alerts.Rules) > 0 && c.Alerts.StateFile == "" {
+		errs = append(errs, errors.New("alerts.state_file is empty"))
+	}
+	if c.Alerts.Timeout <= 0 {
+		errs = append(errs, errors.New("alerts.timeout must be positive"))
+	}
+	if c.Digest.Enabled {
+		if c.Digest.Interval <= 0 {
+			errs = append(errs, errors.New("digest.interval must be positive"))
+		}
+		if c.Digest.StateFile == "" {
+			errs = append(errs, errors.New("digest.state_file is empty"))
+		}
+		if _, _, err := net.SplitHostPort(c.Digest.SMTP.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("digest.smtp.addr %q must be host:port", c.Digest.SMTP.Addr))
+		}
+		if _, err := mail.ParseAddress(c.Digest.SMTP.From); err != nil {
+			errs = append(errs, fmt.Errorf("digest.smtp.from %q is not an address", c.Digest.SMTP.From))
+		}
+	}
+	for _, sub := range c.Digest.Subscribers {
+		addr, ids, ok := strings.Cut(sub, ":")
+		if _, err := mail.ParseAddress(strings.TrimSpace(addr)); err != nil || !ok || len(strings.Fields(ids)) == 0 {
+			errs = append(errs, fmt.Errorf("digest.subscribers: %q is not \"address: AIRPORT ...\"", sub))
+		}
+	}
+	if c.Bundle.MinZoom < 0 || c.Bundle.MinZoom > c.Bundle.MaxZoom || c.Bundle.MaxZoom > 22 {
+		errs = append(errs, fmt.Errorf("bundle zooms must satisfy 0 <= min_zoom (%d) <= max_zoom (%d) <= 22", c.Bundle.MinZoom, c.Bundle.MaxZoom))
+	}
+	if c.Bundle.CorridorNM <= 0 {
+		errs = append(errs, errors.New("bundle.corridor_nm must be positive"))
+	}
+	if c.Bundle.MaxTiles <= 0 || c.Bundle.Fetchers <= 0 {
+		errs = append(errs, errors.New("bundle.max_tiles and bundle.fetchers must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+func validateBounds(name string, b Bounds) []error {
+	var errs []error
+	if b.LatMin < -90 || b.LatMax > 90 || b.LatMin >= b.LatMax {
+		errs = append(errs, fmt.Errorf("%s: latitude range %g..%g is invalid", name, b.LatMin, b.LatMax))
+	}
+	if b.LngMin < -180 || b.LngMax > 180 || b.LngMin >= b.LngMax {
+		errs = append(errs, fmt.Errorf("%s: longitude range %g..%g is invalid", name, b.LngMin, b.LngMax))
+	}
+	return errs
+}
+
+type namedSource struct {
+	Name string
+	SourceConfig
+}
+
+// sources lists every source with its config name, in download order.
+func (c *Config) sources() []namedSource {
+	return []namedSource{
+		{"metars", c.Sources.Metars},
+		{"tafs", c.Sources.Tafs},
+		{"aircraft_reports", c.Sources.AircraftReports},
+		{"pireps", c.Sources.Pireps},
+		{"airsigmets", c.Sources.AirSigmets},
+		{"winds", c.Sources.Winds},
+	}
+}
+
+// configFlags holds the command line settings that apply on top of the
+// config file. Every binary registers them with addConfigFlags.
+type configFlags struct {
+	path      string
+	overrides []string
+}
+
+// addConfigFlags registers -config, the generic -set key=value override and
+// shorthands for the settings that get changed most often.
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{}
+	fs.StringVar(&cf.path, "config", "", "config file (default $MAPSRV_CONFIG or ./"+defaultConfigFile+")")
+	fs.Func("set", "override a config setting, e.g. -set sources.pireps.enabled=false", func(s string) error {
+		if !strings.Contains(s, "=") {
+			return fmt.Errorf("%q is not key=value", s)
+		}
+		cf.overrides = append(cf.overrides, s)
+		return nil
+	})
+	alias := func(name, key, usage string) {
+		fs.Func(name, usage, func(s string) error {
+			cf.overrides = append(cf.overrides, key+"="+strconv.Quote(s))
+			return nil
+		})
+	}
+	alias("data-dir", "paths.data_dir", "directory for downloaded and generated files")
+	alias("airports", "paths.airports", "airport database file")
+	alias("receiver", "receiver.addr", "UAT receiver websocket address")
+	alias("log-level", "log.level", "debug, info, warn or error")
+	fs.Func("region", "ingest region as lng1,lat1,lng2,lat2", func(s string) error {
+		b, err := parseBoundsArg(s)
+		if err != nil {
+			return err
+		}
+		cf.overrides = append(cf.overrides,
+			fmt.Sprintf("region.lat_min=%v", b.LatMin), fmt.Sprintf("region.lat_max=%v", b.LatMax),
+			fmt.Sprintf("region.lng_min=%v", b.LngMin), fmt.Sprintf("region.lng_max=%v", b.LngMax))
+		return nil
+	})
+	fs.Func("sources", "comma separated list of sources to enable, the rest are disabled; empty leaves them as configured", func(s string) error {
+		want := map[string]bool{}
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				want[name] = true
+			}
+		}
+		if len(want) == 0 {
+			return nil
+		}
+		for _, name := range []string{"metars", "tafs", "pireps", "aircraft_reports", "airsigmets", "winds"} {
+			cf.overrides = append(cf.overrides, fmt.Sprintf("sources.%s.enabled=%v", name, want[name]))
+			delete(want, name)
+		}
+		for name := range want {
+			return fmt.Errorf("unknown source %q", name)
+		}
+		return nil
+	})
+	return cf
+}
+
+// parseBoundsArg reads "lng1,lat1,lng2,lat2", the same order the map API
+// uses for its bounds parameter.
+func parseBoundsArg(s string) (Bounds, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Bounds{}, fmt.Errorf("bounds %q must be lng1,lat1,lng2,lat2", s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return Bounds{}, fmt.Errorf("bounds %q: %w", s, err)
+		}
+		v[i] = f
+	}
+	return Bounds{LngMin: v[0], LatMin: v[1], LngMax: v[2], LatMax: v[3]}, nil
+}
+
+// load builds the configuration from the flags after fs.Parse.
+func (cf *configFlags) load() (*Config, error) {
+	return loadConfig(cf.path, cf.overrides)
+}
+
+// loadConfig reads the config file at path and applies the key=value
+// overrides. With no path it falls back to $MAPSRV_CONFIG and then
+// ./mapsrv.toml; when none of those exist the defaults are used as is.
+func loadConfig(path string, overrides []string) (*Config, error) {
+	cfg := defaultConfig()
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv("MAPSRV_CONFIG")
+		explicit = path != ""
+	}
+	if !explicit {
+		path = defaultConfigFile
+	}
+	buf, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := decodeConfig(string(buf), cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case explicit || !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	for _, o := range overrides {
+		key, val, _ := strings.Cut(o, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		// A value that is not TOML, such as a bare path, is a string.
+		err := decodeConfig(key+" = "+val, cfg)
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			err = decodeConfig(key+" = "+strconv.Quote(val), cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("override %s: %w", key, err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// decodeConfig decodes TOML into cfg, leaving the settings it does not
+// mention alone. Durations are written as strings such as "5m". A key
+// that is not a setting is an error rather than being ignored, so that a
+// typo does not silently fall back to the default.
+func decodeConfig(data string, cfg *Config) error {
+	md, err := toml.Decode(data, cfg)
+	if err != nil {
+		return err
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = k.String()
+		}
+		return fmt.Errorf("unknown setting %s", strings.Join(names, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// Isolines of a surface analysis grid by marching squares, joined into
+// lines and written as GeoJSON: one MultiLineString feature per level.
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxContourLevels keeps a tiny interval from asking for millions of lines.
+const maxContourLevels = 200
+
+// gridEdge names the grid edge a contour crosses: the one going east from
+// point i,j when east is set, otherwise the one going north.
+type gridEdge struct {
+	east bool
+	i, j int
+}
+
+// edgePoint is where level crosses e, as lng/lat.
+func (g *grid) edgePoint(e gridEdge, level float64) [2]float64 {
+	i2, j2 := e.i, e.j+1
+	if e.east {
+		i2, j2 = e.i+1, e.j
+	}
+	a, b := g.at(e.i, e.j), g.at(i2, j2)
+	t := 0.5
+	if a != b {
+		t = (level - a) / (b - a)
+	}
+	i := float64(e.i) + t*float64(i2-e.i)
+	j := float64(e.j) + t*float64(j2-e.j)
+	return [2]float64{round4(g.lng(i)), round4(g.lat(j))}
+}
+
+func round4(v float64) float64 {
+	return math.Round(v*1e4) / 1e4
+}
+
+// Corner bits are 1 for the south-west point, 2 south-east, 4 north-east
+// and 8 north-west; edges are 0 south, 1 east, 2 north and 3 west.
+// The two saddles, 5 and 10, depend on the centre and are handled apart.
+var marchingSegments = [16][][2]int{
+	1: {{3, 0}}, 2: {{0, 1}}, 3: {{3, 1}}, 4: {{1, 2}},
+	6: {{0, 2}}, 7: {{3, 2}}, 8: {{2, 3}}, 9: {{0, 2}},
+	11: {{1, 2}}, 12: {{3, 1}}, 13: {{0, 1}}, 14: {{3, 0}},
+}
+
+// contourLines traces level through g. Cells with an empty corner are
+// skipped, so lines stop at the edge of the analysed area.
+func contourLines(g *grid, level float64) [][][2]float64 {
+	var segs [][2]gridEdge
+	for j := 0; j+1 < g.NY; j++ {
+		for i := 0; i+1 < g.NX; i++ {
+			a, b, c, d := g.at(i, j), g.at(i+1, j), g.at(i+1, j+1), g.at(i, j+1)
+			if math.IsNaN(a) || math.IsNaN(b) || math.IsNaN(c) || math.IsNaN(d) {
+				continue
+			}
+			idx := 0
+			for k, v := range []float64{a, b, c, d} {
+				if v >= level {
+					idx |= 1 << k
+				}
+			}
+			edges := [4]gridEdge{{true, i, j}, {false, i + 1, j}, {true, i, j + 1}, {false, i, j}}
+			pairs := marchingSegments[idx]
+			high := (a+b+c+d)/4 >= level
+			switch {
+			case idx == 5 && high, idx == 10 && !high:
+				pairs = [][2]int{{0, 1}, {2, 3}}
+			case idx == 5, idx == 10:
+				pairs = [][2]int{{3, 0}, {1, 2}}
+			}
+			for _, p := range pairs {
+				segs = append(segs, [2]gridEdge{edges[p[0]], edges[p[1]]})
+			}
+		}
+	}
+	// Every edge is shared by at most two segments; follow them end to
+	// end, starting from the loose ends so open lines come out whole.
+	ends := make(map[gridEdge][]int)
+	for k, s := range segs {
+		ends[s[0]] = append(ends[s[0]], k)
+		ends[s[1]] = append(ends[s[1]], k)
+	}
+	used := make([]bool, len(segs))
+	follow := func(from gridEdge, k int) [][2]float64 {
+		line := [][2]float64{g.edgePoint(from, level)}
+		at := from
+		for k >= 0 {
+			used[k] = true
+			if segs[k][0] == at {
+				at = segs[k][1]
+			} else {
+				at = segs[k][0]
+			}
+			line = append(line, g.edgePoint(at, level))
+			next := -1
+			for _, n := range ends[at] {
+				if !used[n] {
+					next = n
+					break
+				}
+			}
+			k = next
+		}
+		return line
+	}
+	var lines [][][2]float64
+	for k, s := range segs {
+		if !used[k] && (len(ends[s[0]]) == 1 || len(ends[s[1]]) == 1) {
+			from := s[0]
+			if len(ends[from]) != 1 {
+				from = s[1]
+			}
+			lines = append(lines, follow(from, k))
+		}
+	}
+	for k, s := range segs {
+		if !used[k] {
+			lines = append(lines, follow(s[0], k))
+		}
+	}
+	return lines
+}
+
+// contourLevels reads ?levels=a,b,c or ?interval=x, falling back to the
+// field's own levels or interval.
+func contourLevels(g *grid, f *gridField, levelsArg, intervalArg string) ([]float64, error) {
+	if levelsArg != "" {
+		var levels []float64
+		for _, s := range strings.Split(levelsArg, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, errors.New("levels must be a comma separated list of numbers")
+			}
+			levels = append(levels, v)
+		}
+		if len(levels) > maxContourLevels {
+			return nil, errors.New("too many levels")
+		}
+		sort.Float64s(levels)
+		return levels, nil
+	}
+	interval := f.interval
+	if intervalArg != "" {
+		v, err := strconv.ParseFloat(intervalArg, 64)
+		if err != nil || !(v > 0) || math.IsInf(v, 0) {
+			return nil, errors.New("interval must be a positive number")
+		}
+		interval = v
+	} else if len(f.levels) > 0 {
+		return f.levels, nil
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range g.V {
+		if !math.IsNaN(v) {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	if lo > hi {
+		return nil, nil
+	}
+	first := math.Ceil(lo/interval) * interval
+	if (hi-first)/interval >= maxContourLevels {
+		return nil, errors.New("interval is too small for the range of the data")
+	}
+	var levels []float64
+	for v := first; v <= hi; v += interval {
+		// Keep 29.92 from coming out as 29.919999999999998.
+		levels = append(levels, math.Round(v*1e6)/1e6)
+	}
+	return levels, nil
+}
+
+type geoJSONFeature struct {
+	Type       string         `json:"type"`
+	Geometry   any            `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+func contourGeoJSON(g *grid, f *gridField, levels []float64) geoJSONCollection {
+	fc := geoJSONCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, level := range levels {
+		lines := contourLines(g, level)
+		if len(lines) == 0 {
+			continue
+		}
+		props := map[string]any{"field": f.name, "level": level}
+		if f.units != "" {
+			props["units"] = f.units
+		}
+		fc.Features = append(fc.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{Type: "MultiLineString", Coordinates: lines},
+			Properties: props,
+		})
+	}
+	return fc
+}
@@ -0,0 +1,48 @@
+//go:build getwx
+
+package main
+
+// Pressure and density altitude of a field from its elevation and the
+// temperature, dewpoint and altimeter setting of its METAR, in the
+// standard atmosphere.
+
+import "math"
+
+const (
+	// isaLapse is the exponent of the standard atmosphere's pressure
+	// against height, and isaHeight the height in feet it scales by.
+	isaLapse  = 0.190263
+	isaHeight = 145442.16
+)
+
+// pressureAltitude is the height in feet of the standard atmosphere at
+// which the pressure is what a field at elev feet, altimeter altimHg, has.
+func pressureAltitude(elev, altimHg float64) float64 {
+	return elev + isaHeight*(1-math.Pow(altimHg/29.92126, isaLapse))
+}
+
+// densityAltitude is the height in feet of the standard atmosphere with the
+// density of the air at pressure altitude pa with temperature tempC. The
+// dewpoint, when known, accounts for the lighter moist air; NaN leaves it
+// out.
+func densityAltitude(pa, tempC, dewC float64) float64 {
+	pressure := 1013.25 * math.Pow(1-pa/isaHeight, 1/isaLapse) // hPa
+	t := tempC + 273.15
+	if !math.IsNaN(dewC) {
+		vapor := 6.1078 * math.Pow(10, 7.5*dewC/(237.3+dewC))
+		t /= 1 - 0.379*vapor/pressure
+	}
+	ratio := (pressure / 1013.25) * (288.15 / t)
+	return isaHeight * (1 - math.Pow(ratio, 0.234969))
+}
+
+// fieldAltitudes works out pressure and density altitude from a raw METAR,
+// ok is false when it lacks the temperature or altimeter setting.
+func fieldAltitudes(elev float64, metar string) (pa, da float64, ok bool) {
+	obs := parseMetarText(metar)
+	if math.IsNaN(elev) || math.IsNaN(obs.TempC) || math.IsNaN(obs.AltimHg) {
+		return 0, 0, false
+	}
+	pa = pressureAltitude(elev, obs.AltimHg)
+	return pa, densityAltitude(pa, obs.TempC, obs.DewC), true
+}
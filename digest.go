@@ -0,0 +1,406 @@
+//go:build getwx
+
+package main
+
+// The weather digest: every digest.interval getwx -daemon mails each
+// subscriber the current METAR, the decoded TAF periods still to come and
+// the flight category changes since their last digest for the airports
+// they watch, as plain text and HTML through the digest.smtp relay.
+// getwx -digest sends one straight away. The category changes are
+// recorded after every ingest in digest.state_file, which also remembers
+// when each subscriber was last sent a digest.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type digestSubscriber struct {
+	Addr     string
+	Airports []string
+}
+
+// digestSubscribers reads digest.subscribers, with each airport under the
+// identifier its weather goes by.
+func digestSubscribers() []digestSubscriber {
+	var out []digestSubscriber
+	for _, s := range cfg.Digest.Subscribers {
+		addr, ids, _ := strings.Cut(s, ":")
+		sub := digestSubscriber{Addr: strings.TrimSpace(addr)}
+		seen := map[string]bool{}
+		for _, id := range strings.Fields(ids) {
+			if id = airportDB.ident(id); !seen[id] {
+				seen[id] = true
+				sub.Airports = append(sub.Airports, id)
+			}
+		}
+		out = append(out, sub)
+	}
+	return out
+}
+
+type categoryChange struct {
+	ICAO string    `json:"icao"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+type digestState struct {
+	// Categories is the last category seen at each watched airport.
+	Categories map[string]string    `json:"categories"`
+	Changes    []categoryChange     `json:"changes"`
+	Sent       map[string]time.Time `json:"sent"`
+}
+
+// digestMu keeps the ingest and the digest job from writing the state
+// file at the same time.
+var digestMu sync.Mutex
+
+func readDigestState(fname string) (*digestState, error) {
+	st := &digestState{Categories: map[string]string{}, Sent: map[string]time.Time{}}
+	buf, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, st); err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	if st.Categories == nil {
+		st.Categories = map[string]string{}
+	}
+	if st.Sent == nil {
+		st.Sent = map[string]time.Time{}
+	}
+	return st, nil
+}
+
+func (st *digestState) write(fname string) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, append(b, '\n'))
+}
+
+// recordCategories notes the category changes at the watched airports in
+// the METARs just read.
+func recordCategories() error {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	fname := cfg.Path(cfg.Digest.StateFile)
+	st, err := readDigestState(fname)
+	if err != nil {
+		return err
+	}
+	watched := map[string]bool{}
+	for _, sub := range digestSubscribers() {
+		for _, id := range sub.Airports {
+			watched[id] = true
+		}
+	}
+	now := time.Now().UTC()
+	for _, m := range metars {
+		if !watched[m.ICAO] || m.COND == "" {
+			continue
+		}
+		if prev := st.Categories[m.ICAO]; prev != "" && prev != m.COND {
+			st.Changes = append(st.Changes, categoryChange{ICAO: m.ICAO, From: prev, To: m.COND, Time: now})
+		}
+		st.Categories[m.ICAO] = m.COND
+	}
+	return st.write(fname)
+}
+
+// sendDigests mails every subscriber whose digest is due, or all of them
+// when force is set. A digest sent less than half an interval ago is not
+// due, so restarting the daemon does not send another straight away.
+func sendDigests(force bool) error {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	fname := cfg.Path(cfg.Digest.StateFile)
+	st, err := readDigestState(fname)
+	if err != nil {
+		return err
+	}
+	weather, err := readDigestWeather(cfg.Path(cfg.Output.Weather))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	subs := digestSubscribers()
+	var errs []error
+	for _, sub := range subs {
+		since, ok := st.Sent[sub.Addr]
+		if !ok {
+			since = now.Add(-cfg.Digest.Interval)
+		}
+		if !force && ok && now.Sub(since) < cfg.Digest.Interval/2 {
+			continue
+		}
+		d := buildDigest(sub, weather, st.Changes, since, now)
+		msg, err := composeDigest(sub.Addr, d)
+		if err == nil {
+			err = sendMail(sub.Addr, msg)
+		}
+		if err != nil {
+			digestMails.Inc("failed")
+			errs = append(errs, fmt.Errorf("digest to %s: %w", sub.Addr, err))
+			continue
+		}
+		digestMails.Inc("sent")
+		slog.Info("sent digest", "to", sub.Addr, "airports", len(sub.Airports))
+		st.Sent[sub.Addr] = now
+	}
+	// Changes every subscriber has been told about are dropped.
+	oldest := now
+	for _, sub := range subs {
+		if t, ok := st.Sent[sub.Addr]; !ok {
+			oldest = now.Add(-cfg.Digest.Interval)
+			break
+		} else if t.Before(oldest) {
+			oldest = t
+		}
+	}
+	kept := st.Changes[:0]
+	for _, c := range st.Changes {
+		if !c.Time.Before(oldest) {
+			kept = append(kept, c)
+		}
+	}
+	st.Changes = kept
+	if err := st.write(fname); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+var digestMails = newCounter("getwx_digest_mails_total", "Digest emails, by result.", "result")
+
+// readDigestWeather reads output.weather by station.
+func readDigestWeather(fname string) (map[string]weatherData, error) {
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var list []weatherData
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	out := make(map[string]weatherData, len(list))
+	for _, wx := range list {
+		out[wx.ICAO] = wx
+	}
+	return out, nil
+}
+
+type digest struct {
+	To       string
+	Since    string
+	Time     string
+	Airports []digestAirport
+}
+
+type digestAirport struct {
+	Ident    string
+	Name     string
+	Category string
+	Color    string
+	Metar    string
+	Changes  []digestChange
+	Periods  []digestPeriod
+	// Missing is set when weather.txt has nothing for the airport.
+	Missing bool
+}
+
+type digestChange struct {
+	From, To, Time string
+}
+
+type digestPeriod struct {
+	Change   string
+	When     string
+	Category string
+	Color    string
+	Weather  string
+}
+
+// digestTime is how times are written in the digest, e.g. "Mon 19 1820Z".
+func digestTime(t time.Time) string {
+	return t.UTC().Format("Mon 02 1504Z")
+}
+
+func buildDigest(sub digestSubscriber, weather map[string]weatherData, changes []categoryChange, since, now time.Time) digest {
+	d := digest{To: sub.Addr, Since: digestTime(since), Time: digestTime(now)}
+	for _, id := range sub.Airports {
+		a := digestAirport{Ident: id}
+		if info := airportDB.find(id); info != nil {
+			a.Name = info.Name
+		}
+		wx, ok := weather[id]
+		if !ok || wx.Metar == "" {
+			a.Missing = true
+			d.Airports = append(d.Airports, a)
+			continue
+		}
+		a.Category, a.Color, a.Metar = wx.Cond, getCondition(wx.Cond), plainText(wx.Metar)
+		for _, c := range changes {
+			if c.ICAO == id && c.Time.After(since) {
+				a.Changes = append(a.Changes, digestChange{From: c.From, To: c.To, Time: digestTime(c.Time)})
+			}
+		}
+		for _, p := range decodeTafText(wx.TAF, now) {
+			if !p.To.IsZero() && !p.To.After(now) {
+				continue
+			}
+			cat := p.category()
+			dp := digestPeriod{Change: p.Change, Category: cat, Color: getCondition(cat), Weather: p.describe()}
+			switch {
+			case p.From.IsZero():
+			case p.To.IsZero():
+				dp.When = "from " + digestTime(p.From)
+			default:
+				dp.When = digestTime(p.From) + " to " + digestTime(p.To)
+			}
+			if dp.Weather == "" {
+				dp.Weather = p.Text
+			}
+			a.Periods = append(a.Periods, dp)
+		}
+		d.Airports = append(d.Airports, a)
+	}
+	return d
+}
+
+var digestText = template.Must(template.New("text").Parse(`Weather digest for {{.To}}, {{.Time}}
+Category changes are since {{.Since}}.
+{{range .Airports}}
+{{.Ident}}{{if .Name}} {{.Name}}{{end}}{{if .Category}}: {{.Category}}{{end}}
+{{- if .Missing}}
+  No current report.
+{{- else}}
+  METAR {{.Metar}}
+{{- if .Changes}}
+  Changes:{{range $i, $c := .Changes}}{{if $i}},{{end}} {{$c.From}} to {{$c.To}} at {{$c.Time}}{{end}}
+{{- else}}
+  No category changes.
+{{- end}}
+{{- if .Periods}}
+  Forecast:
+{{- range .Periods}}
+    {{if .Change}}{{.Change}} {{end}}{{.When}}{{if .Category}} [{{.Category}}]{{end}}: {{.Weather}}
+{{- end}}
+{{- end}}
+{{- end}}
+{{end}}`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<html><body style="font-family: sans-serif">
+<h2>Weather digest, {{.Time}}</h2>
+<p>Category changes are since {{.Since}}.</p>
+{{range .Airports}}
+<h3>{{.Ident}}{{if .Name}} {{.Name}}{{end}}{{if .Category}} <span style="background: {{.Color}}; padding: 0 4px">{{.Category}}</span>{{end}}</h3>
+{{if .Missing}}<p>No current report.</p>{{else}}
+<p><code>{{.Metar}}</code></p>
+{{if .Changes}}<ul>{{range .Changes}}<li>{{.From}} to {{.To}} at {{.Time}}</li>{{end}}</ul>{{else}}<p>No category changes.</p>{{end}}
+{{if .Periods}}<table cellpadding="3">
+{{range .Periods}}<tr><td>{{.Change}}</td><td>{{.When}}</td><td>{{if .Category}}<span style="background: {{.Color}}; padding: 0 4px">{{.Category}}</span>{{end}}</td><td>{{.Weather}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}{{end}}
+</body></html>
+`))
+
+// composeDigest writes the digest as a mail message, multipart with an
+// HTML part when digest.html is set.
+func composeDigest(to string, d digest) ([]byte, error) {
+	var text, html bytes.Buffer
+	if err := digestText.Execute(&text, d); err != nil {
+		return nil, err
+	}
+	if cfg.Digest.HTML {
+		if err := digestHTML.Execute(&html, d); err != nil {
+			return nil, err
+		}
+	}
+	var msg bytes.Buffer
+	from := mail.Address{Address: cfg.Digest.SMTP.From}
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		from.String(), (&mail.Address{Address: to}).String(), mimeHeader(cfg.Digest.Subject), time.Now().Format(time.RFC1123Z))
+	if !cfg.Digest.HTML {
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuoted(&msg, text.Bytes()); err != nil {
+			return nil, err
+		}
+		return msg.Bytes(), nil
+	}
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct {
+		typ  string
+		body []byte
+	}{{"text/plain", text.Bytes()}, {"text/html", html.Bytes()}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.typ + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuoted(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+func writeQuoted(w io.Writer, body []byte) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write(body); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// mimeHeader encodes a header value that is not plain ASCII.
+func mimeHeader(s string) string {
+	for _, c := range s {
+		if c > 126 {
+			return mime.QEncoding.Encode("utf-8", s)
+		}
+	}
+	return s
+}
+
+// sendMail hands msg to the digest.smtp relay, logging in first when a
+// username is set.
+func sendMail(to string, msg []byte) error {
+	c := cfg.Digest.SMTP
+	var auth smtp.Auth
+	if c.Username != "" {
+		host, _, _ := net.SplitHostPort(c.Addr)
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return smtp.SendMail(c.Addr, auth, c.From, []string{to}, msg)
+}
@@ -0,0 +1,271 @@
+//go:build getwx
+
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpMessage is one mail as the fake relay got it.
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTP is a relay on a local port that takes every mail it is
+// handed, without extensions or authentication.
+type fakeSMTP struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) addr() string { return s.ln.Addr().String() }
+
+func (s *fakeSMTP) serve(c net.Conn) {
+	defer c.Close()
+	tc := textproto.NewConn(c)
+	var msg smtpMessage
+	tc.PrintfLine("220 localhost fake relay")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tc.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = smtpMessage{From: smtpPath(arg)}
+			tc.PrintfLine("250 ok")
+		case "RCPT":
+			msg.To = append(msg.To, smtpPath(arg))
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			data, err := io.ReadAll(tc.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tc.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tc.PrintfLine("250 ok")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 %s not implemented", verb)
+		}
+	}
+}
+
+// smtpPath is the address in "FROM:<a@b>" or "TO:<a@b>".
+func smtpPath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	return strings.Trim(strings.TrimSpace(path), "<>")
+}
+
+// take returns the mails that arrived since the last call, by recipient.
+func (s *fakeSMTP) take() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	got := s.messages
+	s.messages = nil
+	sort.Slice(got, func(i, j int) bool { return strings.Join(got[i].To, ",") < strings.Join(got[j].To, ",") })
+	return got
+}
+
+// digestParts reads a multipart/alternative digest into its decoded
+// parts, by content type.
+func digestParts(t *testing.T, data string) (*mail.Message, map[string]string) {
+	t.Helper()
+	m, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("reading the mail: %v\n%s", err, data)
+	}
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q (%v), want multipart/alternative", m.Header.Get("Content-Type"), err)
+	}
+	parts := map[string]string{}
+	var order []string
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if enc := p.Header.Get("Content-Transfer-Encoding"); enc != "quoted-printable" {
+			t.Errorf("%s part is %q, want quoted-printable", typ, enc)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[typ] = string(body)
+		order = append(order, typ)
+	}
+	if strings.Join(order, " ") != "text/plain text/html" {
+		t.Errorf("parts = %v, want text/plain then text/html", order)
+	}
+	return m, parts
+}
+
+func TestSendDigests(t *testing.T) {
+	relay := newFakeSMTP(t)
+
+	oldCfg, oldDB := cfg, airportDB
+	t.Cleanup(func() { cfg, airportDB = oldCfg, oldDB })
+	cfg = defaultConfig()
+	cfg.Paths.DataDir = t.TempDir()
+	cfg.Digest.Subscribers = []string{"pilot@example.com: KRAC", "ops@example.com: mke ORD"}
+	cfg.Digest.SMTP.Addr = relay.addr()
+	cfg.Digest.SMTP.From = "weather@example.com"
+	airportDB = nil
+	weather := `[
+{ "Lng": "-87.81", "Lat": "42.76", "ICAO": "KRAC", "Cond": "VFR", "Metar": "KRAC 191855Z 27014KT 10SM CLR 18/06 A3002" },
+{ "Lng": "-87.90", "Lat": "42.95", "ICAO": "KMKE", "Cond": "MVFR", "Metar": "KMKE 191852Z 27010KT 10SM BKN025 19/05 A3001" } ]`
+	if err := os.WriteFile(filepath.Join(cfg.Paths.DataDir, cfg.Output.Weather), []byte(weather), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody has had a digest yet: both are sent, each to its subscriber
+	// alone and from digest.smtp.from.
+	if err := sendDigests(false); err != nil {
+		t.Fatal(err)
+	}
+	got := relay.take()
+	if len(got) != 2 {
+		t.Fatalf("sent %d mails, want 2: %+v", len(got), got)
+	}
+	want := []struct {
+		to            string
+		text, notText []string
+		html          []string
+	}{
+		{
+			to:      "ops@example.com",
+			text:    []string{"KMKE: MVFR", "METAR KMKE 191852Z 27010KT 10SM BKN025 19/05 A3001", "KORD\n  No current report."},
+			html:    []string{"<code>KMKE 191852Z 27010KT 10SM BKN025 19/05 A3001</code>", "<h3>KORD</h3>", "No current report."},
+			notText: []string{"KRAC"},
+		},
+		{
+			to:      "pilot@example.com",
+			text:    []string{"Weather digest for pilot@example.com", "KRAC: VFR", "METAR KRAC 191855Z 27014KT 10SM CLR 18/06 A3002", "No category changes."},
+			html:    []string{"<code>KRAC 191855Z 27014KT 10SM CLR 18/06 A3002</code>", ">VFR</span>"},
+			notText: []string{"KMKE", "KORD"},
+		},
+	}
+	for i, w := range want {
+		msg := got[i]
+		if msg.From != "weather@example.com" || len(msg.To) != 1 || msg.To[0] != w.to {
+			t.Errorf("mail %d went from %q to %v, want from weather@example.com to %s", i, msg.From, msg.To, w.to)
+			continue
+		}
+		m, parts := digestParts(t, msg.Data)
+		if h := m.Header.Get("To"); h != "<"+w.to+">" {
+			t.Errorf("%s: To header = %q", w.to, h)
+		}
+		if h := m.Header.Get("Subject"); h != "Weather digest" {
+			t.Errorf("%s: Subject header = %q", w.to, h)
+		}
+		for _, s := range w.text {
+			if !strings.Contains(parts["text/plain"], s) {
+				t.Errorf("%s: text part has no %q:\n%s", w.to, s, parts["text/plain"])
+			}
+		}
+		for _, s := range w.notText {
+			if strings.Contains(parts["text/plain"], s) {
+				t.Errorf("%s: text part has %q, which is not theirs:\n%s", w.to, s, parts["text/plain"])
+			}
+		}
+		for _, s := range w.html {
+			if !strings.Contains(parts["text/html"], s) {
+				t.Errorf("%s: HTML part has no %q:\n%s", w.to, s, parts["text/html"])
+			}
+		}
+	}
+	st, err := readDigestState(cfg.Path(cfg.Digest.StateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Sent) != 2 {
+		t.Errorf("digest.json sent = %v, want both subscribers", st.Sent)
+	}
+
+	// Just sent, so not due again.
+	if err := sendDigests(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := relay.take(); len(got) != 0 {
+		t.Errorf("sent %d mails again before they were due", len(got))
+	}
+
+	// force sends them anyway.
+	if err := sendDigests(true); err != nil {
+		t.Fatal(err)
+	}
+	got = relay.take()
+	if len(got) != 2 || got[0].To[0] != "ops@example.com" || got[1].To[0] != "pilot@example.com" {
+		t.Errorf("forced digests went to %+v, want both subscribers", got)
+	}
+
+	// Half an interval after the last one, a digest is due again.
+	st, err = readDigestState(cfg.Path(cfg.Digest.StateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Sent["pilot@example.com"] = time.Now().Add(-cfg.Digest.Interval / 2)
+	if err := st.write(cfg.Path(cfg.Digest.StateFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDigests(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := relay.take(); len(got) != 1 || got[0].To[0] != "pilot@example.com" {
+		t.Errorf("sent %+v, want only the digest that was due", got)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !cgipart && !websocket
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces fname in one step so the CGI never reads a half
+// written file. Each call writes its own temporary file, so two writers of
+// the same file cannot mix their data; the last rename wins.
+func writeFileAtomic(fname string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// CreateTemp makes the file 0600; the web server has to read it.
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fname)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
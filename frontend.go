@@ -0,0 +1,178 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// The map page. index.html and code.js under web/ are templates filled in
+// from the [map] config; web/static holds the stylesheet and icons. All of
+// it is compiled in, so mapserver can serve the page or write it out for
+// Apache without any other files.
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	texttemplate "text/template"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+var (
+	pageTemplate = htmltemplate.Must(htmltemplate.ParseFS(webFiles, "web/index.html"))
+	codeTemplate = texttemplate.Must(texttemplate.New("code.js").Funcs(texttemplate.FuncMap{
+		// json is the only way values get into code.js. encoding/json
+		// escapes <, > and &, so the result is also safe inside a <script>.
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).ParseFS(webFiles, "web/code.js"))
+)
+
+// staticFiles is web/static with the prefix stripped.
+func staticFiles() fs.FS {
+	sub, err := fs.Sub(webFiles, "web/static")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+type tilesSettings struct {
+	URL         string `json:"url"`
+	Attribution string `json:"attribution"`
+	TMS         bool   `json:"tms"`
+}
+
+// pageSettings is what code.js gets as mapConfig.
+type pageSettings struct {
+	API            string        `json:"api"`
+	Static         string        `json:"static"`
+	Bounds         Bounds        `json:"bounds"`
+	Tiles          tilesSettings `json:"tiles"`
+	Center         [2]float64    `json:"center"`
+	Zoom           int           `json:"zoom"`
+	MinZoom        int           `json:"min_zoom"`
+	MaxZoom        int           `json:"max_zoom"`
+	RefreshSeconds float64       `json:"refresh_seconds"`
+	StationLayer   string        `json:"station_layer"`
+	WxTiles        string        `json:"wxtiles"`
+	// Events is the live update stream, empty when there is none.
+	Events string `json:"events"`
+}
+
+func newPageSettings(m MapConfig) pageSettings {
+	return pageSettings{
+		API:            m.API,
+		Static:         m.Static,
+		Bounds:         m.Bounds,
+		Tiles:          tilesSettings(m.Tiles),
+		Center:         [2]float64{m.CenterLat, m.CenterLng},
+		Zoom:           m.Zoom,
+		MinZoom:        m.MinZoom,
+		MaxZoom:        m.MaxZoom,
+		RefreshSeconds: m.Refresh.Seconds(),
+		StationLayer:   m.StationLayer,
+		WxTiles:        "wxtiles/{z}/{x}/{y}.png",
+	}
+}
+
+// pageData fills in index.html.
+type pageData struct {
+	Title   string
+	Leaflet string
+	Static  string
+	Scripts []string
+	CodeJS  string
+}
+
+func renderCodeJS(w io.Writer, s pageSettings) error {
+	return codeTemplate.Execute(w, s)
+}
+
+func renderPage(w io.Writer, m MapConfig) error {
+	return pageTemplate.Execute(w, pageData{
+		Title:   m.Title,
+		Leaflet: m.Leaflet,
+		Static:  m.Static,
+		Scripts: m.Scripts,
+		CodeJS:  "code.js",
+	})
+}
+
+// frontendHandler serves the page at /, code.js and the static files.
+// events is where the page gets live updates, "" for none.
+func frontendHandler(m MapConfig, events string) http.Handler {
+	settings := newPageSettings(m)
+	settings.Events = events
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := renderPage(&buf, m); err != nil {
+			logRequestError(r, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/code.js", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := renderCodeJS(&buf, settings); err != nil {
+			logRequestError(r, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+	mux.Handle("/"+path.Clean(m.Static)+"/", http.StripPrefix("/"+path.Clean(m.Static), http.FileServerFS(staticFiles())))
+	return mux
+}
+
+// writeFrontend writes code.js to codeJS and the static files next to it.
+// index.html is only written when there is none, so a page that has been
+// edited by hand, for instance to add more Leaflet plugins, is kept.
+func writeFrontend(codeJS string, m MapConfig) error {
+	dir := filepath.Dir(codeJS)
+	var buf bytes.Buffer
+	// Apache has no /events; the page polls instead.
+	if err := renderCodeJS(&buf, newPageSettings(m)); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(codeJS, buf.Bytes()); err != nil {
+		return err
+	}
+	index := filepath.Join(dir, "index.html")
+	if _, err := os.Stat(index); os.IsNotExist(err) {
+		buf.Reset()
+		if err := renderPage(&buf, m); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(index, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	static := filepath.Join(dir, filepath.FromSlash(m.Static))
+	return fs.WalkDir(staticFiles(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(static, filepath.FromSlash(name))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := fs.ReadFile(staticFiles(), name)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(target, data)
+	})
+}
@@ -0,0 +1,137 @@
+//go:build !websocket
+
+package main
+
+// Great circle and outline geometry shared by the route briefing, the
+// nearest weather lookup and the alert rules. Angles are in radians and
+// distances in nm.
+
+import "math"
+
+const earthRadiusNM = 3440.065
+
+// waypoint is one point of the route, with the distance to it from the
+// start.
+type waypoint struct {
+	Ident      string  `json:"ident"`
+	Lat        float64 `json:"lat"`
+	Lng        float64 `json:"lng"`
+	DistanceNM float64 `json:"distance_nm"`
+}
+
+func toRad(d float64) float64 { return d * math.Pi / 180 }
+
+func gcDistance(lat1, lng1, lat2, lng2 float64) float64 {
+	p1, p2 := toRad(lat1), toRad(lat2)
+	dp, dl := p2-p1, toRad(lng2-lng1)
+	a := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * earthRadiusNM * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func gcBearing(lat1, lng1, lat2, lng2 float64) float64 {
+	p1, p2 := toRad(lat1), toRad(lat2)
+	dl := toRad(lng2 - lng1)
+	return math.Atan2(math.Sin(dl)*math.Cos(p2), math.Cos(p1)*math.Sin(p2)-math.Sin(p1)*math.Cos(p2)*math.Cos(dl))
+}
+
+// legPosition is where lat/lng lies relative to the leg a-b: how far along
+// it the nearest point is and how far from the leg, clamped to its ends.
+func legPosition(a, b waypoint, lat, lng float64) (along, off float64) {
+	leg := b.DistanceNM - a.DistanceNM
+	d13 := gcDistance(a.Lat, a.Lng, lat, lng)
+	if leg == 0 {
+		return 0, d13
+	}
+	t13 := gcBearing(a.Lat, a.Lng, lat, lng)
+	t12 := gcBearing(a.Lat, a.Lng, b.Lat, b.Lng)
+	dr := d13 / earthRadiusNM
+	xt := math.Asin(math.Sin(dr) * math.Sin(t13-t12))
+	at := math.Acos(math.Max(-1, math.Min(1, math.Cos(dr)/math.Cos(xt)))) * earthRadiusNM
+	if math.Cos(t13-t12) < 0 {
+		at = -at
+	}
+	switch {
+	case at < 0:
+		return 0, d13
+	case at > leg:
+		return leg, gcDistance(b.Lat, b.Lng, lat, lng)
+	}
+	return at, math.Abs(xt) * earthRadiusNM
+}
+
+// routePosition is the distance along the route abeam lat/lng and how far
+// off the route it is, taking the nearest leg.
+func routePosition(route []waypoint, lat, lng float64) (along, off float64) {
+	off = math.Inf(1)
+	for k := 0; k+1 < len(route); k++ {
+		a, o := legPosition(route[k], route[k+1], lat, lng)
+		if o < off {
+			along, off = route[k].DistanceNM+a, o
+		}
+	}
+	return along, off
+}
+
+// advisoryPosition samples the route every few miles and reports where it
+// first comes within width of the advisory's outline, or ok false if it
+// never does.
+func advisoryPosition(route []waypoint, a advisoryData, width float64) (along, lat, lng float64, ok bool) {
+	step := math.Min(width, 10)
+	for k := 0; k+1 < len(route); k++ {
+		p, q := route[k], route[k+1]
+		leg := q.DistanceNM - p.DistanceNM
+		n := int(math.Ceil(leg/step)) + 1
+		for s := 0; s < n; s++ {
+			t := 0.0
+			if n > 1 {
+				t = float64(s) / float64(n-1)
+			}
+			lat, lng := p.Lat+t*(q.Lat-p.Lat), p.Lng+t*(q.Lng-p.Lng)
+			if polygonDistance(a.Points, lat, lng) <= width {
+				return p.DistanceNM + t*leg, lat, lng, true
+			}
+		}
+	}
+	return 0, 0, 0, false
+}
+
+// polygonDistance is how far lat/lng is from the outline in nm, 0 inside
+// it, on a flat projection centred on the point. Advisories are small
+// enough for that to be close.
+func polygonDistance(points [][2]float64, lat, lng float64) float64 {
+	cosLat := math.Cos(toRad(lat))
+	xy := func(p [2]float64) (float64, float64) { return (p[1] - lng) * cosLat * 60, (p[0] - lat) * 60 }
+	inside := false
+	best := math.Inf(1)
+	for k := range points {
+		ax, ay := xy(points[k])
+		bx, by := xy(points[(k+1)%len(points)])
+		if (ay > 0) != (by > 0) && 0 < ax+(0-ay)*(bx-ax)/(by-ay) {
+			inside = !inside
+		}
+		best = math.Min(best, originDistance(ax, ay, bx, by))
+	}
+	if inside {
+		return 0
+	}
+	return best
+}
+
+// originDistance is the distance from 0,0 to the segment a-b.
+func originDistance(ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
+
+// worldPixel is the Web Mercator position of lat/lng in pixels at zoom z,
+// with the world 256 pixels across at zoom 0 as on the map tiles.
+func worldPixel(lat, lng float64, z int) (x, y float64) {
+	n := 256 * math.Exp2(float64(z))
+	lat = math.Max(-85.05112878, math.Min(85.05112878, lat))
+	s := math.Sin(toRad(lat))
+	return (lng + 180) / 360 * n, (0.5 - math.Log((1+s)/(1-s))/(4*math.Pi)) * n
+}
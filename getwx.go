@@ -1,16 +1,28 @@
+//go:build getwx
+
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Pirep struct {
@@ -66,43 +78,116 @@ var metars []Metar
 var pireps []Pirep
 var tafs []Taf
 var winds []WindUL
+var advisories []advisoryData
+var airportDB *airportIndex
+var alertRules []*alertRule
 var useWx bool
 
-var LatMin float64 = 20.0001576517236
-var LatMax float64 = 55.4189882586259
-var LngMin float64 = -179.0008962332189
-var LngMax float64 = -53.7449437099231
+// sourceStats counts what happened to the records of one source in a run.
+// Err is set when the source could not be used at all.
+type sourceStats struct {
+	Name     string
+	Accepted int
+	Rejected int
+	Outside  int
+	Err      error
+}
 
-var LatMinMap float64 = 20.0001576517236
-var LatMaxMap float64 = 55.4189882586259
-var LngMinMap float64 = -179.0008962332189
-var LngMaxMap float64 = -53.7449437099231
+func (s *sourceStats) reject(format string, args ...any) {
+	s.Rejected++
+	slog.Warn("rejected record", "source", s.Name, "reason", fmt.Sprintf(format, args...))
+}
 
-func check(e error) {
-	if e != nil {
-		panic(e)
+func (s *sourceStats) rejectRows(n int, fname string) {
+	if n > 0 {
+		s.Rejected += n
+		slog.Warn("rejected malformed rows", "source", s.Name, "file", fname, "rows", n)
 	}
 }
 
+func (s *sourceStats) fail(err error) {
+	s.Err = err
+	slog.Error("source failed", "source", s.Name, "err", err)
+}
+
+// runSummary collects the sourceStats of one run in the order the sources
+// were first seen.
+type runSummary struct {
+	sources []*sourceStats
+}
+
+func (r *runSummary) source(name string) *sourceStats {
+	for _, s := range r.sources {
+		if s.Name == name {
+			return s
+		}
+	}
+	s := &sourceStats{Name: name}
+	r.sources = append(r.sources, s)
+	return s
+}
+
+// print logs one summary line per source and updates the record gauges.
+func (r *runSummary) print() {
+	for _, s := range r.sources {
+		attrs := []any{"source", s.Name, "accepted", s.Accepted, "rejected", s.Rejected}
+		if s.Outside > 0 {
+			attrs = append(attrs, "outside_region", s.Outside)
+		}
+		if s.Err != nil {
+			attrs = append(attrs, "err", s.Err)
+		}
+		slog.Info("summary", attrs...)
+		recordsMetric.Set(float64(s.Accepted), s.Name, "accepted")
+		recordsMetric.Set(float64(s.Rejected), s.Name, "rejected")
+	}
+}
+
+// usable reports whether the run produced anything worth putting on the map.
+func (r *runSummary) usable() bool {
+	return len(metars) > 0 || len(pireps) > 0
+}
+
 func DownloadFile(filepath string, url string) error {
+	return downloadContext(context.Background(), filepath, url)
+}
+
+// downloadContext fetches url into filepath. The body is written to a
+// temporary file and renamed into place, so a download that fails or is
+// cancelled half way leaves the previous copy alone.
+func downloadContext(ctx context.Context, filepath string, url string) error {
 
 	// Get the data
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{URL: url, Code: resp.StatusCode}
+	}
 
 	// Create the file
-	out, err := os.Create(filepath)
+	tmp := filepath + ".part"
+	out, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
 	// Write the body to file
 	_, err = io.Copy(out, resp.Body)
-	return err
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath)
 }
 
 func FindMetar(x string) int {
@@ -132,6 +217,23 @@ func FindTaf(x string) int {
 	return -1
 }
 
+// airportElevations maps each airport the way METARs name it to its field
+// elevation in feet, from airports.txt and then the airport database.
+func airportElevations() map[string]float64 {
+	elev := make(map[string]float64, len(airports))
+	for _, apt := range airports {
+		if v, err := strconv.ParseFloat(apt.Alt, 64); err == nil {
+			elev[apt.ICAO] = v
+		}
+	}
+	if db, err := readAirportDB(); err == nil && db != nil {
+		for _, a := range db.Airports {
+			elev[a.Ident] = a.ElevationFt
+		}
+	}
+	return elev
+}
+
 func stripK(apt string) string {
 	if apt[:1] == "K" {
 		return apt[1:]
@@ -139,43 +241,67 @@ func stripK(apt string) string {
 	return apt
 }
 
+// makeAirportName is the identifier the map uses for apt, see
+// airportIndex.ident.
 func makeAirportName(apt string) string {
-	if apt[:1] != "C" {
-		if apt[:1] != "K" {
-			return "K" + apt
-		}
-	}
-	return apt
+	return airportDB.ident(apt)
 }
 
-func readAirports(fname string) {
+func readAirports(fname string, stats *sourceStats) {
 	f, err := os.Open(fname)
-	check(err)
-	fmt.Println("Opened " + fname)
+	if err != nil {
+		stats.fail(err)
+		return
+	}
+	defer f.Close()
+	slog.Debug("opened", "file", fname)
 	reader := csv.NewReader(bufio.NewReader(f))
+	reader.FieldsPerRecord = -1
 
 	for {
 		line, error := reader.Read()
 		if error == io.EOF {
 			break
 		} else if error != nil {
-			log.Fatal(error)
+			if _, ok := error.(*csv.ParseError); ok {
+				stats.reject("%v", error)
+				continue
+			}
+			stats.fail(error)
+			return
+		}
+		row, _ := reader.FieldPos(0)
+		if len(line) < 4 {
+			stats.reject("%s line %d: expected 4 fields, got %d", fname, row, len(line))
+			continue
+		}
+		ident := strings.TrimSpace(line[0])
+		if ident == "" {
+			stats.reject("%s line %d: empty identifier", fname, row)
+			continue
 		}
 		AptLat, err := strconv.ParseFloat(strings.TrimSpace(line[1]), 64)
-		check(err)
-		AptLng, _ := strconv.ParseFloat(strings.TrimSpace(line[2]), 64)
-		if AptLat >= LatMin && AptLat <= LatMax {
-			if AptLng >= LngMin && AptLng <= LngMax {
-				airports = append(airports, Airport{
-					ICAO: makeAirportName(line[0]),
-					Lat:  strings.TrimSpace(line[1]),
-					Lng:  strings.TrimSpace(line[2]),
-					Alt:  line[3],
-				})
-			}
+		if err != nil {
+			stats.reject("%s line %d (%s): bad latitude %q", fname, row, ident, line[1])
+			continue
+		}
+		AptLng, err := strconv.ParseFloat(strings.TrimSpace(line[2]), 64)
+		if err != nil {
+			stats.reject("%s line %d (%s): bad longitude %q", fname, row, ident, line[2])
+			continue
+		}
+		if !cfg.Region.Contains(AptLat, AptLng) {
+			stats.Outside++
+			continue
 		}
+		stats.Accepted++
+		airports = append(airports, Airport{
+			ICAO: makeAirportName(ident),
+			Lat:  strings.TrimSpace(line[1]),
+			Lng:  strings.TrimSpace(line[2]),
+			Alt:  strings.TrimSpace(line[3]),
+		})
 	}
-	defer f.Close()
 //		fmt.Println("$data = json_decode('[")
 //		for i := range airports {
 //			fmt.Println(" {\"loc\":["+airports[i].Lat+","+airports[i].Lng+"], \"title\": \""+airports[i].ICAO+"\"}," )
@@ -183,155 +309,390 @@ func readAirports(fname string) {
 //		fmt.Println("]',true);")
 }
 
-//				  new L.LatLng(40.0003047916915, -93.0008962332189),
-//				  new L.LatLng(44.2728613107929, -84.644232216245));
-
-func scanPireps(fname string) {
+// importRunways reads an OurAirports-style runways.csv and writes the ends
+// of the open runways at the airports in airports.txt or the airport
+// database to paths.runways, keyed by the identifier the map uses. Ends
+// without a true heading get one from their number, which is magnetic and
+// so only roughly right.
+func importRunways(fname string, stats *sourceStats) error {
 	f, err := os.Open(fname)
-	check(err)
-	fmt.Println("Opened " + fname)
-	reader := csv.NewReader(bufio.NewReader(f))
-	reader.FieldsPerRecord = 45
-	for {
-		line, error := reader.Read()
-		if error == io.EOF {
-			break
-		} else if error != nil {
-			if strings.Contains(error.Error(), "wrong number of fields in line") {
-				// ignore copyright notice
-				fmt.Printf("%#v\n", err)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t, err := readAWCTable(f, "airport_ident", "le_ident")
+	if err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+	stats.rejectRows(t.Skipped, fname)
+	known := make(map[string]bool, len(airports))
+	for _, apt := range airports {
+		known[apt.ICAO] = true
+	}
+	if airportDB != nil {
+		for _, a := range airportDB.Airports {
+			known[a.Ident] = true
+		}
+	}
+	ends := make(map[string][]runwayEnd)
+	for _, row := range t.Rows {
+		apt := t.str(row, "airport_ident")
+		if apt != "" {
+			apt = makeAirportName(apt)
+		}
+		if apt == "" || !known[apt] {
+			stats.Outside++
+			continue
+		}
+		if t.bool(row, "closed") || t.str(row, "closed") == "1" {
+			continue
+		}
+		length, width := t.float(row, "length_ft"), t.float(row, "width_ft")
+		added := 0
+		for _, side := range []string{"le", "he"} {
+			ident := t.str(row, side+"_ident")
+			if ident == "" {
 				continue
 			}
-		}
-
-		if len(line) > 1 {
-			//		fmt.Println("Adding "+line[0]+" - "+line[1])
-			PirepLat, _ := strconv.ParseFloat(strings.TrimSpace(line[9]), 64)
-			//			check(err)
-			PirepLng, _ := strconv.ParseFloat(strings.TrimSpace(line[10]), 64)
-			if PirepLat >= LatMin && PirepLat <= LatMax {
-				if PirepLng >= LngMin && PirepLng <= LngMax {
-					//					for j := 0; j < len(line); j++ {
-					//						fmt.Printf("[%d] - %s\n", j, line[j])
-					//					}
-					pireps = append(pireps, Pirep{
-						Report: line[43],
-						Lat:    line[9],
-						Lng:    line[10],
-					})
-				}
+			heading := t.float(row, side+"_heading_degt")
+			if !hasValue(heading) {
+				heading = runwayNumberHeading(ident)
+			}
+			if !hasValue(heading) {
+				stats.reject("%s runway %s: no heading", apt, ident)
+				continue
+			}
+			e := runwayEnd{Ident: ident, Heading: heading, Surface: strings.ToUpper(t.str(row, "surface"))}
+			if hasValue(length) {
+				e.LengthFt = int(length)
 			}
+			if hasValue(width) {
+				e.WidthFt = int(width)
+			}
+			ends[apt] = append(ends[apt], e)
+			added++
+		}
+		if added > 0 {
+			stats.Accepted++
 		}
 	}
-	defer f.Close()
+	b, err := json.Marshal(ends)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg.Path(cfg.Paths.Runways), append(b, '\n'))
 }
 
-func scanMetars(fname string) {
-	f, err := os.Open(fname)
-	check(err)
-	fmt.Println("Opened " + fname)
-	reader := csv.NewReader(bufio.NewReader(f))
-	reader.FieldsPerRecord = 44
-	for {
-		line, error := reader.Read()
-		if error == io.EOF {
-			break
-		} else if error != nil {
-			if strings.Contains(error.Error(), "wrong number of fields in line") {
-				// ignore copyright notice
-				fmt.Printf("%#v\n", err)
-				continue
-			}
-		}
+// runwayNumberHeading is the heading a runway number stands for, NaN for
+// helipads and the like.
+func runwayNumberHeading(ident string) float64 {
+	n, err := strconv.Atoi(strings.TrimRight(ident, "LCRW"))
+	if err != nil || n < 1 || n > 36 {
+		return math.NaN()
+	}
+	return float64(n * 10)
+}
 
-		if len(line) > 1 {
-			//		fmt.Println("Adding "+line[0]+" - "+line[1])
-			metars = append(metars, Metar{
-				ICAO:  line[1],
-				METAR: line[0],
-				COND:  line[30],
-				LONG:  line[4],
-				LAT:   line[3],
-			})
+//				  new L.LatLng(40.0003047916915, -93.0008962332189),
+//				  new L.LatLng(44.2728613107929, -84.644232216245));
+
+func scanPireps(fname string, stats *sourceStats) {
+	recs, t, err := readPirepFile(fname)
+	if err != nil {
+		stats.fail(err)
+		return
+	}
+	slog.Debug("opened", "file", fname)
+	stats.rejectRows(t.Skipped, fname)
+	for _, rec := range recs {
+		if rec.RawText == "" || !hasValue(rec.Latitude) || !hasValue(rec.Longitude) {
+			stats.reject("PIREP without a report or position: %q", rec.RawText)
+			continue
+		}
+		if !cfg.Region.Contains(rec.Latitude, rec.Longitude) {
+			stats.Outside++
+			continue
 		}
+		stats.Accepted++
+		pireps = append(pireps, Pirep{
+			Report: rec.RawText,
+			Lat:    formatAWCFloat(rec.Latitude),
+			Lng:    formatAWCFloat(rec.Longitude),
+		})
 	}
-	defer f.Close()
 }
 
-func scanUatReportFile(fname string) {
-	f2, err2 := os.Open(fname)
-	if err2 != nil {
-		panic(err2)
+func scanMetars(fname string, stats *sourceStats) {
+	recs, t, err := readMetarFile(fname)
+	if err != nil {
+		stats.fail(err)
+		return
+	}
+	slog.Debug("opened", "file", fname)
+	stats.rejectRows(t.Skipped, fname)
+	for _, rec := range recs {
+		if rec.StationID == "" || rec.RawText == "" {
+			stats.reject("METAR without a station or report: %q", rec.RawText)
+			continue
+		}
+		if !hasValue(rec.Latitude) || !hasValue(rec.Longitude) {
+			stats.reject("%s: METAR without a position", rec.StationID)
+			continue
+		}
+		stats.Accepted++
+		metars = append(metars, Metar{
+			ICAO:  rec.StationID,
+			METAR: rec.RawText,
+			COND:  rec.FlightCategory,
+			LONG:  formatAWCFloat(rec.Longitude),
+			LAT:   formatAWCFloat(rec.Latitude),
+		})
 	}
-	readBuf := make([]byte, 1048576)
-	count, err := f2.Read(readBuf)
+}
+
+// scanUatReportFile merges the reports the websocket client saved from the
+// UAT receiver. A METAR or TAF replaces the downloaded one for its station
+// when it was issued later, or adds the station, placed from airports.txt
+// or the airport database; winds aloft only fill in stations the FB
+// forecast does not have.
+func scanUatReportFile(fname string, stats *sourceStats) {
+	readBuf, err := os.ReadFile(fname)
 	if err != nil {
-		panic(err)
+		stats.fail(err)
+		return
 	}
-	errRead := json.Unmarshal(readBuf[0:count], &Rpts)
+	Rpts = nil
+	errRead := json.Unmarshal(readBuf, &Rpts)
 	if errRead != nil {
-		panic(errRead)
+		stats.fail(fmt.Errorf("%s: %w", fname, errRead))
+		return
 	}
-	f2.Sync()
-	f2.Close()
-	fmt.Printf("Read in %d reports\n", len(Rpts))
-	// Read METARS into data
+	slog.Info("read UAT reports", "file", fname, "reports", len(Rpts))
 	for _, rpt := range Rpts {
+		if rpt.Location == "" {
+			stats.reject("UAT report without a station")
+			continue
+		}
 		if len(rpt.Metar) > 0 {
-			fmt.Printf("%s has METAR %s\n", rpt.Location, rpt.Metar)
-			metars = append(metars, Metar{
-				ICAO:  rpt.Location,
-				METAR: rpt.Location + " " + rpt.Metar,
-				COND:  "VFR",
-			})
+			slog.Debug("UAT METAR", "station", rpt.Location, "metar", rpt.Metar)
+			text := rpt.Location + " " + strings.ReplaceAll(rpt.Metar, "<br>", " ")
+			if i := FindMetar(rpt.Location); i != -1 {
+				if issuedAfter(text, metars[i].METAR) {
+					metars[i].METAR = text
+					metars[i].COND = uatCategory(text)
+				}
+			} else if lat, lng, ok := airportPosition(rpt.Location); ok {
+				metars = append(metars, Metar{
+					ICAO:  rpt.Location,
+					METAR: text,
+					COND:  uatCategory(text),
+					LAT:   lat,
+					LONG:  lng,
+				})
+			} else {
+				// Its TAF and winds would have no station to go with.
+				stats.reject("%s: UAT report for an airport that is not known or not in the region", rpt.Location)
+				continue
+			}
 		}
+		stats.Accepted++
 		if len(rpt.TAF) > 0 {
-			fmt.Printf("%s has TAF %s\n", rpt.Location, rpt.TAF)
-			tafs = append(tafs, Taf{
-				ICAO: rpt.Location,
-				TAF:  rpt.Location + " " + rpt.TAF,
-			})
+			slog.Debug("UAT TAF", "station", rpt.Location, "taf", rpt.TAF)
+			text := rpt.Location + " " + rpt.TAF
+			if i := FindTaf(rpt.Location); i == -1 {
+				tafs = append(tafs, Taf{ICAO: rpt.Location, TAF: text})
+			} else if issuedAfter(text, tafs[i].TAF) {
+				tafs[i].TAF = text
+			}
 		}
-		if len(rpt.Winds) > 0 {
-			fmt.Printf("%s has Winds %s\n", rpt.Location, rpt.Winds)
+		if len(rpt.Winds) > 0 && FindWinds(rpt.Location) == -1 {
+			slog.Debug("UAT winds", "station", rpt.Location, "winds", rpt.Winds)
 			winds = append(winds, WindUL{
 				ICAO:  rpt.Location,
-				Winds: rpt.Location + " " + rpt.Winds,
+				Winds: rpt.Location + " " + strings.ReplaceAll(rpt.Winds, "<br>", " "),
 			})
 		}
 	}
 }
 
-func scanTafs(fname string) {
-	f, err := os.Open(fname)
-	check(err)
-	fmt.Println("Opened " + fname)
-	reader := csv.NewReader(bufio.NewReader(f))
-	reader.FieldsPerRecord = 44
-	for {
-		line, error := reader.Read()
-		if error == io.EOF {
-			break
-		} else if error != nil {
-			if strings.Contains(error.Error(), "wrong number of fields in line") {
-				// ignore copyright notice
-				fmt.Printf("%#v\n", err)
-				continue
+var issuedRe = regexp.MustCompile(`^(\d{2})(\d{4})Z$`)
+
+// issuedAfter reports whether report a carries a later ddhhmmZ time than
+// b. A day that goes back more than half a month is taken to be in the
+// next month.
+func issuedAfter(a, b string) bool {
+	issued := func(s string) (day, hhmm int, ok bool) {
+		for _, w := range strings.Fields(strings.ReplaceAll(s, "<br>", " ")) {
+			if m := issuedRe.FindStringSubmatch(w); m != nil {
+				day, _ = strconv.Atoi(m[1])
+				hhmm, _ = strconv.Atoi(m[2])
+				return day, hhmm, true
 			}
 		}
+		return 0, 0, false
+	}
+	da, ta, okA := issued(a)
+	db, tb, okB := issued(b)
+	switch {
+	case !okA:
+		return false
+	case !okB:
+		return true
+	case da != db:
+		if d := da - db; d > 15 || d < -15 {
+			return da < db
+		}
+		return da > db
+	}
+	return ta > tb
+}
 
-		if len(line) > 1 {
-			//		for j:=0; j < len(line); j++ {
-			//			fmt.Printf("[%d] - %s\n",j,line[j])
-			//		}
-			tafs = append(tafs, Taf{
-				ICAO: line[1],
-				TAF:  line[0],
-			})
+// uatCategory works the flight category out of a METAR, which the UAT
+// broadcast does not carry the way the download does.
+func uatCategory(metar string) string {
+	cat := metarCategory("", parseMetarText(metar))
+	if math.IsNaN(cat) {
+		return ""
+	}
+	return categoryNames[int(cat)]
+}
+
+// airportPosition is where id is, from airports.txt or else the airport
+// database, as long as it is in the region.
+func airportPosition(id string) (lat, lng string, ok bool) {
+	for _, a := range airports {
+		if a.ICAO == id {
+			return a.Lat, a.Lng, true
 		}
 	}
-	defer f.Close()
+	if a := airportDB.find(id); a != nil && cfg.Region.Contains(a.Lat, a.Lng) {
+		return formatAWCFloat(a.Lat), formatAWCFloat(a.Lng), true
+	}
+	return "", "", false
 }
+
+func scanTafs(fname string, stats *sourceStats) {
+	recs, t, err := readTafFile(fname)
+	if err != nil {
+		stats.fail(err)
+		return
+	}
+	slog.Debug("opened", "file", fname)
+	stats.rejectRows(t.Skipped, fname)
+	for _, rec := range recs {
+		if rec.StationID == "" || rec.RawText == "" {
+			stats.reject("TAF without a station or report: %q", rec.RawText)
+			continue
+		}
+		stats.Accepted++
+		tafs = append(tafs, Taf{
+			ICAO: rec.StationID,
+			TAF:  rec.RawText,
+		})
+	}
+}
+
+// fbGroupRe is one level of an FB winds aloft line, see decodeWinds.
+var fbGroupRe = regexp.MustCompile(`^\d{4}([+-]\d{2}|\d{2})?$`)
+
+// scanWinds reads the FB winds and temperatures aloft forecast. Each table
+// starts with an "FT  3000  6000 ..." header and runs to the next blank
+// line; the stations in it are FAA identifiers and their groups are kept
+// as they are, the levels below the station left out.
+func scanWinds(fname string, stats *sourceStats) {
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		stats.fail(err)
+		return
+	}
+	slog.Debug("opened", "file", fname)
+	tables := 0
+	inTable := false
+	for _, line := range strings.Split(string(buf), "\n") {
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 0:
+			inTable = false
+			continue
+		case f[0] == "FT":
+			inTable = true
+			tables++
+			continue
+		case !inTable:
+			continue
+		}
+		ok := len(f) > 1
+		for _, g := range f[1:] {
+			if !fbGroupRe.MatchString(g) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			stats.reject("winds aloft line: %q", strings.TrimSpace(line))
+			continue
+		}
+		stats.Accepted++
+		winds = append(winds, WindUL{
+			ICAO:  airportDB.ident(f[0]),
+			Winds: strings.Join(f, " "),
+		})
+	}
+	if tables == 0 {
+		stats.fail(fmt.Errorf("%s: no winds aloft table", fname))
+	}
+}
+
+// scanAirSigmets keeps the AIRMETs and SIGMETs that are still valid and
+// touch the region.
+func scanAirSigmets(fname string, stats *sourceStats) {
+	recs, t, err := readAirSigmetFile(fname)
+	if err != nil {
+		stats.fail(err)
+		return
+	}
+	slog.Debug("opened", "file", fname)
+	stats.rejectRows(t.Skipped, fname)
+	now := time.Now()
+	for _, rec := range recs {
+		if len(rec.Points) < 3 {
+			stats.reject("%s without an outline: %q", rec.AirSigmetType, rec.RawText)
+			continue
+		}
+		if !rec.ValidTimeTo.IsZero() && rec.ValidTimeTo.Before(now) {
+			continue
+		}
+		inside := false
+		for _, p := range rec.Points {
+			if cfg.Region.Contains(p[0], p[1]) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			stats.Outside++
+			continue
+		}
+		stats.Accepted++
+		adv := advisoryData{
+			Type:      rec.AirSigmetType,
+			Hazard:    rec.Hazard,
+			Severity:  rec.Severity,
+			ValidFrom: rec.ValidTimeFrom,
+			ValidTo:   rec.ValidTimeTo,
+			Raw:       rec.RawText,
+			Points:    rec.Points,
+		}
+		if hasValue(rec.MinFtMsl) {
+			adv.MinFt = int(rec.MinFtMsl)
+		}
+		if hasValue(rec.MaxFtMsl) {
+			adv.MaxFt = int(rec.MaxFtMsl)
+		}
+		advisories = append(advisories, adv)
+	}
+}
+
 func isOnMap(lat float64, lng float64) {
 }
 
@@ -453,6 +814,9 @@ type weatherData struct {
 	TAF			string
 	UpWinds		string
 	Lightning	string
+	Elevation	string
+	PressureAlt	string
+	DensityAlt	string
 }
 
 var WeatherData[] weatherData
@@ -473,23 +837,38 @@ func getLightning(metar string) int {
 	return 0
 }
 
-func generatePireps(fname string) {
-	w, err := os.Create(fname)
-	check(err)
+// jstr quotes s as a JSON string, so a quote or backslash in one report
+// cannot break the whole file.
+func jstr(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func generatePireps(fname string) error {
 	message := "[ "
 	for i:= range pireps {
-		message = message + fmt.Sprintf(" { \"Report\": \"%s\", \"Lng\": \"%s\", \"Lat\": \"%s\" },\n",pireps[i].Report,pireps[i].Lng,pireps[i].Lat)
+		message = message + fmt.Sprintf(" { \"Report\": %s, \"Lng\": %s, \"Lat\": %s },\n",jstr(pireps[i].Report),jstr(pireps[i].Lng),jstr(pireps[i].Lat))
 	}
 	message = message + fmt.Sprintf("{} ]\n")
-	w.Write([]byte(message))
-	w.Close()
+	return writeFileAtomic(fname, []byte(message))
+}
+
+func generateAdvisories(fname string) error {
+	all := advisories
+	if all == nil {
+		all = []advisoryData{}
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, append(b, '\n'))
 }
 
-func generateFile(fname string) {
+func generateFile(fname string) error {
 
-	w, err := os.Create(fname)
-	check(err)
 	message := "[ "
+	elevations := airportElevations()
 	
 	for i := range metars {
 		//		ApICAO := airports[i].ICAO
@@ -500,7 +879,7 @@ func generateFile(fname string) {
 		WindIndex := FindWinds(metars[i].ICAO)
 		// Do we have a metar?
 		if MetarIndex != -1 {
-			message = message + fmt.Sprintf("{ \"Lng\": \"%s\", \"Lat\": \"%s\", \"ICAO\": \"%s\", ",metars[i].LONG, metars[i].LAT, metars[i].ICAO)
+			message = message + fmt.Sprintf("{ \"Lng\": %s, \"Lat\": %s, \"ICAO\": %s, ",jstr(metars[i].LONG), jstr(metars[i].LAT), jstr(metars[i].ICAO))
 			MetarString := metars[MetarIndex].METAR
 			wdir, wspeed, wgust := getWinds(MetarString)
 			wbarb := wspeed
@@ -509,11 +888,16 @@ func generateFile(fname string) {
 				wbarb = -1
 			}
 			
-			message = message + fmt.Sprintf("\"WindDir\": \"%d\", \"WindSpeed\": \"%d\", \"WindBarb\": \"%d\", \"WindGust\": \"%d\", \"Metar\": \"%s\"", wdir, wspeed, wbarb, wgust, MetarString)
+			message = message + fmt.Sprintf("\"WindDir\": \"%d\", \"WindSpeed\": \"%d\", \"WindBarb\": \"%d\", \"WindGust\": \"%d\", \"Metar\": %s", wdir, wspeed, wbarb, wgust, jstr(MetarString))
 			cond := getCondition(metars[MetarIndex].COND)
 			precip := getPrecip(MetarString)
 			tt := getTemperature(MetarString)
-			message = message + fmt.Sprintf(", \"Cond\": \"%s\", \"CondColor\": \"%s\", \"Precip\": \"%s\", \"Temperature\": \"%s\"", metars[MetarIndex].COND, cond, precip, tt)
+			message = message + fmt.Sprintf(", \"Cond\": %s, \"CondColor\": %s, \"Precip\": %s, \"Temperature\": %s", jstr(metars[MetarIndex].COND), jstr(cond), jstr(precip), jstr(tt))
+			if elev, ok := elevations[metars[i].ICAO]; ok {
+				if pa, da, ok := fieldAltitudes(elev, MetarString); ok {
+					message = message + fmt.Sprintf(", \"Elevation\": \"%.0f\", \"PressureAlt\": \"%.0f\", \"DensityAlt\": \"%.0f\"", elev, pa, da)
+				}
+			}
 			if TafIndex != -1 {
 				TafString := tafs[TafIndex].TAF
 				var taftmp string
@@ -523,12 +907,12 @@ func generateFile(fname string) {
 					taftmp = strings.Replace(TafString, " FM", "<br><b>FM</b>", -1)
 				}
 				
-				message = message + fmt.Sprintf(", \"TAF\": \"<br><small>%s</small>\"", taftmp)
+				message = message + fmt.Sprintf(", \"TAF\": %s", jstr("<br><small>"+taftmp+"</small>"))
 	
 			}
 			if WindIndex != -1 {
 				WindString := winds[WindIndex].Winds
-				message = message + fmt.Sprintf(", \"UpWinds\": \"%s\"", WindString)
+				message = message + fmt.Sprintf(", \"UpWinds\": %s", jstr(WindString))
 
 			}
 			message = message + fmt.Sprintf(", \"Lightning\": \"%d\"",getLightning(MetarString))
@@ -540,71 +924,304 @@ func generateFile(fname string) {
 //	}
 	// close init function
 	message = message + fmt.Sprintf("{} ]\n")
-	w.Write([]byte(message))
-	w.Close()
+	return writeFileAtomic(fname, []byte(message))
 }
 
 func tryRead(fname string) {
 	fd, err := os.Open(fname)
 	if err != nil {
-		fmt.Println("Cannot read file")
+		slog.Error("cannot read file", "file", fname, "err", err)
 		return
 	}
 	defer fd.Close()
 	buf := make([]byte, 1048576*8)
 	count, err := fd.Read(buf)
 	if err != nil {
-		fmt.Println("Trouble reading file")
+		slog.Error("trouble reading file", "file", fname, "err", err)
 		return
 	}
 	var newWeatherData[] weatherData
 	err = json.Unmarshal(buf[0:count], &newWeatherData)
 	if err != nil {
-		fmt.Println("Trouble parsing file")
+		slog.Error("trouble parsing file", "file", fname, "err", err)
 		return
 	}
 	WeatherData = newWeatherData
-	fmt.Println("Read in weather data!")
-	fmt.Printf("Size is %d\n",len(WeatherData))
+	slog.Info("read in weather data", "file", fname, "stations", len(WeatherData))
 }
 
 var useFlag string
+var cfg *Config
+var daemon bool
+var runwaysFile string
+var airportsFile, frequenciesFile string
+var digestNow bool
+
+var rebuildMu sync.Mutex
+
+// rebuild rescans whatever has been downloaded, and the reports the UAT
+// websocket client saved, and regenerates weather.txt, with the winds
+// aloft in its station entries, pireps.txt and advisories.txt, counting
+// accepted and rejected records in sum. A source that is missing or
+// unreadable is skipped and the rest still go out.
+// The error is only for a run that produced nothing usable: no METARs or
+// PIREPs were read, or neither weather.txt nor pireps.txt was written.
+// In daemon mode every product finishes on its own schedule, so this is
+// serialized to keep two runs from writing at once.
+func rebuild(sum *runSummary) error {
+	rebuildMu.Lock()
+	defer rebuildMu.Unlock()
+	metars, tafs, pireps, advisories, winds = nil, nil, nil, nil, nil
+	src := cfg.Sources
+	if src.Metars.Enabled {
+		scanMetars(cfg.Path(src.Metars.File), sum.source("metars"))
+	}
+	if src.Tafs.Enabled {
+		scanTafs(cfg.Path(src.Tafs.File), sum.source("tafs"))
+	}
+	if src.Pireps.Enabled {
+		scanPireps(cfg.Path(src.Pireps.File), sum.source("pireps"))
+	}
+	if src.AirSigmets.Enabled {
+		scanAirSigmets(cfg.Path(src.AirSigmets.File), sum.source("airsigmets"))
+	}
+	if src.Winds.Enabled {
+		scanWinds(cfg.Path(src.Winds.File), sum.source("winds"))
+	}
+	// The UAT reports go last so that they can replace older downloads.
+	if dump := cfg.Path(cfg.Receiver.Dump); Exists(dump) {
+		scanUatReportFile(dump, sum.source("uat"))
+	}
+	if !sum.usable() {
+		return errors.New("no METARs or PIREPs were read, keeping the previous output")
+	}
+	// The map is usable as long as either of weather.txt and pireps.txt
+	// was written; the files that were not are only warned about.
+	weatherErr := generateFile(cfg.Path(cfg.Output.Weather))
+	if weatherErr != nil {
+		weatherErr = fmt.Errorf("writing weather: %w", weatherErr)
+		slog.Warn("output not written", "file", cfg.Path(cfg.Output.Weather), "err", weatherErr)
+	}
+	pirepErr := generatePireps(cfg.Path(cfg.Output.Pireps))
+	if pirepErr != nil {
+		pirepErr = fmt.Errorf("writing pireps: %w", pirepErr)
+		slog.Warn("output not written", "file", cfg.Path(cfg.Output.Pireps), "err", pirepErr)
+	}
+	if weatherErr != nil && pirepErr != nil {
+		return errors.Join(weatherErr, pirepErr)
+	}
+	// Unlike the PIREPs, a missing advisory download keeps the last file
+	// rather than clearing the map.
+	if src.AirSigmets.Enabled && sum.source("airsigmets").Err == nil {
+		if err := generateAdvisories(cfg.Path(cfg.Output.Advisories)); err != nil {
+			slog.Warn("output not written", "file", cfg.Path(cfg.Output.Advisories), "err", err)
+		}
+	}
+	if len(cfg.Digest.Subscribers) > 0 && src.Metars.Enabled && sum.source("metars").Err == nil {
+		if err := recordCategories(); err != nil {
+			slog.Warn("recording category changes for the digest", "err", err)
+		}
+	}
+	if len(alertRules) > 0 {
+		fresh := map[alertKind]bool{
+			alertStation:  src.Metars.Enabled && sum.source("metars").Err == nil,
+			alertPirep:    src.Pireps.Enabled && sum.source("pireps").Err == nil,
+			alertAdvisory: src.AirSigmets.Enabled && sum.source("airsigmets").Err == nil,
+		}
+		// A webhook being down is no reason to call the ingest failed.
+		if err := checkAlerts(alertRules, fresh); err != nil {
+			slog.Warn("checking alerts", "err", err)
+		}
+	}
+	return nil
+}
+
+var (
+	downloadDuration = newHistogram("getwx_download_duration_seconds", "Time taken to download each product.", defaultBuckets, "product")
+	downloadFailures = newCounter("getwx_download_failures_total", "Downloads that failed, by product.", "product")
+	lastDownload     = newGauge("getwx_last_success_timestamp_seconds", "Unix time of the last successful download, by product.", "product")
+	recordsMetric    = newGauge("getwx_records", "Records accepted and rejected by the last run, by product.", "product", "result")
+	_                = newGauge("getwx_data_age_seconds", "Age of the newest downloaded copy of each product.", "product").onScrape(func(m *metric) {
+		for _, s := range cfg.sources() {
+			if st, err := os.Stat(cfg.Path(s.File)); err == nil && s.Enabled {
+				m.Set(time.Since(st.ModTime()).Seconds(), s.Name)
+			}
+		}
+	})
+	_ = newGaugeFunc("getwx_output_age_seconds", "Age of the generated weather file.", func() float64 {
+		st, err := os.Stat(cfg.Path(cfg.Output.Weather))
+		if err != nil {
+			return math.NaN()
+		}
+		return time.Since(st.ModTime()).Seconds()
+	})
+)
+
+// fetch downloads one product and records how it went.
+func fetch(ctx context.Context, s namedSource) error {
+	start := time.Now()
+	slog.Debug("downloading", "product", s.Name, "url", s.URL)
+	err := downloadContext(ctx, cfg.Path(s.File), s.URL)
+	downloadDuration.Since(start, s.Name)
+	if err != nil {
+		downloadFailures.Inc(s.Name)
+		return err
+	}
+	lastDownload.Set(float64(time.Now().Unix()), s.Name)
+	slog.Info("downloaded", "product", s.Name, "file", s.File, "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Exists reports whether the named file or directory exists.
+func Exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// runDaemon keeps getwx running, fetching every enabled product on its own
+// interval until SIGINT or SIGTERM.
+func runDaemon() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sched := newScheduler(cfg.Scheduler, cfg.Path(cfg.Scheduler.StatusFile))
+	for _, s := range cfg.sources() {
+		if !s.Enabled {
+			continue
+		}
+		s := s
+		sched.add(s.Name, s.Interval, func(ctx context.Context) error {
+			if err := fetch(ctx, s); err != nil {
+				return err
+			}
+			// aircraft reports are only downloaded for now
+			if s.Name == "aircraft_reports" {
+				return nil
+			}
+			sum := &runSummary{}
+			err := rebuild(sum)
+			sum.print()
+			return err
+		})
+	}
+	// The websocket client saves its reports every save_interval; a dump
+	// that has changed is merged in straight away rather than waiting for
+	// the next download.
+	var lastDump []byte
+	sched.add("uat", cfg.Receiver.SaveInterval, func(ctx context.Context) error {
+		buf, err := os.ReadFile(cfg.Path(cfg.Receiver.Dump))
+		if errors.Is(err, os.ErrNotExist) || bytes.Equal(buf, lastDump) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		lastDump = buf
+		sum := &runSummary{}
+		err = rebuild(sum)
+		sum.print()
+		return err
+	})
+	if cfg.Digest.Enabled {
+		sched.add("digest", cfg.Digest.Interval, func(ctx context.Context) error {
+			return sendDigests(false)
+		})
+	}
+	serveMetrics(ctx, cfg.Metrics.Getwx)
+	slog.Info("running as a daemon", "status", cfg.Path(cfg.Scheduler.StatusFile))
+	sched.Run(ctx)
+	slog.Info("stopped")
+}
 
 func main() {
-	useWx = false
-	args := os.Args[1:]
-	if len(args) != 0 && args[0] == "-w" {
-		useWx = true
+	flag.BoolVar(&useWx, "w", false, "download the weather from aviationweather.gov")
+	flag.BoolVar(&daemon, "daemon", false, "keep running and download each product on its configured interval")
+	flag.StringVar(&runwaysFile, "import-runways", "", "import runways from an OurAirports-style runways.csv into paths.runways and exit")
+	flag.StringVar(&airportsFile, "import-airports", "", "import an OurAirports airports.csv or NASR APT_BASE.csv into paths.airport_db and exit")
+	flag.StringVar(&frequenciesFile, "import-frequencies", "", "with -import-airports, an OurAirports airport-frequencies.csv or NASR FRQ.csv")
+	flag.BoolVar(&digestNow, "digest", false, "mail the weather digest to every subscriber now and exit")
+	cflags := addConfigFlags(flag.CommandLine)
+	flag.Parse()
+	var err error
+	cfg, err = cflags.load()
+	if err != nil {
+		fatal("loading config", err)
+	}
+	setupLogging(cfg.Log)
+	if alertRules, err = parseAlertRules(cfg.Alerts.Rules); err != nil {
+		fatal("reading alert rules", err)
 	}
 	if useWx == true {
 		useFlag = "On"
 	} else {
 		useFlag = "Off"
 	}
-	fmt.Println("Launching the program. useWx flag is " + useFlag)
-	readAirports("airports.txt")
+	slog.Info("launching the program", "useWx", useFlag, "daemon", daemon)
+	sum := &runSummary{}
+	if airportsFile != "" {
+		err := importAirports(airportsFile, frequenciesFile, sum.source("airport database"))
+		if err != nil || runwaysFile == "" {
+			sum.print()
+		}
+		if err != nil {
+			fatal("importing airports", err)
+		}
+		slog.Info("imported airports", "file", cfg.Path(cfg.Paths.AirportDB))
+		if runwaysFile == "" {
+			return
+		}
+	}
+	airportDB, err = readAirportDB()
+	if err != nil {
+		slog.Warn("cannot read the airport database, guessing ICAO identifiers", "file", cfg.Path(cfg.Paths.AirportDB), "err", err)
+	}
+	readAirports(cfg.Path(cfg.Paths.Airports), sum.source("airports"))
+	if runwaysFile != "" {
+		err := importRunways(runwaysFile, sum.source("runways"))
+		sum.print()
+		if err != nil {
+			fatal("importing runways", err)
+		}
+		slog.Info("imported runways", "file", cfg.Path(cfg.Paths.Runways))
+		return
+	}
+	if digestNow {
+		if err := sendDigests(true); err != nil {
+			fatal("sending the digest", err)
+		}
+		return
+	}
+	if daemon {
+		runDaemon()
+		return
+	}
 	if useWx == true {
-		fmt.Println("Downloading metars.csv")
-		err := DownloadFile("metars.csv", "https://aviationweather.gov/adds/dataserver_current/current/metars.cache.csv")
-		check(err)
-		fmt.Println("Downloading tafs.csv")
-		err2 := DownloadFile("tafs.csv", "https://aviationweather.gov/adds/dataserver_current/current/tafs.cache.csv")
-		check(err2)
-		fmt.Println("Downloading reports.csv")
-		err3 := DownloadFile("reports.csv", "https://aviationweather.gov/adds/dataserver_current/current/aircraftreports.cache.csv")
-		check(err3)
-		fmt.Println("Downloading pireps.csv")
-		err4 := DownloadFile("pireps.csv", "https://aviationweather.gov/adds/dataserver_current/current/pireps.cache.csv")
-		check(err4)
-		scanMetars("metars.csv")
-		scanTafs("tafs.csv")
-		scanPireps("pireps.csv")
-		generateFile("./weather.txt")
-		generatePireps("./pireps.txt")
+		for _, s := range cfg.sources() {
+			if !s.Enabled {
+				continue
+			}
+			err := fetch(context.Background(), s)
+			if err != nil {
+				// carry on with the previous copy, if there is one
+				sum.source(s.Name).fail(fmt.Errorf("download: %w", err))
+			}
+		}
+		err := rebuild(sum)
+		sum.print()
+		if err != nil {
+			slog.Error("nothing usable was produced", "err", err)
+			os.Exit(1)
+		}
 	} else {
-//		scanUatReportFile("dump.txt")
+		// Without -w only the copies already downloaded and the UAT
+		// reports go into the output.
+		err := rebuild(sum)
+		sum.print()
+		if err != nil {
+			slog.Error("nothing usable was produced", "err", err)
+			os.Exit(1)
+		}
 	}
-	tryRead("./weather.txt")
+	tryRead(cfg.Path(cfg.Output.Weather))
 }
 
 /*
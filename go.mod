@@ -0,0 +1,9 @@
+module mapsrv
+
+go 1.22
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/andybalholm/brotli v1.2.6
+	github.com/gorilla/websocket v1.5.3
+)
@@ -0,0 +1,502 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// Surface analysis: station values interpolated onto a regular lat/lng
+// grid over map.bounds, so the map can show where it is IFR and not only
+// which stations are. mapserver -serve has each field as
+//
+//	/grid/{field}.json                   the grid itself
+//	/grid/{field}/contours.geojson       isolines (see contour.go)
+//	/grid/{field}/{z}/{x}/{y}.png        shaded tiles
+//
+// Grids are inverse distance weighted means of the stations within
+// grid.radius_nm and are rebuilt when weather.txt changes.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gridAlpha is the opacity of the shaded tiles.
+const gridAlpha = 140
+
+var gridBuilds = newHistogram("grid_build_duration_seconds", "Time taken to interpolate a surface analysis grid, by field.", defaultBuckets, "field")
+
+type rampStop struct {
+	v   float64
+	col color.RGBA
+}
+
+// gridField is one analysed quantity. value reads it from a station, NaN
+// when the station does not report it. Contours default to levels, or to
+// every interval across the grid's range.
+type gridField struct {
+	name     string
+	units    string
+	value    func(s tileStation) float64
+	levels   []float64
+	interval float64
+	ramp     []rampStop
+	// steps shades each band in its ramp colour instead of blending.
+	steps bool
+}
+
+func stationTempC(s tileStation) float64 {
+	if !math.IsNaN(s.obs.TempC) {
+		return s.obs.TempC
+	}
+	if f, err := strconv.ParseFloat(s.wx.Temperature, 64); err == nil {
+		return (f - 32) * 5 / 9
+	}
+	return math.NaN()
+}
+
+func stationCeiling(s tileStation) float64 {
+	switch {
+	case !math.IsNaN(s.obs.Ceiling):
+		return math.Min(s.obs.Ceiling, unlimitedCeiling)
+	case s.obs.Cover != "":
+		return unlimitedCeiling
+	}
+	return math.NaN()
+}
+
+func stationVisibility(s tileStation) float64 {
+	return math.Min(s.obs.VisSM, 10)
+}
+
+var gridFields = []*gridField{
+	{
+		name: "temp", units: "F", interval: 10,
+		value: func(s tileStation) float64 { return cToF(stationTempC(s)) },
+		ramp: []rampStop{
+			{-20, color.RGBA{128, 0, 160, 255}}, {0, color.RGBA{0, 64, 255, 255}}, {32, color.RGBA{0, 200, 255, 255}},
+			{50, color.RGBA{0, 200, 80, 255}}, {70, color.RGBA{255, 220, 0, 255}}, {90, color.RGBA{255, 128, 0, 255}},
+			{110, color.RGBA{200, 0, 0, 255}},
+		},
+	},
+	{
+		name: "spread", units: "F", levels: []float64{2, 4, 6, 10},
+		value: func(s tileStation) float64 { return (s.obs.TempC - s.obs.DewC) * 9 / 5 },
+		ramp: []rampStop{
+			{0, color.RGBA{200, 0, 0, 255}}, {3, color.RGBA{255, 128, 0, 255}}, {6, color.RGBA{255, 220, 0, 255}},
+			{10, color.RGBA{0, 200, 80, 255}}, {20, color.RGBA{0, 120, 60, 255}},
+		},
+	},
+	{
+		// Estimated from the surface temperature at the standard lapse
+		// rate of 2C per 1000ft.
+		name: "freezing_level", units: "ft AGL", interval: 2000,
+		value: func(s tileStation) float64 { return math.Max(0, stationTempC(s)/2*1000) },
+		ramp: []rampStop{
+			{0, color.RGBA{0, 64, 255, 255}}, {4000, color.RGBA{0, 200, 255, 255}},
+			{8000, color.RGBA{0, 200, 80, 255}}, {12000, color.RGBA{255, 220, 0, 255}},
+		},
+	},
+	{
+		name: "ceiling", units: "ft AGL", levels: []float64{500, 1000, 3000},
+		value: stationCeiling,
+		ramp: []rampStop{
+			{0, color.RGBA{255, 96, 255, 255}}, {500, color.RGBA{255, 96, 255, 255}}, {1000, color.RGBA{255, 48, 48, 255}},
+			{3000, color.RGBA{64, 64, 255, 255}}, {5000, color.RGBA{96, 255, 96, 255}},
+		},
+	},
+	{
+		name: "visibility", units: "SM", levels: []float64{1, 3, 5},
+		value: stationVisibility,
+		ramp: []rampStop{
+			{0, color.RGBA{255, 96, 255, 255}}, {1, color.RGBA{255, 48, 48, 255}}, {3, color.RGBA{64, 64, 255, 255}},
+			{5, color.RGBA{96, 255, 96, 255}},
+		},
+	},
+	{
+		name: "altimeter", units: "inHg", interval: 0.04,
+		value: func(s tileStation) float64 { return s.obs.AltimHg },
+		ramp: []rampStop{
+			{29.2, color.RGBA{128, 0, 160, 255}}, {29.6, color.RGBA{0, 64, 255, 255}}, {29.92, color.RGBA{230, 230, 230, 255}},
+			{30.2, color.RGBA{255, 128, 0, 255}}, {30.6, color.RGBA{200, 0, 0, 255}},
+		},
+	},
+	{
+		name: "wind", units: "kt", interval: 10,
+		value: func(s tileStation) float64 { _, speed, _ := stationWind(s.wx, s.obs); return speed },
+		ramp: []rampStop{
+			{0, color.RGBA{220, 255, 220, 255}}, {10, color.RGBA{0, 200, 80, 255}}, {20, color.RGBA{255, 220, 0, 255}},
+			{30, color.RGBA{255, 128, 0, 255}}, {50, color.RGBA{200, 0, 0, 255}},
+		},
+	},
+	{
+		// Worked out from the ceiling and visibility grids rather than
+		// interpolated. The 1.5 contour is the edge of the IFR areas.
+		name: "category", levels: []float64{catIFR - 0.5, catMVFR - 0.5, catVFR - 0.5}, steps: true,
+		ramp: []rampStop{
+			{catLIFR, parseHexColor(categoryColors["LIFR"])}, {catIFR, parseHexColor(categoryColors["IFR"])},
+			{catMVFR, parseHexColor(categoryColors["MVFR"])}, {catVFR, colorNone},
+		},
+	},
+}
+
+func findGridField(name string) *gridField {
+	for _, f := range gridFields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// grid holds values at LatMin + j*Res, LngMin + i*Res, row by row from
+// the south. Points without enough stations nearby are NaN.
+type grid struct {
+	Bounds Bounds
+	Res    float64
+	NX, NY int
+	V      []float64
+}
+
+func newGrid(b Bounds, res float64) *grid {
+	g := &grid{Bounds: b, Res: res}
+	g.NX = int(math.Floor((b.LngMax-b.LngMin)/res)) + 1
+	g.NY = int(math.Floor((b.LatMax-b.LatMin)/res)) + 1
+	g.V = make([]float64, g.NX*g.NY)
+	return g
+}
+
+func (g *grid) at(i, j int) float64 {
+	return g.V[j*g.NX+i]
+}
+
+func (g *grid) lat(j float64) float64 { return g.Bounds.LatMin + j*g.Res }
+func (g *grid) lng(i float64) float64 { return g.Bounds.LngMin + i*g.Res }
+
+// sample is the bilinear value at lat/lng, or NaN outside the grid or next
+// to an empty point. nearest takes the closest point instead, for fields
+// whose values are classes.
+func (g *grid) sample(lat, lng float64, nearest bool) float64 {
+	x := (lng - g.Bounds.LngMin) / g.Res
+	y := (lat - g.Bounds.LatMin) / g.Res
+	if x < 0 || y < 0 || x > float64(g.NX-1) || y > float64(g.NY-1) {
+		return math.NaN()
+	}
+	if nearest {
+		return g.at(int(math.Round(x)), int(math.Round(y)))
+	}
+	i, j := int(x), int(y)
+	if i == g.NX-1 {
+		i--
+	}
+	if j == g.NY-1 {
+		j--
+	}
+	fx, fy := x-float64(i), y-float64(j)
+	a, b, c, d := g.at(i, j), g.at(i+1, j), g.at(i+1, j+1), g.at(i, j+1)
+	return (a*(1-fx)+b*fx)*(1-fy) + (d*(1-fx)+c*fx)*fy
+}
+
+type gridPoint struct {
+	lat, lng, v float64
+}
+
+// interpolate builds the grid for f by inverse distance weighting.
+// Stations are binned by the search radius so each grid point only looks
+// at the stations near it.
+func interpolate(stations []tileStation, f *gridField, gc GridConfig, b Bounds) *grid {
+	binDeg := gc.RadiusNM / 60
+	bins := make(map[[2]int][]gridPoint)
+	for _, s := range stations {
+		v := f.value(s)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		k := [2]int{int(math.Floor(s.lat / binDeg)), int(math.Floor(s.lng / binDeg))}
+		bins[k] = append(bins[k], gridPoint{s.lat, s.lng, v})
+	}
+	g := newGrid(b, gc.Resolution)
+	for j := 0; j < g.NY; j++ {
+		lat := g.lat(float64(j))
+		cosLat := math.Cos(lat * math.Pi / 180)
+		// A degree of longitude shrinks towards the pole, so more bins
+		// are in reach east and west.
+		span := int(math.Ceil(1 / math.Max(cosLat, 0.01)))
+		bi := int(math.Floor(lat / binDeg))
+		for i := 0; i < g.NX; i++ {
+			lng := g.lng(float64(i))
+			bj := int(math.Floor(lng / binDeg))
+			var sum, weights float64
+			n := 0
+			exact := math.NaN()
+		search:
+			for di := -1; di <= 1; di++ {
+				for dj := -span; dj <= span; dj++ {
+					for _, p := range bins[[2]int{bi + di, bj + dj}] {
+						d := 60 * math.Hypot(p.lat-lat, (p.lng-lng)*cosLat)
+						if d > gc.RadiusNM {
+							continue
+						}
+						if d < 0.01 {
+							exact = p.v
+							break search
+						}
+						w := 1 / math.Pow(d, gc.Power)
+						sum += w * p.v
+						weights += w
+						n++
+					}
+				}
+			}
+			v := math.NaN()
+			switch {
+			case !math.IsNaN(exact):
+				v = exact
+			case n >= gc.MinStations:
+				v = sum / weights
+			}
+			g.V[j*g.NX+i] = v
+		}
+	}
+	return g
+}
+
+type gridCache struct {
+	mu      sync.Mutex
+	modTime time.Time
+	grids   map[string]*grid
+	tiles   map[string][]byte
+}
+
+var surfaceGrids = &gridCache{}
+
+// load returns the grid for f, building it if weather.txt has changed
+// since it was last built.
+func (gc *gridCache) load(f *gridField) (*grid, time.Time, error) {
+	stations, modTime, err := wxTiles.load()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.grids == nil || !modTime.Equal(gc.modTime) {
+		gc.modTime = modTime
+		gc.grids = make(map[string]*grid)
+		gc.tiles = make(map[string][]byte)
+	}
+	return gc.build(f, stations), modTime, nil
+}
+
+// build returns the cached grid for f or makes it; gc.mu is held.
+func (gc *gridCache) build(f *gridField, stations []tileStation) *grid {
+	if g, ok := gc.grids[f.name]; ok {
+		return g
+	}
+	start := time.Now()
+	var g *grid
+	if f.name == "category" {
+		ceiling := gc.build(findGridField("ceiling"), stations)
+		vis := gc.build(findGridField("visibility"), stations)
+		g = newGrid(ceiling.Bounds, ceiling.Res)
+		for k := range g.V {
+			g.V[k] = flightCategory(ceiling.V[k], vis.V[k])
+		}
+	} else {
+		g = interpolate(stations, f, cfg.Grid, cfg.Map.Bounds)
+	}
+	gridBuilds.Since(start, f.name)
+	gc.grids[f.name] = g
+	return g
+}
+
+func (gc *gridCache) get(key string) ([]byte, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	b, ok := gc.tiles[key]
+	return b, ok
+}
+
+func (gc *gridCache) put(key string, modTime time.Time, b []byte) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if !modTime.Equal(gc.modTime) {
+		return
+	}
+	if len(gc.tiles) >= maxCachedTiles {
+		gc.tiles = make(map[string][]byte)
+	}
+	gc.tiles[key] = b
+}
+
+// rampColor is the colour of v on the field's ramp.
+func (f *gridField) rampColor(v float64) color.RGBA {
+	r := f.ramp
+	if v <= r[0].v {
+		return r[0].col
+	}
+	for k := 1; k < len(r); k++ {
+		if v < r[k].v {
+			if f.steps {
+				return r[k-1].col
+			}
+			t := (v - r[k-1].v) / (r[k].v - r[k-1].v)
+			a, b := r[k-1].col, r[k].col
+			mix := func(x, y uint8) uint8 { return uint8(float64(x) + t*(float64(y)-float64(x)) + 0.5) }
+			return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+		}
+	}
+	return r[len(r)-1].col
+}
+
+// renderGridTile shades tile z/x/y. Latitude only changes down the tile and
+// longitude across it, so each is worked out once per row and column.
+func renderGridTile(g *grid, f *gridField, z, x, y int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	n := float64(tileSize) * math.Exp2(float64(z))
+	lngs := make([]float64, tileSize)
+	for px := range lngs {
+		lngs[px] = (float64(x*tileSize+px)+0.5)/n*360 - 180
+	}
+	for py := 0; py < tileSize; py++ {
+		my := math.Pi * (1 - 2*(float64(y*tileSize+py)+0.5)/n)
+		lat := math.Atan(math.Sinh(my)) * 180 / math.Pi
+		for px, lng := range lngs {
+			v := g.sample(lat, lng, f.steps)
+			if math.IsNaN(v) {
+				continue
+			}
+			c := f.rampColor(v)
+			a := uint32(c.A) * gridAlpha / 255
+			off := img.PixOffset(px, py)
+			img.Pix[off] = uint8(uint32(c.R) * a / 255)
+			img.Pix[off+1] = uint8(uint32(c.G) * a / 255)
+			img.Pix[off+2] = uint8(uint32(c.B) * a / 255)
+			img.Pix[off+3] = uint8(a)
+		}
+	}
+	return img
+}
+
+// gridJSON is /grid/{field}.json. Empty points are null.
+type gridJSON struct {
+	Field      string     `json:"field"`
+	Units      string     `json:"units,omitempty"`
+	LatMin     float64    `json:"lat_min"`
+	LngMin     float64    `json:"lng_min"`
+	Resolution float64    `json:"resolution"`
+	Rows       int        `json:"rows"`
+	Cols       int        `json:"cols"`
+	Values     []*float64 `json:"values"`
+	Updated    time.Time  `json:"updated"`
+}
+
+func fieldFromPath(w http.ResponseWriter, r *http.Request, name string) *gridField {
+	f := findGridField(name)
+	if f == nil {
+		http.Error(w, "unknown field", http.StatusNotFound)
+	}
+	return f
+}
+
+// gridHandler serves the grids, their contours and the shaded tiles.
+func gridHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/grid/{file}", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(r.PathValue("file"), ".json")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f := fieldFromPath(w, r, name)
+		if f == nil {
+			return
+		}
+		g, modTime, err := surfaceGrids.load(f)
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, "weather data is not available", http.StatusServiceUnavailable)
+			return
+		}
+		out := gridJSON{Field: f.name, Units: f.units, LatMin: g.Bounds.LatMin, LngMin: g.Bounds.LngMin,
+			Resolution: g.Res, Rows: g.NY, Cols: g.NX, Values: make([]*float64, len(g.V)), Updated: modTime.UTC()}
+		for k, v := range g.V {
+			if !math.IsNaN(v) {
+				v := math.Round(v*100) / 100
+				out.Values[k] = &v
+			}
+		}
+		writeGridJSON(w, r, out, "application/json", modTime)
+	})
+	mux.HandleFunc("/grid/{field}/contours.geojson", func(w http.ResponseWriter, r *http.Request) {
+		f := fieldFromPath(w, r, r.PathValue("field"))
+		if f == nil {
+			return
+		}
+		g, modTime, err := surfaceGrids.load(f)
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, "weather data is not available", http.StatusServiceUnavailable)
+			return
+		}
+		levels, err := contourLevels(g, f, r.FormValue("levels"), r.FormValue("interval"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeGridJSON(w, r, contourGeoJSON(g, f, levels), "application/geo+json", modTime)
+	})
+	mux.HandleFunc("/grid/{field}/{z}/{x}/{y}", func(w http.ResponseWriter, r *http.Request) {
+		f := fieldFromPath(w, r, r.PathValue("field"))
+		if f == nil {
+			return
+		}
+		z, x, y, ok := parseTilePath(r, ".png")
+		if !ok {
+			http.Error(w, "no such tile", http.StatusNotFound)
+			return
+		}
+		g, modTime, err := surfaceGrids.load(f)
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, "weather data is not available", http.StatusServiceUnavailable)
+			return
+		}
+		key := fmt.Sprintf("%s/%d/%d/%d", f.name, z, x, y)
+		body, ok := surfaceGrids.get(key)
+		if !ok {
+			var buf bytes.Buffer
+			enc := png.Encoder{CompressionLevel: png.BestSpeed}
+			if err := enc.Encode(&buf, renderGridTile(g, f, z, x, y)); err != nil {
+				logRequestError(r, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			body = buf.Bytes()
+			surfaceGrids.put(key, modTime, body)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%s"`, modTime.UnixNano(), key))
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		http.ServeContent(w, r, "", modTime.Truncate(time.Second), bytes.NewReader(body))
+	})
+	return mux
+}
+
+func writeGridJSON(w http.ResponseWriter, r *http.Request, v any, contentType string, modTime time.Time) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	http.ServeContent(w, r, "", modTime.Truncate(time.Second), bytes.NewReader(b))
+}
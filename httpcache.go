@@ -0,0 +1,169 @@
+//go:build !getwx && !websocket
+
+package main
+
+// Caching and compression for the map API. Every answer is worked out
+// from getwx's files, so the newest of their times is the data generation:
+// it is the ETag, and a client that already has it gets a 304 before any
+// work is done. max-age runs until getwx's next scheduled download, from
+// its status file. Bodies over a kilobyte are compressed with brotli or
+// gzip, whichever the client prefers.
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// defaultMaxAge is used when getwx's schedule is not known.
+	defaultMaxAge = 60 * time.Second
+	// compressMinSize is the smallest body worth compressing.
+	compressMinSize = 1024
+)
+
+// dataGeneration is the time of the newest file the map API reads, zero
+// when there are none.
+func dataGeneration() time.Time {
+	var gen time.Time
+	for _, name := range []string{cfg.Output.Weather, cfg.Output.Pireps, cfg.Output.Advisories,
+		cfg.Paths.Airports, cfg.Paths.Navaids, cfg.Paths.Runways, cfg.Paths.AirportDB} {
+		if name == "" {
+			continue
+		}
+		if st, err := os.Stat(cfg.Path(name)); err == nil && st.ModTime().After(gen) {
+			gen = st.ModTime()
+		}
+	}
+	return gen
+}
+
+func generationETag(gen time.Time) string {
+	// Weak, since the compressed and plain bodies are the same data.
+	return fmt.Sprintf(`W/"%x"`, gen.UnixNano())
+}
+
+// etagMatch reports whether an If-None-Match header lists etag, compared
+// weakly as RFC 9110 has it.
+func etagMatch(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// nextRefresh is how long until getwx downloads new weather, going by the
+// status file of getwx -daemon. ok is false without one.
+func nextRefresh() (wait time.Duration, ok bool) {
+	buf, err := os.ReadFile(cfg.Path(cfg.Scheduler.StatusFile))
+	if err != nil {
+		return 0, false
+	}
+	var jobs map[string]struct {
+		Running bool      `json:"running"`
+		NextRun time.Time `json:"next_run"`
+	}
+	if err := json.Unmarshal(buf, &jobs); err != nil {
+		return 0, false
+	}
+	var next time.Time
+	for _, s := range cfg.sources() {
+		j, found := jobs[s.Name]
+		if !found || !s.Enabled {
+			continue
+		}
+		if j.Running {
+			return 0, true
+		}
+		if next.IsZero() || j.NextRun.Before(next) {
+			next = j.NextRun
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	return max(time.Until(next), 0), true
+}
+
+// setCacheHeaders marks an answer as good until the next download.
+func setCacheHeaders(w http.ResponseWriter, etag string) {
+	maxAge, ok := nextRefresh()
+	if !ok {
+		maxAge = defaultMaxAge
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("Vary", "Accept-Encoding")
+}
+
+// contentEncoding picks the coding for an answer from Accept-Encoding:
+// br or gzip, whichever has the higher q, br when they tie, or "" for
+// neither. A coding with q=0 is refused, and * stands for any coding the
+// header does not name.
+func contentEncoding(r *http.Request) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		v := 1.0
+		if s, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				v = f
+			}
+		}
+		q[coding] = v
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"br", "gzip"} {
+		v, ok := q[coding]
+		if !ok {
+			v = q["*"]
+		}
+		if v > bestQ {
+			best, bestQ = coding, v
+		}
+	}
+	return best
+}
+
+// writeBody writes an answer, compressed when that is worth it.
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte) {
+	coding := ""
+	if len(body) >= compressMinSize {
+		coding = contentEncoding(r)
+	}
+	var zw io.WriteCloser
+	switch coding {
+	case "br":
+		zw = brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	case "gzip":
+		zw, _ = gzip.NewWriterLevel(w, gzip.BestSpeed)
+	default:
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Encoding", coding)
+	w.Header().Del("Content-Length")
+	zw.Write(body)
+	if err := zw.Close(); err != nil {
+		logRequestError(r, err)
+	}
+}
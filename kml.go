@@ -0,0 +1,384 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// KML and KMZ export of the current weather, for Google Earth and EFB apps
+// that import KMZ content packs. Stations are placemarks coloured by
+// flight category with the METAR and TAF as their description, PIREPs
+// sit at their reported altitude with an icon for the hazard, and
+// AIRMETs and SIGMETs are volumes between their altitude bands.
+// mapserver -export-kml weather.kmz writes a file; mapserver -serve has
+// /kml/weather.kml and /kml/weather.kmz, with ?bounds= to cut it down.
+// The icons are drawn here and go in the KMZ, or under files/ next to a
+// KML.
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kmlIconSize  = 32
+	feetToMeters = 0.3048
+)
+
+var kmlCategories = []string{"VFR", "MVFR", "IFR", "LIFR"}
+
+// pirepStyles colours the PIREP icons, which are drawn white so the
+// styles can tint them.
+var pirepStyles = map[string]color.RGBA{
+	"report":     {255, 255, 255, 255},
+	"turbulence": {255, 170, 0, 255},
+	"icing":      {80, 160, 255, 255},
+}
+
+var urgentColor = color.RGBA{255, 40, 40, 255}
+
+// advisoryColors colour the advisories by hazard; the rest are yellow.
+var advisoryColors = map[string]color.RGBA{
+	"CONVECTIVE": {255, 0, 0, 255},
+	"TURB":       {255, 140, 0, 255},
+	"ICE":        {0, 120, 255, 255},
+	"IFR":        {160, 0, 200, 255},
+	"MTN OBSCN":  {255, 100, 180, 255},
+	"ASH":        {120, 120, 120, 255},
+}
+
+var otherAdvisoryColor = color.RGBA{255, 220, 0, 255}
+
+// kmlColor is c in KML's aabbggrr order.
+func kmlColor(c color.RGBA, alpha uint8) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", alpha, c.B, c.G, c.R)
+}
+
+// pirepHazard sorts a PIREP by the icon it gets, and whether it is urgent
+// or reports something severe.
+func pirepHazard(report string) (hazard string, urgent bool) {
+	upper := strings.ToUpper(report)
+	switch {
+	case strings.Contains(upper, "/TB"):
+		hazard = "turbulence"
+	case strings.Contains(upper, "/IC"):
+		hazard = "icing"
+	default:
+		hazard = "report"
+	}
+	urgent = strings.Contains(" "+upper+" ", " UUA ") || strings.Contains(upper, "SEV")
+	return hazard, urgent
+}
+
+var kmlIcons = sync.OnceValue(func() map[string][]byte {
+	draw := func(f func(p painter)) []byte {
+		r := newRasterPainter(kmlIconSize, kmlIconSize, 1)
+		f(r)
+		var buf bytes.Buffer
+		png.Encode(&buf, r.img)
+		return buf.Bytes()
+	}
+	white := color.RGBA{255, 255, 255, 255}
+	outline := func(p painter, pts []pt) {
+		p.polygon(pts, white)
+		p.polyline(append(pts, pts[0]), 2, colorBlack)
+	}
+	return map[string][]byte{
+		"station.png": draw(func(p painter) { p.circle(pt{16, 16}, 11, white, 2, colorBlack) }),
+		"report.png":  draw(func(p painter) { outline(p, []pt{{16, 3}, {29, 16}, {16, 29}, {3, 16}}) }),
+		"turbulence.png": draw(func(p painter) {
+			outline(p, []pt{{3, 26}, {16, 5}, {29, 26}, {16, 19}})
+		}),
+		"icing.png": draw(func(p painter) {
+			var pts []pt
+			for k := 0; k < 6; k++ {
+				a := float64(k) * math.Pi / 3
+				pts = append(pts, pt{16 + 13*math.Sin(a), 16 - 13*math.Cos(a)})
+			}
+			outline(p, pts)
+		}),
+	}
+})
+
+// kmlWriter writes the document, escaping everything it is given.
+type kmlWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (k *kmlWriter) printf(format string, args ...any) {
+	if k.err == nil {
+		_, k.err = fmt.Fprintf(k.w, format, args...)
+	}
+}
+
+// writeKML writes the weather inside b as a KML document. Missing files
+// leave their folder empty.
+func writeKML(w io.Writer, b Bounds) error {
+	stations, err := ParseAirports(b.LngMin, b.LatMin, b.LngMax, b.LatMax)
+	if err != nil {
+		return err
+	}
+	pireps, err := parsePireps(b.LngMin, b.LatMin, b.LngMax, b.LatMax)
+	if err != nil {
+		slog.Warn("kml: reading PIREPs", "err", err)
+	}
+	advisories, _, err := readAdvisories()
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("kml: reading advisories", "err", err)
+	}
+
+	k := &kmlWriter{w: w}
+	k.printf("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<kml xmlns=\"http://www.opengis.net/kml/2.2\">\n<Document>\n")
+	k.printf("<name>%s</name>\n", xmlText(cfg.Map.Title))
+	k.printf("<description>%s</description>\n", xmlText("Weather as of "+time.Now().UTC().Format("2006-01-02 15:04Z")))
+	for _, cat := range append(kmlCategories, "unknown") {
+		c, ok := categoryColors[cat]
+		col := color.RGBA{200, 200, 200, 255}
+		if ok {
+			col = parseHexColor(c)
+		}
+		k.printf("<Style id=\"cat-%s\"><IconStyle><color>%s</color><scale>0.7</scale><Icon><href>files/station.png</href></Icon></IconStyle><LabelStyle><scale>0.7</scale></LabelStyle></Style>\n", cat, kmlColor(col, 255))
+	}
+	for _, hazard := range []string{"report", "turbulence", "icing"} {
+		col := pirepStyles[hazard]
+		k.printf("<Style id=\"pirep-%s\"><IconStyle><color>%s</color><Icon><href>files/%s.png</href></Icon></IconStyle><LabelStyle><scale>0</scale></LabelStyle></Style>\n", hazard, kmlColor(col, 255), hazard)
+		k.printf("<Style id=\"pirep-%s-urgent\"><IconStyle><color>%s</color><scale>1.2</scale><Icon><href>files/%s.png</href></Icon></IconStyle><LabelStyle><scale>0</scale></LabelStyle></Style>\n", hazard, kmlColor(urgentColor, 255), hazard)
+	}
+
+	k.printf("<Folder><name>Stations</name>\n")
+	for _, wx := range stations {
+		cat := wx.Cond
+		if _, ok := categoryColors[cat]; !ok {
+			cat = "unknown"
+		}
+		desc := "<b>" + htmlEscape(wx.Metar) + "</b>"
+		if taf := plainText(wx.TAF); taf != "" {
+			desc += "<br><br>" + htmlEscape(taf)
+		}
+		k.printf("<Placemark><name>%s</name><styleUrl>#cat-%s</styleUrl><description>%s</description><Point><coordinates>%s,%s</coordinates></Point></Placemark>\n",
+			xmlText(wx.ICAO), cat, xmlText(desc), xmlText(wx.Lng), xmlText(wx.Lat))
+	}
+	k.printf("</Folder>\n<Folder><name>PIREPs</name>\n")
+	for _, pr := range pireps {
+		hazard, urgent := pirepHazard(pr.Report)
+		style := "pirep-" + hazard
+		if urgent {
+			style += "-urgent"
+		}
+		alt := pirepAltitude(pr.Report)
+		point := fmt.Sprintf("<Point><coordinates>%s,%s</coordinates></Point>", xmlText(pr.Lng), xmlText(pr.Lat))
+		name := "PIREP"
+		if alt > 0 {
+			name = fmt.Sprintf("PIREP FL%03d", alt/100)
+			point = fmt.Sprintf("<Point><extrude>1</extrude><altitudeMode>absolute</altitudeMode><coordinates>%s,%s,%.0f</coordinates></Point>",
+				xmlText(pr.Lng), xmlText(pr.Lat), float64(alt)*feetToMeters)
+		}
+		k.printf("<Placemark><name>%s</name><styleUrl>#%s</styleUrl><description>%s</description>%s</Placemark>\n",
+			name, style, xmlText(htmlEscape(pr.Report)), point)
+	}
+	k.printf("</Folder>\n<Folder><name>Advisories</name>\n")
+	for _, a := range advisories {
+		if len(a.Points) < 3 || !advisoryInBounds(a, b) {
+			continue
+		}
+		col, ok := advisoryColors[a.Hazard]
+		if !ok {
+			col = otherAdvisoryColor
+		}
+		name := strings.TrimSpace(a.Hazard + " " + a.Type)
+		desc := htmlEscape(a.Raw)
+		if a.MinFt > 0 || a.MaxFt > 0 {
+			desc = fmt.Sprintf("%s to %s<br><br>%s", altitudeText(a.MinFt), altitudeText(a.MaxFt), desc)
+		}
+		k.printf("<Placemark><name>%s</name><description>%s</description>", xmlText(name), xmlText(desc))
+		if !a.ValidFrom.IsZero() && !a.ValidTo.IsZero() {
+			k.printf("<TimeSpan><begin>%s</begin><end>%s</end></TimeSpan>", a.ValidFrom.UTC().Format(time.RFC3339), a.ValidTo.UTC().Format(time.RFC3339))
+		}
+		k.printf("<Style><LineStyle><color>%s</color><width>2</width></LineStyle><PolyStyle><color>%s</color></PolyStyle></Style>",
+			kmlColor(col, 255), kmlColor(col, 90))
+		k.printf("%s</Placemark>\n", advisoryGeometry(a))
+	}
+	k.printf("</Folder>\n</Document>\n</kml>\n")
+	return k.err
+}
+
+func htmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// altitudeText is an altitude the way advisories give it: SFC, feet or
+// a flight level from 18000 ft.
+func altitudeText(ft int) string {
+	switch {
+	case ft <= 0:
+		return "SFC"
+	case ft >= 18000:
+		return fmt.Sprintf("FL%03d", ft/100)
+	}
+	return strconv.Itoa(ft) + " ft"
+}
+
+// advisoryInBounds reports whether a has a corner in b, or covers all of
+// it.
+func advisoryInBounds(a advisoryData, b Bounds) bool {
+	for _, p := range a.Points {
+		if inBoxDeg(p[0], p[1], b.LngMin, b.LatMin, b.LngMax, b.LatMax) {
+			return true
+		}
+	}
+	// An outline larger than the bounds has no point in them.
+	lng := (b.LngMin + b.LngMax) / 2
+	if b.LngMin > b.LngMax {
+		lng = wrapLng(lng + 180)
+	}
+	return polygonDistance(a.Points, (b.LatMin+b.LatMax)/2, lng) == 0
+}
+
+// advisoryGeometry is the advisory's outline: on the ground without an
+// altitude, extruded down from the top when it starts at the surface, and
+// otherwise a floor, a ceiling and the walls between them.
+func advisoryGeometry(a advisoryData) string {
+	ring := func(ft int) string {
+		var b strings.Builder
+		b.WriteString("<outerBoundaryIs><LinearRing><coordinates>")
+		for _, p := range a.Points {
+			fmt.Fprintf(&b, "%g,%g,%.0f ", p[1], p[0], float64(ft)*feetToMeters)
+		}
+		b.WriteString("</coordinates></LinearRing></outerBoundaryIs>")
+		return b.String()
+	}
+	switch {
+	case a.MaxFt <= 0:
+		return "<Polygon><tessellate>1</tessellate><altitudeMode>clampToGround</altitudeMode>" + ring(0) + "</Polygon>"
+	case a.MinFt <= 0:
+		return "<Polygon><extrude>1</extrude><altitudeMode>absolute</altitudeMode>" + ring(a.MaxFt) + "</Polygon>"
+	}
+	var b strings.Builder
+	b.WriteString("<MultiGeometry>")
+	for _, ft := range []int{a.MinFt, a.MaxFt} {
+		b.WriteString("<Polygon><altitudeMode>absolute</altitudeMode>" + ring(ft) + "</Polygon>")
+	}
+	lo, hi := float64(a.MinFt)*feetToMeters, float64(a.MaxFt)*feetToMeters
+	for i := 0; i+1 < len(a.Points); i++ {
+		p, q := a.Points[i], a.Points[i+1]
+		fmt.Fprintf(&b, "<Polygon><altitudeMode>absolute</altitudeMode><outerBoundaryIs><LinearRing><coordinates>%g,%g,%.0f %g,%g,%.0f %g,%g,%.0f %g,%g,%.0f %g,%g,%.0f</coordinates></LinearRing></outerBoundaryIs></Polygon>",
+			p[1], p[0], lo, q[1], q[0], lo, q[1], q[0], hi, p[1], p[0], hi, p[1], p[0], lo)
+	}
+	b.WriteString("</MultiGeometry>")
+	return b.String()
+}
+
+// writeKMZ writes the KML and its icons as a KMZ archive.
+func writeKMZ(w io.Writer, b Bounds) error {
+	zw := zip.NewWriter(w)
+	// Readers take the first .kml in the archive as the document.
+	f, err := zw.Create("doc.kml")
+	if err != nil {
+		return err
+	}
+	if err := writeKML(f, b); err != nil {
+		return err
+	}
+	for name, icon := range kmlIcons() {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: "files/" + name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(icon); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+var everywhere = Bounds{LngMin: -180, LatMin: -90, LngMax: 180, LatMax: 90}
+
+// exportKML writes the weather to fname, as a KMZ when it ends in .kmz
+// and otherwise as KML with the icons in files/ beside it.
+func exportKML(fname string) error {
+	var buf bytes.Buffer
+	if strings.EqualFold(filepath.Ext(fname), ".kmz") {
+		if err := writeKMZ(&buf, everywhere); err != nil {
+			return err
+		}
+		return writeFileAtomic(fname, buf.Bytes())
+	}
+	if err := writeKML(&buf, everywhere); err != nil {
+		return err
+	}
+	dir := filepath.Join(filepath.Dir(fname), "files")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, icon := range kmlIcons() {
+		if err := writeFileAtomic(filepath.Join(dir, name), icon); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(fname, buf.Bytes())
+}
+
+// kmlHandler serves /kml/weather.kml, /kml/weather.kmz and the icons the
+// KML refers to under /kml/files/.
+func kmlHandler() http.Handler {
+	mux := http.NewServeMux()
+	serve := func(kmz bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			b := everywhere
+			if s := r.FormValue("bounds"); s != "" {
+				v, err := parseViewBounds(s)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				b = v
+			}
+			var buf bytes.Buffer
+			var err error
+			typ, name := "application/vnd.google-earth.kml+xml", "weather.kml"
+			if kmz {
+				typ, name = "application/vnd.google-earth.kmz", "weather.kmz"
+				err = writeKMZ(&buf, b)
+			} else {
+				err = writeKML(&buf, b)
+			}
+			if err != nil {
+				logRequestError(r, err)
+				writeAPIError(w, http.StatusServiceUnavailable, "weather data is not available")
+				return
+			}
+			w.Header().Set("Content-Type", typ)
+			w.Header().Set("Content-Disposition", "attachment; filename="+name)
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			if kmz {
+				w.Write(buf.Bytes())
+				return
+			}
+			writeBody(w, r, buf.Bytes())
+		}
+	}
+	mux.HandleFunc("/kml/weather.kml", serve(false))
+	mux.HandleFunc("/kml/weather.kmz", serve(true))
+	mux.HandleFunc("/kml/files/{name}", func(w http.ResponseWriter, r *http.Request) {
+		icon, ok := kmlIcons()[r.PathValue("name")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(icon)
+	})
+	return mux
+}
@@ -0,0 +1,182 @@
+//go:build !getwx && !websocket
+
+package main
+
+// Level of detail for ?req=airports: with &zoom= the map page gets no more
+// stations than it can show without the labels running into each other.
+// The stations are ranked, towered airports first and then by size from
+// the airport database, and taken in that order up to map.max_stations
+// (or &max=, when that is fewer). Below map.thin_zoom a station is only
+// taken when it is map.station_spacing pixels from the ones already
+// taken, and below map.detail_zoom the stations come without the report
+// text, which the page loads when a popup is opened. Without &zoom or
+// &max the answer is every station in the bounds, as before.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const maxLODZoom = 22
+
+type lodQuery struct {
+	zoom int // -1 when not given
+	max  int // 0 for no limit
+}
+
+func parseLODQuery(zoom, max string) (lodQuery, error) {
+	q := lodQuery{zoom: -1}
+	if zoom != "" {
+		v, err := strconv.Atoi(zoom)
+		if err != nil || v < 0 || v > maxLODZoom {
+			return q, fmt.Errorf("zoom must be between 0 and %d", maxLODZoom)
+		}
+		q.zoom, q.max = v, cfg.Map.MaxStations
+	}
+	if max != "" {
+		v, err := strconv.Atoi(max)
+		if err != nil || v < 1 || v > cfg.Map.MaxStations {
+			return q, fmt.Errorf("max must be between 1 and %d", cfg.Map.MaxStations)
+		}
+		q.max = v
+	}
+	return q, nil
+}
+
+// stationSummary is the part of a station the map draws; the rest is only
+// in the popup.
+type stationSummary struct {
+	Lng            string
+	Lat            string
+	ICAO           string
+	WindDir        string
+	WindBarb       string
+	WindSpeed      string
+	WindGust       string
+	Cond           string
+	CondColor      string
+	Precip         string
+	Temperature    string
+	Lightning      string
+	DensityAltHigh bool `json:",omitempty"`
+}
+
+func summarize(wx weatherData) stationSummary {
+	return stationSummary{
+		Lng: wx.Lng, Lat: wx.Lat, ICAO: wx.ICAO,
+		WindDir: wx.WindDir, WindBarb: wx.WindBarb, WindSpeed: wx.WindSpeed, WindGust: wx.WindGust,
+		Cond: wx.Cond, CondColor: wx.CondColor, Precip: wx.Precip,
+		Temperature: wx.Temperature, Lightning: wx.Lightning,
+		DensityAltHigh: wx.DensityAltHigh,
+	}
+}
+
+// stationsInView answers req=airports for the bounds and q.
+func stationsInView(b Bounds, q lodQuery) (any, error) {
+	list, err := ParseAirports(b.LngMin, b.LatMin, b.LngMax, b.LatMax)
+	if err != nil || (q.zoom < 0 && q.max == 0) {
+		return list, err
+	}
+	list = thinStations(list, q)
+	if q.zoom < 0 || q.zoom >= cfg.Map.DetailZoom {
+		return list, nil
+	}
+	out := make([]stationSummary, len(list))
+	for i, wx := range list {
+		out[i] = summarize(wx)
+	}
+	return out, nil
+}
+
+// airportSizes ranks the airport types, OurAirports' and NASR's; the
+// types not listed come after.
+var airportSizes = map[string]int{
+	"large_airport":  0,
+	"medium_airport": 1,
+	"small_airport":  2,
+	"airport":        2,
+}
+
+// thinStations keeps the stations worth showing at q.zoom, best first.
+func thinStations(list []weatherData, q lodQuery) []weatherData {
+	db, err := readAirportDB()
+	if err != nil {
+		// Without the database the stations are only spaced out.
+		slog.Warn("reading airport database", "file", cfg.Path(cfg.Paths.AirportDB), "err", err)
+	}
+	type ranked struct {
+		wx      weatherData
+		towered bool
+		size    int
+		// key orders stations of the same rank the same way every time
+		// without favouring any part of the alphabet.
+		key uint32
+	}
+	rs := make([]ranked, len(list))
+	for i, wx := range list {
+		r := ranked{wx: wx, size: len(airportSizes)}
+		if a := db.find(wx.ICAO); a != nil {
+			r.towered = a.Towered
+			if s, ok := airportSizes[a.Type]; ok {
+				r.size = s
+			}
+		}
+		h := fnv.New32a()
+		h.Write([]byte(wx.ICAO))
+		r.key = h.Sum32()
+		rs[i] = r
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		a, b := rs[i], rs[j]
+		if a.towered != b.towered {
+			return a.towered
+		}
+		if a.size != b.size {
+			return a.size < b.size
+		}
+		return a.key < b.key
+	})
+
+	spacing := cfg.Map.StationSpacing
+	thin := q.zoom >= 0 && q.zoom < cfg.Map.ThinZoom && spacing > 0
+	// The stations taken, by spacing sized cell, so each one only has to
+	// be checked against its neighbours.
+	type cell struct{ x, y int }
+	taken := map[cell][][2]float64{}
+	out := []weatherData{}
+	for _, r := range rs {
+		if q.max > 0 && len(out) >= q.max {
+			break
+		}
+		if thin {
+			lat, err1 := strconv.ParseFloat(r.wx.Lat, 64)
+			lng, err2 := strconv.ParseFloat(r.wx.Lng, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			x, y := worldPixel(lat, lng, q.zoom)
+			c := cell{int(math.Floor(x / spacing)), int(math.Floor(y / spacing))}
+			near := false
+			for dx := -1; dx <= 1 && !near; dx++ {
+				for dy := -1; dy <= 1 && !near; dy++ {
+					for _, p := range taken[cell{c.x + dx, c.y + dy}] {
+						if math.Hypot(p[0]-x, p[1]-y) < spacing {
+							near = true
+							break
+						}
+					}
+				}
+			}
+			if near {
+				continue
+			}
+			taken[c] = append(taken[c], [2]float64{x, y})
+		}
+		out = append(out, r.wx)
+	}
+	return out
+}
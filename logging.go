@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the slog default logger for the [log] section.
+// Everything goes to stderr; for the CGI that is the web server error log.
+func setupLogging(c LogConfig) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if strings.EqualFold(c.Format, "json") {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// fatal logs err and exits, for errors at startup.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(2)
+}
+
+// logRequestError logs a failure while answering an HTTP request.
+func logRequestError(r *http.Request, err error) {
+	slog.Error("request failed", "method", r.Method, "url", r.URL.String(), "err", err)
+}
+
+func validateLogConfig(c LogConfig) []error {
+	var errs []error
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level %q must be debug, info, warn or error", c.Level))
+	}
+	if f := strings.ToLower(c.Format); f != "text" && f != "json" {
+		errs = append(errs, fmt.Errorf("log.format %q must be text or json", c.Format))
+	}
+	return errs
+}
@@ -0,0 +1,409 @@
+//go:build !getwx && !websocket
+
+package main
+
+// The map API: stations and PIREPs inside the visible bounds, read from the
+// files getwx writes. It is served by the CGI (cgipart) and by mapserver
+// -serve, which keeps it running in one process.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type pirepData struct {
+	Report string
+	Lng    string
+	Lat    string
+}
+
+type weatherData struct {
+	Lng         string
+	Lat         string
+	ICAO        string
+	WindDir     string
+	WindBarb    string
+	WindSpeed   string
+	WindGust    string
+	Metar       string
+	Cond        string
+	CondColor   string
+	Precip      string
+	Temperature string
+	TAF         string
+	UpWinds     string
+	Lightning   string
+	Elevation   string
+	PressureAlt string
+	DensityAlt  string
+
+	// Filled in by ParseAirports from paths.runways.
+	Runways           []runwayWind `json:",omitempty"`
+	FavoredRunway     string       `json:",omitempty"`
+	CrosswindExceeded bool         `json:",omitempty"`
+	DensityAltHigh    bool         `json:",omitempty"`
+}
+
+var (
+	apiDuration = newHistogram("mapapi_request_duration_seconds", "Map API request latency, by request type and status code.", defaultBuckets, "req", "code")
+	_           = newGaugeFunc("mapapi_weather_age_seconds", "Age of the weather file the map API serves.", func() float64 {
+		st, err := os.Stat(cfg.Path(cfg.Output.Weather))
+		if err != nil {
+			return math.NaN()
+		}
+		return time.Since(st.ModTime()).Seconds()
+	})
+)
+
+// readJSONFile decodes one of getwx's output files. The files end with an
+// empty {} entry; it has no coordinates, so the bounds filters drop it.
+func readJSONFile(fname string, v any) error {
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// inBox reports whether the text coordinates lie strictly inside the box,
+// which crosses the antimeridian when Lng1 is east of Lng2.
+func inBox(lat, lng string, Lng1, Lat1, Lng2, Lat2 float64) bool {
+	Lng, err1 := strconv.ParseFloat(lng, 64)
+	Lat, err2 := strconv.ParseFloat(lat, 64)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return inBoxDeg(Lat, Lng, Lng1, Lat1, Lng2, Lat2)
+}
+
+// inBoxDeg is inBox for a position already in degrees.
+func inBoxDeg(Lat, Lng float64, Lng1, Lat1, Lng2, Lat2 float64) bool {
+	inLng := Lng > Lng1 && Lng < Lng2
+	if Lng1 > Lng2 {
+		inLng = Lng > Lng1 || Lng < Lng2
+	}
+	return inLng && (Lat > Lat1 && Lat < Lat2)
+}
+
+func parsePireps(Lng1 float64, Lat1 float64, Lng2 float64, Lat2 float64) ([]pirepData, error) {
+	var all []pirepData
+	if err := readJSONFile(cfg.Path(cfg.Output.Pireps), &all); err != nil {
+		return nil, err
+	}
+	prList := []pirepData{}
+	for _, pr := range all {
+		if inBox(pr.Lat, pr.Lng, Lng1, Lat1, Lng2, Lat2) {
+			prList = append(prList, pr)
+		}
+	}
+	return prList, nil
+}
+
+// readWeatherData reads weather.txt and reports when it was written.
+func readWeatherData() ([]weatherData, time.Time, error) {
+	fname := cfg.Path(cfg.Output.Weather)
+	st, err := os.Stat(fname)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var all []weatherData
+	if err := readJSONFile(fname, &all); err != nil {
+		return nil, time.Time{}, err
+	}
+	return all, st.ModTime(), nil
+}
+
+func ParseAirports(Lng1 float64, Lat1 float64, Lng2 float64, Lat2 float64) ([]weatherData, error) {
+	all, _, err := readWeatherData()
+	if err != nil {
+		return nil, err
+	}
+	runways, err := readRunways()
+	if err != nil {
+		// The weather is still worth having without the runway winds.
+		slog.Warn("reading runways", "file", cfg.Path(cfg.Paths.Runways), "err", err)
+	}
+	apList := []weatherData{}
+	for _, wx := range all {
+		if inBox(wx.Lat, wx.Lng, Lng1, Lat1, Lng2, Lat2) {
+			if ends := stationRunways(runways, wx.ICAO); ends != nil {
+				addRunwayWinds(&wx, ends)
+			}
+			wx.DensityAltHigh = densityAltHigh(wx)
+			apList = append(apList, wx)
+		}
+	}
+	return apList, nil
+}
+
+// addRunwayWinds fills in the runway fields of wx from its METAR wind.
+func addRunwayWinds(wx *weatherData, ends []runwayEnd) {
+	obs := parseMetarText(wx.Metar)
+	winds, fav := runwayWinds(ends, obs.WindDir, obs.WindSpeed, obs.WindGust)
+	wx.Runways = winds
+	if fav != nil {
+		wx.FavoredRunway = fav.Runway
+		limit := cfg.Map.CrosswindLimit
+		wx.CrosswindExceeded = limit > 0 && float64(fav.maxCrosswind()) > limit
+	}
+}
+
+// densityAltHigh tells whether wx is at or over map.density_altitude_alert.
+func densityAltHigh(wx weatherData) bool {
+	da, err := strconv.ParseFloat(wx.DensityAlt, 64)
+	return err == nil && cfg.Map.DensityAltitudeAlert > 0 && da >= cfg.Map.DensityAltitudeAlert
+}
+
+type densityAltData struct {
+	ICAO          string  `json:"icao"`
+	Lat           float64 `json:"lat"`
+	Lng           float64 `json:"lng"`
+	ElevationFt   int     `json:"elevation_ft"`
+	PressureAltFt int     `json:"pressure_altitude_ft"`
+	DensityAltFt  int     `json:"density_altitude_ft"`
+	// AboveFieldFt is how much higher the field performs than it is.
+	AboveFieldFt int  `json:"above_field_ft"`
+	Alert        bool `json:"alert"`
+}
+
+// parseDensityAlt lists the stations in the box that have a density
+// altitude, highest first.
+func parseDensityAlt(Lng1 float64, Lat1 float64, Lng2 float64, Lat2 float64) ([]densityAltData, error) {
+	all, _, err := readWeatherData()
+	if err != nil {
+		return nil, err
+	}
+	list := []densityAltData{}
+	for _, wx := range all {
+		if wx.DensityAlt == "" || !inBox(wx.Lat, wx.Lng, Lng1, Lat1, Lng2, Lat2) {
+			continue
+		}
+		lat, _ := strconv.ParseFloat(wx.Lat, 64)
+		lng, _ := strconv.ParseFloat(wx.Lng, 64)
+		elev, _ := strconv.Atoi(wx.Elevation)
+		pa, _ := strconv.Atoi(wx.PressureAlt)
+		da, _ := strconv.Atoi(wx.DensityAlt)
+		list = append(list, densityAltData{
+			ICAO:          wx.ICAO,
+			Lat:           lat,
+			Lng:           lng,
+			ElevationFt:   elev,
+			PressureAltFt: pa,
+			DensityAltFt:  da,
+			AboveFieldFt:  da - elev,
+			Alert:         densityAltHigh(wx),
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].DensityAltFt > list[j].DensityAltFt })
+	return list, nil
+}
+
+// findStation looks a station up by any of its identifiers, see
+// airportIndex.aliases.
+func findStation(all []weatherData, icao string) (weatherData, bool) {
+	db, _ := readAirportDB()
+	ids := db.aliases(icao)
+	for _, wx := range all {
+		for _, id := range ids {
+			if wx.ICAO == id {
+				return wx, true
+			}
+		}
+	}
+	return weatherData{}, false
+}
+
+type airportNotFound struct {
+	id   string
+	noDB bool
+}
+
+func (e *airportNotFound) Error() string {
+	if e.noDB {
+		return "there is no airport database, see getwx -import-airports"
+	}
+	return "unknown airport " + e.id
+}
+
+// airportDetail answers req=airport: the airport database entry with the
+// runways and, when the airport reports, its weather.
+type airportDetail struct {
+	airportInfo
+	Runways []runwayEnd  `json:"runways,omitempty"`
+	Weather *weatherData `json:"weather,omitempty"`
+}
+
+func parseAirport(id string) (*airportDetail, error) {
+	db, err := readAirportDB()
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, &airportNotFound{id: id, noDB: true}
+	}
+	a := db.find(id)
+	if a == nil {
+		return nil, &airportNotFound{id: id}
+	}
+	out := &airportDetail{airportInfo: *a}
+	runways, err := readRunways()
+	if err != nil {
+		return nil, err
+	}
+	out.Runways = stationRunways(runways, a.Ident)
+	all, _, err := readWeatherData()
+	if err != nil {
+		return nil, err
+	}
+	if wx, ok := findStation(all, a.Ident); ok {
+		if out.Runways != nil {
+			addRunwayWinds(&wx, out.Runways)
+		}
+		wx.DensityAltHigh = densityAltHigh(wx)
+		out.Weather = &wx
+	}
+	return out, nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// mapAPIHandler answers ?req=airports&bounds=... (thinned with &zoom= and
+// &max=, lod.go), ?req=pireps&bounds=...,
+// ?req=densityalt&bounds=..., ?req=airport&id=..., ?req=nearestwx&id=...
+// (nearest.go), ?req=route&route=... (route.go) and ?req=plan&route=...
+// (plan.go).
+func mapAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		req := r.FormValue("req")
+		// A CGI has no server to catch a panic; answer 500 instead of
+		// dying without a response.
+		defer func() {
+			if v := recover(); v != nil {
+				logRequestError(r, fmt.Errorf("panic: %v", v))
+				writeAPIError(rec, http.StatusInternalServerError, "internal error")
+				apiDuration.Since(start, "other", strconv.Itoa(rec.code))
+			}
+		}()
+		serveMapAPI(rec, req, r)
+		if !slices.Contains(mapAPIRequests, req) {
+			req = "other"
+		}
+		apiDuration.Since(start, req, strconv.Itoa(rec.code))
+	})
+}
+
+func serveMapAPI(w http.ResponseWriter, req string, r *http.Request) {
+	if aerr := checkAPIRequest(r, req); aerr != nil {
+		if aerr.Status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "GET, HEAD")
+		}
+		writeAPIError(w, aerr.Status, aerr.Message)
+		return
+	}
+	// The parameters are checked before the ETag, so a bad request is
+	// refused even when the data has not changed.
+	var answer func() (any, error)
+	switch req {
+	case "airports", "pireps", "densityalt":
+		b, berr := parseViewBounds(r.FormValue("bounds"))
+		if berr != nil {
+			writeAPIError(w, http.StatusBadRequest, berr.Error())
+			return
+		}
+		switch req {
+		case "airports":
+			q, qerr := parseLODQuery(r.FormValue("zoom"), r.FormValue("max"))
+			if qerr != nil {
+				writeAPIError(w, http.StatusBadRequest, qerr.Error())
+				return
+			}
+			answer = func() (any, error) { return stationsInView(b, q) }
+		case "pireps":
+			answer = func() (any, error) { return parsePireps(b.LngMin, b.LatMin, b.LngMax, b.LatMax) }
+		default:
+			answer = func() (any, error) { return parseDensityAlt(b.LngMin, b.LatMin, b.LngMax, b.LatMax) }
+		}
+	case "airport":
+		id := r.FormValue("id")
+		if id == "" {
+			writeAPIError(w, http.StatusBadRequest, "id is required")
+			return
+		}
+		answer = func() (any, error) { return parseAirport(id) }
+	case "nearestwx":
+		q, qerr := parseNearestQuery(r.FormValue("id"), r.FormValue("lat"), r.FormValue("lng"), r.FormValue("n"))
+		if qerr != nil {
+			writeAPIError(w, http.StatusBadRequest, qerr.Error())
+			return
+		}
+		answer = func() (any, error) { return nearestWeather(q) }
+	case "route":
+		q, qerr := parseRouteQuery(r.FormValue("route"), r.FormValue("width"), r.FormValue("altitude"))
+		if qerr != nil {
+			writeAPIError(w, http.StatusBadRequest, qerr.Error())
+			return
+		}
+		answer = func() (any, error) { return briefRoute(q) }
+	case "plan":
+		q, qerr := parsePlanQuery(r.FormValue("route"), r.FormValue("altitude"), r.FormValue("tas"), r.FormValue("burn"), r.FormValue("max_altitude"))
+		if qerr != nil {
+			writeAPIError(w, http.StatusBadRequest, qerr.Error())
+			return
+		}
+		answer = func() (any, error) { return planRoute(q) }
+	}
+	gen := dataGeneration()
+	etag := generationETag(gen)
+	if !gen.IsZero() && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		setCacheHeaders(w, etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := answer()
+	var werr *waypointError
+	var perr *planError
+	if errors.As(err, &werr) || errors.As(err, &perr) {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var aerr *airportNotFound
+	if errors.As(err, &aerr) {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		logRequestError(r, err)
+		writeAPIError(w, http.StatusServiceUnavailable, "weather data is not available")
+		return
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		logRequestError(r, err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !gen.IsZero() {
+		setCacheHeaders(w, etag)
+	}
+	writeBody(w, r, b)
+}
@@ -0,0 +1,176 @@
+//go:build !websocket
+
+package main
+
+// Decoding of the raw METAR text that weather.txt carries for each station,
+// for the parts of the report the station model plots, and the flight
+// category they add up to.
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// metarObs is what a METAR says about one observation. Missing numbers are
+// NaN and missing strings empty.
+type metarObs struct {
+	WindDir   float64 // degrees true the wind is from, NaN for variable
+	WindSpeed float64 // knots
+	WindGust  float64 // knots
+	VisSM     float64 // statute miles
+	VisText   string  // visibility as reported, e.g. "1 1/2" or "M1/4"
+	Cover     string  // most cover reported: CLR, FEW, SCT, BKN, OVC or VV
+	Ceiling   float64 // feet AGL of the lowest BKN, OVC or VV layer
+	Weather   []string
+	TempC     float64
+	DewC      float64
+	AltimHg   float64 // inches of mercury
+}
+
+var (
+	metarWindRe = regexp.MustCompile(`^(\d{3}|VRB)(\d{2,3})(?:G(\d{2,3}))?(KT|MPS)$`)
+	metarVisRe  = regexp.MustCompile(`^(M|P)?(?:(\d+)|(\d+)/(\d+))SM$`)
+	metarSkyRe  = regexp.MustCompile(`^(FEW|SCT|BKN|OVC|VV)(\d{3}|///)`)
+	metarTempRe = regexp.MustCompile(`^(M?\d{2})/(M?\d{2})?$`)
+	metarAltRe  = regexp.MustCompile(`^([AQ])(\d{4})$`)
+	metarWxRe   = regexp.MustCompile(`^(\+|-|VC)?(MI|PR|BC|DR|BL|SH|TS|FZ)?((?:DZ|RA|SN|SG|IC|PL|GR|GS|UP|BR|FG|FU|VA|DU|SA|HZ|PY|PO|SQ|FC|SS|DS)*)$`)
+)
+
+var coverRank = map[string]int{"CLR": 0, "SKC": 0, "FEW": 1, "SCT": 2, "BKN": 3, "OVC": 4, "VV": 5}
+
+// parseMetarText decodes a raw METAR. The station and time groups are
+// skipped and decoding stops at RMK.
+func parseMetarText(metar string) metarObs {
+	nan := math.NaN()
+	obs := metarObs{WindDir: nan, WindSpeed: nan, WindGust: nan, VisSM: nan, Ceiling: nan, TempC: nan, DewC: nan, AltimHg: nan}
+	words := strings.Fields(strings.ReplaceAll(metar, "<br>", " "))
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w == "RMK" {
+			break
+		}
+		if m := metarWindRe.FindStringSubmatch(w); m != nil {
+			if m[1] != "VRB" {
+				obs.WindDir, _ = strconv.ParseFloat(m[1], 64)
+			}
+			obs.WindSpeed, _ = strconv.ParseFloat(m[2], 64)
+			if m[3] != "" {
+				obs.WindGust, _ = strconv.ParseFloat(m[3], 64)
+			}
+			if m[4] == "MPS" {
+				obs.WindSpeed *= 1.94384
+				obs.WindGust *= 1.94384
+			}
+			continue
+		}
+		// Whole miles and a fraction are two words: "1 1/2SM".
+		if n, err := strconv.Atoi(w); err == nil && i+1 < len(words) && strings.HasSuffix(words[i+1], "SM") {
+			if m := metarVisRe.FindStringSubmatch(words[i+1]); m != nil && m[3] != "" {
+				num, _ := strconv.ParseFloat(m[3], 64)
+				den, _ := strconv.ParseFloat(m[4], 64)
+				if den > 0 {
+					obs.VisSM = float64(n) + num/den
+					obs.VisText = w + " " + strings.TrimSuffix(words[i+1], "SM")
+					i++
+					continue
+				}
+			}
+		}
+		if m := metarVisRe.FindStringSubmatch(w); m != nil {
+			if m[2] != "" {
+				obs.VisSM, _ = strconv.ParseFloat(m[2], 64)
+			} else {
+				num, _ := strconv.ParseFloat(m[3], 64)
+				den, _ := strconv.ParseFloat(m[4], 64)
+				if den > 0 {
+					obs.VisSM = num / den
+				}
+			}
+			obs.VisText = strings.TrimSuffix(w, "SM")
+			continue
+		}
+		if w == "CLR" || w == "SKC" || w == "CAVOK" {
+			if obs.Cover == "" {
+				obs.Cover = "CLR"
+			}
+			continue
+		}
+		if m := metarSkyRe.FindStringSubmatch(w); m != nil {
+			if coverRank[m[1]] > coverRank[obs.Cover] || obs.Cover == "" {
+				obs.Cover = m[1]
+			}
+			if h, err := strconv.ParseFloat(m[2], 64); err == nil && coverRank[m[1]] >= 3 && math.IsNaN(obs.Ceiling) {
+				obs.Ceiling = h * 100
+			}
+			continue
+		}
+		if m := metarTempRe.FindStringSubmatch(w); m != nil {
+			obs.TempC = metarTemp(m[1])
+			if m[2] != "" {
+				obs.DewC = metarTemp(m[2])
+			}
+			continue
+		}
+		if m := metarAltRe.FindStringSubmatch(w); m != nil {
+			v, _ := strconv.ParseFloat(m[2], 64)
+			if m[1] == "A" {
+				obs.AltimHg = v / 100
+			} else {
+				obs.AltimHg = v * 0.0295300
+			}
+			continue
+		}
+		if m := metarWxRe.FindStringSubmatch(w); m != nil && i > 0 && (m[2] != "" || m[3] != "") {
+			obs.Weather = append(obs.Weather, w)
+		}
+	}
+	return obs
+}
+
+// metarTemp reads a METAR temperature such as 18 or M03.
+func metarTemp(s string) float64 {
+	neg := strings.HasPrefix(s, "M")
+	v, err := strconv.ParseFloat(strings.TrimPrefix(s, "M"), 64)
+	if err != nil {
+		return math.NaN()
+	}
+	if neg {
+		return -v
+	}
+	return v
+}
+
+func cToF(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// unlimitedCeiling is what a station reporting no ceiling counts as, so
+// clear skies pull the interpolated ceiling up rather than being ignored.
+const unlimitedCeiling = 12000
+
+// Flight categories as numbers, worst first, so that the category grid can
+// be contoured and shaded like the others.
+const (
+	catLIFR = iota
+	catIFR
+	catMVFR
+	catVFR
+)
+
+var categoryNames = [...]string{catLIFR: "LIFR", catIFR: "IFR", catMVFR: "MVFR", catVFR: "VFR"}
+
+func flightCategory(ceiling, vis float64) float64 {
+	switch {
+	case math.IsNaN(ceiling) || math.IsNaN(vis):
+		return math.NaN()
+	case ceiling < 500 || vis < 1:
+		return catLIFR
+	case ceiling < 1000 || vis < 3:
+		return catIFR
+	case ceiling <= 3000 || vis <= 5:
+		return catMVFR
+	}
+	return catVFR
+}
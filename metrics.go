@@ -0,0 +1,232 @@
+package main
+
+// A minimal Prometheus text-format registry, enough for the counters,
+// gauges and histograms the long-running programs export on /metrics.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+type metric struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+
+	mu      sync.Mutex
+	series  map[string]*series
+	collect func(m *metric)
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+var metrics = &metricsRegistry{}
+
+// defaultBuckets suit downloads and API requests: 5ms up to a minute.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+func (r *metricsRegistry) register(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m.series = make(map[string]*series)
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return metrics.register(&metric{name: name, help: help, kind: kindCounter, labels: labels})
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return metrics.register(&metric{name: name, help: help, kind: kindGauge, labels: labels})
+}
+
+// newGaugeFunc is a gauge computed at scrape time, such as the age of a file.
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return newGauge(name, help).onScrape(func(m *metric) { m.Set(fn()) })
+}
+
+// onScrape sets a function that refreshes the metric's values just before
+// they are written out.
+func (m *metric) onScrape(collect func(m *metric)) *metric {
+	m.collect = collect
+	return m
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return metrics.register(&metric{name: name, help: help, kind: kindHistogram, labels: labels, buckets: buckets})
+}
+
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), values...)}
+		if m.kind == kindHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+func (m *metric) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Since observes the seconds elapsed since start.
+func (m *metric) Since(start time.Time, labelValues ...string) {
+	m.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (r *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	list := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range list {
+		if m.collect != nil {
+			m.collect(m)
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		m.mu.Lock()
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := m.series[k]
+			labels := formatLabels(m.labels, s.labelValues)
+			if m.kind != kindHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", m.name, labels, formatMetricValue(s.value))
+				continue
+			}
+			names := append(append([]string(nil), m.labels...), "le")
+			for i, bound := range m.buckets {
+				le := formatLabels(names, append(append([]string(nil), s.labelValues...), formatMetricValue(bound)))
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, le, s.counts[i])
+			}
+			inf := formatLabels(names, append(append([]string(nil), s.labelValues...), "+Inf"))
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, inf, s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", m.name, labels, formatMetricValue(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", m.name, labels, s.count)
+		}
+		m.mu.Unlock()
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		parts[i] = n + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(w)
+	})
+}
+
+// serveMetrics exposes /metrics on addr until ctx is cancelled. An empty
+// addr turns it off.
+func serveMetrics(ctx context.Context, addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	go func() {
+		slog.Info("serving metrics", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,582 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// Vector tiles: stations, PIREPs and AIRMET/SIGMET outlines as Mapbox
+// Vector Tiles (version 2) at /vt/{z}/{x}/{y}.pbf, for clients such as
+// MapLibre that style and filter the weather themselves. Points outside a
+// tile's buffer are left out; advisory outlines are clipped to the buffer
+// and simplified to about a pixel at the tile's zoom. Tiles are cached until
+// one of the data files changes.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	mvtExtent = 4096
+	// mvtBuffer is how far past the tile edge, in tile units, features are
+	// kept so symbols and outlines do not stop short at tile boundaries.
+	mvtBuffer = 256
+	// mvtTolerance is the simplification tolerance in tile units, one pixel
+	// of a 256px tile.
+	mvtTolerance = mvtExtent / tileSize
+	// mvtDetailZoom is the zoom from which stations carry their METAR.
+	mvtDetailZoom = 9
+)
+
+var (
+	vtRenders  = newHistogram("vt_render_duration_seconds", "Time taken to encode a vector tile.", defaultBuckets)
+	vtRequests = newCounter("vt_requests_total", "Vector tile requests, by whether the tile was cached.", "cache")
+)
+
+// Protocol buffer encoding, just the parts vector_tile.proto needs.
+
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+)
+
+type pbWriter struct {
+	b []byte
+}
+
+func (w *pbWriter) varint(v uint64) {
+	w.b = binary.AppendUvarint(w.b, v)
+}
+
+func (w *pbWriter) key(field, wire int) {
+	w.varint(uint64(field<<3 | wire))
+}
+
+func (w *pbWriter) uint(field int, v uint64) {
+	w.key(field, pbVarint)
+	w.varint(v)
+}
+
+func (w *pbWriter) sint(field int, v int64) {
+	w.key(field, pbVarint)
+	w.varint(zigzag(v))
+}
+
+func (w *pbWriter) bool(field int, v bool) {
+	var n uint64
+	if v {
+		n = 1
+	}
+	w.uint(field, n)
+}
+
+func (w *pbWriter) double(field int, v float64) {
+	w.key(field, pbFixed64)
+	w.b = binary.LittleEndian.AppendUint64(w.b, math.Float64bits(v))
+}
+
+func (w *pbWriter) bytes(field int, b []byte) {
+	w.key(field, pbBytes)
+	w.varint(uint64(len(b)))
+	w.b = append(w.b, b...)
+}
+
+func (w *pbWriter) string(field int, s string) {
+	w.bytes(field, []byte(s))
+}
+
+func (w *pbWriter) packed(field int, vs []uint32) {
+	var p pbWriter
+	for _, v := range vs {
+		p.varint(uint64(v))
+	}
+	w.bytes(field, p.b)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+// Geometry types and commands from the vector tile spec.
+const (
+	mvtPoint   = 1
+	mvtPolygon = 3
+
+	mvtMoveTo    = 1
+	mvtLineTo    = 2
+	mvtClosePath = 7
+)
+
+func mvtCommand(id, count int) uint32 {
+	return uint32(id&7 | count<<3)
+}
+
+// mvtProp is one feature attribute. Values are strings, ints, float64s or
+// bools.
+type mvtProp struct {
+	key string
+	val any
+}
+
+// mvtLayer collects features and the shared key and value tables.
+type mvtLayer struct {
+	name     string
+	keys     []string
+	keyIdx   map[string]int
+	values   []any
+	valIdx   map[any]int
+	features [][]byte
+}
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{name: name, keyIdx: make(map[string]int), valIdx: make(map[any]int)}
+}
+
+func (l *mvtLayer) add(typ int, geom []uint32, props []mvtProp) {
+	var tags []uint32
+	for _, p := range props {
+		k, ok := l.keyIdx[p.key]
+		if !ok {
+			k = len(l.keys)
+			l.keys = append(l.keys, p.key)
+			l.keyIdx[p.key] = k
+		}
+		v, ok := l.valIdx[p.val]
+		if !ok {
+			v = len(l.values)
+			l.values = append(l.values, p.val)
+			l.valIdx[p.val] = v
+		}
+		tags = append(tags, uint32(k), uint32(v))
+	}
+	var f pbWriter
+	if len(tags) > 0 {
+		f.packed(2, tags)
+	}
+	f.uint(3, uint64(typ))
+	f.packed(4, geom)
+	l.features = append(l.features, f.b)
+}
+
+func (l *mvtLayer) encode(tile *pbWriter) {
+	if len(l.features) == 0 {
+		return
+	}
+	var w pbWriter
+	w.uint(15, 2)
+	w.string(1, l.name)
+	for _, f := range l.features {
+		w.bytes(2, f)
+	}
+	for _, k := range l.keys {
+		w.string(3, k)
+	}
+	for _, v := range l.values {
+		var vw pbWriter
+		switch v := v.(type) {
+		case string:
+			vw.string(1, v)
+		case float64:
+			vw.double(3, v)
+		case int:
+			vw.sint(6, int64(v))
+		case bool:
+			vw.bool(7, v)
+		}
+		w.bytes(4, vw.b)
+	}
+	w.uint(5, mvtExtent)
+	tile.bytes(3, w.b)
+}
+
+// mvtTile maps lat/lng to the coordinates of one tile.
+type mvtTile struct {
+	z, x, y int
+}
+
+func (t mvtTile) project(lat, lng float64) pt {
+	p := mercatorPixel(lat, lng, t.z)
+	scale := float64(mvtExtent) / tileSize
+	return pt{(p.X - float64(t.x*tileSize)) * scale, (p.Y - float64(t.y*tileSize)) * scale}
+}
+
+func inBuffer(p pt) bool {
+	return p.X >= -mvtBuffer && p.Y >= -mvtBuffer && p.X <= mvtExtent+mvtBuffer && p.Y <= mvtExtent+mvtBuffer
+}
+
+func pointGeometry(p pt) []uint32 {
+	return []uint32{mvtCommand(mvtMoveTo, 1), uint32(zigzag(int64(math.Round(p.X)))), uint32(zigzag(int64(math.Round(p.Y))))}
+}
+
+// clipRing clips a closed ring to the tile and its buffer
+// (Sutherland-Hodgman, one edge of the box at a time).
+func clipRing(ring []pt) []pt {
+	const lo, hi = -mvtBuffer, mvtExtent + mvtBuffer
+	edges := []struct {
+		inside func(pt) bool
+		cross  func(a, b pt) pt
+	}{
+		{func(p pt) bool { return p.X >= lo }, func(a, b pt) pt { return crossX(a, b, lo) }},
+		{func(p pt) bool { return p.X <= hi }, func(a, b pt) pt { return crossX(a, b, hi) }},
+		{func(p pt) bool { return p.Y >= lo }, func(a, b pt) pt { return crossY(a, b, lo) }},
+		{func(p pt) bool { return p.Y <= hi }, func(a, b pt) pt { return crossY(a, b, hi) }},
+	}
+	for _, e := range edges {
+		if len(ring) == 0 {
+			break
+		}
+		var out []pt
+		prev := ring[len(ring)-1]
+		for _, cur := range ring {
+			switch {
+			case e.inside(cur) && !e.inside(prev):
+				out = append(out, e.cross(prev, cur), cur)
+			case e.inside(cur):
+				out = append(out, cur)
+			case e.inside(prev):
+				out = append(out, e.cross(prev, cur))
+			}
+			prev = cur
+		}
+		ring = out
+	}
+	return ring
+}
+
+func crossX(a, b pt, x float64) pt {
+	return pt{x, a.Y + (b.Y-a.Y)*(x-a.X)/(b.X-a.X)}
+}
+
+func crossY(a, b pt, y float64) pt {
+	return pt{a.X + (b.X-a.X)*(y-a.Y)/(b.Y-a.Y), y}
+}
+
+// simplify drops points closer than tol to the line through their
+// neighbours (Douglas-Peucker). The first and last points are kept.
+func simplify(pts []pt, tol float64) []pt {
+	if len(pts) < 3 {
+		return pts
+	}
+	keep := make([]bool, len(pts))
+	keep[0], keep[len(pts)-1] = true, true
+	var walk func(i, j int)
+	walk = func(i, j int) {
+		best, at := 0.0, -1
+		for k := i + 1; k < j; k++ {
+			if d := segmentDistance(pts[k], pts[i], pts[j]); d > best {
+				best, at = d, k
+			}
+		}
+		if at >= 0 && best > tol {
+			keep[at] = true
+			walk(i, at)
+			walk(at, j)
+		}
+	}
+	walk(0, len(pts)-1)
+	var out []pt
+	for i, p := range pts {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func segmentDistance(p, a, b pt) float64 {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	l := dx*dx + dy*dy
+	if l == 0 {
+		return math.Hypot(p.X-a.X, p.Y-a.Y)
+	}
+	t := math.Max(0, math.Min(1, ((p.X-a.X)*dx+(p.Y-a.Y)*dy)/l))
+	return math.Hypot(p.X-(a.X+t*dx), p.Y-(a.Y+t*dy))
+}
+
+// polygonGeometry encodes an advisory outline for tile t, or returns nil
+// when nothing of it is left inside the tile.
+func polygonGeometry(t mvtTile, points [][2]float64) []uint32 {
+	ring := make([]pt, 0, len(points))
+	for _, p := range points {
+		ring = append(ring, t.project(p[0], p[1]))
+	}
+	if n := len(ring); n > 1 && ring[0] == ring[n-1] {
+		ring = ring[:n-1]
+	}
+	ring = clipRing(ring)
+	if len(ring) < 3 {
+		return nil
+	}
+	// Simplify as an open line from the first point round and back to it.
+	ring = simplify(append(ring, ring[0]), mvtTolerance)
+	ring = ring[:len(ring)-1]
+	var ints [][2]int64
+	for _, p := range ring {
+		q := [2]int64{int64(math.Round(p.X)), int64(math.Round(p.Y))}
+		if len(ints) > 0 && ints[len(ints)-1] == q {
+			continue
+		}
+		ints = append(ints, q)
+	}
+	if len(ints) > 1 && ints[0] == ints[len(ints)-1] {
+		ints = ints[:len(ints)-1]
+	}
+	if len(ints) < 3 {
+		return nil
+	}
+	// Exterior rings have a positive area in tile coordinates, where y
+	// points down.
+	var area int64
+	for i, a := range ints {
+		b := ints[(i+1)%len(ints)]
+		area += a[0]*b[1] - b[0]*a[1]
+	}
+	if area == 0 {
+		return nil
+	}
+	if area < 0 {
+		for i, j := 0, len(ints)-1; i < j; i, j = i+1, j-1 {
+			ints[i], ints[j] = ints[j], ints[i]
+		}
+	}
+	geom := []uint32{mvtCommand(mvtMoveTo, 1)}
+	var cx, cy int64
+	for i, p := range ints {
+		if i == 1 {
+			geom = append(geom, mvtCommand(mvtLineTo, len(ints)-1))
+		}
+		geom = append(geom, uint32(zigzag(p[0]-cx)), uint32(zigzag(p[1]-cy)))
+		cx, cy = p[0], p[1]
+	}
+	return append(geom, mvtCommand(mvtClosePath, 1))
+}
+
+// vtPirep is a PIREP with its position parsed.
+type vtPirep struct {
+	report   string
+	lat, lng float64
+}
+
+// vtData is everything the vector tiles are drawn from.
+type vtData struct {
+	stations   []tileStation
+	pireps     []vtPirep
+	advisories []advisoryData
+	modTime    time.Time
+}
+
+type vtCache struct {
+	mu    sync.Mutex
+	stamp string
+	data  *vtData
+	tiles map[string][]byte
+}
+
+var vectorTiles = &vtCache{}
+
+// fileTime is the modification time of an optional data file; a file that
+// does not exist yet has the zero time.
+func fileTime(fname string) (time.Time, error) {
+	st, err := os.Stat(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return st.ModTime(), nil
+}
+
+// load returns the current data and a stamp that changes whenever one of
+// the files does, rereading the PIREPs and advisories when they change.
+// The stations come from the raster tiles' cache.
+func (vc *vtCache) load() (*vtData, string, error) {
+	stations, wxTime, err := wxTiles.load()
+	if err != nil {
+		return nil, "", err
+	}
+	prTime, err := fileTime(cfg.Path(cfg.Output.Pireps))
+	if err != nil {
+		return nil, "", err
+	}
+	advTime, err := fileTime(cfg.Path(cfg.Output.Advisories))
+	if err != nil {
+		return nil, "", err
+	}
+	stamp := fmt.Sprintf("%x-%x-%x", wxTime.UnixNano(), prTime.UnixNano(), advTime.UnixNano())
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if vc.data != nil && vc.stamp == stamp {
+		return vc.data, stamp, nil
+	}
+	d := &vtData{stations: stations, modTime: wxTime}
+	if !prTime.IsZero() {
+		var all []pirepData
+		if err := readJSONFile(cfg.Path(cfg.Output.Pireps), &all); err != nil {
+			return nil, "", err
+		}
+		for _, pr := range all {
+			lat, err1 := strconv.ParseFloat(pr.Lat, 64)
+			lng, err2 := strconv.ParseFloat(pr.Lng, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			d.pireps = append(d.pireps, vtPirep{report: pr.Report, lat: lat, lng: lng})
+		}
+		if prTime.After(d.modTime) {
+			d.modTime = prTime
+		}
+	}
+	if !advTime.IsZero() {
+		if d.advisories, _, err = readAdvisories(); err != nil {
+			return nil, "", err
+		}
+		if advTime.After(d.modTime) {
+			d.modTime = advTime
+		}
+	}
+	vc.stamp, vc.data = stamp, d
+	vc.tiles = make(map[string][]byte)
+	return d, stamp, nil
+}
+
+func (vc *vtCache) get(key string) ([]byte, bool) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	b, ok := vc.tiles[key]
+	return b, ok
+}
+
+func (vc *vtCache) put(key, stamp string, b []byte) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if stamp != vc.stamp {
+		return
+	}
+	if len(vc.tiles) >= maxCachedTiles {
+		vc.tiles = make(map[string][]byte)
+	}
+	vc.tiles[key] = b
+}
+
+// stationProps are a station's attributes. The METAR only goes into the
+// detailed tiles, where the stations are few enough for it not to matter.
+func stationProps(s tileStation, z int) []mvtProp {
+	props := []mvtProp{{"icao", s.wx.ICAO}}
+	if s.wx.Cond != "" {
+		props = append(props, mvtProp{"category", s.wx.Cond})
+	}
+	if s.wx.CondColor != "" {
+		props = append(props, mvtProp{"color", s.wx.CondColor})
+	}
+	dir, speed, gust := stationWind(s.wx, s.obs)
+	if !math.IsNaN(dir) {
+		props = append(props, mvtProp{"wind_dir", int(dir)})
+	}
+	if !math.IsNaN(speed) {
+		props = append(props, mvtProp{"wind_speed", int(speed)})
+	}
+	if !math.IsNaN(gust) && gust > 0 {
+		props = append(props, mvtProp{"wind_gust", int(gust)})
+	}
+	if t, err := strconv.Atoi(s.wx.Temperature); err == nil {
+		props = append(props, mvtProp{"temp", t})
+	}
+	if s.wx.Precip != "" {
+		props = append(props, mvtProp{"precip", s.wx.Precip})
+	}
+	props = append(props, mvtProp{"lightning", s.wx.Lightning != "" && s.wx.Lightning != "0"})
+	if z >= mvtDetailZoom && s.wx.Metar != "" {
+		props = append(props, mvtProp{"metar", s.wx.Metar})
+	}
+	return props
+}
+
+func advisoryProps(a advisoryData) []mvtProp {
+	props := []mvtProp{{"type", a.Type}, {"hazard", a.Hazard}}
+	if a.Severity != "" {
+		props = append(props, mvtProp{"severity", a.Severity})
+	}
+	if a.MinFt != 0 {
+		props = append(props, mvtProp{"min_ft", a.MinFt})
+	}
+	if a.MaxFt != 0 {
+		props = append(props, mvtProp{"max_ft", a.MaxFt})
+	}
+	if !a.ValidFrom.IsZero() {
+		props = append(props, mvtProp{"valid_from", a.ValidFrom.UTC().Format(time.RFC3339)})
+	}
+	if !a.ValidTo.IsZero() {
+		props = append(props, mvtProp{"valid_to", a.ValidTo.UTC().Format(time.RFC3339)})
+	}
+	return append(props, mvtProp{"raw", a.Raw})
+}
+
+// renderVectorTile encodes the stations, pireps and advisories layers of
+// tile z/x/y. Layers with nothing in the tile are left out.
+func renderVectorTile(d *vtData, z, x, y int) []byte {
+	t := mvtTile{z, x, y}
+	stations := newMVTLayer("stations")
+	for _, s := range d.stations {
+		if p := t.project(s.lat, s.lng); inBuffer(p) {
+			stations.add(mvtPoint, pointGeometry(p), stationProps(s, z))
+		}
+	}
+	pireps := newMVTLayer("pireps")
+	for _, pr := range d.pireps {
+		if p := t.project(pr.lat, pr.lng); inBuffer(p) {
+			pireps.add(mvtPoint, pointGeometry(p), []mvtProp{{"report", pr.report}})
+		}
+	}
+	advisories := newMVTLayer("advisories")
+	for _, a := range d.advisories {
+		if geom := polygonGeometry(t, a.Points); geom != nil {
+			advisories.add(mvtPolygon, geom, advisoryProps(a))
+		}
+	}
+	var tile pbWriter
+	advisories.encode(&tile)
+	pireps.encode(&tile)
+	stations.encode(&tile)
+	return tile.b
+}
+
+// vectorTileHandler serves /vt/{z}/{x}/{y}.pbf.
+func vectorTileHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		z, x, y, ok := parseTilePath(r, ".pbf")
+		if !ok {
+			http.Error(w, "no such tile", http.StatusNotFound)
+			return
+		}
+		d, stamp, err := vectorTiles.load()
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, "weather data is not available", http.StatusServiceUnavailable)
+			return
+		}
+		key := fmt.Sprintf("%d/%d/%d", z, x, y)
+		body, ok := vectorTiles.get(key)
+		if ok {
+			vtRequests.Inc("hit")
+		} else {
+			vtRequests.Inc("miss")
+			start := time.Now()
+			body = renderVectorTile(d, z, x, y)
+			vtRenders.Since(start)
+			vectorTiles.put(key, stamp, body)
+		}
+		w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%s"`, stamp, key))
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		http.ServeContent(w, r, "", d.modTime.Truncate(time.Second), bytes.NewReader(body))
+	})
+}
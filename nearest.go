@@ -0,0 +1,309 @@
+//go:build !getwx && !websocket
+
+package main
+
+// Weather for airports that do not report it: ?req=nearestwx&id=3CK, or
+// &lat=..&lng=.., lists the nearest reporting stations with distance,
+// bearing and how much higher or lower they are, and blends their reports
+// into what to expect at the airport. The blend weighs each station by the
+// inverse square of its distance, moves temperatures and cloud bases to
+// the airport's elevation, and only uses stations within nearestBlendNM.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultNearest = 3
+	maxNearest     = 10
+	nearestBlendNM = 75
+	// Lapse rates in °C per foot for temperature and dewpoint.
+	tempLapse = 0.00198
+	dewLapse  = 0.00055
+)
+
+type nearestQuery struct {
+	id       string
+	lat, lng float64
+	n        int
+}
+
+func parseNearestQuery(id, lat, lng, n string) (nearestQuery, error) {
+	q := nearestQuery{id: strings.ToUpper(strings.TrimSpace(id)), n: defaultNearest}
+	if q.id == "" {
+		var err1, err2 error
+		q.lat, err1 = strconv.ParseFloat(lat, 64)
+		q.lng, err2 = strconv.ParseFloat(lng, 64)
+		if err1 != nil || err2 != nil || math.IsNaN(q.lat) || math.IsNaN(q.lng) ||
+			math.Abs(q.lat) > 90 || math.Abs(q.lng) > 180 {
+			return q, errors.New("id or lat and lng are required")
+		}
+	}
+	if n != "" {
+		v, err := strconv.Atoi(n)
+		if err != nil || v < 1 || v > maxNearest {
+			return q, fmt.Errorf("n must be between 1 and %d", maxNearest)
+		}
+		q.n = v
+	}
+	return q, nil
+}
+
+type nearestStation struct {
+	ICAO       string  `json:"icao"`
+	Lat        float64 `json:"lat"`
+	Lng        float64 `json:"lng"`
+	DistanceNM float64 `json:"distance_nm"`
+	// Bearing is degrees true from the airport to the station.
+	Bearing     int  `json:"bearing"`
+	ElevationFt *int `json:"elevation_ft,omitempty"`
+	// ElevationDiffFt is how much higher the station is than the airport.
+	ElevationDiffFt *int   `json:"elevation_diff_ft,omitempty"`
+	Category        string `json:"category,omitempty"`
+	Metar           string `json:"metar"`
+}
+
+// expectedConditions is the blend of the nearby reports. The ceiling is
+// above the airport and left out when none of the stations has one.
+type expectedConditions struct {
+	Stations     int      `json:"stations"`
+	Category     string   `json:"category,omitempty"`
+	CeilingFt    *int     `json:"ceiling_ft,omitempty"`
+	VisibilitySM *float64 `json:"visibility_sm,omitempty"`
+	WindDir      *int     `json:"wind_dir,omitempty"`
+	WindSpeed    *int     `json:"wind_speed,omitempty"`
+	TempC        *float64 `json:"temp_c,omitempty"`
+	DewpointC    *float64 `json:"dewpoint_c,omitempty"`
+	AltimeterHg  *float64 `json:"altimeter_hg,omitempty"`
+}
+
+type nearestWx struct {
+	Ident       string              `json:"ident,omitempty"`
+	Name        string              `json:"name,omitempty"`
+	Lat         float64             `json:"lat"`
+	Lng         float64             `json:"lng"`
+	ElevationFt *int                `json:"elevation_ft,omitempty"`
+	Stations    []nearestStation    `json:"stations"`
+	Expected    *expectedConditions `json:"expected,omitempty"`
+}
+
+// reportingStation is a station with what the blend needs from it.
+type reportingStation struct {
+	wx       weatherData
+	obs      metarObs
+	lat, lng float64
+	elev     float64 // NaN when unknown
+	dist     float64
+}
+
+func nearestWeather(q nearestQuery) (*nearestWx, error) {
+	all, _, err := readWeatherData()
+	if err != nil {
+		return nil, err
+	}
+	db, err := readAirportDB()
+	if err != nil {
+		return nil, err
+	}
+	out := &nearestWx{Lat: q.lat, Lng: q.lng, Stations: []nearestStation{}}
+	elev := math.NaN()
+	if q.id != "" {
+		var ok bool
+		if out.Lat, out.Lng, elev, ok, err = locateAirport(q.id, db, all); err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &airportNotFound{id: q.id}
+		}
+		out.Ident = db.ident(q.id)
+		if a := db.find(q.id); a != nil {
+			out.Name = a.Name
+		}
+	}
+	if !math.IsNaN(elev) {
+		out.ElevationFt = intPtr(elev)
+	}
+	var near []reportingStation
+	for _, wx := range all {
+		lat, err1 := strconv.ParseFloat(wx.Lat, 64)
+		lng, err2 := strconv.ParseFloat(wx.Lng, 64)
+		if err1 != nil || err2 != nil || wx.Metar == "" {
+			continue
+		}
+		near = append(near, reportingStation{
+			wx: wx, obs: parseMetarText(wx.Metar), lat: lat, lng: lng,
+			elev: stationElevation(wx, db),
+			dist: gcDistance(out.Lat, out.Lng, lat, lng),
+		})
+	}
+	sort.Slice(near, func(i, j int) bool { return near[i].dist < near[j].dist })
+	if len(near) > q.n {
+		near = near[:q.n]
+	}
+	for _, s := range near {
+		ns := nearestStation{
+			ICAO:       s.wx.ICAO,
+			Lat:        s.lat,
+			Lng:        s.lng,
+			DistanceNM: round1(s.dist),
+			Bearing:    int(math.Round(math.Mod(gcBearing(out.Lat, out.Lng, s.lat, s.lng)*180/math.Pi+360, 360))),
+			Category:   s.wx.Cond,
+			Metar:      s.wx.Metar,
+		}
+		if !math.IsNaN(s.elev) {
+			ns.ElevationFt = intPtr(s.elev)
+			if !math.IsNaN(elev) {
+				ns.ElevationDiffFt = intPtr(s.elev - elev)
+			}
+		}
+		out.Stations = append(out.Stations, ns)
+	}
+	out.Expected = blendReports(near, elev)
+	return out, nil
+}
+
+// locateAirport finds id in the airport database, among the stations or in
+// airports.txt, with its elevation when one of them has it.
+func locateAirport(id string, db *airportIndex, all []weatherData) (lat, lng, elev float64, ok bool, err error) {
+	if a := db.find(id); a != nil {
+		return a.Lat, a.Lng, a.ElevationFt, true, nil
+	}
+	ids := db.aliases(id)
+	for _, wx := range all {
+		for _, alias := range ids {
+			if wx.ICAO != alias {
+				continue
+			}
+			lat, err1 := strconv.ParseFloat(wx.Lat, 64)
+			lng, err2 := strconv.ParseFloat(wx.Lng, 64)
+			if err1 == nil && err2 == nil {
+				return lat, lng, stationElevation(wx, db), true, nil
+			}
+		}
+	}
+	err = scanPointFile(cfg.Path(cfg.Paths.Airports), func(ident string, plat, plng, pelev float64) {
+		for _, alias := range ids {
+			if !ok && ident == alias {
+				lat, lng, elev, ok = plat, plng, pelev, true
+			}
+		}
+	})
+	return lat, lng, elev, ok, err
+}
+
+// stationElevation is the field elevation getwx found for wx, or the
+// airport database's, NaN if neither has one.
+func stationElevation(wx weatherData, db *airportIndex) float64 {
+	if v, err := strconv.ParseFloat(wx.Elevation, 64); err == nil {
+		return v
+	}
+	if a := db.find(wx.ICAO); a != nil {
+		return a.ElevationFt
+	}
+	return math.NaN()
+}
+
+// blendReports works out the expected conditions at an airport elev feet
+// high, NaN if not known, from the stations near it.
+func blendReports(near []reportingStation, elev float64) *expectedConditions {
+	type sum struct{ v, w float64 }
+	var ceil, vis, temp, dew, altim, speed sum
+	var wind windComponents
+	var windW float64
+	add := func(s *sum, v, w float64) {
+		if !math.IsNaN(v) {
+			s.v += v * w
+			s.w += w
+		}
+	}
+	used := 0
+	for _, s := range near {
+		if s.dist > nearestBlendNM {
+			continue
+		}
+		used++
+		w := 1 / math.Max(1, s.dist*s.dist)
+		// Differences in elevation only count when both are known.
+		rise := 0.0
+		if !math.IsNaN(elev) && !math.IsNaN(s.elev) {
+			rise = s.elev - elev
+		}
+		// Cloud bases are blended above sea level when the elevations are
+		// known, so a ceiling in the valley is not carried up the hill.
+		switch {
+		case !math.IsNaN(s.obs.Ceiling):
+			add(&ceil, math.Min(s.obs.Ceiling, unlimitedCeiling)+rise, w)
+		case s.obs.Cover != "":
+			add(&ceil, unlimitedCeiling+rise, w)
+		}
+		add(&vis, math.Min(s.obs.VisSM, 10), w)
+		add(&temp, s.obs.TempC+tempLapse*rise, w)
+		add(&dew, s.obs.DewC+dewLapse*rise, w)
+		add(&altim, s.obs.AltimHg, w)
+		if !math.IsNaN(s.obs.WindSpeed) {
+			add(&speed, s.obs.WindSpeed, w)
+			if !math.IsNaN(s.obs.WindDir) {
+				c := windFrom(s.obs.WindDir, s.obs.WindSpeed)
+				wind.u += c.u * w
+				wind.v += c.v * w
+				windW += w
+			}
+		}
+	}
+	if used == 0 {
+		return nil
+	}
+	e := &expectedConditions{Stations: used}
+	mean := func(s sum) float64 {
+		if s.w == 0 {
+			return math.NaN()
+		}
+		return s.v / s.w
+	}
+	c, v := mean(ceil), mean(vis)
+	if cat := flightCategory(c, v); !math.IsNaN(cat) {
+		e.Category = categoryNames[int(cat)]
+	}
+	if !math.IsNaN(c) && c < unlimitedCeiling {
+		e.CeilingFt = intPtr(math.Round(math.Max(0, c)/100) * 100)
+	}
+	if !math.IsNaN(v) {
+		e.VisibilitySM = floatPtr(round1(v))
+	}
+	if s := mean(speed); !math.IsNaN(s) {
+		e.WindSpeed = intPtr(s)
+		// Winds from all round cancel out and leave no direction.
+		if windW > 0 && s >= 1 {
+			if dir, vs := (windComponents{wind.u / windW, wind.v / windW}).dirSpeed(); vs > 0 {
+				if dir = math.Round(dir/10) * 10; dir == 0 {
+					dir = 360
+				}
+				e.WindDir = intPtr(dir)
+			}
+		}
+	}
+	if t := mean(temp); !math.IsNaN(t) {
+		e.TempC = floatPtr(round1(t))
+		if d := mean(dew); !math.IsNaN(d) {
+			e.DewpointC = floatPtr(round1(math.Min(d, t)))
+		}
+	}
+	if a := mean(altim); !math.IsNaN(a) {
+		e.AltimeterHg = floatPtr(math.Round(a*100) / 100)
+	}
+	return e
+}
+
+func intPtr(v float64) *int {
+	i := int(math.Round(v))
+	return &i
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,743 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// OGC services, for GIS tools and EFB apps that do not speak the map API.
+// mapserver -serve has
+//
+//	/wmts   WMTS 1.0.0, KVP and RESTful: the sectional chart, the station
+//	        layer and the surface analysis fields as GoogleMapsCompatible
+//	        tiles
+//	/wms    WMS 1.3.0, also taking 1.1.1 requests: GetMap draws the station
+//	        layer for any box, and GetFeatureInfo answers with the METAR and
+//	        TAF of the stations nearest the point
+//
+// The WMTS tiles are the /wxtiles and /grid ones. The sectional tiles are
+// not ours, so GetTile sends the client to them with a redirect.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+const (
+	wmtsMatrixSet = "GoogleMapsCompatible"
+	// webMercatorR is the sphere radius of EPSG:3857, in metres.
+	webMercatorR = 6378137.0
+	wmsMaxSize   = 4096
+	// featureInfoRadius is how near the point, in pixels, a station must be
+	// for GetFeatureInfo.
+	featureInfoRadius = 16
+	maxFeatureCount   = 10
+)
+
+var ogcRequests = newCounter("ogc_requests_total", "WMS and WMTS requests, by service and request.", "service", "request")
+
+// ogcError is an OGC exception: code is one of the exception codes the
+// specifications list, locator the parameter at fault.
+type ogcError struct {
+	status  int
+	code    string
+	locator string
+	msg     string
+}
+
+func ogcMissing(param string) *ogcError {
+	return &ogcError{http.StatusBadRequest, "MissingParameterValue", param, param + " is required"}
+}
+
+func ogcInvalid(param, format string, args ...any) *ogcError {
+	return &ogcError{http.StatusBadRequest, "InvalidParameterValue", param, fmt.Sprintf(format, args...)}
+}
+
+// xmlText escapes s for XML text and attributes.
+func xmlText(s string) string {
+	var b strings.Builder
+	xmlEscape(&b, s)
+	return b.String()
+}
+
+// writeWMTSError sends an OWS exception report.
+func writeWMTSError(w http.ResponseWriter, e *ogcError) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ExceptionReport xmlns="http://www.opengis.net/ows/1.1" version="1.0.0">
+  <Exception exceptionCode="%s" locator="%s"><ExceptionText>%s</ExceptionText></Exception>
+</ExceptionReport>
+`, e.code, xmlText(e.locator), xmlText(e.msg))
+}
+
+// writeWMSError sends a WMS service exception report.
+func writeWMSError(w http.ResponseWriter, e *ogcError) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(e.status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ServiceExceptionReport version="1.3.0" xmlns="http://www.opengis.net/ogc">
+  <ServiceException code="%s" locator="%s">%s</ServiceException>
+</ServiceExceptionReport>
+`, e.code, xmlText(e.locator), xmlText(e.msg))
+}
+
+// ogcParams reads the query; OGC parameter names are not case sensitive.
+func ogcParams(r *http.Request) map[string]string {
+	q := map[string]string{}
+	for k, v := range r.URL.Query() {
+		q[strings.ToUpper(k)] = v[0]
+	}
+	return q
+}
+
+// publicBase is the URL the capabilities link to, without a trailing
+// slash.
+func publicBase(r *http.Request) string {
+	if cfg.Server.PublicURL != "" {
+		return strings.TrimSuffix(cfg.Server.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	return scheme + "://" + r.Host
+}
+
+// wmtsLayer is one tile layer. tilePath is where mapserver serves its
+// tiles, nil for the sectional chart.
+type wmtsLayer struct {
+	ID, Title, Abstract string
+	tilePath            func(z, x, y int) string
+}
+
+func wmtsLayers() []wmtsLayer {
+	var layers []wmtsLayer
+	if cfg.Map.Tiles.URL != "" {
+		layers = append(layers, wmtsLayer{ID: "sectional", Title: cfg.Map.Tiles.Attribution, Abstract: "The chart tiles under the map page."})
+	}
+	layers = append(layers, wmtsLayer{
+		ID: "stations", Title: "Stations", Abstract: "Station models drawn from the latest METARs.",
+		tilePath: func(z, x, y int) string { return fmt.Sprintf("/wxtiles/%d/%d/%d.png", z, x, y) },
+	})
+	for _, f := range gridFields {
+		name := f.name
+		title := "Surface analysis: " + strings.ReplaceAll(name, "_", " ")
+		if f.units != "" {
+			title += " (" + f.units + ")"
+		}
+		layers = append(layers, wmtsLayer{
+			ID: "grid_" + name, Title: title, Abstract: "Station values interpolated over the map area.",
+			tilePath: func(z, x, y int) string { return fmt.Sprintf("/grid/%s/%d/%d/%d.png", name, z, x, y) },
+		})
+	}
+	return layers
+}
+
+type tileMatrix struct {
+	Z     int
+	Scale string
+	N     int
+}
+
+var wmtsCapabilities = texttemplate.Must(texttemplate.New("wmts").Funcs(texttemplate.FuncMap{"x": xmlText}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">
+  <ows:ServiceIdentification>
+    <ows:Title>{{x .Title}}</ows:Title>
+    <ows:ServiceType>OGC WMTS</ows:ServiceType>
+    <ows:ServiceTypeVersion>1.0.0</ows:ServiceTypeVersion>
+  </ows:ServiceIdentification>
+  <ows:OperationsMetadata>
+{{- range $op := .Operations}}
+    <ows:Operation name="{{$op}}">
+      <ows:DCP><ows:HTTP><ows:Get xlink:href="{{x $.Base}}/wmts?">
+        <ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>KVP</ows:Value></ows:AllowedValues></ows:Constraint>
+      </ows:Get></ows:HTTP></ows:DCP>
+    </ows:Operation>
+{{- end}}
+  </ows:OperationsMetadata>
+  <Contents>
+{{- range .Layers}}
+    <Layer>
+      <ows:Title>{{x .Title}}</ows:Title>
+      <ows:Abstract>{{x .Abstract}}</ows:Abstract>
+      <ows:WGS84BoundingBox>
+        <ows:LowerCorner>{{$.Bounds.LngMin}} {{$.Bounds.LatMin}}</ows:LowerCorner>
+        <ows:UpperCorner>{{$.Bounds.LngMax}} {{$.Bounds.LatMax}}</ows:UpperCorner>
+      </ows:WGS84BoundingBox>
+      <ows:Identifier>{{.ID}}</ows:Identifier>
+      <Style isDefault="true"><ows:Identifier>default</ows:Identifier></Style>
+      <Format>image/png</Format>
+      <TileMatrixSetLink><TileMatrixSet>{{$.MatrixSet}}</TileMatrixSet></TileMatrixSetLink>
+      <ResourceURL format="image/png" resourceType="tile" template="{{x $.Base}}/wmts/{{.ID}}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png"/>
+    </Layer>
+{{- end}}
+    <TileMatrixSet>
+      <ows:Identifier>{{.MatrixSet}}</ows:Identifier>
+      <ows:SupportedCRS>urn:ogc:def:crs:EPSG::3857</ows:SupportedCRS>
+      <WellKnownScaleSet>urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible</WellKnownScaleSet>
+{{- range .Matrices}}
+      <TileMatrix>
+        <ows:Identifier>{{.Z}}</ows:Identifier>
+        <ScaleDenominator>{{.Scale}}</ScaleDenominator>
+        <TopLeftCorner>-20037508.3427892 20037508.3427892</TopLeftCorner>
+        <TileWidth>256</TileWidth>
+        <TileHeight>256</TileHeight>
+        <MatrixWidth>{{.N}}</MatrixWidth>
+        <MatrixHeight>{{.N}}</MatrixHeight>
+      </TileMatrix>
+{{- end}}
+    </TileMatrixSet>
+  </Contents>
+  <ServiceMetadataURL xlink:href="{{x .Base}}/wmts/1.0.0/WMTSCapabilities.xml"/>
+</Capabilities>
+`))
+
+// wmtsHandler serves /wmts. tiles is the server's mux, which GetTile
+// hands the weather tiles to.
+func wmtsHandler(tiles http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wmts", func(w http.ResponseWriter, r *http.Request) {
+		q := ogcParams(r)
+		if s := q["SERVICE"]; s != "" && !strings.EqualFold(s, "WMTS") {
+			writeWMTSError(w, ogcInvalid("service", "service must be WMTS"))
+			return
+		}
+		switch req := q["REQUEST"]; {
+		case req == "":
+			writeWMTSError(w, ogcMissing("request"))
+		case strings.EqualFold(req, "GetCapabilities"):
+			serveWMTSCapabilities(w, r)
+		case strings.EqualFold(req, "GetTile"):
+			ogcRequests.Inc("wmts", "GetTile")
+			if f := q["FORMAT"]; f != "" && f != "image/png" {
+				writeWMTSError(w, ogcInvalid("format", "format must be image/png"))
+				return
+			}
+			if st := q["STYLE"]; st != "" && st != "default" {
+				writeWMTSError(w, ogcInvalid("style", "style must be default"))
+				return
+			}
+			serveWMTSTile(w, r, tiles, q["LAYER"], q["TILEMATRIXSET"], q["TILEMATRIX"], q["TILEROW"], q["TILECOL"])
+		default:
+			writeWMTSError(w, &ogcError{http.StatusNotImplemented, "OperationNotSupported", "request", "request must be GetCapabilities or GetTile"})
+		}
+	})
+	mux.HandleFunc("/wmts/1.0.0/WMTSCapabilities.xml", serveWMTSCapabilities)
+	mux.HandleFunc("/wmts/{layer}/{set}/{z}/{row}/{col}", func(w http.ResponseWriter, r *http.Request) {
+		ogcRequests.Inc("wmts", "GetTile")
+		col, ok := strings.CutSuffix(r.PathValue("col"), ".png")
+		if !ok {
+			writeWMTSError(w, ogcInvalid("format", "tiles are .png"))
+			return
+		}
+		serveWMTSTile(w, r, tiles, r.PathValue("layer"), r.PathValue("set"), r.PathValue("z"), r.PathValue("row"), col)
+	})
+	return mux
+}
+
+func serveWMTSCapabilities(w http.ResponseWriter, r *http.Request) {
+	ogcRequests.Inc("wmts", "GetCapabilities")
+	var matrices []tileMatrix
+	for z := 0; z <= maxTileZoom; z++ {
+		// 0.28 mm pixels, as the specification has it.
+		scale := 2 * math.Pi * webMercatorR / (tileSize * math.Exp2(float64(z))) / 0.00028
+		matrices = append(matrices, tileMatrix{Z: z, Scale: strconv.FormatFloat(scale, 'f', -1, 64), N: 1 << z})
+	}
+	var buf bytes.Buffer
+	err := wmtsCapabilities.Execute(&buf, map[string]any{
+		"Title":      cfg.Map.Title,
+		"Base":       publicBase(r),
+		"Operations": []string{"GetCapabilities", "GetTile"},
+		"Layers":     wmtsLayers(),
+		"Bounds":     cfg.Map.Bounds,
+		"MatrixSet":  wmtsMatrixSet,
+		"Matrices":   matrices,
+	})
+	if err != nil {
+		logRequestError(r, err)
+		writeWMTSError(w, &ogcError{http.StatusInternalServerError, "NoApplicableCode", "", "internal error"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buf.Bytes())
+}
+
+// serveWMTSTile answers GetTile for either encoding.
+func serveWMTSTile(w http.ResponseWriter, r *http.Request, tiles http.Handler, layerID, set, matrix, row, col string) {
+	for param, v := range map[string]string{"layer": layerID, "tilematrixset": set, "tilematrix": matrix, "tilerow": row, "tilecol": col} {
+		if v == "" {
+			writeWMTSError(w, ogcMissing(param))
+			return
+		}
+	}
+	var layer *wmtsLayer
+	for _, l := range wmtsLayers() {
+		if l.ID == layerID {
+			layer = &l
+			break
+		}
+	}
+	if layer == nil {
+		writeWMTSError(w, ogcInvalid("layer", "unknown layer %q", layerID))
+		return
+	}
+	if set != wmtsMatrixSet {
+		writeWMTSError(w, ogcInvalid("tilematrixset", "tilematrixset must be %s", wmtsMatrixSet))
+		return
+	}
+	z, err := strconv.Atoi(matrix)
+	if err != nil || z < 0 || z > maxTileZoom {
+		writeWMTSError(w, ogcInvalid("tilematrix", "tilematrix must be 0 to %d", maxTileZoom))
+		return
+	}
+	y, erry := strconv.Atoi(row)
+	x, errx := strconv.Atoi(col)
+	switch {
+	case erry != nil || y < 0 || y >= 1<<z:
+		writeWMTSError(w, &ogcError{http.StatusBadRequest, "TileOutOfRange", "tilerow", "tilerow is outside the matrix"})
+		return
+	case errx != nil || x < 0 || x >= 1<<z:
+		writeWMTSError(w, &ogcError{http.StatusBadRequest, "TileOutOfRange", "tilecol", "tilecol is outside the matrix"})
+		return
+	}
+	if layer.tilePath == nil {
+		http.Redirect(w, r, sectionalTileURL(r, z, x, y), http.StatusFound)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL = &url.URL{Path: layer.tilePath(z, x, y)}
+	tiles.ServeHTTP(w, r2)
+}
+
+// sectionalTileURL is where a chart tile is, resolved against the
+// server for a relative map.tiles.url.
+func sectionalTileURL(r *http.Request, z, x, y int) string {
+	s := fillTileURL(cfg.Map.Tiles, z, x, y)
+	u, err := url.Parse(s)
+	if err != nil || u.IsAbs() {
+		return s
+	}
+	base, _ := url.Parse(publicBase(r) + "/")
+	return base.ResolveReference(u).String()
+}
+
+// fillTileURL fills t.url in for a tile, counting rows from the bottom
+// for TMS tiles.
+func fillTileURL(t TilesConfig, z, x, y int) string {
+	if t.TMS {
+		y = 1<<z - 1 - y
+	}
+	return strings.NewReplacer("{z}", strconv.Itoa(z), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y), "{s}", "a", "{r}", "").Replace(t.URL)
+}
+
+// wmsView is the image a GetMap or GetFeatureInfo request describes. The
+// box is in the units of the CRS, x to the east.
+type wmsView struct {
+	mercator               bool
+	minx, miny, maxx, maxy float64
+	width, height          int
+}
+
+// mercatorMeters is lat/lng in EPSG:3857.
+func mercatorMeters(lat, lng float64) (x, y float64) {
+	lat = math.Max(-85.05112878, math.Min(85.05112878, lat))
+	return webMercatorR * toRad(lng), webMercatorR * math.Log(math.Tan(math.Pi/4+toRad(lat)/2))
+}
+
+func (v wmsView) project(lat, lng float64) pt {
+	x, y := lng, lat
+	if v.mercator {
+		x, y = mercatorMeters(lat, lng)
+	}
+	return pt{
+		X: (x - v.minx) / (v.maxx - v.minx) * float64(v.width),
+		Y: (v.maxy - y) / (v.maxy - v.miny) * float64(v.height),
+	}
+}
+
+// zoom is the tile zoom nearest the view's scale, which decides what the
+// station layer draws.
+func (v wmsView) zoom() int {
+	world := 360.0
+	if v.mercator {
+		world = 2 * math.Pi * webMercatorR
+	}
+	z := math.Round(math.Log2(world * float64(v.width) / (tileSize * (v.maxx - v.minx))))
+	return int(math.Max(0, math.Min(maxTileZoom, z)))
+}
+
+// parseWMSView reads the parameters GetMap and GetFeatureInfo share. In
+// WMS 1.3.0 EPSG:4326 boxes are latitude first; in 1.1.1 and for CRS:84
+// they are longitude first.
+func parseWMSView(q map[string]string) (wmsView, *ogcError) {
+	var v wmsView
+	if q["LAYERS"] == "" {
+		return v, ogcMissing("layers")
+	}
+	for _, l := range strings.Split(q["LAYERS"], ",") {
+		if l != "stations" {
+			return v, &ogcError{http.StatusBadRequest, "LayerNotDefined", "layers", fmt.Sprintf("unknown layer %q", l)}
+		}
+	}
+	for _, st := range strings.Split(q["STYLES"], ",") {
+		if st != "" && st != "default" {
+			return v, &ogcError{http.StatusBadRequest, "StyleNotDefined", "styles", fmt.Sprintf("unknown style %q", st)}
+		}
+	}
+	version, crsParam := q["VERSION"], "crs"
+	crs := q["CRS"]
+	if version == "1.1.1" || (crs == "" && q["SRS"] != "") {
+		version, crsParam, crs = "1.1.1", "srs", q["SRS"]
+	}
+	code := "InvalidCRS"
+	if crsParam == "srs" {
+		code = "InvalidSRS"
+	}
+	latFirst := false
+	switch strings.ToUpper(crs) {
+	case "":
+		return v, ogcMissing(crsParam)
+	case "EPSG:3857", "EPSG:900913":
+		v.mercator = true
+	case "EPSG:4326":
+		latFirst = version != "1.1.1"
+	case "CRS:84":
+	default:
+		return v, &ogcError{http.StatusBadRequest, code, crsParam, fmt.Sprintf("%s must be EPSG:3857, EPSG:4326 or CRS:84", crsParam)}
+	}
+	parts := strings.Split(q["BBOX"], ",")
+	if q["BBOX"] == "" {
+		return v, ogcMissing("bbox")
+	}
+	if len(parts) != 4 {
+		return v, ogcInvalid("bbox", "bbox must be minx,miny,maxx,maxy")
+	}
+	var b [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return v, ogcInvalid("bbox", "bbox must be four numbers")
+		}
+		b[i] = f
+	}
+	if latFirst {
+		b[0], b[1], b[2], b[3] = b[1], b[0], b[3], b[2]
+	}
+	v.minx, v.miny, v.maxx, v.maxy = b[0], b[1], b[2], b[3]
+	if v.minx >= v.maxx || v.miny >= v.maxy {
+		return v, ogcInvalid("bbox", "bbox must have its minimum below its maximum")
+	}
+	var err1, err2 error
+	v.width, err1 = strconv.Atoi(q["WIDTH"])
+	v.height, err2 = strconv.Atoi(q["HEIGHT"])
+	if err1 != nil || err2 != nil || v.width < 1 || v.height < 1 || v.width > wmsMaxSize || v.height > wmsMaxSize {
+		return v, ogcInvalid("width", "width and height must be 1 to %d", wmsMaxSize)
+	}
+	return v, nil
+}
+
+var wmsCapabilities = texttemplate.Must(texttemplate.New("wms").Funcs(texttemplate.FuncMap{"x": xmlText}).Parse(`
+{{- define "dcp"}}<DCPType><HTTP><Get><OnlineResource xlink:type="simple" xlink:href="{{x .Base}}/wms?"/></Get></HTTP></DCPType>{{end -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<WMS_Capabilities version="1.3.0" xmlns="http://www.opengis.net/wms" xmlns:xlink="http://www.w3.org/1999/xlink">
+  <Service>
+    <Name>WMS</Name>
+    <Title>{{x .Title}}</Title>
+    <OnlineResource xlink:type="simple" xlink:href="{{x .Base}}/wms"/>
+    <MaxWidth>{{.MaxSize}}</MaxWidth>
+    <MaxHeight>{{.MaxSize}}</MaxHeight>
+  </Service>
+  <Capability>
+    <Request>
+      <GetCapabilities><Format>text/xml</Format>{{template "dcp" .}}</GetCapabilities>
+      <GetMap><Format>image/png</Format>{{template "dcp" .}}</GetMap>
+      <GetFeatureInfo>
+{{- range .InfoFormats}}<Format>{{.}}</Format>{{end}}{{template "dcp" .}}</GetFeatureInfo>
+    </Request>
+    <Exception><Format>XML</Format></Exception>
+    <Layer>
+      <Title>{{x .Title}}</Title>
+      <CRS>EPSG:3857</CRS>
+      <CRS>EPSG:4326</CRS>
+      <CRS>CRS:84</CRS>
+      <EX_GeographicBoundingBox>
+        <westBoundLongitude>{{.Bounds.LngMin}}</westBoundLongitude>
+        <eastBoundLongitude>{{.Bounds.LngMax}}</eastBoundLongitude>
+        <southBoundLatitude>{{.Bounds.LatMin}}</southBoundLatitude>
+        <northBoundLatitude>{{.Bounds.LatMax}}</northBoundLatitude>
+      </EX_GeographicBoundingBox>
+      <BoundingBox CRS="CRS:84" minx="{{.Bounds.LngMin}}" miny="{{.Bounds.LatMin}}" maxx="{{.Bounds.LngMax}}" maxy="{{.Bounds.LatMax}}"/>
+      <BoundingBox CRS="EPSG:4326" minx="{{.Bounds.LatMin}}" miny="{{.Bounds.LngMin}}" maxx="{{.Bounds.LatMax}}" maxy="{{.Bounds.LngMax}}"/>
+      <BoundingBox CRS="EPSG:3857" minx="{{index .Mercator 0}}" miny="{{index .Mercator 1}}" maxx="{{index .Mercator 2}}" maxy="{{index .Mercator 3}}"/>
+      <Layer queryable="1" opaque="0">
+        <Name>stations</Name>
+        <Title>Stations</Title>
+        <Abstract>Station models drawn from the latest METARs; GetFeatureInfo gives the METAR and TAF.</Abstract>
+        <Style><Name>default</Name><Title>Default</Title></Style>
+      </Layer>
+    </Layer>
+  </Capability>
+</WMS_Capabilities>
+`))
+
+var wmsInfoFormats = []string{"text/plain", "text/html", "application/json", "application/geo+json"}
+
+// wmsHandler serves /wms.
+func wmsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := ogcParams(r)
+		if s := q["SERVICE"]; s != "" && !strings.EqualFold(s, "WMS") {
+			writeWMSError(w, ogcInvalid("service", "service must be WMS"))
+			return
+		}
+		switch req := q["REQUEST"]; {
+		case req == "":
+			writeWMSError(w, ogcMissing("request"))
+		case strings.EqualFold(req, "GetCapabilities"):
+			serveWMSCapabilities(w, r)
+		case strings.EqualFold(req, "GetMap"):
+			serveWMSMap(w, r, q)
+		case strings.EqualFold(req, "GetFeatureInfo"):
+			serveWMSFeatureInfo(w, r, q)
+		default:
+			writeWMSError(w, &ogcError{http.StatusNotImplemented, "OperationNotSupported", "request", "request must be GetCapabilities, GetMap or GetFeatureInfo"})
+		}
+	})
+}
+
+func serveWMSCapabilities(w http.ResponseWriter, r *http.Request) {
+	ogcRequests.Inc("wms", "GetCapabilities")
+	b := cfg.Map.Bounds
+	x1, y1 := mercatorMeters(b.LatMin, b.LngMin)
+	x2, y2 := mercatorMeters(b.LatMax, b.LngMax)
+	var buf bytes.Buffer
+	err := wmsCapabilities.Execute(&buf, map[string]any{
+		"Title":       cfg.Map.Title,
+		"Base":        publicBase(r),
+		"MaxSize":     wmsMaxSize,
+		"InfoFormats": wmsInfoFormats,
+		"Bounds":      b,
+		"Mercator":    []string{fmt.Sprintf("%.2f", x1), fmt.Sprintf("%.2f", y1), fmt.Sprintf("%.2f", x2), fmt.Sprintf("%.2f", y2)},
+	})
+	if err != nil {
+		logRequestError(r, err)
+		writeWMSError(w, &ogcError{http.StatusInternalServerError, "NoApplicableCode", "", "internal error"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf.Bytes())
+}
+
+func serveWMSMap(w http.ResponseWriter, r *http.Request, q map[string]string) {
+	ogcRequests.Inc("wms", "GetMap")
+	v, oerr := parseWMSView(q)
+	if oerr != nil {
+		writeWMSError(w, oerr)
+		return
+	}
+	if f := q["FORMAT"]; f != "image/png" {
+		writeWMSError(w, &ogcError{http.StatusBadRequest, "InvalidFormat", "format", "format must be image/png"})
+		return
+	}
+	var bg *color.RGBA
+	if !strings.EqualFold(q["TRANSPARENT"], "TRUE") {
+		c := color.RGBA{255, 255, 255, 255}
+		if s := q["BGCOLOR"]; s != "" {
+			n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 32)
+			if err != nil || n > 0xffffff {
+				writeWMSError(w, ogcInvalid("bgcolor", "bgcolor must be 0xRRGGBB"))
+				return
+			}
+			c = color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 255}
+		}
+		bg = &c
+	}
+	stations, _, err := wxTiles.load()
+	if err != nil {
+		logRequestError(r, err)
+		writeWMSError(w, &ogcError{http.StatusServiceUnavailable, "NoApplicableCode", "", "weather data is not available"})
+		return
+	}
+	img := image.Image(renderStations(stations, v.width, v.height, v.zoom(), v.project))
+	if bg != nil {
+		out := image.NewRGBA(image.Rect(0, 0, v.width, v.height))
+		draw.Draw(out, out.Bounds(), image.NewUniform(*bg), image.Point{}, draw.Src)
+		draw.Draw(out, out.Bounds(), img, image.Point{}, draw.Over)
+		img = out
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(&buf, img); err != nil {
+		logRequestError(r, err)
+		writeWMSError(w, &ogcError{http.StatusInternalServerError, "NoApplicableCode", "", "internal error"})
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write(buf.Bytes())
+}
+
+// stationInfo is what GetFeatureInfo tells about a station.
+type stationInfo struct {
+	ICAO     string  `json:"icao"`
+	Lat      float64 `json:"-"`
+	Lng      float64 `json:"-"`
+	Category string  `json:"category,omitempty"`
+	Metar    string  `json:"metar"`
+	TAF      string  `json:"taf,omitempty"`
+}
+
+var featureInfoHTML = htmltemplate.Must(htmltemplate.New("info").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Stations</title></head><body>
+{{- range .}}
+<h3>{{.ICAO}}{{if .Category}} ({{.Category}}){{end}}</h3>
+<p><code>{{.Metar}}</code></p>
+{{- if .TAF}}
+<p><code>{{.TAF}}</code></p>
+{{- end}}
+{{- else}}
+<p>No station here.</p>
+{{- end}}
+</body></html>
+`))
+
+func serveWMSFeatureInfo(w http.ResponseWriter, r *http.Request, q map[string]string) {
+	ogcRequests.Inc("wms", "GetFeatureInfo")
+	if q["QUERY_LAYERS"] == "" {
+		writeWMSError(w, ogcMissing("query_layers"))
+		return
+	}
+	v, oerr := parseWMSView(map[string]string{
+		"LAYERS": q["QUERY_LAYERS"], "STYLES": q["STYLES"], "VERSION": q["VERSION"], "CRS": q["CRS"], "SRS": q["SRS"],
+		"BBOX": q["BBOX"], "WIDTH": q["WIDTH"], "HEIGHT": q["HEIGHT"],
+	})
+	if oerr != nil {
+		if oerr.locator == "layers" {
+			oerr.locator = "query_layers"
+		}
+		writeWMSError(w, oerr)
+		return
+	}
+	iName, jName := "I", "J"
+	if q["I"] == "" && q["X"] != "" {
+		iName, jName = "X", "Y"
+	}
+	i, erri := strconv.Atoi(q[iName])
+	j, errj := strconv.Atoi(q[jName])
+	if erri != nil || errj != nil || i < 0 || j < 0 || i >= v.width || j >= v.height {
+		writeWMSError(w, &ogcError{http.StatusBadRequest, "InvalidPoint", strings.ToLower(iName), fmt.Sprintf("%s and %s must be a pixel of the map", iName, jName)})
+		return
+	}
+	format := q["INFO_FORMAT"]
+	if format == "" {
+		format = "text/plain"
+	}
+	known := false
+	for _, f := range wmsInfoFormats {
+		known = known || f == format
+	}
+	if !known {
+		writeWMSError(w, &ogcError{http.StatusBadRequest, "InvalidFormat", "info_format", "info_format must be one of " + strings.Join(wmsInfoFormats, ", ")})
+		return
+	}
+	count := 1
+	if s := q["FEATURE_COUNT"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeWMSError(w, ogcInvalid("feature_count", "feature_count must be a positive number"))
+			return
+		}
+		count = min(n, maxFeatureCount)
+	}
+	stations, _, err := wxTiles.load()
+	if err != nil {
+		logRequestError(r, err)
+		writeWMSError(w, &ogcError{http.StatusServiceUnavailable, "NoApplicableCode", "", "weather data is not available"})
+		return
+	}
+	found := nearestToPixel(stations, v, float64(i)+0.5, float64(j)+0.5, count)
+	switch format {
+	case "text/plain":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(found) == 0 {
+			fmt.Fprintln(w, "No station here.")
+		}
+		for k, s := range found {
+			if k > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintln(w, s.ICAO)
+			fmt.Fprintln(w, "METAR", s.Metar)
+			if s.TAF != "" {
+				fmt.Fprintln(w, s.TAF)
+			}
+		}
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := featureInfoHTML.Execute(w, found); err != nil {
+			logRequestError(r, err)
+		}
+	default:
+		type feature struct {
+			Type       string         `json:"type"`
+			Geometry   map[string]any `json:"geometry"`
+			Properties stationInfo    `json:"properties"`
+		}
+		fc := struct {
+			Type     string    `json:"type"`
+			Features []feature `json:"features"`
+		}{Type: "FeatureCollection", Features: []feature{}}
+		for _, s := range found {
+			fc.Features = append(fc.Features, feature{
+				Type:       "Feature",
+				Geometry:   map[string]any{"type": "Point", "coordinates": []float64{s.Lng, s.Lat}},
+				Properties: s,
+			})
+		}
+		w.Header().Set("Content-Type", format)
+		json.NewEncoder(w).Encode(fc)
+	}
+}
+
+// nearestToPixel is up to n stations within featureInfoRadius of x, y on
+// the view, nearest first.
+func nearestToPixel(stations []tileStation, v wmsView, x, y float64, n int) []stationInfo {
+	type hit struct {
+		s    tileStation
+		dist float64
+	}
+	var hits []hit
+	for _, s := range stations {
+		p := v.project(s.lat, s.lng)
+		if d := math.Hypot(p.X-x, p.Y-y); d <= featureInfoRadius {
+			hits = append(hits, hit{s, d})
+		}
+	}
+	sort.Slice(hits, func(a, b int) bool { return hits[a].dist < hits[b].dist })
+	out := []stationInfo{}
+	for _, h := range hits {
+		if len(out) == n {
+			break
+		}
+		info := stationInfo{ICAO: h.s.wx.ICAO, Lat: h.s.lat, Lng: h.s.lng, Metar: h.s.wx.Metar, TAF: plainText(h.s.wx.TAF)}
+		if cat := flightCategory(stationCeiling(h.s), stationVisibility(h.s)); !math.IsNaN(cat) {
+			info.Category = categoryNames[int(cat)]
+		}
+		out = append(out, info)
+	}
+	return out
+}
@@ -0,0 +1,445 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// Two-dimensional drawing for the station model and the weather tiles. A
+// painter draws in its own units; svgPainter writes SVG elements and
+// rasterPainter fills an image.RGBA with a small antialiased scanline
+// rasterizer and a built-in bitmap font, so PNGs need no font files.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+type pt struct{ X, Y float64 }
+
+type textAnchor int
+
+const (
+	anchorStart textAnchor = iota
+	anchorMiddle
+	anchorEnd
+)
+
+type painter interface {
+	// polygon fills a closed shape.
+	polygon(pts []pt, fill color.RGBA)
+	// polyline strokes an open path with round joins.
+	polyline(pts []pt, width float64, stroke color.RGBA)
+	// circle fills and, when width > 0, outlines a circle.
+	circle(c pt, r float64, fill color.RGBA, width float64, stroke color.RGBA)
+	// text draws s with its baseline at p. size is the cap height; halo
+	// draws a white outline first so the text reads over a busy map.
+	text(p pt, size float64, anchor textAnchor, fill color.RGBA, halo bool, s string)
+}
+
+var (
+	colorNone  = color.RGBA{}
+	colorBlack = color.RGBA{0, 0, 0, 255}
+	colorWhite = color.RGBA{255, 255, 255, 255}
+)
+
+// parseHexColor reads #rgb, #rrggbb or white, falling back to grey.
+func parseHexColor(s string) color.RGBA {
+	var r, g, b uint8
+	if s == "white" {
+		return colorWhite
+	}
+	switch len(s) {
+	case 7:
+		if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err == nil {
+			return color.RGBA{r, g, b, 255}
+		}
+	case 4:
+		if _, err := fmt.Sscanf(s, "#%1x%1x%1x", &r, &g, &b); err == nil {
+			return color.RGBA{r * 17, g * 17, b * 17, 255}
+		}
+	}
+	return color.RGBA{128, 128, 128, 255}
+}
+
+func svgColor(c color.RGBA) string {
+	if c.A == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func svgPoints(pts []pt) string {
+	parts := make([]string, len(pts))
+	for i, p := range pts {
+		parts[i] = fmt.Sprintf("%.2f,%.2f", p.X, p.Y)
+	}
+	return strings.Join(parts, " ")
+}
+
+// svgPainter collects SVG elements; writeSVG wraps them in a document.
+type svgPainter struct {
+	b strings.Builder
+}
+
+func (s *svgPainter) polygon(pts []pt, fill color.RGBA) {
+	fmt.Fprintf(&s.b, `<polygon points="%s" fill="%s"/>`+"\n", svgPoints(pts), svgColor(fill))
+}
+
+func (s *svgPainter) polyline(pts []pt, width float64, stroke color.RGBA) {
+	fmt.Fprintf(&s.b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="%.2f" stroke-linecap="round" stroke-linejoin="round"/>`+"\n",
+		svgPoints(pts), svgColor(stroke), width)
+}
+
+func (s *svgPainter) circle(c pt, r float64, fill color.RGBA, width float64, stroke color.RGBA) {
+	fmt.Fprintf(&s.b, `<circle cx="%.2f" cy="%.2f" r="%.2f" fill="%s"`, c.X, c.Y, r, svgColor(fill))
+	if width > 0 {
+		fmt.Fprintf(&s.b, ` stroke="%s" stroke-width="%.2f"`, svgColor(stroke), width)
+	}
+	s.b.WriteString("/>\n")
+}
+
+func (s *svgPainter) text(p pt, size float64, anchor textAnchor, fill color.RGBA, halo bool, str string) {
+	anchors := [...]string{"start", "middle", "end"}
+	// Arial's cap height is about 0.72 of its font size.
+	fmt.Fprintf(&s.b, `<text x="%.2f" y="%.2f" font-family="Arial, Helvetica, sans-serif" font-size="%.2f" text-anchor="%s" fill="%s"`,
+		p.X, p.Y, size/0.72, anchors[anchor], svgColor(fill))
+	if halo {
+		fmt.Fprintf(&s.b, ` stroke="#ffffff" stroke-width="%.2f" paint-order="stroke"`, size/3)
+	}
+	s.b.WriteString(">")
+	xmlEscape(&s.b, str)
+	s.b.WriteString("</text>\n")
+}
+
+func xmlEscape(b *strings.Builder, s string) {
+	for _, r := range s {
+		switch r {
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '&':
+			b.WriteString("&amp;")
+		case '"':
+			b.WriteString("&quot;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// writeSVG writes the collected elements as a document of width x height
+// pixels showing the viewBox 0 0 vw vh.
+func (s *svgPainter) writeSVG(w io.Writer, width, height int, vw, vh float64) error {
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %g %g">`+"\n%s</svg>\n",
+		width, height, vw, vh, s.b.String())
+	return err
+}
+
+// rasterPainter draws into img; its units are scaled by scale and then
+// offset by origin pixels.
+type rasterPainter struct {
+	img    *image.RGBA
+	scale  float64
+	origin pt
+}
+
+func newRasterPainter(width, height int, scale float64) *rasterPainter {
+	return &rasterPainter{img: image.NewRGBA(image.Rect(0, 0, width, height)), scale: scale}
+}
+
+func (r *rasterPainter) px(p pt) pt {
+	return pt{p.X*r.scale + r.origin.X, p.Y*r.scale + r.origin.Y}
+}
+
+func (r *rasterPainter) polygon(pts []pt, fill color.RGBA) {
+	dev := make([]pt, len(pts))
+	for i, p := range pts {
+		dev[i] = r.px(p)
+	}
+	r.fillNonZero([][]pt{dev}, fill)
+}
+
+func (r *rasterPainter) polyline(pts []pt, width float64, stroke color.RGBA) {
+	var paths [][]pt
+	hw := width * r.scale / 2
+	for i := 0; i+1 < len(pts); i++ {
+		a, b := r.px(pts[i]), r.px(pts[i+1])
+		dx, dy := b.X-a.X, b.Y-a.Y
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			continue
+		}
+		nx, ny := -dy/l*hw, dx/l*hw
+		paths = append(paths, clockwise([]pt{{a.X + nx, a.Y + ny}, {b.X + nx, b.Y + ny}, {b.X - nx, b.Y - ny}, {a.X - nx, a.Y - ny}}))
+	}
+	for _, p := range pts {
+		paths = append(paths, circlePath(r.px(p), hw, 12))
+	}
+	// One fill for every piece keeps overlaps from being painted twice.
+	r.fillNonZero(paths, stroke)
+}
+
+func (r *rasterPainter) circle(c pt, rad float64, fill color.RGBA, width float64, stroke color.RGBA) {
+	dc := r.px(c)
+	dr := rad * r.scale
+	n := int(math.Max(16, math.Min(96, dr*2)))
+	if fill.A > 0 {
+		r.fillNonZero([][]pt{circlePath(dc, dr, n)}, fill)
+	}
+	if width > 0 {
+		hw := width * r.scale / 2
+		outer := circlePath(dc, dr+hw, n)
+		inner := circlePath(dc, math.Max(0, dr-hw), n)
+		// Reverse the inner ring so the nonzero rule leaves a hole.
+		for i, j := 0, len(inner)-1; i < j; i, j = i+1, j-1 {
+			inner[i], inner[j] = inner[j], inner[i]
+		}
+		r.fillNonZero([][]pt{outer, inner}, stroke)
+	}
+}
+
+// clockwise reverses p if needed so that every piece of a union winds the
+// same way; otherwise the nonzero rule would cut holes where they overlap.
+func clockwise(p []pt) []pt {
+	area := 0.0
+	for i := range p {
+		q := p[(i+1)%len(p)]
+		area += p[i].X*q.Y - q.X*p[i].Y
+	}
+	if area < 0 {
+		for i, j := 0, len(p)-1; i < j; i, j = i+1, j-1 {
+			p[i], p[j] = p[j], p[i]
+		}
+	}
+	return p
+}
+
+// circlePath is a clockwise polygon (on screen, y down) around c.
+func circlePath(c pt, rad float64, n int) []pt {
+	out := make([]pt, n)
+	for i := range out {
+		a := 2 * math.Pi * float64(i) / float64(n)
+		out[i] = pt{c.X + rad*math.Cos(a), c.Y + rad*math.Sin(a)}
+	}
+	return out
+}
+
+func (r *rasterPainter) text(p pt, size float64, anchor textAnchor, fill color.RGBA, halo bool, s string) {
+	cell := size / fontHeight
+	width := textWidth(s, size)
+	x := p.X
+	switch anchor {
+	case anchorMiddle:
+		x -= width / 2
+	case anchorEnd:
+		x -= width
+	}
+	top := p.Y - size
+	if halo {
+		r.glyphs(s, x, top, cell, cell*0.9, colorWhite)
+	}
+	r.glyphs(s, x, top, cell, 0, fill)
+}
+
+// glyphs fills the lit cells of each character, grown by pad on every side.
+func (r *rasterPainter) glyphs(s string, x, top, cell, pad float64, c color.RGBA) {
+	var paths [][]pt
+	for _, ch := range strings.ToUpper(s) {
+		g, ok := font5x7[ch]
+		if !ok {
+			g = font5x7['?']
+		}
+		for row, bits := range g {
+			for col := 0; col < fontWidth; col++ {
+				if bits[col] != '#' {
+					continue
+				}
+				x0 := x + float64(col)*cell - pad
+				y0 := top + float64(row)*cell - pad
+				x1, y1 := x0+cell+2*pad, y0+cell+2*pad
+				// Clockwise on screen, like circlePath.
+				paths = append(paths, []pt{r.px(pt{x0, y0}), r.px(pt{x1, y0}), r.px(pt{x1, y1}), r.px(pt{x0, y1})})
+			}
+		}
+		x += float64(fontWidth+1) * cell
+	}
+	r.fillNonZero(paths, c)
+}
+
+// textWidth is how wide the raster font draws s at cap height size.
+func textWidth(s string, size float64) float64 {
+	n := len([]rune(s))
+	if n == 0 {
+		return 0
+	}
+	return float64(n*(fontWidth+1)-1) * size / fontHeight
+}
+
+// fillNonZero scan-converts paths with the nonzero winding rule, taking
+// four samples down each pixel and exact horizontal coverage for
+// antialiasing, and blends c over the image.
+func (r *rasterPainter) fillNonZero(paths [][]pt, c color.RGBA) {
+	if c.A == 0 {
+		return
+	}
+	b := r.img.Bounds()
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	type edge struct {
+		x0, y0, x1, y1 float64
+		dir            int
+	}
+	var edges []edge
+	for _, p := range paths {
+		for i := range p {
+			a, q := p[i], p[(i+1)%len(p)]
+			if a.Y == q.Y {
+				continue
+			}
+			e := edge{a.X, a.Y, q.X, q.Y, 1}
+			if a.Y > q.Y {
+				e = edge{q.X, q.Y, a.X, a.Y, -1}
+			}
+			edges = append(edges, e)
+			minY = math.Min(minY, e.y0)
+			maxY = math.Max(maxY, e.y1)
+		}
+	}
+	if len(edges) == 0 {
+		return
+	}
+	y0 := int(math.Max(float64(b.Min.Y), math.Floor(minY)))
+	y1 := int(math.Min(float64(b.Max.Y), math.Ceil(maxY)))
+	w := b.Dx()
+	cover := make([]float64, w+1)
+	type cross struct {
+		x   float64
+		dir int
+	}
+	const sub = 4
+	var xs []cross
+	for y := y0; y < y1; y++ {
+		for i := range cover {
+			cover[i] = 0
+		}
+		lo, hi := w, -1
+		for s := 0; s < sub; s++ {
+			sy := float64(y) + (float64(s)+0.5)/sub
+			xs = xs[:0]
+			for _, e := range edges {
+				if sy < e.y0 || sy >= e.y1 {
+					continue
+				}
+				t := (sy - e.y0) / (e.y1 - e.y0)
+				xs = append(xs, cross{e.x0 + t*(e.x1-e.x0), e.dir})
+			}
+			sort.Slice(xs, func(i, j int) bool { return xs[i].x < xs[j].x })
+			wind := 0
+			for i := 0; i+1 < len(xs); i++ {
+				wind += xs[i].dir
+				if wind == 0 {
+					continue
+				}
+				a := math.Max(xs[i].x-float64(b.Min.X), 0)
+				z := math.Min(xs[i+1].x-float64(b.Min.X), float64(w))
+				if z <= a {
+					continue
+				}
+				ia, iz := int(a), int(z)
+				if ia < lo {
+					lo = ia
+				}
+				if iz > hi {
+					hi = iz
+				}
+				if ia == iz {
+					cover[ia] += (z - a) / sub
+					continue
+				}
+				cover[ia] += (float64(ia+1) - a) / sub
+				for x := ia + 1; x < iz; x++ {
+					cover[x] += 1.0 / sub
+				}
+				if iz < w {
+					cover[iz] += (z - float64(iz)) / sub
+				}
+			}
+		}
+		for x := lo; x <= hi && x < w; x++ {
+			if x < 0 || cover[x] <= 0 {
+				continue
+			}
+			blend(r.img, b.Min.X+x, y, c, math.Min(cover[x], 1))
+		}
+	}
+}
+
+// blend composites c at coverage a over the pixel (premultiplied RGBA).
+func blend(img *image.RGBA, x, y int, c color.RGBA, a float64) {
+	i := img.PixOffset(x, y)
+	p := img.Pix[i : i+4 : i+4]
+	sa := float64(c.A) / 255 * a
+	inv := 1 - sa
+	p[0] = uint8(float64(c.R)*sa + float64(p[0])*inv + 0.5)
+	p[1] = uint8(float64(c.G)*sa + float64(p[1])*inv + 0.5)
+	p[2] = uint8(float64(c.B)*sa + float64(p[2])*inv + 0.5)
+	p[3] = uint8(255*sa + float64(p[3])*inv + 0.5)
+}
+
+const (
+	fontWidth  = 5
+	fontHeight = 7
+)
+
+// font5x7 is a 5x7 bitmap font covering what station plots need.
+var font5x7 = map[rune][fontHeight]string{
+	' ': {".....", ".....", ".....", ".....", ".....", ".....", "....."},
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"#####", "...#.", "..#..", "...#.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'B': {"####.", "#...#", "#...#", "####.", "#...#", "#...#", "####."},
+	'C': {".###.", "#...#", "#....", "#....", "#....", "#...#", ".###."},
+	'D': {"###..", "#..#.", "#...#", "#...#", "#...#", "#..#.", "###.."},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'F': {"#####", "#....", "#....", "####.", "#....", "#....", "#...."},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".####"},
+	'H': {"#...#", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'I': {".###.", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'J': {"..###", "...#.", "...#.", "...#.", "...#.", "#..#.", ".##.."},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#"},
+	'O': {".###.", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'Q': {".###.", "#...#", "#...#", "#...#", "#.#.#", "#..#.", ".##.#"},
+	'R': {"####.", "#...#", "#...#", "####.", "#.#..", "#..#.", "#...#"},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'U': {"#...#", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'V': {"#...#", "#...#", "#...#", "#...#", "#...#", ".#.#.", "..#.."},
+	'W': {"#...#", "#...#", "#...#", "#.#.#", "#.#.#", "#.#.#", ".#.#."},
+	'X': {"#...#", "#...#", ".#.#.", "..#..", ".#.#.", "#...#", "#...#"},
+	'Y': {"#...#", "#...#", ".#.#.", "..#..", "..#..", "..#..", "..#.."},
+	'Z': {"#####", "....#", "...#.", "..#..", ".#...", "#....", "#####"},
+	'-': {".....", ".....", ".....", "#####", ".....", ".....", "....."},
+	'+': {".....", "..#..", "..#..", "#####", "..#..", "..#..", "....."},
+	'/': {".....", "....#", "...#.", "..#..", ".#...", "#....", "....."},
+	'.': {".....", ".....", ".....", ".....", ".....", ".##..", ".##.."},
+	',': {".....", ".....", ".....", ".....", ".##..", "..#..", ".#..."},
+	':': {".....", ".##..", ".##..", ".....", ".##..", ".##..", "....."},
+	'?': {".###.", "#...#", "....#", "...#.", "..#..", ".....", "..#.."},
+	'*': {".....", "..#..", "#.#.#", ".###.", "#.#.#", "..#..", "....."},
+	'°': {".##..", "#..#.", "#..#.", ".##..", ".....", ".....", "....."},
+}
@@ -0,0 +1,346 @@
+//go:build !getwx && !websocket
+
+package main
+
+// Flight planning against the winds aloft:
+// ?req=plan&route=KRAC+KMSN&altitude=6500&tas=120&burn=9.5 works out the
+// true heading, groundspeed, time and fuel of every leg and of the route,
+// and which winds aloft level would be quickest. Winds come from the FB
+// forecasts weather.txt carries, interpolated between levels and between
+// the nearest forecast stations every few miles along each leg. Headings
+// and courses are true.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// planStepNM is how often along a leg the wind is worked out again.
+	planStepNM = 25
+	// windsStations and windsRadiusNM pick the forecasts a point's wind is
+	// interpolated from.
+	windsStations = 3
+	windsRadiusNM = 300
+)
+
+type planQuery struct {
+	names       []string
+	altitude    int
+	tas         float64
+	burn        float64
+	maxAltitude int
+}
+
+func parsePlanQuery(route, altitude, tas, burn, maxAltitude string) (planQuery, error) {
+	rq, err := parseRouteQuery(route, "", altitude)
+	if err != nil {
+		return planQuery{}, err
+	}
+	q := planQuery{names: rq.names, altitude: rq.altitude}
+	if altitude == "" {
+		return q, errors.New("altitude is required")
+	}
+	if q.tas, err = strconv.ParseFloat(tas, 64); err != nil || !(q.tas > 0) || q.tas > 1000 {
+		return q, errors.New("tas must be the true airspeed in knots")
+	}
+	if burn != "" {
+		if q.burn, err = strconv.ParseFloat(burn, 64); err != nil || !(q.burn >= 0) || math.IsInf(q.burn, 0) {
+			return q, errors.New("burn must be the fuel burn per hour")
+		}
+	}
+	q.maxAltitude = max(q.altitude, 12000)
+	if maxAltitude != "" {
+		if q.maxAltitude, err = strconv.Atoi(maxAltitude); err != nil || q.maxAltitude < standardLevels[0] {
+			return q, fmt.Errorf("max_altitude must be at least %d", standardLevels[0])
+		}
+	}
+	return q, nil
+}
+
+// windsStation is an FB forecast with its position.
+type windsStation struct {
+	ident    string
+	lat, lng float64
+	levels   []windsLevel
+}
+
+// windComponents is a wind as the east and north components of the
+// direction it blows towards, so winds can be averaged.
+type windComponents struct {
+	u, v float64
+}
+
+func windFrom(dir, speed float64) windComponents {
+	r := toRad(dir)
+	return windComponents{-speed * math.Sin(r), -speed * math.Cos(r)}
+}
+
+func (w windComponents) dirSpeed() (dir, speed float64) {
+	speed = math.Hypot(w.u, w.v)
+	if speed < 0.5 {
+		return 0, 0
+	}
+	dir = math.Mod(math.Atan2(-w.u, -w.v)*180/math.Pi+360, 360)
+	return dir, speed
+}
+
+// at is the station's wind at altitude, interpolated between the levels
+// either side of it. Below the lowest level it has, that level is used,
+// and the same above the highest.
+func (s windsStation) at(altitude int) windComponents {
+	l := s.levels
+	if altitude <= l[0].Level {
+		return windFrom(float64(l[0].Dir), float64(l[0].Speed))
+	}
+	for k := 1; k < len(l); k++ {
+		if altitude <= l[k].Level {
+			t := float64(altitude-l[k-1].Level) / float64(l[k].Level-l[k-1].Level)
+			a := windFrom(float64(l[k-1].Dir), float64(l[k-1].Speed))
+			b := windFrom(float64(l[k].Dir), float64(l[k].Speed))
+			return windComponents{a.u + t*(b.u-a.u), a.v + t*(b.v-a.v)}
+		}
+	}
+	last := l[len(l)-1]
+	return windFrom(float64(last.Dir), float64(last.Speed))
+}
+
+// windAt is the wind at lat/lng and altitude, weighted by inverse distance
+// from the nearest forecast stations, and the stations used. With none in
+// reach it is calm.
+func windAt(stations []windsStation, lat, lng float64, altitude int) (windComponents, []string) {
+	type near struct {
+		s windsStation
+		d float64
+	}
+	var nearest []near
+	for _, s := range stations {
+		if d := gcDistance(lat, lng, s.lat, s.lng); d <= windsRadiusNM {
+			nearest = append(nearest, near{s, d})
+		}
+	}
+	sort.Slice(nearest, func(i, j int) bool { return nearest[i].d < nearest[j].d })
+	if len(nearest) > windsStations {
+		nearest = nearest[:windsStations]
+	}
+	var sum windComponents
+	var weights float64
+	var used []string
+	for _, n := range nearest {
+		w := n.s.at(altitude)
+		if n.d < 1 {
+			return w, []string{n.s.ident}
+		}
+		weight := 1 / (n.d * n.d)
+		sum.u += weight * w.u
+		sum.v += weight * w.v
+		weights += weight
+		used = append(used, n.s.ident)
+	}
+	if weights == 0 {
+		return windComponents{}, nil
+	}
+	return windComponents{sum.u / weights, sum.v / weights}, used
+}
+
+// windTriangle is the true heading and groundspeed for course at tas in
+// wind w. ok is false when the crosswind is more than the airspeed.
+func windTriangle(course, tas float64, w windComponents) (heading, gs float64, ok bool) {
+	wd, ws := w.dirSpeed()
+	angle := toRad(wd - course)
+	cross := ws * math.Sin(angle)
+	if math.Abs(cross) >= tas {
+		return 0, 0, false
+	}
+	wca := math.Asin(cross / tas)
+	gs = tas*math.Cos(wca) - ws*math.Cos(angle)
+	if gs <= 0 {
+		return 0, 0, false
+	}
+	heading = math.Mod(course+wca*180/math.Pi+360, 360)
+	return heading, gs, true
+}
+
+// interpolatePoint is the point fraction t of the way along the great
+// circle from a to b.
+func interpolatePoint(a, b waypoint, t float64) (lat, lng float64) {
+	p1, l1, p2, l2 := toRad(a.Lat), toRad(a.Lng), toRad(b.Lat), toRad(b.Lng)
+	d := (b.DistanceNM - a.DistanceNM) / earthRadiusNM
+	if d == 0 {
+		return a.Lat, a.Lng
+	}
+	s1, s2 := math.Sin((1-t)*d)/math.Sin(d), math.Sin(t*d)/math.Sin(d)
+	x := s1*math.Cos(p1)*math.Cos(l1) + s2*math.Cos(p2)*math.Cos(l2)
+	y := s1*math.Cos(p1)*math.Sin(l1) + s2*math.Cos(p2)*math.Sin(l2)
+	z := s1*math.Sin(p1) + s2*math.Sin(p2)
+	return math.Atan2(z, math.Hypot(x, y)) * 180 / math.Pi, math.Atan2(y, x) * 180 / math.Pi
+}
+
+type planLeg struct {
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	DistanceNM  float64  `json:"distance_nm"`
+	Course      float64  `json:"course"`
+	Heading     float64  `json:"heading"`
+	WindDir     float64  `json:"wind_dir"`
+	WindSpeed   float64  `json:"wind_speed"`
+	Groundspeed float64  `json:"groundspeed"`
+	ETEMinutes  float64  `json:"ete_min"`
+	Fuel        float64  `json:"fuel,omitempty"`
+	Winds       []string `json:"winds_from,omitempty"`
+}
+
+type planAltitude struct {
+	AltitudeFt  int     `json:"altitude_ft"`
+	Groundspeed float64 `json:"groundspeed"`
+	ETEMinutes  float64 `json:"ete_min"`
+	Fuel        float64 `json:"fuel,omitempty"`
+}
+
+type flightPlan struct {
+	Route         []waypoint     `json:"route"`
+	AltitudeFt    int            `json:"altitude_ft"`
+	TAS           float64        `json:"tas"`
+	Burn          float64        `json:"burn,omitempty"`
+	Legs          []planLeg      `json:"legs"`
+	TotalNM       float64        `json:"total_nm"`
+	ETEMinutes    float64        `json:"ete_min"`
+	Fuel          float64        `json:"fuel,omitempty"`
+	WindsStations int            `json:"winds_stations"`
+	Altitudes     []planAltitude `json:"altitudes"`
+	BestAltitude  int            `json:"best_altitude_ft,omitempty"`
+	NoWindsAloft  bool           `json:"no_winds_aloft,omitempty"`
+}
+
+// flyLeg works out one leg at altitude, a step at a time.
+func flyLeg(a, b waypoint, stations []windsStation, altitude int, tas float64) (planLeg, error) {
+	leg := planLeg{From: a.Ident, To: b.Ident, DistanceNM: b.DistanceNM - a.DistanceNM}
+	steps := max(1, int(math.Ceil(leg.DistanceNM/planStepNM)))
+	var hours float64
+	seen := map[string]bool{}
+	for s := 0; s < steps; s++ {
+		lat, lng := interpolatePoint(a, b, (float64(s)+0.5)/float64(steps))
+		nlat, nlng := interpolatePoint(a, b, (float64(s)+1)/float64(steps))
+		course := math.Mod(gcBearing(lat, lng, nlat, nlng)*180/math.Pi+360, 360)
+		w, used := windAt(stations, lat, lng, altitude)
+		heading, gs, ok := windTriangle(course, tas, w)
+		if !ok {
+			return leg, fmt.Errorf("%s-%s: the wind at %dft is stronger than the airspeed", a.Ident, b.Ident, altitude)
+		}
+		hours += leg.DistanceNM / float64(steps) / gs
+		for _, id := range used {
+			if !seen[id] {
+				seen[id] = true
+				leg.Winds = append(leg.Winds, id)
+			}
+		}
+		// The middle step stands for the leg in the output.
+		if s == steps/2 {
+			leg.Course, leg.Heading = course, heading
+			leg.WindDir, leg.WindSpeed = w.dirSpeed()
+		}
+	}
+	if leg.DistanceNM > 0 {
+		leg.Groundspeed = leg.DistanceNM / hours
+	} else {
+		leg.Groundspeed = tas
+	}
+	leg.ETEMinutes = hours * 60
+	return leg, nil
+}
+
+// planRoute flies the route at the requested altitude and at every winds
+// aloft level up to the maximum, to find the quickest. Without any winds
+// aloft every level would come out the same, so the plan is flown in calm
+// wind, flagged NoWindsAloft, and suggests no altitude.
+func planRoute(q planQuery) (*flightPlan, error) {
+	all, _, err := readWeatherData()
+	if err != nil {
+		return nil, err
+	}
+	route, err := resolveWaypoints(q.names, all)
+	if err != nil {
+		return nil, err
+	}
+	var stations []windsStation
+	for _, wx := range all {
+		levels := decodeWinds(wx.UpWinds)
+		lat, err1 := strconv.ParseFloat(wx.Lat, 64)
+		lng, err2 := strconv.ParseFloat(wx.Lng, 64)
+		if levels == nil || err1 != nil || err2 != nil {
+			continue
+		}
+		stations = append(stations, windsStation{ident: strings.TrimSpace(wx.ICAO), lat: lat, lng: lng, levels: levels})
+	}
+	fly := func(altitude int) ([]planLeg, float64, error) {
+		var legs []planLeg
+		var minutes float64
+		for k := 0; k+1 < len(route); k++ {
+			leg, err := flyLeg(route[k], route[k+1], stations, altitude, q.tas)
+			if err != nil {
+				return nil, 0, err
+			}
+			legs = append(legs, leg)
+			minutes += leg.ETEMinutes
+		}
+		return legs, minutes, nil
+	}
+	legs, minutes, err := fly(q.altitude)
+	if err != nil {
+		return nil, &planError{err}
+	}
+	total := route[len(route)-1].DistanceNM
+	p := &flightPlan{Route: route, AltitudeFt: q.altitude, TAS: q.tas, Burn: q.burn, TotalNM: total,
+		ETEMinutes: minutes, Fuel: minutes / 60 * q.burn, WindsStations: len(stations), Altitudes: []planAltitude{}}
+	for _, leg := range legs {
+		leg.Fuel = leg.ETEMinutes / 60 * q.burn
+		p.Legs = append(p.Legs, roundLeg(leg))
+	}
+	p.NoWindsAloft = len(stations) == 0
+	bestMinutes := math.Inf(1)
+	for _, level := range standardLevels {
+		if level > q.maxAltitude || p.NoWindsAloft {
+			break
+		}
+		_, m, err := fly(level)
+		if err != nil {
+			continue
+		}
+		alt := planAltitude{AltitudeFt: level, ETEMinutes: round1(m), Fuel: round1(m / 60 * q.burn)}
+		if m > 0 {
+			alt.Groundspeed = math.Round(total / (m / 60))
+		}
+		p.Altitudes = append(p.Altitudes, alt)
+		if m < bestMinutes {
+			bestMinutes, p.BestAltitude = m, level
+		}
+	}
+	for k := range p.Route {
+		p.Route[k].DistanceNM = round1(p.Route[k].DistanceNM)
+	}
+	p.TotalNM, p.ETEMinutes, p.Fuel = round1(p.TotalNM), round1(p.ETEMinutes), round1(p.Fuel)
+	return p, nil
+}
+
+// planError is a plan that cannot be flown as asked, as opposed to data
+// that could not be read.
+type planError struct {
+	err error
+}
+
+func (e *planError) Error() string { return e.err.Error() }
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+func roundLeg(l planLeg) planLeg {
+	l.DistanceNM, l.ETEMinutes, l.Fuel = round1(l.DistanceNM), round1(l.ETEMinutes), round1(l.Fuel)
+	l.Course, l.Heading, l.WindDir = math.Round(l.Course), math.Round(l.Heading), math.Round(l.WindDir)
+	l.WindSpeed, l.Groundspeed = math.Round(l.WindSpeed), math.Round(l.Groundspeed)
+	return l
+}
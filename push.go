@@ -0,0 +1,262 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// Live updates for the map page: mapserver -serve streams what changed in
+// weather.txt and pireps.txt as Server-Sent Events on
+// /events?bounds=lng1,lat1,lng2,lat2. Every server.push_interval the files
+// are checked; when getwx has rewritten one, the stations that are new or
+// changed and the PIREPs that are new go to each client whose bounds they
+// are in, along with the ones that have gone. A client that falls behind
+// is dropped and reloads when its browser reconnects.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	pushBuffer    = 16
+	pushKeepAlive = 30 * time.Second
+	// pushRetryMS is how long browsers wait before reconnecting.
+	pushRetryMS = 10000
+)
+
+// pushUpdate is one event. Removed stations and PIREPs are listed by
+// ICAO and report text.
+type pushUpdate struct {
+	Stations        []weatherData `json:"stations,omitempty"`
+	RemovedStations []string      `json:"removed_stations,omitempty"`
+	Pireps          []pirepData   `json:"pireps,omitempty"`
+	RemovedPireps   []string      `json:"removed_pireps,omitempty"`
+}
+
+func (u *pushUpdate) empty() bool {
+	return len(u.Stations) == 0 && len(u.RemovedStations) == 0 && len(u.Pireps) == 0 && len(u.RemovedPireps) == 0
+}
+
+type pushClient struct {
+	bounds *Bounds // nil for everywhere
+	events chan *pushUpdate
+}
+
+// pushHub keeps the connected clients and, for the watcher alone, the
+// last copy of the files: each station's JSON, to tell when it changed,
+// and the PIREPs by report.
+type pushHub struct {
+	mu      sync.Mutex
+	clients map[*pushClient]bool
+
+	stations  map[string][]byte
+	pireps    map[string]bool
+	wxTime    time.Time
+	pirepTime time.Time
+}
+
+var pushClients = newGauge("push_clients", "Map pages connected to /events.")
+
+func newPushHub() *pushHub {
+	return &pushHub{clients: map[*pushClient]bool{}}
+}
+
+// watch checks the files every interval until ctx is done.
+func (h *pushHub) watch(ctx context.Context, interval time.Duration) {
+	// The first look only takes the snapshot.
+	h.check()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.check()
+		}
+	}
+}
+
+// check works out what changed since the last look and sends it on.
+func (h *pushHub) check() {
+	u := &pushUpdate{}
+	first := h.stations == nil
+	if st, err := os.Stat(cfg.Path(cfg.Output.Weather)); err == nil && !st.ModTime().Equal(h.wxTime) {
+		list, err := ParseAirports(-180, -90, 180, 90)
+		if err != nil {
+			slog.Warn("push: reading weather", "err", err)
+		} else {
+			h.wxTime = st.ModTime()
+			h.diffStations(list, u)
+		}
+	}
+	if st, err := os.Stat(cfg.Path(cfg.Output.Pireps)); err == nil && !st.ModTime().Equal(h.pirepTime) {
+		list, err := parsePireps(-180, -90, 180, 90)
+		if err != nil {
+			slog.Warn("push: reading PIREPs", "err", err)
+		} else {
+			h.pirepTime = st.ModTime()
+			h.diffPireps(list, u)
+		}
+	}
+	if first || u.empty() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		cu := h.filter(u, c.bounds)
+		if cu.empty() {
+			continue
+		}
+		select {
+		case c.events <- cu:
+		default:
+			// Too far behind; closing makes the browser reconnect and
+			// reload everything.
+			h.drop(c)
+		}
+	}
+}
+
+func (h *pushHub) diffStations(list []weatherData, u *pushUpdate) {
+	next := make(map[string][]byte, len(list))
+	for _, wx := range list {
+		b, _ := json.Marshal(wx)
+		next[wx.ICAO] = b
+		if old, ok := h.stations[wx.ICAO]; !ok || !bytes.Equal(old, b) {
+			u.Stations = append(u.Stations, wx)
+		}
+	}
+	for id := range h.stations {
+		if _, ok := next[id]; !ok {
+			u.RemovedStations = append(u.RemovedStations, id)
+		}
+	}
+	h.stations = next
+}
+
+func (h *pushHub) diffPireps(list []pirepData, u *pushUpdate) {
+	next := make(map[string]bool, len(list))
+	for _, pr := range list {
+		next[pr.Report] = true
+		if !h.pireps[pr.Report] {
+			u.Pireps = append(u.Pireps, pr)
+		}
+	}
+	for report := range h.pireps {
+		if _, ok := next[report]; !ok {
+			u.RemovedPireps = append(u.RemovedPireps, report)
+		}
+	}
+	h.pireps = next
+}
+
+// filter keeps the part of u inside b. What has gone is sent to every
+// client; the page ignores anything it does not have.
+func (h *pushHub) filter(u *pushUpdate, b *Bounds) *pushUpdate {
+	if b == nil {
+		return u
+	}
+	in := func(lat, lng string) bool {
+		return inBox(lat, lng, b.LngMin, b.LatMin, b.LngMax, b.LatMax)
+	}
+	out := &pushUpdate{}
+	for _, wx := range u.Stations {
+		if in(wx.Lat, wx.Lng) {
+			out.Stations = append(out.Stations, wx)
+		}
+	}
+	for _, pr := range u.Pireps {
+		if in(pr.Lat, pr.Lng) {
+			out.Pireps = append(out.Pireps, pr)
+		}
+	}
+	out.RemovedStations, out.RemovedPireps = u.RemovedStations, u.RemovedPireps
+	return out
+}
+
+func (h *pushHub) add(b *Bounds) *pushClient {
+	c := &pushClient{bounds: b, events: make(chan *pushUpdate, pushBuffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+	pushClients.Set(float64(len(h.clients)))
+	return c
+}
+
+// drop closes a client's events; h.mu is held.
+func (h *pushHub) drop(c *pushClient) {
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.events)
+		pushClients.Set(float64(len(h.clients)))
+	}
+}
+
+func (h *pushHub) remove(c *pushClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(c)
+}
+
+// closeAll ends every stream, so the server can shut down.
+func (h *pushHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		h.drop(c)
+	}
+}
+
+// ServeHTTP streams the updates for the bounds in the query.
+func (h *pushHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b *Bounds
+	if s := r.FormValue("bounds"); s != "" {
+		v, err := parseViewBounds(s)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		b = &v
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	c := h.add(b)
+	defer h.remove(c)
+	fmt.Fprintf(w, "retry: %d\n\n", pushRetryMS)
+	if err := rc.Flush(); err != nil {
+		logRequestError(r, err)
+		return
+	}
+	ping := time.NewTicker(pushKeepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case u, ok := <-c.events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(u)
+			if err != nil {
+				logRequestError(r, err)
+				return
+			}
+			fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
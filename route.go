@@ -0,0 +1,388 @@
+//go:build !getwx && !websocket
+
+package main
+
+// Route briefings: ?req=route&route=KRAC+KMSN+43.5/-90.2&width=25&altitude=6000
+// returns the METARs, TAFs, winds aloft, PIREPs and advisories within width
+// nm of the great circle legs between the waypoints, in the order they come
+// along the route. Waypoints are stations in weather.txt, airports and
+// navaids by identifier, or lat/lng.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxWaypoints and maxCorridorNM keep one request from asking for
+	// the whole country.
+	maxWaypoints      = 50
+	maxCorridorNM     = 200
+	defaultCorridorNM = 25
+)
+
+// routeItem is one report along the route. DistanceNM is along the route
+// to the point abeam the report and OffsetNM how far off the route it is.
+type routeItem struct {
+	Kind       string  `json:"kind"`
+	Ident      string  `json:"ident,omitempty"`
+	Lat        float64 `json:"lat"`
+	Lng        float64 `json:"lng"`
+	DistanceNM float64 `json:"distance_nm"`
+	OffsetNM   float64 `json:"offset_nm"`
+	Text       string  `json:"text"`
+	Category   string  `json:"category,omitempty"`
+	AltitudeFt int     `json:"altitude_ft,omitempty"`
+	// Winds aloft at the level nearest the requested altitude.
+	LevelFt   int  `json:"level_ft,omitempty"`
+	WindDir   *int `json:"wind_dir,omitempty"`
+	WindSpeed *int `json:"wind_speed,omitempty"`
+	TempC     *int `json:"temp_c,omitempty"`
+	// Advisories.
+	Type   string `json:"type,omitempty"`
+	Hazard string `json:"hazard,omitempty"`
+	MinFt  int    `json:"min_ft,omitempty"`
+	MaxFt  int    `json:"max_ft,omitempty"`
+}
+
+type routeBriefing struct {
+	Route      []waypoint  `json:"route"`
+	TotalNM    float64     `json:"total_nm"`
+	WidthNM    float64     `json:"width_nm"`
+	AltitudeFt int         `json:"altitude_ft,omitempty"`
+	Items      []routeItem `json:"items"`
+}
+
+type routeQuery struct {
+	names    []string
+	width    float64
+	altitude int
+}
+
+// waypointError lists the waypoints that could not be found.
+type waypointError struct {
+	names []string
+}
+
+func (e *waypointError) Error() string {
+	return "unknown waypoints: " + strings.Join(e.names, ", ")
+}
+
+func parseRouteQuery(route, width, altitude string) (routeQuery, error) {
+	q := routeQuery{names: strings.FieldsFunc(strings.ToUpper(route), func(r rune) bool {
+		return r == ' ' || r == ',' || r == '+'
+	}), width: defaultCorridorNM}
+	if len(q.names) < 2 {
+		return q, errors.New("route needs at least two waypoints")
+	}
+	if len(q.names) > maxWaypoints {
+		return q, fmt.Errorf("route has more than %d waypoints", maxWaypoints)
+	}
+	if width != "" {
+		v, err := strconv.ParseFloat(width, 64)
+		if err != nil || !(v > 0) || v > maxCorridorNM {
+			return q, fmt.Errorf("width must be between 0 and %d nm", maxCorridorNM)
+		}
+		q.width = v
+	}
+	if altitude != "" {
+		v, err := strconv.Atoi(altitude)
+		if err != nil || v < 0 || v > 60000 {
+			return q, errors.New("altitude must be feet MSL between 0 and 60000")
+		}
+		q.altitude = v
+	}
+	return q, nil
+}
+
+var latLngRe = regexp.MustCompile(`^(-?\d+(?:\.\d+)?)/(-?\d+(?:\.\d+)?)$`)
+
+// resolveWaypoints finds each name among the weather stations, then the
+// airport database and the airports and navaids files. Those mix ICAO and
+// FAA identifiers, so KRAC and RAC find each other, and so do PANC and ANC
+// when the airport database has them.
+func resolveWaypoints(names []string, stations []weatherData) ([]waypoint, error) {
+	db, err := readAirportDB()
+	if err != nil {
+		return nil, err
+	}
+	route := make([]waypoint, len(names))
+	found := make([]bool, len(names))
+	want := make(map[string][]int)
+	for k, name := range names {
+		if m := latLngRe.FindStringSubmatch(name); m != nil {
+			lat, _ := strconv.ParseFloat(m[1], 64)
+			lng, _ := strconv.ParseFloat(m[2], 64)
+			if lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 {
+				route[k], found[k] = waypoint{Ident: name, Lat: lat, Lng: lng}, true
+				continue
+			}
+		}
+		for _, id := range db.aliases(name) {
+			want[id] = append(want[id], k)
+		}
+	}
+	set := func(ident string, lat, lng float64) {
+		for _, k := range want[ident] {
+			if !found[k] {
+				route[k], found[k] = waypoint{Ident: names[k], Lat: lat, Lng: lng}, true
+			}
+		}
+	}
+	for _, wx := range stations {
+		lat, err1 := strconv.ParseFloat(wx.Lat, 64)
+		lng, err2 := strconv.ParseFloat(wx.Lng, 64)
+		if err1 == nil && err2 == nil {
+			set(strings.ToUpper(wx.ICAO), lat, lng)
+		}
+	}
+	if db != nil && !allFound(found) {
+		for _, a := range db.Airports {
+			set(a.Ident, a.Lat, a.Lng)
+		}
+	}
+	for _, fname := range []string{cfg.Paths.Airports, cfg.Paths.Navaids} {
+		if fname == "" || allFound(found) {
+			continue
+		}
+		err := scanPointFile(cfg.Path(fname), func(ident string, lat, lng, _ float64) {
+			set(ident, lat, lng)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var missing []string
+	for k, ok := range found {
+		if !ok {
+			missing = append(missing, names[k])
+		}
+	}
+	if missing != nil {
+		return nil, &waypointError{missing}
+	}
+	for k := 1; k < len(route); k++ {
+		p, q := route[k-1], route[k]
+		route[k].DistanceNM = p.DistanceNM + gcDistance(p.Lat, p.Lng, q.Lat, q.Lng)
+	}
+	return route, nil
+}
+
+func allFound(found []bool) bool {
+	for _, ok := range found {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// scanPointFile reads "ident, lat, lng, elevation" lines, the format of
+// airports.txt, skipping any it cannot parse. A missing elevation is NaN.
+func scanPointFile(fname string, set func(ident string, lat, lng, elev float64)) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := csv.NewReader(bufio.NewReader(f))
+	reader.FieldsPerRecord = -1
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil || len(line) < 3 {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(line[1]), 64)
+		lng, err2 := strconv.ParseFloat(strings.TrimSpace(line[2]), 64)
+		elev := math.NaN()
+		if len(line) > 3 {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(line[3]), 64); err == nil {
+				elev = v
+			}
+		}
+		if err1 == nil && err2 == nil {
+			set(strings.ToUpper(strings.TrimSpace(line[0])), lat, lng, elev)
+		}
+	}
+}
+
+var (
+	pirepLevelRe   = regexp.MustCompile(`/FL(\d{3})`)
+	windsGroupRe   = regexp.MustCompile(`^(\d{4})([+-]\d{2}|\d{2})?$`)
+	standardLevels = []int{3000, 6000, 9000, 12000, 18000, 24000, 30000, 34000, 39000}
+)
+
+// pirepAltitude reads the /FL group of a PIREP as feet, 0 when absent.
+func pirepAltitude(report string) int {
+	if m := pirepLevelRe.FindStringSubmatch(report); m != nil {
+		fl, _ := strconv.Atoi(m[1])
+		return fl * 100
+	}
+	return 0
+}
+
+// windsLevel is one level of a winds aloft forecast. Temp is nil when the
+// level has none, as at 3000ft.
+type windsLevel struct {
+	Level, Dir, Speed int
+	Temp              *int
+}
+
+// decodeWinds reads winds aloft text in the FB format ("2714 2725+05 ..."),
+// whose groups are for 3000 to 39000ft with the low levels left out at high
+// stations. It returns nil when the text does not look like FB winds.
+func decodeWinds(text string) []windsLevel {
+	var groups [][]string
+	for _, w := range strings.Fields(text) {
+		if m := windsGroupRe.FindStringSubmatch(w); m != nil {
+			groups = append(groups, m)
+		}
+	}
+	if len(groups) == 0 || len(groups) > len(standardLevels) {
+		return nil
+	}
+	levels := standardLevels[len(standardLevels)-len(groups):]
+	out := make([]windsLevel, len(groups))
+	for k, m := range groups {
+		dir, _ := strconv.Atoi(m[1][:2])
+		speed, _ := strconv.Atoi(m[1][2:])
+		dir *= 10
+		switch {
+		case m[1] == "9900":
+			dir, speed = 0, 0
+		case dir > 360:
+			// Speeds of 100kt and more add 500 to the direction.
+			dir, speed = dir-500, speed+100
+		}
+		out[k] = windsLevel{Level: levels[k], Dir: dir, Speed: speed}
+		if m[2] != "" {
+			t, _ := strconv.Atoi(m[2])
+			if m[2][0] != '+' && m[2][0] != '-' {
+				// Above 24000ft the sign is left out; it is always minus.
+				t = -t
+			}
+			out[k].Temp = &t
+		}
+	}
+	return out
+}
+
+// windsAt is the level of text nearest altitude.
+func windsAt(text string, altitude int) (level, dir, speed int, temp *int, ok bool) {
+	levels := decodeWinds(text)
+	if levels == nil {
+		return 0, 0, 0, nil, false
+	}
+	best := levels[0]
+	for _, l := range levels {
+		if abs(l.Level-altitude) < abs(best.Level-altitude) {
+			best = l
+		}
+	}
+	return best.Level, best.Dir, best.Speed, best.Temp, true
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// briefRoute collects everything along the route.
+func briefRoute(q routeQuery) (*routeBriefing, error) {
+	stations, _, err := readWeatherData()
+	if err != nil {
+		return nil, err
+	}
+	route, err := resolveWaypoints(q.names, stations)
+	if err != nil {
+		return nil, err
+	}
+	b := &routeBriefing{Route: route, TotalNM: route[len(route)-1].DistanceNM, WidthNM: q.width, AltitudeFt: q.altitude, Items: []routeItem{}}
+	add := func(it routeItem) {
+		it.DistanceNM = math.Round(it.DistanceNM*10) / 10
+		it.OffsetNM = math.Round(it.OffsetNM*10) / 10
+		b.Items = append(b.Items, it)
+	}
+	for _, wx := range stations {
+		lat, err1 := strconv.ParseFloat(wx.Lat, 64)
+		lng, err2 := strconv.ParseFloat(wx.Lng, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		along, off := routePosition(route, lat, lng)
+		if off > q.width {
+			continue
+		}
+		base := routeItem{Ident: wx.ICAO, Lat: lat, Lng: lng, DistanceNM: along, OffsetNM: off}
+		if wx.Metar != "" {
+			it := base
+			it.Kind, it.Text, it.Category = "metar", wx.Metar, wx.Cond
+			add(it)
+		}
+		if wx.TAF != "" {
+			it := base
+			it.Kind, it.Text = "taf", plainText(wx.TAF)
+			add(it)
+		}
+		if wx.UpWinds != "" {
+			it := base
+			it.Kind, it.Text = "winds", wx.UpWinds
+			if level, dir, speed, temp, ok := windsAt(wx.UpWinds, q.altitude); ok {
+				it.LevelFt, it.WindDir, it.WindSpeed, it.TempC = level, &dir, &speed, temp
+			}
+			add(it)
+		}
+	}
+	var pireps []pirepData
+	if err := readJSONFile(cfg.Path(cfg.Output.Pireps), &pireps); err != nil {
+		return nil, err
+	}
+	for _, pr := range pireps {
+		lat, err1 := strconv.ParseFloat(pr.Lat, 64)
+		lng, err2 := strconv.ParseFloat(pr.Lng, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if along, off := routePosition(route, lat, lng); off <= q.width {
+			add(routeItem{Kind: "pirep", Lat: lat, Lng: lng, DistanceNM: along, OffsetNM: off, Text: pr.Report, AltitudeFt: pirepAltitude(pr.Report)})
+		}
+	}
+	// Advisories are optional: getwx only writes them when the source is
+	// enabled.
+	advisories, _, err := readAdvisories()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, a := range advisories {
+		if len(a.Points) < 3 {
+			continue
+		}
+		if q.altitude > 0 && (a.MinFt > 0 && q.altitude < a.MinFt || a.MaxFt > 0 && q.altitude > a.MaxFt) {
+			continue
+		}
+		if along, lat, lng, ok := advisoryPosition(route, a, q.width); ok {
+			add(routeItem{Kind: "advisory", Lat: lat, Lng: lng, DistanceNM: along, Text: a.Raw,
+				Type: a.Type, Hazard: a.Hazard, MinFt: a.MinFt, MaxFt: a.MaxFt})
+		}
+	}
+	sort.SliceStable(b.Items, func(i, j int) bool { return b.Items[i].DistanceNM < b.Items[j].DistanceNM })
+	for k := range b.Route {
+		b.Route[k].DistanceNM = math.Round(b.Route[k].DistanceNM*10) / 10
+	}
+	b.TotalNM = math.Round(b.TotalNM*10) / 10
+	return b, nil
+}
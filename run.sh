@@ -1,6 +1,5 @@
 #!/bin/bash
-# Run Map server
+# Run Map server once. getwx -daemon (getwx.service) replaces this cron job.
+# Only warnings and errors are logged; cron mails them if there are any.
 cd /disk/dev/mapsrv
-./getwx -w > /dev/null
-#./mapserver -w > /dev/null
-
+./getwx -w -log-level warn
@@ -0,0 +1,137 @@
+//go:build !websocket
+
+package main
+
+// Runways: getwx -import-runways turns an OurAirports-style runways.csv
+// into paths.runways, one entry per runway end keyed by airport ident, and
+// the map API uses it to split each station's wind into headwind and
+// crosswind for every runway.
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// runwayEnd is one end of a runway. Heading is degrees true.
+type runwayEnd struct {
+	Ident    string  `json:"ident"`
+	Heading  float64 `json:"heading"`
+	LengthFt int     `json:"length_ft,omitempty"`
+	WidthFt  int     `json:"width_ft,omitempty"`
+	Surface  string  `json:"surface,omitempty"`
+}
+
+// runwayWind is the wind on one runway end. Headwind is negative for a
+// tailwind and Crosswind positive from the right. The gust values are
+// only set when the wind is gusting.
+type runwayWind struct {
+	Runway        string
+	Heading       float64
+	LengthFt      int    `json:",omitempty"`
+	Surface       string `json:",omitempty"`
+	Headwind      int
+	Crosswind     int
+	GustHeadwind  int `json:",omitempty"`
+	GustCrosswind int `json:",omitempty"`
+}
+
+// runwayWinds works out the components of the wind on every end and picks
+// the one with the most headwind, the longer runway on a tie. A calm or
+// variable wind has no favoured runway.
+func runwayWinds(ends []runwayEnd, dir, speed, gust float64) ([]runwayWind, *runwayWind) {
+	if math.IsNaN(dir) || math.IsNaN(speed) || len(ends) == 0 {
+		return nil, nil
+	}
+	out := make([]runwayWind, len(ends))
+	for k, e := range ends {
+		a := (dir - e.Heading) * math.Pi / 180
+		out[k] = runwayWind{
+			Runway:    e.Ident,
+			Heading:   e.Heading,
+			LengthFt:  e.LengthFt,
+			Surface:   e.Surface,
+			Headwind:  int(math.Round(speed * math.Cos(a))),
+			Crosswind: int(math.Round(speed * math.Sin(a))),
+		}
+		if !math.IsNaN(gust) && gust > speed {
+			out[k].GustHeadwind = int(math.Round(gust * math.Cos(a)))
+			out[k].GustCrosswind = int(math.Round(gust * math.Sin(a)))
+		}
+	}
+	if speed == 0 {
+		return out, nil
+	}
+	best := 0
+	for k, w := range out {
+		b := out[best]
+		if w.Headwind > b.Headwind || w.Headwind == b.Headwind && w.LengthFt > b.LengthFt {
+			best = k
+		}
+	}
+	return out, &out[best]
+}
+
+// maxCrosswind is the larger of the steady and gust crosswind.
+func (w runwayWind) maxCrosswind() int {
+	c, g := w.Crosswind, w.GustCrosswind
+	if c < 0 {
+		c = -c
+	}
+	if g < 0 {
+		g = -g
+	}
+	return max(c, g)
+}
+
+var runwayCache struct {
+	sync.Mutex
+	modTime time.Time
+	ends    map[string][]runwayEnd
+}
+
+// readRunways reads paths.runways, keeping it until the file changes. A
+// missing file means no runway data.
+func readRunways() (map[string][]runwayEnd, error) {
+	if cfg.Paths.Runways == "" {
+		return nil, nil
+	}
+	fname := cfg.Path(cfg.Paths.Runways)
+	st, err := os.Stat(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	runwayCache.Lock()
+	defer runwayCache.Unlock()
+	if runwayCache.ends != nil && st.ModTime().Equal(runwayCache.modTime) {
+		return runwayCache.ends, nil
+	}
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	ends := make(map[string][]runwayEnd)
+	if err := json.Unmarshal(buf, &ends); err != nil {
+		return nil, err
+	}
+	runwayCache.modTime, runwayCache.ends = st.ModTime(), ends
+	return ends, nil
+}
+
+// stationRunways finds a station's runways. A runway file imported before
+// the airport database may use another of its identifiers, so KRAC also
+// finds RAC.
+func stationRunways(all map[string][]runwayEnd, icao string) []runwayEnd {
+	db, _ := readAirportDB()
+	for _, id := range db.aliases(icao) {
+		if ends, ok := all[id]; ok {
+			return ends
+		}
+	}
+	return nil
+}
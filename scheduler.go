@@ -0,0 +1,228 @@
+//go:build getwx
+
+package main
+
+// A small in-process scheduler for getwx -daemon. Each job has its own
+// cadence and runs in its own goroutine, so a job never overlaps with
+// itself; a run that is still going when the next one is due just delays
+// it. Failures that look transient are retried with exponential backoff.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+// jobStatus is what the scheduler remembers about a job. It is written to
+// the status file after every run so it can be checked from outside.
+type jobStatus struct {
+	Interval            string    `json:"interval"`
+	Running             bool      `json:"running"`
+	LastStart           time.Time `json:"last_start"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	NextRun             time.Time `json:"next_run"`
+}
+
+type scheduler struct {
+	jobs       []*job
+	jitter     time.Duration
+	retries    int
+	backoff    time.Duration
+	statusFile string
+
+	mu     sync.Mutex
+	status map[string]*jobStatus
+	// writeMu serializes writeStatus.
+	writeMu sync.Mutex
+}
+
+func newScheduler(c SchedulerConfig, statusFile string) *scheduler {
+	return &scheduler{
+		jitter:     c.Jitter,
+		retries:    c.Retries,
+		backoff:    c.RetryBackoff,
+		statusFile: statusFile,
+		status:     make(map[string]*jobStatus),
+	}
+}
+
+func (s *scheduler) add(name string, interval time.Duration, run func(ctx context.Context) error) {
+	s.jobs = append(s.jobs, &job{name: name, interval: interval, run: run})
+	s.status[name] = &jobStatus{Interval: interval.String()}
+}
+
+// Run starts every job and blocks until ctx is cancelled and the jobs that
+// were in flight have finished.
+func (s *scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, j := range s.jobs {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			s.loop(ctx, j)
+		}(j)
+	}
+	wg.Wait()
+	s.writeStatus()
+}
+
+func (s *scheduler) loop(ctx context.Context, j *job) {
+	// Spread the first runs out a little so every product does not hit
+	// the server in the same second.
+	delay := s.randomJitter()
+	for {
+		s.update(j.name, func(st *jobStatus) { st.NextRun = time.Now().Add(delay) })
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		start := time.Now()
+		s.runOnce(ctx, j)
+		if ctx.Err() != nil {
+			return
+		}
+		delay = j.interval - time.Since(start) + s.randomJitter()
+		if delay < 0 {
+			delay = 0
+		}
+	}
+}
+
+func (s *scheduler) randomJitter() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.jitter)))
+}
+
+// runOnce runs a job, retrying transient failures, and records the result.
+func (s *scheduler) runOnce(ctx context.Context, j *job) {
+	start := time.Now()
+	s.update(j.name, func(st *jobStatus) {
+		st.Running = true
+		st.LastStart = start
+	})
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = safeRun(ctx, j.run)
+		if err == nil || attempt >= s.retries || !isTransient(err) || ctx.Err() != nil {
+			break
+		}
+		wait := s.backoff << attempt
+		slog.Warn("job attempt failed, retrying", "job", j.name, "attempt", attempt+1, "err", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+	s.update(j.name, func(st *jobStatus) {
+		st.Running = false
+		if err != nil {
+			st.LastFailure = time.Now()
+			st.LastError = err.Error()
+			st.ConsecutiveFailures++
+		} else {
+			st.LastSuccess = time.Now()
+			st.LastError = ""
+			st.ConsecutiveFailures = 0
+		}
+	})
+	if err != nil {
+		slog.Error("job failed", "job", j.name, "err", err)
+	} else {
+		slog.Info("job finished", "job", j.name, "duration", time.Since(start).Round(time.Millisecond))
+	}
+	s.writeStatus()
+}
+
+// safeRun turns a panic inside a job into an error so one bad run does not
+// take the daemon down with it.
+func safeRun(ctx context.Context, run func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(ctx)
+}
+
+// httpStatusError is returned for a download that got a non-200 response.
+type httpStatusError struct {
+	URL  string
+	Code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("GET %s: HTTP %d", e.URL, e.Code)
+}
+
+// isTransient reports whether retrying err might succeed: network trouble,
+// truncated bodies and server-side HTTP errors.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *httpStatusError
+	if errors.As(err, &se) {
+		return se.Code == 429 || se.Code >= 500
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (s *scheduler) update(name string, f func(*jobStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.status[name])
+}
+
+func (s *scheduler) snapshot() map[string]jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]jobStatus, len(s.status))
+	for name, st := range s.status {
+		out[name] = *st
+	}
+	return out
+}
+
+// writeStatus writes the status file. Every job calls it when it starts
+// and finishes, so the writes are serialized to keep an older snapshot
+// from landing after a newer one.
+func (s *scheduler) writeStatus() {
+	if s.statusFile == "" {
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	buf, err := json.MarshalIndent(s.snapshot(), "", "  ")
+	if err != nil {
+		slog.Error("writing status file", "file", s.statusFile, "err", err)
+		return
+	}
+	if err := writeFileAtomic(s.statusFile, buf); err != nil {
+		slog.Error("writing status file", "file", s.statusFile, "err", err)
+	}
+}
@@ -0,0 +1,347 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// The station model: one symbol per station with the sky cover circle, a
+// wind barb, temperature and dewpoint, present weather, visibility and
+// altimeter, laid out the way the surface analysis charts do it. It is
+// drawn in a 100x100 box with the station at the centre and served as
+// /station/{icao}.svg or .png.
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stationBox = 100
+
+var (
+	colorTemp = color.RGBA{200, 0, 0, 255}
+	colorDew  = color.RGBA{0, 130, 0, 255}
+	colorText = color.RGBA{34, 34, 34, 255}
+	colorWx   = color.RGBA{0, 150, 0, 255}
+	colorTS   = color.RGBA{207, 0, 0, 255}
+	colorFog  = color.RGBA{150, 130, 0, 255}
+)
+
+// categoryColors match getCondition in getwx.go, for data without a
+// CondColor.
+var categoryColors = map[string]string{
+	"VFR":  "#60FF60",
+	"MVFR": "#4040FF",
+	"IFR":  "#FF3030",
+	"LIFR": "#FF60FF",
+}
+
+func categoryColor(wx weatherData) color.RGBA {
+	if wx.CondColor != "" {
+		return parseHexColor(wx.CondColor)
+	}
+	if c, ok := categoryColors[wx.Cond]; ok {
+		return parseHexColor(c)
+	}
+	return color.RGBA{200, 200, 200, 255}
+}
+
+// stationName is the ICAO without the K the way the map labels it.
+func stationName(icao string) string {
+	if len(icao) == 4 && icao[0] == 'K' {
+		return icao[1:]
+	}
+	return icao
+}
+
+// stationWind is the wind to plot, preferring the METAR and falling back
+// to the fields getwx worked out.
+func stationWind(wx weatherData, obs metarObs) (dir, speed, gust float64) {
+	dir, speed, gust = obs.WindDir, obs.WindSpeed, obs.WindGust
+	if math.IsNaN(speed) {
+		if v, err := strconv.ParseFloat(wx.WindSpeed, 64); err == nil {
+			speed = v
+		}
+		if v, err := strconv.ParseFloat(wx.WindDir, 64); err == nil {
+			dir = v
+		}
+		if v, err := strconv.ParseFloat(wx.WindGust, 64); err == nil && v > speed {
+			gust = v
+		}
+	}
+	return dir, speed, gust
+}
+
+// drawStationModel draws wx into the 100x100 box at the painter's origin.
+func drawStationModel(p painter, wx weatherData) {
+	obs := parseMetarText(wx.Metar)
+	c := pt{50, 50}
+	const r = 9.0
+
+	dir, speed, gust := stationWind(wx, obs)
+	if !math.IsNaN(speed) && !math.IsNaN(dir) && speed >= 3 {
+		drawWindBarb(p, c, r, dir, speed, 34, colorBlack)
+	}
+
+	p.circle(c, r, categoryColor(wx), 1.5, colorBlack)
+	drawSkyCover(p, c, r*0.62, obs.Cover)
+	if !math.IsNaN(speed) && speed < 3 {
+		// Calm: a second circle around the station.
+		p.circle(c, r+3.5, colorNone, 1.2, colorBlack)
+	}
+
+	const size = 9.0
+	temp := math.NaN()
+	if !math.IsNaN(obs.TempC) {
+		temp = cToF(obs.TempC)
+	} else if v, err := strconv.ParseFloat(wx.Temperature, 64); err == nil {
+		temp = v
+	}
+	if !math.IsNaN(temp) {
+		p.text(pt{37, 41}, size, anchorEnd, colorTemp, true, strconv.Itoa(int(math.Round(temp))))
+	}
+	if !math.IsNaN(obs.DewC) {
+		p.text(pt{37, 68}, size, anchorEnd, colorDew, true, strconv.Itoa(int(math.Round(cToF(obs.DewC)))))
+	}
+
+	// Present weather sits between the temperature and dewpoint, just
+	// left of the circle, with visibility beyond it.
+	const wxY = 50.5
+	visRight := 37.0
+	if len(obs.Weather) > 0 {
+		drawPresentWeather(p, pt{31, wxY}, obs.Weather)
+		visRight = 25
+	}
+	if obs.VisText != "" && (obs.VisSM < 10 || math.IsNaN(obs.VisSM)) {
+		// Long values such as 1 1/2 are shrunk to stay inside the box.
+		vs := math.Min(size*0.85, size*(visRight-1)/textWidth(obs.VisText, size))
+		p.text(pt{visRight, wxY + vs/2}, vs, anchorEnd, colorText, true, obs.VisText)
+	}
+
+	if !math.IsNaN(obs.AltimHg) {
+		// The last three digits, as plotted for sea-level pressure: 30.02 is 002.
+		p.text(pt{63, 41}, size, anchorStart, colorText, true, fmt.Sprintf("%03d", int(math.Round(obs.AltimHg*100))%1000))
+	}
+	if !math.IsNaN(gust) && gust > speed {
+		p.text(pt{63, 68}, size, anchorStart, colorTemp, true, fmt.Sprintf("G%d", int(math.Round(gust))))
+	}
+	p.text(pt{50, 88}, size*0.85, anchorMiddle, colorText, true, stationName(wx.ICAO))
+}
+
+// drawSkyCover fills the part of the inner circle the clouds cover.
+func drawSkyCover(p painter, c pt, r float64, cover string) {
+	p.circle(c, r, colorWhite, 0.8, colorBlack)
+	quarters := map[string]int{"FEW": 1, "SCT": 2, "BKN": 3, "OVC": 4}[cover]
+	switch {
+	case cover == "VV":
+		d := r * 0.7
+		p.polyline([]pt{{c.X - d, c.Y - d}, {c.X + d, c.Y + d}}, 1.3, colorBlack)
+		p.polyline([]pt{{c.X - d, c.Y + d}, {c.X + d, c.Y - d}}, 1.3, colorBlack)
+	case quarters == 4:
+		p.circle(c, r, colorBlack, 0, colorNone)
+	case quarters > 0:
+		// Clockwise from north, a quarter of the circle per step.
+		pie := []pt{c}
+		steps := 12 * quarters
+		for i := 0; i <= steps; i++ {
+			a := -math.Pi/2 + math.Pi/2*float64(quarters)*float64(i)/float64(steps)
+			pie = append(pie, pt{c.X + r*math.Cos(a), c.Y + r*math.Sin(a)})
+		}
+		p.polygon(pie, colorBlack)
+	}
+}
+
+// drawWindBarb draws the staff from the edge of the station circle toward
+// where the wind comes from, with a pennant per 50 knots, a full barb per
+// 10 and a half barb for 5. Barbs go on the clockwise side of the staff,
+// as they are drawn in the northern hemisphere.
+func drawWindBarb(p painter, c pt, r, dir, speed, length float64, col color.RGBA) {
+	a := dir * math.Pi / 180
+	u := pt{math.Sin(a), -math.Cos(a)}
+	f := pt{-u.Y, u.X}
+	at := func(d float64) pt { return pt{c.X + u.X*d, c.Y + u.Y*d} }
+	end := r + length
+	p.polyline([]pt{at(r), at(end)}, 1.5, col)
+
+	const barb, gap = 14.0, 4.5
+	knots := int(math.Round(speed/5)) * 5
+	d := end
+	for ; knots >= 50; knots -= 50 {
+		base := at(d)
+		inner := at(d - gap*1.2)
+		tip := pt{base.X + f.X*barb, base.Y + f.Y*barb}
+		p.polygon([]pt{base, tip, inner}, col)
+		d -= gap * 1.6
+	}
+	if d < end {
+		d -= gap * 0.2
+	}
+	for ; knots >= 10; knots -= 10 {
+		drawBarbLine(p, at(d), u, f, barb, col)
+		d -= gap
+	}
+	if knots >= 5 {
+		if d == end {
+			// A lone half barb is set in from the end so it is not read
+			// as a full one.
+			d -= gap
+		}
+		drawBarbLine(p, at(d), u, f, barb/2, col)
+	}
+}
+
+func drawBarbLine(p painter, base, u, f pt, l float64, col color.RGBA) {
+	// Barbs lean out toward the end of the staff.
+	tip := pt{base.X + (f.X+u.X*0.35)*l, base.Y + (f.Y+u.Y*0.35)*l}
+	p.polyline([]pt{base, tip}, 1.5, col)
+}
+
+// drawPresentWeather draws a simplified symbol for the most significant
+// weather group centred on c.
+func drawPresentWeather(p painter, c pt, groups []string) {
+	wx := strings.Join(groups, " ")
+	heavy := strings.Contains(wx, "+")
+	light := strings.Contains(wx, "-")
+	count := 3
+	if heavy {
+		count = 4
+	} else if light {
+		count = 2
+	}
+	switch {
+	case strings.Contains(wx, "TS"):
+		p.polygon([]pt{{c.X - 0.7, c.Y - 5}, {c.X + 2.8, c.Y - 5}, {c.X + 0.7, c.Y - 0.7}, {c.X + 2.8, c.Y - 0.7}, {c.X - 2.1, c.Y + 5.6}, {c.X - 0.7, c.Y + 0.7}, {c.X - 2.8, c.Y + 0.7}}, colorTS)
+	case strings.Contains(wx, "SN"), strings.Contains(wx, "SG"), strings.Contains(wx, "IC"), strings.Contains(wx, "PL"):
+		for _, q := range weatherDots(c, count) {
+			drawAsterisk(p, q, 2.2, colorWx)
+		}
+	case strings.Contains(wx, "RA"), strings.Contains(wx, "DZ"), strings.Contains(wx, "GR"), strings.Contains(wx, "GS"), strings.Contains(wx, "UP"):
+		col := colorWx
+		if strings.Contains(wx, "FZ") {
+			col = colorTS
+		}
+		drizzle := strings.Contains(wx, "DZ") && !strings.Contains(wx, "RA")
+		for _, q := range weatherDots(c, count) {
+			p.circle(q, 1.6, col, 0, colorNone)
+			if drizzle {
+				p.polyline([]pt{{q.X + 1.2, q.Y + 0.5}, {q.X - 0.6, q.Y + 3}}, 1, col)
+			}
+		}
+		if strings.Contains(wx, "SH") {
+			p.polygon([]pt{{c.X - 2.5, c.Y + 4.5}, {c.X + 2.5, c.Y + 4.5}, {c.X, c.Y + 7}}, col)
+		}
+	case strings.Contains(wx, "FG"):
+		for i := -1; i <= 1; i++ {
+			y := c.Y + float64(i)*2.5
+			p.polyline([]pt{{c.X - 5, y}, {c.X + 5, y}}, 1.2, colorFog)
+		}
+	case strings.Contains(wx, "BR"):
+		for i := -1; i <= 1; i += 2 {
+			y := c.Y + float64(i)*1.8
+			p.polyline([]pt{{c.X - 5, y}, {c.X + 5, y}}, 1.2, colorFog)
+		}
+	case strings.Contains(wx, "HZ"), strings.Contains(wx, "FU"), strings.Contains(wx, "DU"):
+		p.circle(pt{c.X - 2.2, c.Y}, 2.2, colorNone, 1.1, colorFog)
+		p.circle(pt{c.X + 2.2, c.Y}, 2.2, colorNone, 1.1, colorFog)
+	default:
+		p.text(pt{c.X, c.Y + 3}, 6, anchorMiddle, colorTS, true, strings.TrimLeft(groups[0], "+-"))
+	}
+}
+
+// weatherDots places n marks around c: side by side for two, a triangle
+// for three and a diamond for four.
+func weatherDots(c pt, n int) []pt {
+	switch n {
+	case 2:
+		return []pt{{c.X - 2.5, c.Y}, {c.X + 2.5, c.Y}}
+	case 4:
+		return []pt{{c.X, c.Y - 3.2}, {c.X - 3.2, c.Y}, {c.X + 3.2, c.Y}, {c.X, c.Y + 3.2}}
+	}
+	return []pt{{c.X, c.Y - 2.5}, {c.X - 2.8, c.Y + 1.8}, {c.X + 2.8, c.Y + 1.8}}
+}
+
+func drawAsterisk(p painter, c pt, r float64, col color.RGBA) {
+	for i := 0; i < 3; i++ {
+		a := math.Pi / 3 * float64(i)
+		d := pt{math.Cos(a) * r, math.Sin(a) * r}
+		p.polyline([]pt{{c.X - d.X, c.Y - d.Y}, {c.X + d.X, c.Y + d.Y}}, 0.9, col)
+	}
+}
+
+func renderStationSVG(wx weatherData, size int) []byte {
+	var s svgPainter
+	drawStationModel(&s, wx)
+	var buf bytes.Buffer
+	s.writeSVG(&buf, size, size, stationBox, stationBox)
+	return buf.Bytes()
+}
+
+func renderStationPNG(wx weatherData, size int) ([]byte, error) {
+	r := newRasterPainter(size, size, float64(size)/stationBox)
+	drawStationModel(r, wx)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, r.img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stationHandler serves /station/{icao}.svg and .png with ?size= in pixels.
+// Responses carry the weather file's time and an ETag so browsers and
+// caches can revalidate instead of downloading the symbol again.
+func stationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("file")
+		ext := ""
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name, ext = name[:i], name[i+1:]
+		}
+		if ext != "svg" && ext != "png" {
+			http.NotFound(w, r)
+			return
+		}
+		size := 96
+		if s := r.FormValue("size"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 16 || n > 512 {
+				http.Error(w, "size must be 16 to 512", http.StatusBadRequest)
+				return
+			}
+			size = n
+		}
+		all, modTime, err := readWeatherData()
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, "weather data is not available", http.StatusServiceUnavailable)
+			return
+		}
+		wx, ok := findStation(all, name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var body []byte
+		if ext == "svg" {
+			body = renderStationSVG(wx, size)
+			w.Header().Set("Content-Type", "image/svg+xml")
+		} else {
+			body, err = renderStationPNG(wx, size)
+			if err != nil {
+				logRequestError(r, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+		}
+		h := fnv.New64a()
+		h.Write(body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, h.Sum64()))
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		http.ServeContent(w, r, "", modTime.Truncate(time.Second), bytes.NewReader(body))
+	})
+}
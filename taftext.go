@@ -0,0 +1,229 @@
+//go:build !websocket
+
+package main
+
+// Decoding the raw text of a TAF into its forecast periods: the opening
+// forecast, FM groups, and BECMG, TEMPO and PROB groups with their time
+// ranges. Each period's weather is read with the METAR decoder, since the
+// groups are the same.
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	htmlTagRe     = regexp.MustCompile(`<[^>]*>`)
+	tafIssueRe    = regexp.MustCompile(`^(\d{2})(\d{2})(\d{2})Z$`)
+	tafValidRe    = regexp.MustCompile(`^(\d{2})(\d{2})/(\d{2})(\d{2})$`)
+	tafFromRe     = regexp.MustCompile(`^FM(\d{2})(\d{2})(\d{2})$`)
+	tafProbRe     = regexp.MustCompile(`^PROB(\d{2})$`)
+	tafStationRe  = regexp.MustCompile(`^[A-Z0-9]{3,4}$`)
+	tafHeaderSkip = map[string]bool{"TAF": true, "AMD": true, "COR": true}
+)
+
+// plainText drops the markup getwx adds to TAFs for the popups.
+func plainText(s string) string {
+	return strings.Join(strings.Fields(htmlTagRe.ReplaceAllString(s, " ")), " ")
+}
+
+// tafPeriod is one period of a TAF. Change is "" for the opening forecast,
+// or FM, BECMG, TEMPO, PROB30 or PROB40 (PROB30 TEMPO for both). To is the
+// start of the next FM group, or the end of the TAF, for the periods that
+// do not give their own.
+type tafPeriod struct {
+	Change   string
+	From, To time.Time
+	Text     string
+	Obs      metarObs
+}
+
+// decodeTafText splits a raw TAF into its periods. The day-of-month times
+// are placed in the month nearest ref.
+func decodeTafText(taf string, ref time.Time) []tafPeriod {
+	// The popups bold FM, which leaves it apart from its time.
+	var words []string
+	for _, w := range strings.Fields(plainText(taf)) {
+		if n := len(words); n > 0 && words[n-1] == "FM" && len(w) == 6 && strings.Trim(w, "0123456789") == "" {
+			words[n-1] += w
+			continue
+		}
+		words = append(words, w)
+	}
+	k := 0
+	for k < len(words) && tafHeaderSkip[words[k]] {
+		k++
+	}
+	if k < len(words) && tafStationRe.MatchString(words[k]) && !tafValidRe.MatchString(words[k]) {
+		k++
+	}
+	if k < len(words) {
+		if m := tafIssueRe.FindStringSubmatch(words[k]); m != nil {
+			ref = tafTime(ref, m[1], m[2], m[3])
+			k++
+		}
+	}
+	var periods []tafPeriod
+	var end time.Time
+	cur := tafPeriod{}
+	if k < len(words) {
+		if m := tafValidRe.FindStringSubmatch(words[k]); m != nil {
+			cur.From, end = tafTime(ref, m[1], m[2], "00"), tafTime(ref, m[3], m[4], "00")
+			k++
+		}
+	}
+	var text []string
+	flush := func() {
+		if len(text) > 0 || cur.Change != "" {
+			cur.Text = strings.Join(text, " ")
+			cur.Obs = parseTafWeather(text)
+			periods = append(periods, cur)
+		}
+		text = nil
+	}
+	for ; k < len(words); k++ {
+		w := words[k]
+		switch {
+		case tafFromRe.MatchString(w):
+			m := tafFromRe.FindStringSubmatch(w)
+			flush()
+			cur = tafPeriod{Change: "FM", From: tafTime(ref, m[1], m[2], m[3])}
+		case w == "BECMG" || w == "TEMPO" || tafProbRe.MatchString(w):
+			flush()
+			cur = tafPeriod{Change: w}
+			if tafProbRe.MatchString(w) && k+1 < len(words) && words[k+1] == "TEMPO" {
+				cur.Change += " TEMPO"
+				k++
+			}
+			if k+1 < len(words) {
+				if m := tafValidRe.FindStringSubmatch(words[k+1]); m != nil {
+					cur.From, cur.To = tafTime(ref, m[1], m[2], "00"), tafTime(ref, m[3], m[4], "00")
+					k++
+				}
+			}
+		case w == "RMK":
+			k = len(words)
+		default:
+			text = append(text, w)
+		}
+	}
+	flush()
+	// The opening forecast and FM groups last until the next FM group.
+	for i := range periods {
+		p := &periods[i]
+		if p.Change != "" && p.Change != "FM" {
+			continue
+		}
+		p.To = end
+		for _, q := range periods[i+1:] {
+			if q.Change == "FM" {
+				p.To = q.From
+				break
+			}
+		}
+	}
+	return periods
+}
+
+// parseTafWeather decodes the weather groups of one period. A leading
+// placeholder word stops the METAR decoder from taking the first group for
+// a station.
+func parseTafWeather(words []string) metarObs {
+	obs := parseMetarText("TAF " + strings.Join(words, " "))
+	for _, w := range words {
+		if w == "CAVOK" && math.IsNaN(obs.VisSM) {
+			obs.VisSM = 10
+		}
+	}
+	return obs
+}
+
+// category is the period's flight category, "" when it does not give
+// both the visibility and the sky.
+func (p tafPeriod) category() string {
+	ceiling := p.Obs.Ceiling
+	if math.IsNaN(ceiling) && p.Obs.Cover != "" {
+		ceiling = unlimitedCeiling
+	}
+	cat := flightCategory(ceiling, p.Obs.VisSM)
+	if math.IsNaN(cat) {
+		return ""
+	}
+	return categoryNames[int(cat)]
+}
+
+// describe spells the period's weather out, e.g. "wind 270 at 14 kt
+// gusting 22, visibility 3 sm, BR, ceiling 800 ft overcast".
+func (p tafPeriod) describe() string {
+	o := p.Obs
+	var parts []string
+	switch {
+	case o.WindSpeed == 0:
+		parts = append(parts, "wind calm")
+	case !math.IsNaN(o.WindSpeed):
+		dir := "variable"
+		if !math.IsNaN(o.WindDir) {
+			dir = fmt.Sprintf("%03.0f", o.WindDir)
+		}
+		s := fmt.Sprintf("wind %s at %.0f kt", dir, o.WindSpeed)
+		if !math.IsNaN(o.WindGust) {
+			s += fmt.Sprintf(" gusting %.0f", o.WindGust)
+		}
+		parts = append(parts, s)
+	}
+	switch {
+	case strings.HasPrefix(o.VisText, "P"):
+		parts = append(parts, "visibility over "+o.VisText[1:]+" sm")
+	case strings.HasPrefix(o.VisText, "M"):
+		parts = append(parts, "visibility under "+o.VisText[1:]+" sm")
+	case o.VisText != "":
+		parts = append(parts, "visibility "+o.VisText+" sm")
+	case !math.IsNaN(o.VisSM):
+		parts = append(parts, "visibility "+strconv.FormatFloat(o.VisSM, 'f', -1, 64)+" sm")
+	}
+	parts = append(parts, o.Weather...)
+	switch {
+	case !math.IsNaN(o.Ceiling):
+		parts = append(parts, fmt.Sprintf("ceiling %.0f ft %s", o.Ceiling, coverNames[o.Cover]))
+	case o.Cover != "":
+		parts = append(parts, coverNames[o.Cover])
+	}
+	return strings.Join(parts, ", ")
+}
+
+var coverNames = map[string]string{
+	"CLR": "clear", "FEW": "few clouds", "SCT": "scattered clouds",
+	"BKN": "broken", "OVC": "overcast", "VV": "obscured",
+}
+
+// tafTime turns day, hour and minute into a time in the month nearest
+// ref. Hour 24 is midnight at the end of the day.
+func tafTime(ref time.Time, day, hour, minute string) time.Time {
+	d, _ := strconv.Atoi(day)
+	h, _ := strconv.Atoi(hour)
+	m, _ := strconv.Atoi(minute)
+	ref = ref.UTC()
+	best := time.Time{}
+	for _, month := range []int{-1, 0, 1} {
+		t := time.Date(ref.Year(), ref.Month()+time.Month(month), d, h, m, 0, 0, time.UTC)
+		// A day the month does not have rolls over; that is not it.
+		if t.Day() != d && h != 24 {
+			continue
+		}
+		if best.IsZero() || absDuration(t.Sub(ref)) < absDuration(best.Sub(ref)) {
+			best = t
+		}
+	}
+	return best
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
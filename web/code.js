@@ -0,0 +1,462 @@
+// Generated by mapserver from web/code.js. Stations and PIREPs are loaded
+// from the map API for the part of the map in view.
+var mapConfig = {{json .}};
+
+var map = null;
+var latlng_range = 0.01;
+var overlay;
+var inset_id = "";
+// Stations from the last API response, by ICAO, as [lat, lng].
+var airports = {};
+// Get url parameters
+var params = {};
+window.location.href.replace(/[?&]+([^=&]+)=([^&]*)/gi, function(m, key, value) {
+	params[key] = decodeURIComponent(value);
+});
+
+// esc makes report text safe to put in a popup. Reports may carry <br>,
+// <b> and <small> for layout, so those tags are let back in.
+function esc(s) {
+	s = String(s === undefined || s === null ? "" : s)
+		.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;")
+		.replace(/"/g, "&quot;").replace(/'/g, "&#39;");
+	return s.replace(/&lt;(\/?)(br|b|small)&gt;/gi, "<$1$2>");
+}
+
+function svgText(txt, width, style, transform) {
+	var svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+	svg.setAttribute("width", width);
+	svg.setAttribute("height", 30);
+	var t = document.createElementNS("http://www.w3.org/2000/svg", "text");
+	t.setAttribute("x", 5);
+	t.setAttribute("y", 10);
+	if (transform)
+		t.setAttribute("transform", transform);
+	t.setAttribute("style", "pointer-events: none; font-family: Arial; text-anchor: start;" + style);
+	t.textContent = txt;
+	svg.appendChild(t);
+	return 'data:image/svg+xml,' + encodeURIComponent(new XMLSerializer().serializeToString(svg));
+}
+var halo = "fill: #FFFFFF; stroke: #FFFFFF;stroke-width:2.5;";
+function tempTextWhite(txt) { return svgText(txt, 30, halo + "font-size: 10px;"); }
+function tempTextBlue(txt) { return svgText(txt, 30, "fill: #0000FF; stroke: #0000FF;font-size: 10px;"); }
+function tempTextRed(txt) { return svgText(txt, 30, "fill: #FF0000; stroke: #FF0000;font-size: 10px;"); }
+function nameText(txt) { return svgText(txt, 30, "fill: #222222; stroke: #222222;font-size: 10px;"); }
+function nameTextWhite(txt) { return svgText(txt, 30, halo + "font-size: 10px;"); }
+function wxText(txt) { return svgText(txt, 60, "fill: #cf0000; stroke: #cf0000;font-size: 10px;"); }
+function wxTextWhite(txt) { return svgText(txt, 60, halo + "font-size: 10px;"); }
+function gustText(txt) { return svgText(txt, 30, "fill: #FF0000; stroke: #FF0000;font-size: 11px;", "rotate(30 0,0)"); }
+function gustTextWhite(txt) { return svgText(txt, 30, halo + "font-size: 11px;", "rotate(30 0,0)"); }
+
+function FindReference(lat, lng)
+{
+	for (var index in airports)
+	{
+		val = airports[index];
+		lat1 = val[0];
+		lng1 = val[1];
+		if ( (lat > (lat1 - latlng_range)) && (lat < (lat1 + latlng_range)) && (lng > (lng1 - latlng_range)) && (lng < (lng1 + latlng_range)))
+		{
+			return index;
+		}
+	}
+	return "";
+}
+
+function showCoordinates (e) {
+	alert(e.latlng);
+}
+
+function centerMap (e) {
+	map.panTo(e.latlng);
+}
+
+// showNearestWeather puts what the nearest stations suggest for a spot
+// without a report of its own in a popup.
+function showNearestWeather(e) {
+	apiQuery("req=nearestwx&lat=" + e.latlng.lat + "&lng=" + e.latlng.lng, function(nw) {
+		var x = nw.expected, text = "";
+		if (x) {
+			text = "<b>Expected: " + esc(x.category || "unknown") + "</b>";
+			if (x.ceiling_ft !== undefined)
+				text += ", ceiling " + x.ceiling_ft + " ft";
+			if (x.visibility_sm !== undefined)
+				text += ", " + x.visibility_sm + " SM";
+			if (x.wind_speed !== undefined)
+				text += ", wind " + (x.wind_dir !== undefined ? x.wind_dir : "VRB") + "@" + x.wind_speed;
+			if (x.temp_c !== undefined)
+				text += ", " + x.temp_c + "&deg;C";
+		} else {
+			text = "<b>No station within reach</b>";
+		}
+		nw.stations.forEach(function(s) {
+			text += "<br><small>" + esc(s.icao) + " " + s.distance_nm + " nm " + s.bearing + "&deg;: " + esc(s.metar) + "</small>";
+		});
+		L.popup().setLatLng(e.latlng).setContent(text).openOn(map);
+	}, function(err) { console.log(err); });
+}
+
+function showWeather(e) {
+	f = FindReference(e.latlng.lat,e.latlng.lng);
+	if (f)
+	{
+		str = "https://forecast.weather.gov/MapClick.php?lon="+e.latlng.lng+"&lat="+e.latlng.lat;
+		window.open(str);
+	}
+}
+
+// apiGet calls the map API and hands the decoded JSON to done. extra is
+// added to the query.
+function apiGet(req, bounds, done, extra) {
+	apiQuery("req=" + req + "&bounds=" + [bounds.getWest(), bounds.getSouth(), bounds.getEast(), bounds.getNorth()].join(",") + (extra || ""),
+		done, function(err) { console.log(err); });
+}
+
+function apiQuery(query, done, fail) {
+	var url = mapConfig.api + (mapConfig.api.indexOf("?") < 0 ? "?" : "&") + query;
+	fetch(url)
+		.then(function(response) {
+			if (!response.ok)
+				throw new Error(url + ": HTTP " + response.status);
+			return response.json();
+		})
+		.then(done)
+		.catch(fail);
+}
+
+function init() {
+	var b = mapConfig.bounds;
+	var mapBounds = new L.LatLngBounds(
+		new L.LatLng(b.lat_min, b.lng_min),
+		new L.LatLng(b.lat_max, b.lng_max));
+	var mapMinZoom = mapConfig.min_zoom;
+	var mapMaxZoom = mapConfig.max_zoom;
+	map = L.map('map', {
+		contextmenu: true,
+		contextmenuItems: [{
+			text: 'Show coordinates',
+			callback: showCoordinates
+		}, {
+			text: 'Center map here',
+			callback: centerMap
+		}, {
+			text: 'Nearest weather',
+			callback: showNearestWeather
+		}]
+	});
+	var myRenderer = L.canvas({ padding: 0.5 });
+
+	var airplaneIcon = L.icon({iconUrl: mapConfig.static + 'images/airplane.svg',iconSize: [24, 24],iconAnchor: [0, 0], popupAnchor: [-3, -5]});
+	var tempMarkers =   new L.FeatureGroup();
+	var nameMarkers =   new L.FeatureGroup();
+	var gustMarkers =   new L.FeatureGroup();
+	var precipMarkers = new L.FeatureGroup();
+	var barbMarkers =   new L.FeatureGroup();
+	var lightningMarkers = new L.FeatureGroup();
+	var densityMarkers = new L.FeatureGroup().addTo(map);
+	var dotMarkers =    new L.FeatureGroup();
+	var pirepMarkers =  new L.FeatureGroup().addTo(map);
+	var allMarkers = [tempMarkers, nameMarkers, gustMarkers, precipMarkers, barbMarkers, lightningMarkers, dotMarkers, densityMarkers, pirepMarkers];
+
+	overlay = L.tileLayer(mapConfig.tiles.url, {
+		minZoom: mapMinZoom, maxZoom: mapMaxZoom,
+		bounds: mapBounds,
+		attribution: mapConfig.tiles.attribution, opacity: 0.99,
+		tms: mapConfig.tiles.tms,
+	}).addTo(map);
+	if (L.control.radar)
+		L.control.radar({}).addTo(map);
+
+	function addStation(idval, lat, lng, stationcolor, winddir, barbvel, windspeed, windgust, temperature, stationname, precip, METAR, ltg) {
+		var vp;
+		if (L.viewpoint) {
+			vp = L.viewpoint([lat,lng], { id:idval,radius: 8, contextmenu: true, color: 'black', weight: 1, fillColor: stationcolor,
+				fillOpacity: 0.9, direction: winddir,
+				barb: { width: 5, height: 10, offset: 5, stroke: true, color: 'black', weight: 3, opacity: 1,
+					fill: false,fillColor: 'black',fillOpacity: 1, velocity: barbvel },
+				contextmenuItems: [{
+					text: 'Weather for '+stationname ,
+					callback: showWeather
+				}, {
+					text: 'Airnav for '+stationname,
+				}]
+			});
+		} else {
+			vp = L.circleMarker([lat,lng], { radius: 8, color: 'black', weight: 1, fillColor: stationcolor, fillOpacity: 0.9, renderer: myRenderer });
+		}
+		vp.bindPopup(METAR);
+		barbMarkers.addLayer(vp);
+		dotMarkers.addLayer(L.circleMarker([lat,lng], { radius: 4, color: 'black', weight: 1, fillColor: stationcolor, fillOpacity: 0.9, renderer: myRenderer }).bindPopup(METAR));
+
+		if ( windspeed != windgust) {
+			var thisgustText = "G" + windgust;
+			icon = L.icon({ iconUrl: gustTextWhite(thisgustText), iconSize: [30, 30],iconAnchor: [0, 0]});
+			gustMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false,renderer: myRenderer}));
+			icon = L.icon({ iconUrl: gustText(thisgustText),iconSize: [30, 30],iconAnchor: [0, 0]});
+			gustMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false, renderer: myRenderer}));
+		}
+
+		// Temperature
+		if (temperature != -999)
+		{
+			icon = L.icon({ iconUrl: tempTextWhite(temperature),iconSize: [30, 30],iconAnchor: [12, 20]});
+			tempMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false,renderer: myRenderer}));
+			if (temperature > 32)
+				imgTB = tempTextRed(temperature);
+			else
+				imgTB = tempTextBlue(temperature);
+			icon = L.icon({ iconUrl: imgTB,iconSize: [30, 30],iconAnchor: [12, 20]});
+			tempMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false,renderer: myRenderer}));
+		}
+		// Name text
+		icon = L.icon({ iconUrl: nameTextWhite(stationname),iconSize: [30, 30],iconAnchor: [33, 6]});
+		nameMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false,renderer: myRenderer}));
+		icon = L.icon({ iconUrl: nameText(stationname),iconSize: [30, 30],iconAnchor: [33, 6]});
+		nameMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false,renderer: myRenderer}));
+
+		// Precip if any
+		if ( precip != '' ) {
+			icon = L.icon({ iconUrl: wxTextWhite(precip),iconSize: [60, 30],iconAnchor: [-2, 6]});
+			precipMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false,renderer: myRenderer}));
+			icon = L.icon({ iconUrl: wxText(precip),iconSize: [60, 30],iconAnchor: [-2, 6]});
+			precipMarkers.addLayer(L.marker([lat,lng], {icon: icon, interactive: false,renderer: myRenderer}));
+		}
+		// Lightning if any
+		if (ltg != 0)
+		{
+			var licon = L.icon({ iconUrl: mapConfig.static + 'images/lightning.svg', iconSize: [24,24], iconAnchor: [0,30]});
+			lightningMarkers.addLayer(L.marker([lat,lng], {icon: licon, interactive: false,renderer: myRenderer}));
+		}
+	}
+
+	// With station_layer = "tiles" the server draws the stations into
+	// wxTiles and the page only keeps a clickable dot per station for the
+	// popups.
+	var wxTiles = null;
+	var popupMarkers = new L.FeatureGroup().addTo(map);
+	if (mapConfig.station_layer == "tiles")
+		wxTiles = L.tileLayer(mapConfig.wxtiles, { minZoom: mapMinZoom, maxZoom: mapMaxZoom, bounds: mapBounds }).addTo(map);
+
+	function addPopupMarker(lat, lng, popup) {
+		popupMarkers.addLayer(L.circleMarker([lat,lng], { radius: 8, opacity: 0, fillOpacity: 0, renderer: myRenderer }).bindPopup(popup));
+	}
+
+	// showStations replaces the station layers with one API response.
+	function showStations(list) {
+		for (var i = 0; i < allMarkers.length - 1; i++)
+			allMarkers[i].clearLayers();
+		popupMarkers.clearLayers();
+		airports = {};
+		list.forEach(function(wx, i) {
+			var lat = parseFloat(wx.Lat), lng = parseFloat(wx.Lng);
+			if (isNaN(lat) || isNaN(lng))
+				return;
+			airports[wx.ICAO] = [lat, lng];
+			var speed = parseInt(wx.WindSpeed, 10) || 0;
+			var gust = parseInt(wx.WindGust, 10) || 0;
+			var temp = wx.Temperature === "" ? -999 : parseInt(wx.Temperature, 10);
+			var popup = wx.Metar === undefined ? loadPopup(wx, lat, lng) : stationPopup(wx);
+			// The tiles draw their own ring.
+			if (wx.DensityAltHigh && !wxTiles)
+				densityMarkers.addLayer(L.circleMarker([lat,lng], { radius: 12, color: '#ff7800', weight: 2, fill: false, interactive: false, renderer: myRenderer }));
+			if (wxTiles) {
+				addPopupMarker(lat, lng, popup);
+				return;
+			}
+			var name = wx.ICAO.charAt(0) == "K" ? wx.ICAO.substring(1) : wx.ICAO;
+			addStation(i + 1, lat, lng, wx.CondColor, (parseInt(wx.WindDir, 10) || 0) + 180,
+				parseInt(wx.WindBarb, 10), speed, gust, temp, name, wx.Precip, popup, parseInt(wx.Lightning, 10) || 0);
+		});
+	}
+
+	function stationPopup(wx) {
+		var popup = "<small>" + esc(wx.Metar) + "</small>" + esc(wx.TAF);
+		if (wx.UpWinds)
+			popup += "<small><br>" + esc(wx.UpWinds) + "</small>";
+		popup += runwayText(wx);
+		if (wx.DensityAlt) {
+			popup += "<small><br>Density altitude " + esc(wx.DensityAlt) + " ft, pressure altitude " +
+				esc(wx.PressureAlt) + " ft, field " + esc(wx.Elevation) + " ft</small>";
+			if (wx.DensityAltHigh)
+				popup += "<br><b>High density altitude</b>";
+		}
+		return popup;
+	}
+
+	// loadPopup is the popup of a station that came without its reports,
+	// zoomed out: opening it asks for the whole station.
+	function loadPopup(wx, lat, lng) {
+		return function(layer) {
+			var near = L.latLngBounds([lat - 0.01, lng - 0.01], [lat + 0.01, lng + 0.01]);
+			apiGet("airports", near, function(list) {
+				var full = list.filter(function(s) { return s.ICAO == wx.ICAO; })[0];
+				if (full)
+					layer.setPopupContent(stationPopup(full));
+			});
+			return esc(wx.ICAO) + "&hellip;";
+		};
+	}
+
+	// runwayText describes the wind on the favoured runway.
+	function runwayText(wx) {
+		if (!wx.FavoredRunway)
+			return "";
+		var rw = wx.Runways.filter(function(r) { return r.Runway == wx.FavoredRunway; })[0];
+		var side = rw.Crosswind < 0 ? "left" : "right";
+		var text = "Runway " + esc(rw.Runway) + ": " + Math.abs(rw.Headwind) +
+			(rw.Headwind < 0 ? " kt tailwind, " : " kt headwind, ") +
+			Math.abs(rw.Crosswind) + " kt crosswind from the " + side;
+		if (rw.GustCrosswind)
+			text += ", gusting " + Math.abs(rw.GustCrosswind);
+		if (wx.CrosswindExceeded)
+			text += "<br><b>Crosswind over the limit</b>";
+		return "<small><br>" + text + "</small>";
+	}
+
+	function showPireps(list) {
+		pirepMarkers.clearLayers();
+		list.forEach(function(pr) {
+			var lat = parseFloat(pr.Lat), lng = parseFloat(pr.Lng);
+			if (isNaN(lat) || isNaN(lng))
+				return;
+			pirepMarkers.addLayer(L.marker([lat,lng], {icon: airplaneIcon, title: pr.Report, renderer: myRenderer}).bindPopup(esc(pr.Report)));
+		});
+	}
+
+	// What is on the map, by ICAO and report, for the live updates to
+	// change.
+	var shownStations = {}, shownPireps = {};
+
+	function refresh() {
+		var bounds = map.getBounds();
+		// The tiles draw every station, so their popups need them all.
+		apiGet("airports", bounds, function(list) {
+			shownStations = {};
+			list.forEach(function(wx) { shownStations[wx.ICAO] = wx; });
+			showStations(list);
+		}, wxTiles ? "" : "&zoom=" + map.getZoom());
+		apiGet("pireps", bounds, function(list) {
+			shownPireps = {};
+			list.forEach(function(pr) { shownPireps[pr.Report] = pr; });
+			showPireps(list);
+		});
+	}
+
+	// Under mapserver -serve the server pushes what changes in view, so
+	// the page does not have to poll. Moving the map opens a new stream for
+	// the new bounds; after losing the stream the page reloads everything.
+	var events = null;
+	function listen() {
+		if (!mapConfig.events || !window.EventSource)
+			return;
+		if (events)
+			events.close();
+		var b = map.getBounds();
+		events = new EventSource(mapConfig.events + "?bounds=" + [b.getWest(), b.getSouth(), b.getEast(), b.getNorth()].join(","));
+		var lost = false;
+		events.onerror = function() { lost = true; };
+		events.onopen = function() {
+			if (lost)
+				refresh();
+			lost = false;
+		};
+		events.addEventListener("update", function(e) { applyUpdate(JSON.parse(e.data)); });
+	}
+
+	function applyUpdate(u) {
+		// The stream sends every station in view, but without the tiles the
+		// page only draws those the server kept at this zoom. The others
+		// stay thinned out until the map moves.
+		var stations = (u.stations || []).filter(function(wx) { return wxTiles || shownStations[wx.ICAO]; });
+		if (stations.length || u.removed_stations) {
+			stations.forEach(function(wx) { shownStations[wx.ICAO] = wx; });
+			(u.removed_stations || []).forEach(function(id) { delete shownStations[id]; });
+			showStations(Object.keys(shownStations).map(function(id) { return shownStations[id]; }));
+			if (wxTiles)
+				wxTiles.setUrl(mapConfig.wxtiles + "?t=" + Date.now());
+		}
+		if (u.pireps || u.removed_pireps) {
+			(u.pireps || []).forEach(function(pr) { shownPireps[pr.Report] = pr; });
+			(u.removed_pireps || []).forEach(function(report) { delete shownPireps[report]; });
+			showPireps(Object.keys(shownPireps).map(function(report) { return shownPireps[report]; }));
+		}
+	}
+
+	function updateLayers() {
+		map.removeLayer(lightningMarkers);
+		map.addLayer(lightningMarkers);
+		if (map.getZoom() <7){
+			map.removeLayer(nameMarkers);
+		}
+		else {
+			map.addLayer(nameMarkers);
+		}
+		if (map.getZoom() <8){
+			map.removeLayer(barbMarkers);
+			map.addLayer(dotMarkers);
+		}
+		else {
+			map.addLayer(barbMarkers);
+			map.removeLayer(dotMarkers);
+		}
+		if (map.getZoom() <9){
+			map.removeLayer(precipMarkers);
+			map.removeLayer(tempMarkers);
+			map.removeLayer(gustMarkers);
+		}
+		else {
+			map.addLayer(precipMarkers);
+			map.addLayer(tempMarkers);
+			map.addLayer(gustMarkers);
+		}
+	}
+
+	map.on('zoomend', updateLayers);
+	map.on('moveend', function() {
+		refresh();
+		listen();
+	});
+	setInterval(function() {
+		if (events)
+			return;
+		// New weather means new tiles; the server notices the change, the
+		// query string makes the browser ask again.
+		if (wxTiles)
+			wxTiles.setUrl(mapConfig.wxtiles + "?t=" + Date.now());
+		refresh();
+	}, mapConfig.refresh_seconds * 1000);
+
+	// If passed on the command line, set the view to what the command line requested
+	var z = params.zoom ? params.zoom : 9;
+	if (params.station)
+	{
+		var station = params.station.toUpperCase();
+		// The airport database knows both identifiers of an airport; without
+		// one, look through the stations.
+		apiQuery("req=airport&id=" + encodeURIComponent(station), function(apt) {
+			map.setView([apt.lat, apt.lng], z);
+		}, function() {
+			apiGet("airports", mapBounds, function(list) {
+				for (var i = 0; i < list.length; i++) {
+					if (list[i].ICAO == station || list[i].ICAO == "K" + station) {
+						map.setView([parseFloat(list[i].Lat), parseFloat(list[i].Lng)], z);
+						return;
+					}
+				}
+				alert("Location " + params.station + " not found");
+				map.setView(mapConfig.center, mapConfig.zoom);
+			});
+		});
+	} else
+	if ((params.lat) && (params.lng) && (params.zoom))
+	{
+		map.setView([params.lat, params.lng], params.zoom);
+	}
+	else
+	{
+		if (!map.restoreView || !map.restoreView()) {
+			map.setView(mapConfig.center, mapConfig.zoom);
+		}
+	}
+	updateLayers();
+}
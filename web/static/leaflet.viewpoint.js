@@ -0,0 +1,138 @@
+// L.viewpoint: a circle marker with a wind barb, as the map page draws its
+// stations. It takes the options of L.circleMarker, plus direction, the
+// direction in degrees the wind blows from, and barb:
+//
+//	width     spacing between the feathers along the staff, in pixels
+//	height    length of a full feather, and half the length of the staff
+//	offset    gap between the circle and the staff
+//	velocity  wind speed in units of 5 kt; -1 for calm draws no staff
+//	stroke, color, weight, opacity, fill, fillColor, fillOpacity
+//	          as for a path; pennants are filled with fillColor when fill is
+//	          set and with color otherwise
+//
+// A half feather is 5 kt, a full one 10 kt and a pennant 50 kt, on the
+// clockwise side of the staff. The barb is an icon beside the circle, so
+// it does not take clicks and stays the same size at every zoom.
+(function () {
+	var barbDefaults = {
+		width: 5, height: 10, offset: 5, velocity: -1,
+		stroke: true, color: 'black', weight: 2, opacity: 1,
+		fill: false, fillColor: 'black', fillOpacity: 1
+	};
+
+	L.Viewpoint = L.CircleMarker.extend({
+		options: {
+			direction: null
+		},
+
+		initialize: function (latlng, options) {
+			L.CircleMarker.prototype.initialize.call(this, latlng, options);
+			this.options.barb = L.extend({}, barbDefaults, options && options.barb);
+		},
+
+		onAdd: function (map) {
+			L.CircleMarker.prototype.onAdd.call(this, map);
+			this._updateBarb();
+		},
+
+		onRemove: function (map) {
+			if (this._barb)
+				map.removeLayer(this._barb);
+			L.CircleMarker.prototype.onRemove.call(this, map);
+		},
+
+		setLatLng: function (latlng) {
+			L.CircleMarker.prototype.setLatLng.call(this, latlng);
+			if (this._barb)
+				this._barb.setLatLng(this._latlng);
+			return this;
+		},
+
+		// setDirection changes the wind, velocity in units of 5 kt.
+		setDirection: function (direction, velocity) {
+			this.options.direction = direction;
+			if (velocity !== undefined)
+				this.options.barb.velocity = velocity;
+			this._updateBarb();
+			return this;
+		},
+
+		_updateBarb: function () {
+			if (!this._map)
+				return;
+			if (this._barb) {
+				this._map.removeLayer(this._barb);
+				this._barb = null;
+			}
+			var html = this._barbSVG();
+			if (!html)
+				return;
+			var size = this._barbSize();
+			this._barb = L.marker(this._latlng, {
+				icon: L.divIcon({ className: 'leaflet-viewpoint-barb', html: html,
+					iconSize: [size, size], iconAnchor: [size / 2, size / 2] }),
+				interactive: false, keyboard: false
+			}).addTo(this._map);
+		},
+
+		_feathers: function () {
+			var v = Math.round(Number(this.options.barb.velocity));
+			var pennants = Math.floor(v / 10);
+			v -= pennants * 10;
+			return { pennants: pennants, full: Math.floor(v / 2), half: v % 2 };
+		},
+
+		_staffLength: function () {
+			var b = this.options.barb, f = this._feathers();
+			return Math.max(2 * b.height, (f.pennants + f.full + f.half + 1) * b.width + b.height);
+		},
+
+		_barbSize: function () {
+			var b = this.options.barb;
+			return 2 * Math.ceil(this.options.radius + b.offset + this._staffLength() + b.weight);
+		},
+
+		// _barbSVG draws the barb pointing north and rotates it into the
+		// wind; "" when there is nothing to draw.
+		_barbSVG: function () {
+			var b = this.options.barb, dir = Number(this.options.direction);
+			if (this.options.direction === null || isNaN(dir) || !(Number(b.velocity) >= 0))
+				return '';
+			var f = this._feathers();
+			var c = this._barbSize() / 2;
+			var y0 = c - this.options.radius - b.offset;
+			var tip = y0 - this._staffLength();
+			var d = 'M' + c + ' ' + y0 + 'L' + c + ' ' + tip;
+			var pennants = '';
+			var y = tip, i;
+			for (i = 0; i < f.pennants; i++) {
+				pennants += 'M' + c + ' ' + y + 'L' + (c + b.height) + ' ' + (y + b.width / 2) + 'L' + c + ' ' + (y + b.width) + 'Z';
+				y += b.width + 1;
+			}
+			// Feathers lean towards the tip, so each starts a step further in.
+			for (i = 0; i < f.full; i++) {
+				d += 'M' + c + ' ' + (y + b.width) + 'L' + (c + b.height) + ' ' + y;
+				y += b.width;
+			}
+			if (f.half) {
+				// A half feather on its own stands back from the tip.
+				if (y === tip)
+					y += b.width;
+				d += 'M' + c + ' ' + (y + b.width / 2) + 'L' + (c + b.height / 2) + ' ' + y;
+			}
+			var stroke = b.stroke ? b.color : 'none';
+			var fill = b.fill ? b.fillColor : b.color;
+			var size = 2 * c;
+			return '<svg xmlns="http://www.w3.org/2000/svg" width="' + size + '" height="' + size + '">' +
+				'<g transform="rotate(' + dir + ' ' + c + ' ' + c + ')" stroke="' + stroke + '" stroke-width="' + b.weight +
+				'" stroke-opacity="' + b.opacity + '" stroke-linecap="round">' +
+				'<path fill="none" d="' + d + '"/>' +
+				(pennants ? '<path fill="' + fill + '" fill-opacity="' + b.fillOpacity + '" d="' + pennants + '"/>' : '') +
+				'</g></svg>';
+		}
+	});
+
+	L.viewpoint = function (latlng, options) {
+		return new L.Viewpoint(latlng, options);
+	};
+})();
@@ -2,14 +2,16 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build ignore
+//go:build websocket
 
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"strings"
+	"strconv"
 	"net/url"
 	"os"
 	"os/signal"
@@ -35,10 +37,19 @@ type WeatherMessage struct {
    LocaltimeReceived time.Time `json:"LocaltimeReceiver"`
 }
 
-var addr = flag.String("addr", "192.168.1.8", "http service address")
+var cfg *Config
 
 var Rpts map[string]WeatherReports
 
+var (
+	uatConnected = newGauge("uat_connected", "1 while the websocket to the UAT receiver is open.")
+	uatMessages  = newCounter("uat_messages_total", "Messages received from the UAT receiver, by type.", "type")
+	uatLast      = newGauge("uat_last_message_timestamp_seconds", "Unix time of the last message from the UAT receiver.")
+	uatErrors    = newCounter("uat_errors_total", "Messages that could not be decoded.")
+	uatSaves     = newCounter("uat_saves_total", "Times the reports were written to the dump file.")
+	_            = newGaugeFunc("uat_reports", "Stations with a saved report.", func() float64 { return float64(len(Rpts)) })
+)
+
 // Exists reports whether the named file or directory exists.
 func Exists(name string) bool {
     if _, err := os.Stat(name); err != nil {
@@ -52,14 +63,28 @@ func Exists(name string) bool {
 func main() {
     
 	Rpts = make(map[string]WeatherReports)
+	cflags := addConfigFlags(flag.CommandLine)
+	flag.Func("addr", "http service address (same as -receiver)", func(s string) error {
+		cflags.overrides = append(cflags.overrides, "receiver.addr="+strconv.Quote(s))
+		return nil
+	})
 	flag.Parse()
-	log.SetFlags(0)
+	var err error
+	cfg, err = cflags.load()
+	if err != nil {
+		fatal("loading config", err)
+	}
+	setupLogging(cfg.Log)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	serveMetrics(ctx, cfg.Metrics.Websocket)
+	dumpFile := cfg.Path(cfg.Receiver.Dump)
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
-	if Exists("dump.txt") {
-		f2, err2 := os.Open("dump.txt")
+	if Exists(dumpFile) {
+		f2, err2 := os.Open(dumpFile)
 		if err2 != nil {
 			panic(err2)
 		}
@@ -75,40 +100,50 @@ func main() {
 		f2.Sync()
 		f2.Close()
 	}
-	u := url.URL{Scheme: "ws", Host: *addr, Path: "/weather"}
-	log.Printf("connecting to %s", u.String())
+	u := url.URL{Scheme: "ws", Host: cfg.Receiver.Addr, Path: cfg.Receiver.Path}
+	slog.Info("connecting", "url", u.String())
 
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		fatal("dial", err)
 	}
 	defer c.Close()
-	log.Println("Connected!")
+	slog.Info("connected", "url", u.String())
+	uatConnected.Set(1)
 	done := make(chan struct{})
 
 	go func() {
 		defer close(done)
+		defer uatConnected.Set(0)
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
-				log.Println("read error:", err)
+				slog.Error("read error", "err", err)
 				return
 			}
+			uatLast.Set(float64(time.Now().Unix()))
 //			log.Printf("%s", message)
 			var d = new(WeatherMessage)
 			err2 := json.Unmarshal(message, &d)
 			if err2 != nil {
-				log.Println("Error unmarshal ",err2)
+				slog.Warn("cannot decode message", "err", err2)
+				uatErrors.Inc()
 			}
+			uatMessages.Inc(d.Type)
 			ourLocation := d.Location
 			switch d.Type {
 			case "PIREP", "WINDS":
-				ourLocation = "K"+ourLocation
+				// These carry the FAA identifier.
+				db, err := readAirportDB()
+				if err != nil {
+					slog.Warn("cannot read the airport database", "err", err)
+				}
+				ourLocation = db.ident(ourLocation)
 			}
-			log.Printf("Type %s\nLocation %s\nData %s\n\n",d.Type,ourLocation,d.Data)
+			slog.Debug("message", "type", d.Type, "location", ourLocation, "data", d.Data)
 			// If not in the database then add it
 			if _, ok := Rpts[ourLocation]; !ok {
-				log.Println("Adding new report for "+ourLocation)
+				slog.Info("adding new report", "location", ourLocation)
 				var newrpt WeatherReports
 				newrpt.Location = ourLocation
 			}
@@ -126,13 +161,13 @@ func main() {
 			case "WINDS":
 				rpt.Winds = fmtData
 			default:
-				log.Println("Unhandled type "+d.Type)
+				slog.Warn("unhandled type", "type", d.Type)
 			}
 			Rpts[ourLocation] = rpt
 		}
 	}()
 
-	ticker := time.NewTicker(time.Second * 10)
+	ticker := time.NewTicker(cfg.Receiver.SaveInterval)
 	defer ticker.Stop()
 
 	for {
@@ -140,9 +175,9 @@ func main() {
 		case <-done:
 			return
 		case <-ticker.C:
-			log.Println("Save File ")
+			slog.Debug("saving reports", "file", dumpFile, "reports", len(Rpts))
 			
-			f2, err2 := os.Create("dump.txt")
+			f2, err2 := os.Create(dumpFile)
 			if err2 != nil {
 				panic(err2)
 			}
@@ -153,9 +188,10 @@ func main() {
 			f2.Write(buf)
 			f2.Sync()
 			f2.Close()
+			uatSaves.Inc()
 			
 		case <-interrupt:
-			log.Println("interrupt")
+			slog.Info("interrupt")
 
 			// Cleanly close the connection by sending a close message and then
 			// waiting (with timeout) for the server to close the connection.
@@ -0,0 +1,262 @@
+//go:build !getwx && !cgipart && !websocket
+
+package main
+
+// Weather overlay tiles: the station layer of the map rasterized into
+// transparent 256px XYZ tiles at /wxtiles/{z}/{x}/{y}.png. What is drawn
+// follows the page's zoom rules: category dots below zoom 8 and barbs from
+// 8, names from 7, temperatures, gusts and precipitation from 9.
+// Rendered tiles are kept until weather.txt changes.
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tileSize = 256
+	// tileMargin is how far outside a tile a station can be and still
+	// have part of its symbol and labels inside it.
+	tileMargin = 64
+	// maxCachedTiles bounds the cache; when it is full it starts over.
+	maxCachedTiles = 4096
+	maxTileZoom    = 18
+)
+
+var (
+	tileRenders  = newHistogram("wxtiles_render_duration_seconds", "Time taken to render a weather tile.", defaultBuckets)
+	tileRequests = newCounter("wxtiles_requests_total", "Weather tile requests, by whether the tile was cached.", "cache")
+)
+
+// tileStation is a station with its position worked out once per file.
+type tileStation struct {
+	wx       weatherData
+	obs      metarObs
+	lat, lng float64
+}
+
+type tileCache struct {
+	mu       sync.Mutex
+	modTime  time.Time
+	stations []tileStation
+	tiles    map[string][]byte
+}
+
+var wxTiles = &tileCache{}
+
+// load rereads weather.txt when it has changed since the tiles in the cache
+// were drawn, and throws those tiles away.
+func (tc *tileCache) load() ([]tileStation, time.Time, error) {
+	st, err := os.Stat(cfg.Path(cfg.Output.Weather))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.tiles != nil && st.ModTime().Equal(tc.modTime) {
+		return tc.stations, tc.modTime, nil
+	}
+	all, modTime, err := readWeatherData()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var stations []tileStation
+	for _, wx := range all {
+		lat, err1 := strconv.ParseFloat(wx.Lat, 64)
+		lng, err2 := strconv.ParseFloat(wx.Lng, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		stations = append(stations, tileStation{wx: wx, obs: parseMetarText(wx.Metar), lat: lat, lng: lng})
+	}
+	tc.stations, tc.modTime = stations, modTime
+	tc.tiles = make(map[string][]byte)
+	return stations, modTime, nil
+}
+
+func (tc *tileCache) get(key string) ([]byte, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	b, ok := tc.tiles[key]
+	return b, ok
+}
+
+func (tc *tileCache) put(key string, modTime time.Time, b []byte) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if !modTime.Equal(tc.modTime) {
+		// The file changed while this tile was being drawn.
+		return
+	}
+	if len(tc.tiles) >= maxCachedTiles {
+		tc.tiles = make(map[string][]byte)
+	}
+	tc.tiles[key] = b
+}
+
+// mercatorPixel is the position of lat/lng in global pixels at zoom z.
+func mercatorPixel(lat, lng float64, z int) pt {
+	x, y := worldPixel(lat, lng, z)
+	return pt{X: x, Y: y}
+}
+
+// renderWeatherTile draws the stations that touch tile z/x/y.
+func renderWeatherTile(stations []tileStation, z, x, y int) *image.RGBA {
+	ox, oy := float64(x*tileSize), float64(y*tileSize)
+	return renderStations(stations, tileSize, tileSize, z, func(lat, lng float64) pt {
+		p := mercatorPixel(lat, lng, z)
+		return pt{p.X - ox, p.Y - oy}
+	})
+}
+
+// renderStations draws the stations onto a width by height image, at the
+// pixels project gives. z picks what is drawn, as for the tiles.
+func renderStations(stations []tileStation, width, height, z int, project func(lat, lng float64) pt) *image.RGBA {
+	r := newRasterPainter(width, height, 1)
+	var visible []tileStation
+	var at []pt
+	for _, s := range stations {
+		p := project(s.lat, s.lng)
+		if p.X < -tileMargin || p.Y < -tileMargin || p.X > float64(width)+tileMargin || p.Y > float64(height)+tileMargin {
+			continue
+		}
+		visible = append(visible, s)
+		at = append(at, p)
+	}
+	// Symbols first and labels over them, so a neighbour's barb never
+	// hides a name.
+	for i, s := range visible {
+		drawTileSymbol(r, at[i], s, z)
+	}
+	for i, s := range visible {
+		drawTileLabels(r, at[i], s, z)
+	}
+	return r.img
+}
+
+var (
+	lightningColor = color.RGBA{255, 208, 0, 255}
+	// densityAltColor rings stations over map.density_altitude_alert.
+	densityAltColor = color.RGBA{255, 120, 0, 255}
+)
+
+func drawTileSymbol(p painter, c pt, s tileStation, z int) {
+	col := categoryColor(s.wx)
+	if z < 8 {
+		p.circle(c, 4, col, 1, colorBlack)
+	} else {
+		dir, speed, _ := stationWind(s.wx, s.obs)
+		if !math.IsNaN(speed) && !math.IsNaN(dir) && speed >= 3 {
+			drawWindBarb(p, c, 8, dir, speed, 22, colorBlack)
+		}
+		p.circle(c, 8, col, 1, colorBlack)
+	}
+	if densityAltHigh(s.wx) {
+		rad := 12.0
+		if z < 8 {
+			rad = 7
+		}
+		p.circle(c, rad, color.RGBA{}, 2, densityAltColor)
+	}
+	if s.wx.Lightning != "" && s.wx.Lightning != "0" {
+		o := pt{c.X + 2, c.Y - 28}
+		p.polygon([]pt{{o.X + 8, o.Y}, {o.X + 16, o.Y}, {o.X + 11, o.Y + 9}, {o.X + 17, o.Y + 9}, {o.X + 5, o.Y + 22}, {o.X + 9, o.Y + 12}, {o.X + 3, o.Y + 12}}, lightningColor)
+	}
+}
+
+var (
+	tempBlue   = color.RGBA{0, 0, 255, 255}
+	tempRed    = color.RGBA{255, 0, 0, 255}
+	nameColor  = color.RGBA{34, 34, 34, 255}
+	precipText = color.RGBA{207, 0, 0, 255}
+)
+
+// drawTileLabels places the text where the page's SVG markers put it.
+func drawTileLabels(p painter, c pt, s tileStation, z int) {
+	const size = 7
+	if z >= 7 {
+		p.text(pt{c.X - 11, c.Y + 4}, size, anchorEnd, nameColor, true, stationName(s.wx.ICAO))
+	}
+	if z < 9 {
+		return
+	}
+	if t, err := strconv.Atoi(s.wx.Temperature); err == nil {
+		col := tempBlue
+		if t > 32 {
+			col = tempRed
+		}
+		p.text(pt{c.X - 7, c.Y - 10}, size, anchorStart, col, true, s.wx.Temperature)
+	}
+	_, speed, gust := stationWind(s.wx, s.obs)
+	if !math.IsNaN(gust) && gust > speed {
+		p.text(pt{c.X + 9, c.Y + 16}, size, anchorStart, tempRed, true, fmt.Sprintf("G%d", int(math.Round(gust))))
+	}
+	if s.wx.Precip != "" {
+		p.text(pt{c.X + 11, c.Y + 4}, size, anchorStart, precipText, true, s.wx.Precip)
+	}
+}
+
+// parseTilePath reads z, x and y from a {z}/{x}/{y} route whose last part
+// ends in ext, and checks that the tile exists.
+func parseTilePath(r *http.Request, ext string) (z, x, y int, ok bool) {
+	yname, found := strings.CutSuffix(r.PathValue("y"), ext)
+	if !found {
+		return 0, 0, 0, false
+	}
+	z, errz := strconv.Atoi(r.PathValue("z"))
+	x, errx := strconv.Atoi(r.PathValue("x"))
+	y, erry := strconv.Atoi(yname)
+	if errz != nil || errx != nil || erry != nil || z < 0 || z > maxTileZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// wxTileHandler serves /wxtiles/{z}/{x}/{y}.png.
+func wxTileHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		z, x, y, ok := parseTilePath(r, ".png")
+		if !ok {
+			http.Error(w, "no such tile", http.StatusNotFound)
+			return
+		}
+		stations, modTime, err := wxTiles.load()
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, "weather data is not available", http.StatusServiceUnavailable)
+			return
+		}
+		key := fmt.Sprintf("%d/%d/%d", z, x, y)
+		body, ok := wxTiles.get(key)
+		if ok {
+			tileRequests.Inc("hit")
+		} else {
+			tileRequests.Inc("miss")
+			start := time.Now()
+			var buf bytes.Buffer
+			enc := png.Encoder{CompressionLevel: png.BestSpeed}
+			if err := enc.Encode(&buf, renderWeatherTile(stations, z, x, y)); err != nil {
+				logRequestError(r, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			tileRenders.Since(start)
+			body = buf.Bytes()
+			wxTiles.put(key, modTime, body)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%s"`, modTime.UnixNano(), key))
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		http.ServeContent(w, r, "", modTime.Truncate(time.Second), bytes.NewReader(body))
+	})
+}